@@ -1,4 +1,4 @@
-module app-attach
+module github.com/godirect/hoststack/app-attach
 
 go 1.15
 
@@ -7,5 +7,6 @@ require (
 	github.com/edwarnicke/vpphelper v0.0.0-20210617172001-3e6797de32c3
 	github.com/harshgondaliya/govpp v0.0.0-20210716120413-7fa7f613b02c
 	github.com/justincormack/go-memfd v0.0.0-20170219213707-6e4af0518993
+	github.com/pkg/errors v0.9.1
 	github.com/sirupsen/logrus v1.7.0
 )
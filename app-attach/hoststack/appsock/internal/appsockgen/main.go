@@ -0,0 +1,469 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command appsockgen generates the messages of package appsock from a JSON
+// description of VPP's app socket API, see app_sapi.json. It emits the
+// message type constants, the message structs and their binary encoding.
+//
+// Usage:
+//
+//	appsockgen -in app_sapi.json -out msg_gen.go
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// API is the JSON description of the app socket API
+type API struct {
+	Source    string     `json:"source"`
+	Constants []Constant `json:"constants"`
+	Enums     []Enum     `json:"enums"`
+	Types     []Type     `json:"types"`
+	Messages  []Message  `json:"messages"`
+}
+
+// Constant is a #define of the API
+type Constant struct {
+	Name    string `json:"name"`
+	Value   int    `json:"value"`
+	Comment string `json:"comment"`
+}
+
+// Enum is a C enum, emitted as a block of constants. Enums with a type get a
+// Go type of their own.
+type Enum struct {
+	Name        string      `json:"name"`
+	Type        string      `json:"type"`
+	StripPrefix string      `json:"strip_prefix"`
+	Comment     string      `json:"comment"`
+	Values      []EnumValue `json:"values"`
+}
+
+// EnumValue is a name and value pair, encoded as a JSON array
+type EnumValue struct {
+	Name  string
+	Value int
+}
+
+// UnmarshalJSON decodes ["NAME", value]
+func (v *EnumValue) UnmarshalJSON(data []byte) error {
+	var pair []interface{}
+	if err := json.Unmarshal(data, &pair); err != nil {
+		return err
+	}
+	name, nameOk := pairElem(pair, 0).(string)
+	value, valueOk := pairElem(pair, 1).(float64)
+	if len(pair) != 2 || !nameOk || !valueOk {
+		return errors.Errorf("enum value %s is not a [name, value] pair", data)
+	}
+	v.Name, v.Value = name, int(value)
+	return nil
+}
+
+// Type is a packed C struct
+type Type struct {
+	Name    string  `json:"name"`
+	CName   string  `json:"c_name"`
+	Comment string  `json:"comment"`
+	Fields  []Field `json:"fields"`
+}
+
+// Field is a struct member, an array if Length is set
+type Field struct {
+	Type   string
+	Name   string
+	Length interface{} // a number, or the name of a constant or enum value
+}
+
+// UnmarshalJSON decodes ["type", "name"] and ["type", "name", length]
+func (f *Field) UnmarshalJSON(data []byte) error {
+	var elems []interface{}
+	if err := json.Unmarshal(data, &elems); err != nil {
+		return err
+	}
+	typ, typOk := pairElem(elems, 0).(string)
+	name, nameOk := pairElem(elems, 1).(string)
+	if len(elems) < 2 || len(elems) > 3 || !typOk || !nameOk {
+		return errors.Errorf("field %s is not a [type, name] or [type, name, length] array", data)
+	}
+	f.Type, f.Name = typ, name
+	if len(elems) == 3 {
+		f.Length = elems[2]
+	}
+	return nil
+}
+
+// Message is an app socket message: a message type followed by a struct,
+// if any
+type Message struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Msg     string `json:"msg"`
+	Comment string `json:"comment"`
+}
+
+func pairElem(elems []interface{}, i int) interface{} {
+	if i < len(elems) {
+		return elems[i]
+	}
+	return nil
+}
+
+// scalars maps the API scalar types to Go types and sizes
+var scalars = map[string]struct {
+	goType string
+	size   int
+}{
+	"u8":  {"uint8", 1},
+	"u16": {"uint16", 2},
+	"u32": {"uint32", 4},
+	"u64": {"uint64", 8},
+	"i8":  {"int8", 1},
+	"i16": {"int16", 2},
+	"i32": {"int32", 4},
+	"i64": {"int64", 8},
+}
+
+// initialisms are the words spelled in capitals in Go names
+var initialisms = map[string]string{
+	"api": "API",
+	"ip":  "IP",
+	"tls": "TLS",
+}
+
+// goName converts a C name, in snake or upper case, to a Go name
+func goName(name string) string {
+	var b strings.Builder
+	for _, word := range strings.Split(strings.ToLower(name), "_") {
+		if word == "" {
+			continue
+		}
+		if initialism, ok := initialisms[word]; ok {
+			b.WriteString(initialism)
+			continue
+		}
+		b.WriteString(strings.ToUpper(word[:1]) + word[1:])
+	}
+	return b.String()
+}
+
+// generator resolves the names of an API and writes its Go code
+type generator struct {
+	api    *API
+	pkg    string
+	source string
+	values map[string]value // constants and enum values by C name
+	types  map[string]*Type
+	buf    bytes.Buffer
+}
+
+type value struct {
+	goName string
+	value  int
+}
+
+// Generate returns the formatted Go code of api in package pkg, source
+// names the file it was read from
+func Generate(api *API, pkg, source string) ([]byte, error) {
+	g := &generator{
+		api:    api,
+		pkg:    pkg,
+		source: source,
+		values: make(map[string]value),
+		types:  make(map[string]*Type),
+	}
+	for _, c := range api.Constants {
+		g.values[c.Name] = value{goName: goName(c.Name), value: c.Value}
+	}
+	for _, e := range api.Enums {
+		for _, v := range e.Values {
+			g.values[v.Name] = value{goName: goName(strings.TrimPrefix(v.Name, e.StripPrefix)), value: v.Value}
+		}
+	}
+	for i := range api.Types {
+		g.types[api.Types[i].Name] = &api.Types[i]
+	}
+	if err := g.generate(); err != nil {
+		return nil, err
+	}
+	code, err := format.Source(g.buf.Bytes())
+	if err != nil {
+		return nil, errors.Wrap(err, "generated code does not compile")
+	}
+	return code, nil
+}
+
+func (g *generator) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&g.buf, format, args...)
+}
+
+// commentWidth is the width doc comments are wrapped at
+const commentWidth = 77
+
+// comment writes text as a doc comment
+func (g *generator) comment(text string) {
+	line := "//"
+	for _, word := range strings.Fields(text) {
+		if len(line)+1+len(word) > commentWidth && line != "//" {
+			g.printf("%s\n", line)
+			line = "//"
+		}
+		line += " " + word
+	}
+	g.printf("%s\n", line)
+}
+
+func (g *generator) generate() error {
+	g.printf("%s\n\n// Code generated by appsockgen from %s. DO NOT EDIT.\n\npackage %s\n", licenseHeader, g.source, g.pkg)
+	if g.api.Source != "" {
+		g.printf("\n")
+		g.comment("The messages follow " + g.api.Source)
+	}
+	msgType, err := g.enums()
+	if err != nil {
+		return err
+	}
+	g.constants()
+	size, err := g.msgSize()
+	if err != nil {
+		return err
+	}
+	g.printf("\n// MsgSize is the size of VPP's app_sapi_msg_t, the union of all messages.\n")
+	g.printf("// Messages are padded to it on the wire.\nconst MsgSize = %d\n", size)
+	for i := range g.api.Types {
+		if err := g.structType(&g.api.Types[i]); err != nil {
+			return err
+		}
+	}
+	for i := range g.api.Messages {
+		if err := g.message(&g.api.Messages[i], msgType); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// enums writes the enums and returns the Go type of the message types, the
+// first typed enum
+func (g *generator) enums() (string, error) {
+	var msgType string
+	for _, e := range g.api.Enums {
+		typeName := ""
+		if e.Type != "" {
+			scalar, ok := scalars[e.Type]
+			if !ok {
+				return "", errors.Errorf("enum %s: unknown type %s", e.Name, e.Type)
+			}
+			typeName = goName(e.Name)
+			if msgType == "" {
+				msgType = typeName
+			}
+			g.printf("\n// %s is VPP's %s_e\ntype %s %s\n", typeName, e.Name, typeName, scalar.goType)
+		}
+		g.printf("\n")
+		if e.Comment != "" {
+			g.comment(e.Comment)
+		}
+		g.printf("const (\n")
+		for _, v := range e.Values {
+			g.printf("\t%s %s = %d\n", g.values[v.Name].goName, typeName, v.Value)
+		}
+		g.printf(")\n")
+	}
+	if msgType == "" && len(g.api.Messages) > 0 {
+		return "", errors.New("no typed enum for the message types")
+	}
+	return msgType, nil
+}
+
+func (g *generator) constants() {
+	for _, c := range g.api.Constants {
+		name := goName(c.Name)
+		g.printf("\n")
+		if c.Comment != "" {
+			g.comment(name + " is " + c.Comment)
+		}
+		g.printf("const %s = %d\n", name, c.Value)
+	}
+}
+
+// length returns the Go expression and the value of the length of an array
+// field
+func (g *generator) length(f *Field) (string, int, error) {
+	switch l := f.Length.(type) {
+	case float64:
+		return fmt.Sprint(int(l)), int(l), nil
+	case string:
+		v, ok := g.values[l]
+		if !ok {
+			return "", 0, errors.Errorf("field %s: unknown length %s", f.Name, l)
+		}
+		return v.goName, v.value, nil
+	}
+	return "", 0, errors.Errorf("field %s: length %v is neither a number nor a name", f.Name, f.Length)
+}
+
+// size returns the size of a packed struct
+func (g *generator) size(t *Type) (int, error) {
+	size := 0
+	for i := range t.Fields {
+		f := &t.Fields[i]
+		scalar, ok := scalars[f.Type]
+		if !ok {
+			return 0, errors.Errorf("%s.%s: unknown type %s", t.Name, f.Name, f.Type)
+		}
+		n := 1
+		if f.Length != nil {
+			var err error
+			if _, n, err = g.length(f); err != nil {
+				return 0, errors.WithMessage(err, t.Name)
+			}
+		}
+		size += n * scalar.size
+	}
+	return size, nil
+}
+
+// msgSize returns the size of the largest message, with its message type
+func (g *generator) msgSize() (int, error) {
+	largest := 0
+	for _, m := range g.api.Messages {
+		if m.Msg == "" {
+			continue
+		}
+		t, ok := g.types[m.Msg]
+		if !ok {
+			return 0, errors.Errorf("message %s: unknown type %s", m.Name, m.Msg)
+		}
+		size, err := g.size(t)
+		if err != nil {
+			return 0, err
+		}
+		if size > largest {
+			largest = size
+		}
+	}
+	return 1 + largest, nil
+}
+
+func (g *generator) structType(t *Type) error {
+	name := goName(t.Name)
+	g.printf("\n")
+	doc := name + " is VPP's " + t.CName
+	if t.CName == "" {
+		doc = name + " type"
+	}
+	if t.Comment != "" {
+		doc += ". " + t.Comment
+	}
+	g.comment(doc)
+	g.printf("type %s struct {\n", name)
+	for i := range t.Fields {
+		f := &t.Fields[i]
+		scalar, ok := scalars[f.Type]
+		if !ok {
+			return errors.Errorf("%s.%s: unknown type %s", t.Name, f.Name, f.Type)
+		}
+		goType := scalar.goType
+		if f.Length != nil {
+			length, _, err := g.length(f)
+			if err != nil {
+				return errors.WithMessage(err, t.Name)
+			}
+			goType = "[" + length + "]" + goType
+		}
+		g.printf("\t%s %s\n", goName(f.Name), goType)
+	}
+	g.printf("}\n")
+	return nil
+}
+
+func (g *generator) message(m *Message, msgType string) error {
+	name := "AppSapiMsg" + goName(m.Name)
+	typeValue, ok := g.values[m.Type]
+	if !ok {
+		return errors.Errorf("message %s: unknown message type %s", m.Name, m.Type)
+	}
+	g.printf("\n")
+	doc := fmt.Sprintf("%s is the app socket message of type %s", name, typeValue.goName)
+	if m.Comment != "" {
+		doc += ". " + m.Comment
+	}
+	g.comment(doc)
+	g.printf("type %s struct {\n\tMsgType %s\n", name, msgType)
+	if m.Msg != "" {
+		if _, ok := g.types[m.Msg]; !ok {
+			return errors.Errorf("message %s: unknown type %s", m.Name, m.Msg)
+		}
+		g.printf("\tMsg %s\n", goName(m.Msg))
+	}
+	g.printf("}\n")
+	g.printf("\n// MarshalBinary encodes the message, padded to MsgSize\n")
+	g.printf("func (msg *%s) MarshalBinary() ([]byte, error) {\n\treturn marshal(msg)\n}\n", name)
+	g.printf("\n// UnmarshalBinary decodes the message\n")
+	g.printf("func (msg *%s) UnmarshalBinary(data []byte) error {\n\treturn unmarshal(data, msg)\n}\n", name)
+	return nil
+}
+
+func main() {
+	in := flag.String("in", "app_sapi.json", "JSON description of the app socket API")
+	out := flag.String("out", "msg_gen.go", "generated Go file")
+	pkg := flag.String("pkg", "appsock", "package of the generated file")
+	flag.Parse()
+	data, err := ioutil.ReadFile(*in)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var api API
+	if err := json.Unmarshal(data, &api); err != nil {
+		log.Fatalf("%s: %v", *in, err)
+	}
+	code, err := Generate(&api, *pkg, filepath.Base(*in))
+	if err != nil {
+		log.Fatalf("%s: %v", *in, err)
+	}
+	if err := ioutil.WriteFile(*out, code, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// licenseHeader starts the generated files, as all files of the repository
+const licenseHeader = `// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.`
@@ -0,0 +1,157 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+func readAPI(t *testing.T, path string) *API {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile Error %v", err)
+	}
+	var api API
+	if err := json.Unmarshal(data, &api); err != nil {
+		t.Fatalf("Unmarshal Error %v", err)
+	}
+	return &api
+}
+
+func TestGenerateGolden(t *testing.T) {
+	inputs, err := filepath.Glob("testdata/*.json")
+	if err != nil || len(inputs) == 0 {
+		t.Fatalf("Expected: test inputs in testdata; Current: %v, %v", inputs, err)
+	}
+	for _, input := range inputs {
+		golden := strings.TrimSuffix(input, ".json") + ".golden"
+		code, err := Generate(readAPI(t, input), "test", filepath.Base(input))
+		if err != nil {
+			t.Fatalf("%s: Generate Error %v", input, err)
+		}
+		if *update {
+			if err := ioutil.WriteFile(golden, code, 0644); err != nil {
+				t.Fatalf("WriteFile Error %v", err)
+			}
+			continue
+		}
+		want, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Fatalf("ReadFile Error %v", err)
+		}
+		if !bytes.Equal(code, want) {
+			t.Errorf("%s: Expected: the code in %s, run go test -update after checking the changes; Current:\n%s", input, golden, code)
+		}
+	}
+}
+
+// TestGenerateAppsock checks that the generated messages of package appsock
+// are up to date with app_sapi.json
+func TestGenerateAppsock(t *testing.T) {
+	code, err := Generate(readAPI(t, "../../app_sapi.json"), "appsock", "app_sapi.json")
+	if err != nil {
+		t.Fatalf("Generate Error %v", err)
+	}
+	want, err := ioutil.ReadFile("../../msg_gen.go")
+	if err != nil {
+		t.Fatalf("ReadFile Error %v", err)
+	}
+	if !bytes.Equal(code, want) {
+		t.Errorf("Expected: msg_gen.go to be up to date, run go generate in package appsock")
+	}
+}
+
+func TestGenerateErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		api  string
+		want string
+	}{
+		{
+			name: "unknown field type",
+			api:  `{"types": [{"name": "t", "fields": [["u128", "f"]]}]}`,
+			want: "unknown type u128",
+		},
+		{
+			name: "unknown length",
+			api:  `{"types": [{"name": "t", "fields": [["u8", "f", "N"]]}]}`,
+			want: "unknown length N",
+		},
+		{
+			name: "unknown message type",
+			api:  `{"enums": [{"name": "e", "type": "u8", "values": [["A", 1]]}], "messages": [{"name": "m", "type": "B"}]}`,
+			want: "unknown message type B",
+		},
+		{
+			name: "unknown message struct",
+			api:  `{"enums": [{"name": "e", "type": "u8", "values": [["A", 1]]}], "messages": [{"name": "m", "type": "A", "msg": "t"}]}`,
+			want: "unknown type t",
+		},
+		{
+			name: "untyped message types",
+			api:  `{"enums": [{"name": "e", "values": [["A", 1]]}], "messages": [{"name": "m", "type": "A"}]}`,
+			want: "no typed enum",
+		},
+		{
+			name: "bad field",
+			api:  `{"types": [{"name": "t", "fields": [["u8"]]}]}`,
+			want: "is not a [type, name]",
+		},
+		{
+			name: "bad enum value",
+			api:  `{"enums": [{"name": "e", "values": [["A"]]}]}`,
+			want: "is not a [name, value] pair",
+		},
+	}
+	for _, tt := range tests {
+		var api API
+		err := json.Unmarshal([]byte(tt.api), &api)
+		if err == nil {
+			_, err = Generate(&api, "test", "test.json")
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: Expected: an error containing %q; Current: %v", tt.name, tt.want, err)
+		}
+	}
+}
+
+func TestGoName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "app_attach_reply_msg", want: "AppAttachReplyMsg"},
+		{name: "MSG_TYPE_ADD_DEL_CERT_KEY", want: "MsgTypeAddDelCertKey"},
+		{name: "api_client_handle", want: "APIClientHandle"},
+		{name: "APP_OPTIONS_TLS_ENGINE", want: "AppOptionsTLSEngine"},
+		{name: "n_fds", want: "NFds"},
+		{name: "_leading__double_", want: "LeadingDouble"},
+	}
+	for _, tt := range tests {
+		if name := goName(tt.name); name != tt.want {
+			t.Errorf("%s: Expected: %s; Current: %s", tt.name, tt.want, name)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package appsock implements the messages of VPP's app socket API, the
+// unixpacket protocol spoken on an app namespace socket.
+//
+// The messages are generated from app_sapi.json by appsockgen, see
+// msg_gen.go. Run go generate after changing it.
+package appsock
+
+//go:generate go run ./internal/appsockgen -in app_sapi.json -out msg_gen.go
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// ATTACH is the former name of MsgTypeAttach
+const ATTACH = MsgTypeAttach
+
+// Fd flags of a reply, as in VPP's SESSION_FD_F_*. The fds of a reply are
+// sent in the order of their flag bits.
+const (
+	FdFlagVppMqSegment uint8 = 1
+	FdFlagMemfdSegment uint8 = 2
+	FdFlagShmSegment   uint8 = 4
+	FdFlagVppMqEventfd uint8 = 8
+	FdFlagMqEventfd    uint8 = 16
+)
+
+// Bits of Options[AppOptionsFlags], as in VPP's APP_OPTIONS_FLAGS_*
+const (
+	AppOptionsFlagsAcceptRedirect uint64 = 1 << iota
+	AppOptionsFlagsAddSegment
+	AppOptionsFlagsIsBuiltin
+	AppOptionsFlagsIsTransportApp
+	AppOptionsFlagsIsProxy
+	AppOptionsFlagsUseGlobalScope
+	AppOptionsFlagsUseLocalScope
+	AppOptionsFlagsEvtMqUseEventfd
+	AppOptionsFlagsMemfdForBuiltin
+	AppOptionsFlagsUseHugePage
+)
+
+// PeekMsgType returns the type of an encoded message
+func PeekMsgType(data []byte) AppSapiMsgType {
+	if len(data) == 0 {
+		return MsgTypeNone
+	}
+	return AppSapiMsgType(data[0])
+}
+
+// marshal encodes msg and pads it to MsgSize
+func marshal(msg interface{}) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, MsgSize))
+	if err := binary.Write(buf, binary.LittleEndian, msg); err != nil {
+		return nil, err
+	}
+	if buf.Len() < MsgSize {
+		buf.Write(make([]byte, MsgSize-buf.Len()))
+	}
+	return buf.Bytes(), nil
+}
+
+func unmarshal(data []byte, msg interface{}) error {
+	return binary.Read(bytes.NewReader(data), binary.LittleEndian, msg)
+}
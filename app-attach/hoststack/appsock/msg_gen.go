@@ -0,0 +1,239 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Code generated by appsockgen from app_sapi.json. DO NOT EDIT.
+
+package appsock
+
+// The messages follow src/vnet/session/application_interface.h, VPP 21.06
+
+// AppSapiMsgType is VPP's app_sapi_msg_type_e
+type AppSapiMsgType int8
+
+// Message types, in the order of VPP's app_sapi_msg_type_e
+const (
+	MsgTypeNone               AppSapiMsgType = 0
+	MsgTypeAttach             AppSapiMsgType = 1
+	MsgTypeAttachReply        AppSapiMsgType = 2
+	MsgTypeAddDelWorker       AppSapiMsgType = 3
+	MsgTypeAddDelWorkerReply  AppSapiMsgType = 4
+	MsgTypeSendFds            AppSapiMsgType = 5
+	MsgTypeAddDelCertKey      AppSapiMsgType = 6
+	MsgTypeAddDelCertKeyReply AppSapiMsgType = 7
+)
+
+// Indices into AppAttachMsg.Options, as in VPP's app_attach_options_index_t
+const (
+	AppOptionsFlags               = 0
+	AppOptionsEvtQueueSize        = 1
+	AppOptionsSegmentSize         = 2
+	AppOptionsAddSegmentSize      = 3
+	AppOptionsPrivateSegmentCount = 4
+	AppOptionsRxFifoSize          = 5
+	AppOptionsTxFifoSize          = 6
+	AppOptionsPreallocFifoPairs   = 7
+	AppOptionsPreallocFifoHdrs    = 8
+	AppOptionsNamespace           = 9
+	AppOptionsNamespaceSecret     = 10
+	AppOptionsProxyTransport      = 11
+	AppOptionsAcceptCookie        = 12
+	AppOptionsTLSEngine           = 13
+	AppOptionsMaxFifoSize         = 14
+	AppOptionsHighWatermark       = 15
+	AppOptionsLowWatermark        = 16
+	AppOptionsPctFirstAlloc       = 17
+	AppOptionsNOptions            = 18
+)
+
+// AppNameLen is the size of AppAttachMsg.Name, including the terminating NUL
+const AppNameLen = 64
+
+// MsgSize is the size of VPP's app_sapi_msg_t, the union of all messages.
+// Messages are padded to it on the wire.
+const MsgSize = 209
+
+// AppAttachMsg is VPP's app_sapi_attach_msg_t
+type AppAttachMsg struct {
+	Name    [AppNameLen]uint8
+	Options [AppOptionsNOptions]uint64
+}
+
+// AppAttachReplyMsg is VPP's app_sapi_attach_reply_msg_t
+type AppAttachReplyMsg struct {
+	Retval          int32
+	AppIndex        uint32
+	AppMq           uint64
+	VppCtrlMq       uint64
+	SegmentHandle   uint64
+	APIClientHandle uint32
+	VppCtrlMqThread uint8
+	NFds            uint8
+	FdFlags         uint8
+}
+
+// AppWorkerAddDelMsg is VPP's app_sapi_worker_add_del_msg_t
+type AppWorkerAddDelMsg struct {
+	AppIndex uint32
+	WrkIndex uint32
+	IsAdd    uint8
+}
+
+// AppWorkerAddDelReplyMsg is VPP's app_sapi_worker_add_del_reply_msg_t
+type AppWorkerAddDelReplyMsg struct {
+	Retval               int32
+	WrkIndex             uint32
+	AppEventQueueAddress uint64
+	SegmentHandle        uint64
+	APIClientHandle      uint32
+	NFds                 uint8
+	FdFlags              uint8
+	IsAdd                uint8
+}
+
+// AppCertKeyAddDelMsg is VPP's app_sapi_cert_key_add_del_msg_t. An add
+// request is followed by a second packet of CertkeyLen bytes holding the
+// certificate and then the key.
+type AppCertKeyAddDelMsg struct {
+	Context    uint32
+	Index      uint32
+	CertLen    uint16
+	CertkeyLen uint16
+	IsAdd      uint8
+}
+
+// AppCertKeyAddDelReplyMsg is VPP's app_sapi_cert_key_add_del_reply_msg_t
+type AppCertKeyAddDelReplyMsg struct {
+	Context uint32
+	Retval  int32
+	Index   uint32
+}
+
+// AppSapiMsgAttach is the app socket message of type MsgTypeAttach
+type AppSapiMsgAttach struct {
+	MsgType AppSapiMsgType
+	Msg     AppAttachMsg
+}
+
+// MarshalBinary encodes the message, padded to MsgSize
+func (msg *AppSapiMsgAttach) MarshalBinary() ([]byte, error) {
+	return marshal(msg)
+}
+
+// UnmarshalBinary decodes the message
+func (msg *AppSapiMsgAttach) UnmarshalBinary(data []byte) error {
+	return unmarshal(data, msg)
+}
+
+// AppSapiMsgAttachReply is the app socket message of type MsgTypeAttachReply
+type AppSapiMsgAttachReply struct {
+	MsgType AppSapiMsgType
+	Msg     AppAttachReplyMsg
+}
+
+// MarshalBinary encodes the message, padded to MsgSize
+func (msg *AppSapiMsgAttachReply) MarshalBinary() ([]byte, error) {
+	return marshal(msg)
+}
+
+// UnmarshalBinary decodes the message
+func (msg *AppSapiMsgAttachReply) UnmarshalBinary(data []byte) error {
+	return unmarshal(data, msg)
+}
+
+// AppSapiMsgWorkerAddDel is the app socket message of type
+// MsgTypeAddDelWorker
+type AppSapiMsgWorkerAddDel struct {
+	MsgType AppSapiMsgType
+	Msg     AppWorkerAddDelMsg
+}
+
+// MarshalBinary encodes the message, padded to MsgSize
+func (msg *AppSapiMsgWorkerAddDel) MarshalBinary() ([]byte, error) {
+	return marshal(msg)
+}
+
+// UnmarshalBinary decodes the message
+func (msg *AppSapiMsgWorkerAddDel) UnmarshalBinary(data []byte) error {
+	return unmarshal(data, msg)
+}
+
+// AppSapiMsgWorkerAddDelReply is the app socket message of type
+// MsgTypeAddDelWorkerReply
+type AppSapiMsgWorkerAddDelReply struct {
+	MsgType AppSapiMsgType
+	Msg     AppWorkerAddDelReplyMsg
+}
+
+// MarshalBinary encodes the message, padded to MsgSize
+func (msg *AppSapiMsgWorkerAddDelReply) MarshalBinary() ([]byte, error) {
+	return marshal(msg)
+}
+
+// UnmarshalBinary decodes the message
+func (msg *AppSapiMsgWorkerAddDelReply) UnmarshalBinary(data []byte) error {
+	return unmarshal(data, msg)
+}
+
+// AppSapiMsgSendFds is the app socket message of type MsgTypeSendFds. VPP
+// sends it to pass the fds of a segment ahead of the session event
+// announcing the segment, it carries nothing else.
+type AppSapiMsgSendFds struct {
+	MsgType AppSapiMsgType
+}
+
+// MarshalBinary encodes the message, padded to MsgSize
+func (msg *AppSapiMsgSendFds) MarshalBinary() ([]byte, error) {
+	return marshal(msg)
+}
+
+// UnmarshalBinary decodes the message
+func (msg *AppSapiMsgSendFds) UnmarshalBinary(data []byte) error {
+	return unmarshal(data, msg)
+}
+
+// AppSapiMsgCertKeyAddDel is the app socket message of type
+// MsgTypeAddDelCertKey
+type AppSapiMsgCertKeyAddDel struct {
+	MsgType AppSapiMsgType
+	Msg     AppCertKeyAddDelMsg
+}
+
+// MarshalBinary encodes the message, padded to MsgSize
+func (msg *AppSapiMsgCertKeyAddDel) MarshalBinary() ([]byte, error) {
+	return marshal(msg)
+}
+
+// UnmarshalBinary decodes the message
+func (msg *AppSapiMsgCertKeyAddDel) UnmarshalBinary(data []byte) error {
+	return unmarshal(data, msg)
+}
+
+// AppSapiMsgCertKeyAddDelReply is the app socket message of type
+// MsgTypeAddDelCertKeyReply
+type AppSapiMsgCertKeyAddDelReply struct {
+	MsgType AppSapiMsgType
+	Msg     AppCertKeyAddDelReplyMsg
+}
+
+// MarshalBinary encodes the message, padded to MsgSize
+func (msg *AppSapiMsgCertKeyAddDelReply) MarshalBinary() ([]byte, error) {
+	return marshal(msg)
+}
+
+// UnmarshalBinary decodes the message
+func (msg *AppSapiMsgCertKeyAddDelReply) UnmarshalBinary(data []byte) error {
+	return unmarshal(data, msg)
+}
@@ -14,14 +14,69 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package appsock
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/hex"
 	"testing"
 )
 
+// TestMsgTypes checks the message types and the cert key messages against
+// src/vnet/session/application_interface.h of VPP 21.06:
+//
+//	typedef enum app_sapi_msg_type
+//	{
+//	  APP_SAPI_MSG_TYPE_NONE,
+//	  APP_SAPI_MSG_TYPE_ATTACH,
+//	  APP_SAPI_MSG_TYPE_ATTACH_REPLY,
+//	  APP_SAPI_MSG_TYPE_ADD_DEL_WORKER,
+//	  APP_SAPI_MSG_TYPE_ADD_DEL_WORKER_REPLY,
+//	  APP_SAPI_MSG_TYPE_SEND_FDS,
+//	  APP_SAPI_MSG_TYPE_ADD_DEL_CERT_KEY,
+//	  APP_SAPI_MSG_TYPE_ADD_DEL_CERT_KEY_REPLY,
+//	} __clib_packed app_sapi_msg_type_e;
+//
+//	typedef struct app_sapi_cert_key_add_del_msg_
+//	{
+//	  u32 context;
+//	  u32 index;
+//	  u16 cert_len;
+//	  u16 certkey_len;
+//	  u8 is_add;
+//	} __clib_packed app_sapi_cert_key_add_del_msg_t;
+//
+//	typedef struct app_sapi_cert_key_add_del_reply_msg_
+//	{
+//	  u32 context;
+//	  i32 retval;
+//	  u32 index;
+//	} __clib_packed app_sapi_cert_key_add_del_reply_msg_t;
+func TestMsgTypes(t *testing.T) {
+	types := []AppSapiMsgType{
+		MsgTypeNone,
+		MsgTypeAttach,
+		MsgTypeAttachReply,
+		MsgTypeAddDelWorker,
+		MsgTypeAddDelWorkerReply,
+		MsgTypeSendFds,
+		MsgTypeAddDelCertKey,
+		MsgTypeAddDelCertKeyReply,
+	}
+	for i, msgType := range types {
+		if msgType != AppSapiMsgType(i) {
+			t.Errorf("Expected: message type %d; Current: %d", i, msgType)
+		}
+	}
+	if size := binary.Size(AppCertKeyAddDelMsg{}); size != 13 {
+		t.Errorf("Expected: a cert key add del message of 13 bytes; Current: %d", size)
+	}
+	if size := binary.Size(AppCertKeyAddDelReplyMsg{}); size != 12 {
+		t.Errorf("Expected: a cert key add del reply of 12 bytes; Current: %d", size)
+	}
+}
+
 func TestBinaryMarshaler(t *testing.T) {
 	Msg := AppSapiMsgAttach{MsgType: ATTACH, Msg: AppAttachMsg{Name: [64]uint8{97, 112, 112, 97, 116, 116, 97, 99, 104}, Options: [18]uint64{98}}}
 	encMsg, encErr := Msg.MarshalBinary()
@@ -96,3 +151,28 @@ func TestBinaryUnMarshaler(t *testing.T) {
 		t.Errorf("Expected: replyMsg.Msg.FdFlags = 3; Current: replyMsg.Msg.FdFlags = %v", replyMsg.Msg.FdFlags)
 	}
 }
+
+func TestWorkerAddDelMarshaler(t *testing.T) {
+	msg := AppSapiMsgWorkerAddDel{MsgType: MsgTypeAddDelWorker, Msg: AppWorkerAddDelMsg{AppIndex: 1, WrkIndex: 2, IsAdd: 1}}
+	encMsg, encErr := msg.MarshalBinary()
+	if encErr != nil {
+		t.Errorf("BinaryMarshaling Error %v", encErr)
+	}
+	expOp := make([]byte, MsgSize)
+	copy(expOp, []byte{0x03, 0x01, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0x01})
+	if !bytes.Equal(expOp, encMsg) {
+		t.Errorf("BinaryMarshaling Output Mismatch. Expected Output:\n%v\n Current Output:\n%v", hex.Dump(expOp), hex.Dump(encMsg))
+	}
+
+	ip := make([]byte, MsgSize)
+	copy(ip, []byte{0x04, 0x00, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0x40, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0x01, 0x00, 0x01, 0x00, 0x01, 0x02, 0x01})
+	var replyMsg AppSapiMsgWorkerAddDelReply
+	if decErr := replyMsg.UnmarshalBinary(ip); decErr != nil {
+		t.Errorf("BinaryUnMarshaling Error %v", decErr)
+	}
+	exp := AppWorkerAddDelReplyMsg{WrkIndex: 2, AppEventQueueAddress: 320, SegmentHandle: 0x200000000, APIClientHandle: 0x10001, NFds: 1, FdFlags: 2, IsAdd: 1}
+	if replyMsg.MsgType != MsgTypeAddDelWorkerReply || replyMsg.Msg != exp {
+		t.Errorf("Expected: %+v; Current: %+v", exp, replyMsg.Msg)
+	}
+}
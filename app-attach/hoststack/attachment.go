@@ -0,0 +1,441 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hoststack
+
+import (
+	"context"
+	"net"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/godirect/hoststack/app-attach/hoststack/appsock"
+	"github.com/godirect/hoststack/app-attach/hoststack/fifo"
+	"github.com/godirect/hoststack/app-attach/hoststack/memseg"
+	"github.com/godirect/hoststack/app-attach/hoststack/msgq"
+	"github.com/godirect/hoststack/app-attach/hoststack/session"
+)
+
+// Attachment Struct
+type Attachment struct {
+	ns                 *Namespace
+	udsConn            *sapiConn
+	mu                 sync.Mutex
+	detached           bool
+	detachDone         chan struct{} // closed once Detach released the attachment
+	appAttachReplyMsg  *appsock.AppAttachReplyMsg
+	vppMqMemorySegment *memseg.MemorySegment
+	vppMqFifoSegment   *fifo.Segment // the chunks of the ext configs of connects and listens
+	vppCtrlMq          *msgq.Queue   // the workers send control events to VPP over it
+	vppMqEventFd       int
+	vppEventQueues     map[uint64]*msgq.Queue // the queues of the VPP threads sessions live on, by offset
+	workers            []*Worker
+}
+
+type unixMsgReader interface {
+	ReadMsgUnix(b, oob []byte) (n, oobn, flags int, addr *net.UnixAddr, err error)
+}
+
+// NewAttachment sends an attach request over udsConn and maps the segments
+// VPP returns with the reply. It stops waiting for the reply when ctx ends.
+func NewAttachment(ctx context.Context, ns *Namespace, udsConn net.Conn, options ...AttachOption) (*Attachment, error) {
+	attachment := &Attachment{
+		ns:           ns,
+		udsConn:      ns.sapiConn(udsConn),
+		vppMqEventFd: -1,
+		detachDone:   make(chan struct{}),
+	}
+	if _, ok := udsConn.(unixMsgReader); !ok {
+		return nil, wrapErr(ErrNotDialed, errors.Errorf("connection of type %T cannot receive file descriptors", udsConn))
+	}
+	attachOptions := newAttachOptions(options)
+	msg, optErr := attachOptions.attachMsg()
+	if optErr != nil {
+		return nil, errors.Wrap(optErr, "invalid attach options")
+	}
+	var replyMsg appsock.AppSapiMsgAttachReply
+	var fdList []int
+	exchangeErr := attachment.udsConn.exchange(ctx, func() error {
+		if sendErr := sendMsg(attachment.udsConn, msg); sendErr != nil {
+			return sendErr
+		}
+		var recvErr error
+		fdList, recvErr = attachment.udsConn.recvMsg(appsock.MsgTypeAttachReply, &replyMsg, maxReplyFds)
+		return recvErr
+	})
+	if exchangeErr != nil {
+		closeFds(fdList)
+		if errors.Is(exchangeErr, context.Canceled) || errors.Is(exchangeErr, context.DeadlineExceeded) {
+			exchangeErr = wrapErr(ErrRecv, exchangeErr)
+		}
+		return nil, exchangeErr
+	}
+	if replyMsg.Msg.Retval != 0 {
+		closeFds(fdList)
+		return nil, &ErrAttachRejected{Retval: replyMsg.Msg.Retval}
+	}
+	attachment.appAttachReplyMsg = &replyMsg.Msg
+
+	log.Debugf("App Index: %v\n"+
+		"App Message Queue: %v\n"+
+		"VPP Control Message Queue: %v\n"+
+		"Segment Handle: %v\n"+
+		"API Client Handle: %v\n"+
+		"VPP Control Message Queue Thread Index: %v\n"+
+		"No. of fds exchanged: %v\n"+
+		"FD Flags: %v\n", replyMsg.Msg.AppIndex, replyMsg.Msg.AppMq, replyMsg.Msg.VppCtrlMq, replyMsg.Msg.SegmentHandle,
+		replyMsg.Msg.APIClientHandle, replyMsg.Msg.VppCtrlMqThread, replyMsg.Msg.NFds, replyMsg.Msg.FdFlags)
+
+	if len(fdList) != int(replyMsg.Msg.NFds) {
+		closeFds(fdList)
+		return nil, wrapErr(ErrBadFdCount, errors.Errorf("got %d fds, reply announces %d", len(fdList), replyMsg.Msg.NFds))
+	}
+
+	byFlag, fdErr := fdsByFlag(replyMsg.Msg.FdFlags, fdList)
+	if fdErr != nil {
+		closeFds(fdList)
+		return nil, fdErr
+	}
+	if initErr := attachment.init(&replyMsg.Msg, byFlag); initErr != nil {
+		_ = attachment.release()
+		return nil, initErr
+	}
+	return attachment, nil
+}
+
+// vppEventQueue returns the message queue of the VPP thread at offset in
+// the VPP message queue segment, the workers send the IO events of the
+// sessions of that thread over it
+func (a *Attachment) vppEventQueue(offset uint64) (*msgq.Queue, error) {
+	if offset == a.appAttachReplyMsg.VppCtrlMq && a.vppCtrlMq != nil {
+		return a.vppCtrlMq, nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.detached || a.vppMqMemorySegment == nil {
+		return nil, ErrDetached
+	}
+	if queue, ok := a.vppEventQueues[offset]; ok {
+		return queue, nil
+	}
+	queue, err := openQueue(a.vppMqMemorySegment, offset, -1)
+	if err != nil {
+		return nil, errors.WithMessage(err, "vpp event queue")
+	}
+	if a.vppEventQueues == nil {
+		a.vppEventQueues = make(map[uint64]*msgq.Queue)
+	}
+	a.vppEventQueues[offset] = queue
+	return queue, nil
+}
+
+// addExtConfig writes cfg to a chunk of the VPP message queue segment, as
+// VCL does, and returns the offset of the chunk. VPP frees the chunk once
+// it read the config.
+func (a *Attachment) addExtConfig(cfg *session.ExtConfig) (uint64, error) {
+	data, err := session.Marshal(cfg)
+	if err != nil {
+		return 0, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.detached {
+		return 0, ErrDetached
+	}
+	if a.vppMqFifoSegment == nil {
+		if a.vppMqMemorySegment == nil {
+			return 0, wrapErr(ErrMapSegment, errors.New("vpp did not pass its message queue segment"))
+		}
+		segment, segErr := newFifoSegment(a.vppMqMemorySegment)
+		if segErr != nil {
+			return 0, segErr
+		}
+		a.vppMqFifoSegment = segment
+	}
+	offset, chunk, err := a.vppMqFifoSegment.AllocChunk(0, uint32(len(data)))
+	if err != nil {
+		return 0, wrapErr(ErrMapSegment, err)
+	}
+	copy(chunk, data)
+	return offset, nil
+}
+
+// freeExtConfig frees the chunk of an ext config VPP was not sent
+func (a *Attachment) freeExtConfig(offset uint64) {
+	if offset == 0 {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.detached || a.vppMqFifoSegment == nil {
+		return
+	}
+	if err := a.vppMqFifoSegment.FreeChunk(0, offset); err != nil {
+		log.Warnf("cannot free ext config chunk %#x: %v", offset, err)
+	}
+}
+
+// init maps the segments and opens the message queues of an attach reply,
+// taking ownership of fds
+func (a *Attachment) init(reply *appsock.AppAttachReplyMsg, fds map[uint8]int) error {
+	defer closeFdMap(fds)
+	a.vppMqEventFd = takeFd(fds, appsock.FdFlagVppMqEventfd)
+	if fd := takeFd(fds, appsock.FdFlagVppMqSegment); fd >= 0 {
+		vppMqMemorySegment, segErr := memseg.NewMemorySegment(fd)
+		if segErr != nil {
+			return wrapErr(ErrMapSegment, segErr)
+		}
+		a.vppMqMemorySegment = vppMqMemorySegment
+		vppCtrlMq, mqErr := openQueue(vppMqMemorySegment, reply.VppCtrlMq, a.vppMqEventFd)
+		if mqErr != nil {
+			return errors.WithMessage(mqErr, "vpp control message queue")
+		}
+		a.vppCtrlMq = vppCtrlMq
+	}
+	segmentFd := takeFd(fds, appsock.FdFlagMemfdSegment)
+	if segmentFd < 0 {
+		return wrapErr(ErrBadFdCount, errors.New("missing fifo segment fd"))
+	}
+	memorySegment, segErr := memseg.NewMemorySegment(segmentFd)
+	if segErr != nil {
+		return wrapErr(ErrMapSegment, segErr)
+	}
+	worker := NewWorker(a, memorySegment)
+	worker.apiClientHandle = reply.APIClientHandle
+	worker.eventFd = takeFd(fds, appsock.FdFlagMqEventfd)
+	a.workers = append(a.workers, worker)
+	return worker.init(reply.SegmentHandle, reply.AppMq)
+}
+
+// parseFds returns the fds passed in the control messages of oob. On error
+// it still returns the fds it could parse, for the caller to close.
+func parseFds(oob []byte) ([]int, error) {
+	msgs, parseCtlErr := syscall.ParseSocketControlMessage(oob)
+	if parseCtlErr != nil {
+		return nil, errors.Wrap(parseCtlErr, "error while parsing socket control message")
+	}
+	var fdList []int
+	var err error
+	for i := range msgs {
+		fds, parseRightsErr := syscall.ParseUnixRights(&msgs[i])
+		if parseRightsErr != nil {
+			// keep going, the fds of the other messages are installed too
+			err = errors.Wrap(parseRightsErr, "error while parsing rights")
+			continue
+		}
+		fdList = append(fdList, fds...)
+	}
+	// the fds must not leak into the children of the application
+	for _, fd := range fdList {
+		syscall.CloseOnExec(fd)
+	}
+	return fdList, err
+}
+
+func closeFds(fds []int) {
+	for _, fd := range fds {
+		_ = syscall.Close(fd)
+	}
+}
+
+// maxReplyFds is the largest number of fds VPP sends with a reply, one per
+// fd flag
+const maxReplyFds = 5
+
+// Namespace returns the namespace the application is attached to
+func (a *Attachment) Namespace() *Namespace {
+	return a.ns
+}
+
+// AppIndex returns the application index assigned by VPP
+func (a *Attachment) AppIndex() uint32 {
+	return a.appAttachReplyMsg.AppIndex
+}
+
+// Workers returns the application workers
+func (a *Attachment) Workers() []*Worker {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]*Worker(nil), a.workers...)
+}
+
+// AddWorker registers a new worker with VPP over its own app socket
+// connection. The worker gets its own fifo segment and message queue. It
+// fails with ErrNotDialed for an attachment made without a Namespace, which
+// has no app socket to dial.
+func (a *Attachment) AddWorker(ctx context.Context) (*Worker, error) {
+	if a.isDetached() {
+		return nil, ErrDetached
+	}
+	if a.ns == nil {
+		return nil, wrapErr(ErrNotDialed, errors.New("attachment has no namespace"))
+	}
+	conn, dialErr := a.ns.dialSocket(ctx)
+	if dialErr != nil {
+		return nil, dialErr
+	}
+	udsConn := newSapiConn(conn)
+	var worker *Worker
+	addErr := udsConn.exchange(ctx, func() error {
+		msg := appsock.AppSapiMsgWorkerAddDel{MsgType: appsock.MsgTypeAddDelWorker, Msg: appsock.AppWorkerAddDelMsg{AppIndex: a.AppIndex(), IsAdd: 1}}
+		if sendErr := sendMsg(udsConn, &msg); sendErr != nil {
+			return sendErr
+		}
+		var replyMsg appsock.AppSapiMsgWorkerAddDelReply
+		fds, recvErr := udsConn.recvMsg(appsock.MsgTypeAddDelWorkerReply, &replyMsg, maxReplyFds)
+		if recvErr != nil {
+			return recvErr
+		}
+		if replyMsg.Msg.Retval != 0 {
+			closeFds(fds)
+			return errors.Wrap(SessionError(replyMsg.Msg.Retval), "worker add rejected by vpp")
+		}
+		if len(fds) != int(replyMsg.Msg.NFds) {
+			closeFds(fds)
+			return wrapErr(ErrBadFdCount, errors.Errorf("got %d fds, reply announces %d", len(fds), replyMsg.Msg.NFds))
+		}
+		byFlag, fdErr := fdsByFlag(replyMsg.Msg.FdFlags, fds)
+		if fdErr != nil {
+			closeFds(fds)
+			return fdErr
+		}
+		defer closeFdMap(byFlag)
+		segmentFd := takeFd(byFlag, appsock.FdFlagMemfdSegment)
+		if segmentFd < 0 {
+			return wrapErr(ErrBadFdCount, errors.New("missing worker fifo segment fd"))
+		}
+		memorySegment, segErr := memseg.NewMemorySegment(segmentFd)
+		if segErr != nil {
+			return wrapErr(ErrMapSegment, segErr)
+		}
+		worker = NewWorker(a, memorySegment)
+		worker.index = replyMsg.Msg.WrkIndex
+		worker.apiClientHandle = replyMsg.Msg.APIClientHandle
+		worker.eventFd = takeFd(byFlag, appsock.FdFlagMqEventfd)
+		if initErr := worker.init(replyMsg.Msg.SegmentHandle, replyMsg.Msg.AppEventQueueAddress); initErr != nil {
+			_ = worker.release()
+			worker = nil
+			return initErr
+		}
+		worker.udsConn = udsConn
+		return nil
+	})
+	if addErr != nil {
+		_ = udsConn.Close()
+		return nil, addErr
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.detached {
+		_ = worker.release()
+		return nil, ErrDetached
+	}
+	a.workers = append(a.workers, worker)
+	return worker, nil
+}
+
+// removeWorker forgets a worker deleted with Worker.Close
+func (a *Attachment) removeWorker(worker *Worker) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i := range a.workers {
+		if a.workers[i] == worker {
+			a.workers = append(a.workers[:i], a.workers[i+1:]...)
+			return
+		}
+	}
+}
+
+// Detach detaches the application from VPP, then unmaps and closes all of its
+// memory segments. VPP has no detach message on the app socket, it deletes
+// the workers and detaches the application once their app socket
+// connections close. Detach shuts the connections down and waits for VPP
+// to close its end of each until ctx ends.
+func (a *Attachment) Detach(ctx context.Context) error {
+	a.mu.Lock()
+	if a.detached {
+		a.mu.Unlock()
+		return ErrDetached
+	}
+	a.detached = true
+	var conns []*sapiConn
+	for _, worker := range a.workers {
+		if worker.udsConn != nil {
+			conns = append(conns, worker.udsConn)
+		}
+	}
+	a.mu.Unlock()
+	var err error
+	for _, c := range append(conns, a.udsConn) {
+		if shutdownErr := c.shutdown(ctx); err == nil {
+			err = shutdownErr
+		}
+	}
+	a.mu.Lock()
+	if releaseErr := a.release(); err == nil {
+		err = releaseErr
+	}
+	a.mu.Unlock()
+	a.ns.forgetConn(a.udsConn)
+	close(a.detachDone)
+	return err
+}
+
+// request runs the request/reply exchange fn on the attach connection,
+// bound to ctx
+func (a *Attachment) request(ctx context.Context, fn func() error) error {
+	return a.udsConn.exchange(ctx, fn)
+}
+
+// isDetached reports whether Detach was called
+func (a *Attachment) isDetached() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.detached
+}
+
+// release unmaps and closes the memory segments of the attachment, a.mu
+// must be held
+func (a *Attachment) release() error {
+	var err error
+	for _, worker := range a.workers {
+		var closeErr error
+		worker.closeOnce.Do(func() {
+			closeErr = worker.release()
+		})
+		if err == nil {
+			err = closeErr
+		}
+	}
+	a.workers = nil
+	a.udsConn.dropFds()
+	if a.vppMqEventFd >= 0 {
+		_ = syscall.Close(a.vppMqEventFd)
+		a.vppMqEventFd = -1
+	}
+	a.vppEventQueues = nil
+	if a.vppMqMemorySegment != nil {
+		if closeErr := a.vppMqMemorySegment.Close(); err == nil {
+			err = closeErr
+		}
+		a.vppMqMemorySegment = nil
+	}
+	a.vppMqFifoSegment = nil
+	return err
+}
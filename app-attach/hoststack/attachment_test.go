@@ -0,0 +1,275 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hoststack
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/godirect/hoststack/app-attach/hoststack/appsock"
+	"github.com/godirect/hoststack/app-attach/hoststack/hoststacktest"
+)
+
+func dial(t *testing.T, vpp *hoststacktest.Server) *Namespace {
+	ns := NewNamespace(nil, "0", WithSocketPath(vpp.Path()))
+	if _, err := ns.Dial(context.Background()); err != nil {
+		t.Fatalf("Dial Error %v", err)
+	}
+	t.Cleanup(func() { _ = ns.Close() })
+	return ns
+}
+
+func attach(t *testing.T, vpp *hoststacktest.Server) *Attachment {
+	ns := dial(t, vpp)
+	attachment, err := NewAttachment(context.Background(), ns, ns.udsConn)
+	if err != nil {
+		t.Fatalf("Attach Error %v", err)
+	}
+	if len(attachment.Workers()) != 1 || len(attachment.Workers()[0].MemorySegment().Bytes()) != hoststacktest.DefaultSegmentSize {
+		t.Fatalf("Expected one worker with a %d bytes segment", hoststacktest.DefaultSegmentSize)
+	}
+	return attachment
+}
+
+func TestAttachReplyErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		action hoststacktest.Action
+		want   error
+	}{
+		{name: "rejected", action: hoststacktest.Action{Retval: int32(SessionErrInvalidNs)}, want: SessionErrInvalidNs},
+		{name: "missing fds", action: hoststacktest.Action{MissingFds: true}, want: ErrBadFdCount},
+		{name: "truncated", action: hoststacktest.Action{Truncate: 10}, want: ErrShortReply},
+		{name: "closed", action: hoststacktest.Action{Close: true}, want: ErrRecv},
+		{name: "too long", action: hoststacktest.Action{Pad: 16}, want: ErrRecv},
+		{name: "too many fds", action: hoststacktest.Action{ExtraFds: maxReplyFds}, want: ErrBadFdCount},
+		{name: "unannounced fds", action: hoststacktest.Action{ExtraFds: 1}, want: ErrBadFdCount},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vpp := hoststacktest.NewServer(t)
+			vpp.Script(appsock.MsgTypeAttach, tt.action)
+			ns := dial(t, vpp)
+			if _, err := NewAttachment(context.Background(), ns, ns.udsConn); !errors.Is(err, tt.want) {
+				t.Errorf("Expected: errors.Is(err, %v); Current: %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestAttachContext(t *testing.T) {
+	tests := []struct {
+		name   string
+		cancel bool
+		want   error
+	}{
+		{name: "deadline", want: context.DeadlineExceeded},
+		{name: "canceled", cancel: true, want: context.Canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vpp := hoststacktest.NewServer(t)
+			vpp.Script(appsock.MsgTypeAttach, hoststacktest.Action{NoReply: true})
+			ns := dial(t, vpp)
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			if tt.cancel {
+				time.AfterFunc(10*time.Millisecond, cancel)
+			}
+			start := time.Now()
+			_, err := ns.Attach(ctx)
+			if !errors.Is(err, tt.want) || !errors.Is(err, ErrRecv) {
+				t.Errorf("Expected: errors.Is(err, %v) and errors.Is(err, ErrRecv); Current: %v", tt.want, err)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("Expected: Attach to give up with ctx; Current: %v", elapsed)
+			}
+		})
+	}
+}
+
+func TestDetach(t *testing.T) {
+	vpp := hoststacktest.NewServer(t)
+	attachment := attach(t, vpp)
+	worker, err := attachment.AddWorker(context.Background())
+	if err != nil {
+		t.Fatalf("AddWorker Error %v", err)
+	}
+	segment := attachment.Workers()[0].MemorySegment()
+	if !vpp.Attached(attachment.AppIndex(), 0) || !vpp.Attached(attachment.AppIndex(), worker.Index()) {
+		t.Fatalf("Expected: the application and its worker to be attached")
+	}
+
+	if err := attachment.Detach(context.Background()); err != nil {
+		t.Errorf("Detach Error %v", err)
+	}
+	if segment.Bytes() != nil || worker.MemorySegment().Bytes() != nil || len(attachment.Workers()) != 0 || attachment.vppMqMemorySegment != nil {
+		t.Errorf("Expected all segments to be released after Detach")
+	}
+	// VPP detaches the application once its app socket connections close,
+	// before Detach returns
+	if vpp.Attached(attachment.AppIndex(), 0) || vpp.Attached(attachment.AppIndex(), worker.Index()) {
+		t.Errorf("Expected: the application and its worker to be detached")
+	}
+	for _, req := range vpp.Requests() {
+		if req.MsgType != appsock.MsgTypeAttach && req.MsgType != appsock.MsgTypeAddDelWorker {
+			t.Errorf("Expected: no request but attach and worker add; Current: %d", req.MsgType)
+		}
+	}
+	if err := attachment.Detach(context.Background()); !errors.Is(err, ErrDetached) {
+		t.Errorf("Expected: errors.Is(err, ErrDetached); Current: %v", err)
+	}
+}
+
+func TestDetachCanceled(t *testing.T) {
+	vpp := hoststacktest.NewServer(t)
+	attachment := attach(t, vpp)
+	segment := attachment.Workers()[0].MemorySegment()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// VPP may or may not have dropped the application by the time the wait
+	// gives up, the segments are released either way
+	if err := attachment.Detach(ctx); err != nil && !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected: nil or context.Canceled; Current: %v", err)
+	}
+	if segment.Bytes() != nil || len(attachment.Workers()) != 0 {
+		t.Errorf("Expected all segments to be released after Detach")
+	}
+}
+
+func TestAddWorker(t *testing.T) {
+	vpp := hoststacktest.NewServer(t)
+	attachment := attach(t, vpp)
+
+	worker, err := attachment.AddWorker(context.Background())
+	if err != nil {
+		t.Fatalf("AddWorker Error %v", err)
+	}
+	if worker.Index() != 1 || len(worker.MemorySegment().Bytes()) != hoststacktest.DefaultSegmentSize {
+		t.Errorf("Unexpected worker %+v", worker)
+	}
+	if len(attachment.Workers()) != 2 {
+		t.Errorf("Expected: 2 workers; Current: %d", len(attachment.Workers()))
+	}
+
+	if err := worker.Close(); err != nil {
+		t.Errorf("Worker Close Error %v", err)
+	}
+	if len(attachment.Workers()) != 1 || worker.MemorySegment().Bytes() != nil {
+		t.Errorf("Expected the worker to be removed and its segment released")
+	}
+	if err := worker.Close(); !errors.Is(err, ErrWorkerClosed) {
+		t.Errorf("Expected: errors.Is(err, ErrWorkerClosed); Current: %v", err)
+	}
+	if err := attachment.Workers()[0].Close(); !errors.Is(err, ErrFirstWorker) {
+		t.Errorf("Expected: errors.Is(err, ErrFirstWorker); Current: %v", err)
+	}
+}
+
+func TestAddWorkerNoNamespace(t *testing.T) {
+	vpp := hoststacktest.NewServer(t)
+	ns := dial(t, vpp)
+	attachment, err := NewAttachment(context.Background(), nil, ns.udsConn)
+	if err != nil {
+		t.Fatalf("Attach Error %v", err)
+	}
+	defer func() { _ = attachment.Detach(context.Background()) }()
+	if _, err := attachment.AddWorker(context.Background()); !errors.Is(err, ErrNotDialed) {
+		t.Errorf("Expected: errors.Is(err, ErrNotDialed); Current: %v", err)
+	}
+}
+
+func TestAddWorkerMissingFds(t *testing.T) {
+	vpp := hoststacktest.NewServer(t)
+	attachment := attach(t, vpp)
+
+	vpp.Script(appsock.MsgTypeAddDelWorker, hoststacktest.Action{MissingFds: true})
+	if _, err := attachment.AddWorker(context.Background()); !errors.Is(err, ErrBadFdCount) {
+		t.Errorf("Expected: errors.Is(err, ErrBadFdCount); Current: %v", err)
+	}
+	if len(attachment.Workers()) != 1 {
+		t.Errorf("Expected: 1 worker; Current: %d", len(attachment.Workers()))
+	}
+}
+
+func TestParseFdsCloseOnExec(t *testing.T) {
+	var pipe [2]int
+	if err := syscall.Pipe(pipe[:]); err != nil {
+		t.Fatalf("Pipe Error %v", err)
+	}
+	defer closeFds(pipe[:])
+	// pass the pipe to ourselves so that the kernel installs new fds
+	pair, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair Error %v", err)
+	}
+	defer closeFds(pair[:])
+	if err := syscall.Sendmsg(pair[0], []byte{0}, syscall.UnixRights(pipe[:]...), nil, 0); err != nil {
+		t.Fatalf("Sendmsg Error %v", err)
+	}
+	oob := make([]byte, syscall.CmsgSpace(4*len(pipe)))
+	_, oobn, _, _, err := syscall.Recvmsg(pair[1], make([]byte, 1), oob, 0)
+	if err != nil {
+		t.Fatalf("Recvmsg Error %v", err)
+	}
+	fds, err := parseFds(oob[:oobn])
+	if err != nil || len(fds) != len(pipe) {
+		t.Fatalf("Expected: %d fds; Current: %v, %v", len(pipe), fds, err)
+	}
+	defer closeFds(fds)
+	for _, fd := range fds {
+		flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), syscall.F_GETFD, 0)
+		if errno != 0 || flags&syscall.FD_CLOEXEC == 0 {
+			t.Errorf("Expected: fd %d to be close on exec; Current: flags %#x, %v", fd, flags, errno)
+		}
+	}
+}
+
+// oobConn reads a single message with the control messages in oob
+type oobConn struct {
+	net.Conn
+	oob []byte
+}
+
+func (c *oobConn) ReadMsgUnix(b, oob []byte) (n, oobn, flags int, addr *net.UnixAddr, err error) {
+	return len(b), copy(oob, c.oob), 0, nil, nil
+}
+
+func TestRecvMsgMalformedCmsg(t *testing.T) {
+	var pipe [2]int
+	if err := syscall.Pipe(pipe[:]); err != nil {
+		t.Fatalf("Pipe Error %v", err)
+	}
+	defer closeFds(pipe[:1])
+	// fd passing followed by a control message that is not
+	oob := append(syscall.UnixRights(pipe[1]), syscall.UnixCredentials(&syscall.Ucred{})...)
+	c := newSapiConn(&oobConn{oob: oob})
+	var msg appsock.AppSapiMsgAttachReply
+	// room for both control messages
+	if _, err := c.recvMsg(appsock.MsgTypeAttachReply, &msg, 16); !errors.Is(err, ErrRecv) {
+		t.Errorf("Expected: errors.Is(err, ErrRecv); Current: %v", err)
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(pipe[1]), syscall.F_GETFD, 0); errno != syscall.EBADF {
+		t.Errorf("Expected: the passed fd to be closed; Current: %v", errno)
+	}
+}
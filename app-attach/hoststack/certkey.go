@@ -0,0 +1,106 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hoststack
+
+import (
+	"context"
+	"crypto/tls"
+	"math"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+
+	"github.com/godirect/hoststack/app-attach/hoststack/appsock"
+)
+
+// CertKeyIndex identifies a certificate and key pair registered with VPP
+type CertKeyIndex uint32
+
+// ErrInvalidCertKey is returned by AddCertKey for a pair VPP would not load
+var ErrInvalidCertKey = errors.New("invalid certificate and key pair")
+
+var certKeyContext uint32
+
+// AddCertKey registers a PEM encoded certificate chain and private key with
+// VPP, for use by the tls and quic transports. The pair is checked to parse
+// and to match before it is sent. ctx bounds the wait for the reply of VPP.
+func (a *Attachment) AddCertKey(ctx context.Context, certPEM, keyPEM []byte) (CertKeyIndex, error) {
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		return 0, wrapErr(ErrInvalidCertKey, err)
+	}
+	if len(certPEM)+len(keyPEM) > math.MaxUint16 {
+		return 0, wrapErr(ErrInvalidCertKey, errors.Errorf("certificate and key exceed %d bytes", math.MaxUint16))
+	}
+	if a.isDetached() {
+		return 0, ErrDetached
+	}
+	msg := appsock.AppSapiMsgCertKeyAddDel{MsgType: appsock.MsgTypeAddDelCertKey, Msg: appsock.AppCertKeyAddDelMsg{
+		Context:    atomic.AddUint32(&certKeyContext, 1),
+		CertLen:    uint16(len(certPEM)),
+		CertkeyLen: uint16(len(certPEM) + len(keyPEM)),
+		IsAdd:      1,
+	}}
+	certKey := make([]byte, 0, len(certPEM)+len(keyPEM))
+	certKey = append(append(certKey, certPEM...), keyPEM...)
+	replyMsg, err := a.certKeyRequest(ctx, &msg, certKey)
+	if err != nil {
+		return 0, errors.Wrap(err, "cert key add failed")
+	}
+	return CertKeyIndex(replyMsg.Msg.Index), nil
+}
+
+// DelCertKey removes a certificate and key pair registered with AddCertKey.
+// ctx bounds the wait for the reply of VPP.
+func (a *Attachment) DelCertKey(ctx context.Context, index CertKeyIndex) error {
+	if a.isDetached() {
+		return ErrDetached
+	}
+	msg := appsock.AppSapiMsgCertKeyAddDel{MsgType: appsock.MsgTypeAddDelCertKey, Msg: appsock.AppCertKeyAddDelMsg{
+		Context: atomic.AddUint32(&certKeyContext, 1),
+		Index:   uint32(index),
+	}}
+	_, err := a.certKeyRequest(ctx, &msg, nil)
+	return errors.Wrap(err, "cert key del failed")
+}
+
+func (a *Attachment) certKeyRequest(ctx context.Context, msg *appsock.AppSapiMsgCertKeyAddDel, certKey []byte) (*appsock.AppSapiMsgCertKeyAddDelReply, error) {
+	var replyMsg appsock.AppSapiMsgCertKeyAddDelReply
+	err := a.request(ctx, func() error {
+		if sendErr := sendMsg(a.udsConn, msg); sendErr != nil {
+			return sendErr
+		}
+		if certKey != nil {
+			if _, writeErr := a.udsConn.Write(certKey); writeErr != nil {
+				return wrapErr(ErrSend, writeErr)
+			}
+		}
+		if _, recvErr := a.udsConn.recvMsg(appsock.MsgTypeAddDelCertKeyReply, &replyMsg, 0); recvErr != nil {
+			return recvErr
+		}
+		if replyMsg.Msg.Context != msg.Msg.Context {
+			return wrapErr(ErrRecv, errors.Errorf("reply context %d does not match request context %d", replyMsg.Msg.Context, msg.Msg.Context))
+		}
+		if replyMsg.Msg.Retval != 0 {
+			return SessionError(replyMsg.Msg.Retval)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &replyMsg, nil
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hoststack
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/godirect/hoststack/app-attach/hoststack/appsock"
+	"github.com/godirect/hoststack/app-attach/hoststack/hoststacktest"
+)
+
+func selfSignedCertKey(t *testing.T) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey Error %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "hoststack.test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate Error %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey Error %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func TestAddDelCertKey(t *testing.T) {
+	vpp := hoststacktest.NewServer(t)
+	attachment := attach(t, vpp)
+	certPEM, keyPEM := selfSignedCertKey(t)
+
+	index, err := attachment.AddCertKey(context.Background(), certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("AddCertKey Error %v", err)
+	}
+	requests := vpp.Requests()
+	req := requests[len(requests)-1]
+	var msg appsock.AppSapiMsgCertKeyAddDel
+	if err := msg.UnmarshalBinary(req.Msg); err != nil {
+		t.Fatalf("BinaryUnMarshaling Error %v", err)
+	}
+	if int(msg.Msg.CertLen) != len(certPEM) || int(msg.Msg.CertkeyLen) != len(certPEM)+len(keyPEM) {
+		t.Errorf("Unexpected cert key lengths %+v", msg.Msg)
+	}
+	if !bytes.Equal(req.Payload, append(append([]byte{}, certPEM...), keyPEM...)) {
+		t.Errorf("Expected the certificate followed by the key as payload")
+	}
+
+	if err := attachment.DelCertKey(context.Background(), index); err != nil {
+		t.Errorf("DelCertKey Error %v", err)
+	}
+	requests = vpp.Requests()
+	if err := msg.UnmarshalBinary(requests[len(requests)-1].Msg); err != nil || msg.Msg.IsAdd != 0 || msg.Msg.Index != uint32(index) {
+		t.Errorf("Unexpected cert key del message %+v, %v", msg.Msg, err)
+	}
+
+	vpp.Script(appsock.MsgTypeAddDelCertKey, hoststacktest.Action{Retval: int32(SessionErrNoCryptoCkp)})
+	if err := attachment.DelCertKey(context.Background(), 4); !errors.Is(err, SessionErrNoCryptoCkp) {
+		t.Errorf("Expected: errors.Is(err, SessionErrNoCryptoCkp); Current: %v", err)
+	}
+
+	vpp.Script(appsock.MsgTypeAddDelCertKey, hoststacktest.Action{NoReply: true})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := attachment.AddCertKey(ctx, certPEM, keyPEM); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected: errors.Is(err, context.DeadlineExceeded); Current: %v", err)
+	}
+}
+
+func TestAddCertKeyValidation(t *testing.T) {
+	vpp := hoststacktest.NewServer(t)
+	attachment := attach(t, vpp)
+	certPEM, keyPEM := selfSignedCertKey(t)
+	_, otherKeyPEM := selfSignedCertKey(t)
+
+	tests := []struct {
+		name    string
+		certPEM []byte
+		keyPEM  []byte
+	}{
+		{name: "empty", certPEM: nil, keyPEM: nil},
+		{name: "not pem", certPEM: []byte("certificate"), keyPEM: keyPEM},
+		{name: "key as cert", certPEM: keyPEM, keyPEM: keyPEM},
+		{name: "mismatched key", certPEM: certPEM, keyPEM: otherKeyPEM},
+	}
+	for _, tt := range tests {
+		if _, err := attachment.AddCertKey(context.Background(), tt.certPEM, tt.keyPEM); !errors.Is(err, ErrInvalidCertKey) {
+			t.Errorf("%s: Expected: errors.Is(err, ErrInvalidCertKey); Current: %v", tt.name, err)
+		}
+	}
+	for _, req := range vpp.Requests() {
+		if req.MsgType == appsock.MsgTypeAddDelCertKey {
+			t.Errorf("Expected invalid cert key pairs not to reach vpp")
+		}
+	}
+}
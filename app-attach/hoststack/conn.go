@@ -0,0 +1,330 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hoststack
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// errConnClosed is returned when using a connection after Close, with
+	// the message of the net package
+	errConnClosed = errors.New("use of closed network connection")
+	// errConnGone is returned when VPP freed the session of a connection
+	errConnGone error = syscall.ECONNABORTED
+)
+
+// conn is a net.Conn over a stream session, reads and writes go through the
+// session fifos. CloseWrite and CloseRead half close it.
+type conn struct {
+	session        *appSession
+	network        string
+	laddr, raddr   net.Addr
+	readDeadline   *deadline
+	writeDeadline  *deadline
+	closed         chan struct{}
+	closeOnce      sync.Once
+	readClosed     chan struct{} // closed by CloseRead
+	readCloseOnce  sync.Once
+	writeClosed    chan struct{} // closed by CloseWrite
+	writeCloseOnce sync.Once
+}
+
+func newConn(s *appSession, network string, laddr, raddr net.Addr) *conn {
+	return &conn{
+		session:       s,
+		network:       network,
+		laddr:         laddr,
+		raddr:         raddr,
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+		closed:        make(chan struct{}),
+		readClosed:    make(chan struct{}),
+		writeClosed:   make(chan struct{}),
+	}
+}
+
+// Read reads data VPP received for the session. It returns io.EOF once the
+// peer closed the session and all of its data is read, or after CloseRead.
+func (c *conn) Read(b []byte) (int, error) {
+	for {
+		if isClosedChan(c.readClosed) {
+			return 0, io.EOF
+		}
+		if c.readDeadline.passed() {
+			return 0, c.opError("read", os.ErrDeadlineExceeded)
+		}
+		peerClosed, reset := c.session.peerState()
+		n, notify, err := c.session.read(b)
+		if err != nil {
+			return 0, c.opError("read", err)
+		}
+		if notify {
+			ctx, cancel := c.readDeadline.context()
+			err = c.session.notifyVpp(ctx, EventIORx)
+			cancel()
+			if err != nil {
+				return n, c.opError("read", err)
+			}
+		}
+		switch {
+		case n > 0 || len(b) == 0:
+			return n, nil
+		case reset:
+			return 0, c.opError("read", syscall.ECONNRESET)
+		case peerClosed:
+			return 0, io.EOF
+		}
+		select {
+		case <-c.session.rxEvent:
+		case <-c.session.closing:
+		case <-c.closed:
+		case <-c.readClosed:
+		case <-c.readDeadline.wait():
+		}
+	}
+}
+
+// Write writes data for VPP to send over the session, it waits for room in
+// the tx fifo until all of b is written
+func (c *conn) Write(b []byte) (int, error) {
+	written := 0
+	for {
+		if isClosedChan(c.writeClosed) {
+			return written, c.opError("write", syscall.EPIPE)
+		}
+		if c.writeDeadline.passed() {
+			return written, c.opError("write", os.ErrDeadlineExceeded)
+		}
+		if _, reset := c.session.peerState(); reset {
+			return written, c.opError("write", syscall.ECONNRESET)
+		}
+		n, notify, err := c.session.write(b[written:])
+		if err != nil {
+			return written, c.opError("write", err)
+		}
+		written += n
+		if notify {
+			ctx, cancel := c.writeDeadline.context()
+			err = c.session.notifyVpp(ctx, EventIOTx)
+			cancel()
+			if err != nil {
+				return written, c.opError("write", err)
+			}
+		}
+		if written == len(b) {
+			return written, nil
+		}
+		if n > 0 {
+			continue
+		}
+		select {
+		case <-c.session.txEvent:
+		case <-c.session.closing:
+		case <-c.closed:
+		case <-c.writeClosed:
+		case <-c.writeDeadline.wait():
+		}
+	}
+}
+
+// Close disconnects the session. Blocked reads and writes are unblocked and
+// return errors.
+func (c *conn) Close() error {
+	err := errConnClosed
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		err = c.session.close()
+		if errors.Is(err, ErrWorkerClosed) {
+			err = nil
+		}
+	})
+	if err != nil {
+		return c.opError("close", err)
+	}
+	return nil
+}
+
+// CloseWrite shuts down the sending side of the session: VPP sends what is
+// left in the tx fifo, then closes its side of the transport, the peer reads
+// io.EOF. Writes fail afterwards, reads go on until the peer closes its
+// side. Datagram sessions only stop writing.
+func (c *conn) CloseWrite() error {
+	if c.isClosed() {
+		return c.opError("close", errConnClosed)
+	}
+	first := false
+	c.writeCloseOnce.Do(func() {
+		close(c.writeClosed)
+		first = true
+	})
+	if !first || strings.HasPrefix(c.network, "udp") {
+		return nil
+	}
+	if err := c.session.shutdown(); err != nil {
+		return c.opError("close", err)
+	}
+	return nil
+}
+
+// CloseRead shuts down the receiving side of the connection, reads return
+// io.EOF afterwards. VPP has no such shutdown: what the peer keeps sending
+// fills the rx fifo of the session until it is closed.
+func (c *conn) CloseRead() error {
+	if c.isClosed() {
+		return c.opError("close", errConnClosed)
+	}
+	c.readCloseOnce.Do(func() {
+		close(c.readClosed)
+	})
+	return nil
+}
+
+// LocalAddr returns the address VPP bound the session to
+func (c *conn) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+// RemoteAddr returns the address of the peer
+func (c *conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+// SetDeadline sets the read and write deadlines
+func (c *conn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the deadline of pending and future reads
+func (c *conn) SetReadDeadline(t time.Time) error {
+	if c.isClosed() {
+		return c.opError("set", errConnClosed)
+	}
+	c.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline of pending and future writes
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	if c.isClosed() {
+		return c.opError("set", errConnClosed)
+	}
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *conn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *conn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: c.network, Source: c.laddr, Addr: c.raddr, Err: err}
+}
+
+// deadline is a deadline that can be moved while operations wait for it,
+// as the one of net.Pipe
+type deadline struct {
+	mu     sync.Mutex
+	t      time.Time
+	timer  *time.Timer
+	cancel chan struct{} // closed when the deadline passes
+}
+
+func newDeadline() *deadline {
+	return &deadline{cancel: make(chan struct{})}
+}
+
+// set moves the deadline, the zero time means no deadline
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // wait for the timer callback to close it
+	}
+	d.timer = nil
+	d.t = t
+
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() {
+			close(cancel)
+		})
+		return
+	}
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel closed when the deadline passes
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+// passed reports whether the deadline passed
+func (d *deadline) passed() bool {
+	return isClosedChan(d.wait())
+}
+
+// context returns a context ending at the deadline
+func (d *deadline) context() (context.Context, context.CancelFunc) {
+	d.mu.Lock()
+	t := d.t
+	d.mu.Unlock()
+	if t.IsZero() {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithDeadline(context.Background(), t)
+}
+
+func isClosedChan(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,355 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hoststack
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/godirect/hoststack/app-attach/hoststack/hoststacktest"
+)
+
+// dialSession attaches to a server serving sessions with handler and dials
+// a session
+func dialSession(t *testing.T, handler hoststacktest.SessionHandler, options ...AttachOption) (*hoststacktest.Server, *Attachment, net.Conn) {
+	vpp := hoststacktest.NewServer(t, hoststacktest.WithSessionHandler(handler))
+	ns := dial(t, vpp)
+	attachment, err := NewAttachment(context.Background(), ns, ns.udsConn, options...)
+	if err != nil {
+		t.Fatalf("Attach Error %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := attachment.Dial(ctx, "tcp", "10.0.0.1:80")
+	if err != nil {
+		t.Fatalf("Dial Error %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return vpp, attachment, conn
+}
+
+func testDialEcho(t *testing.T, options ...AttachOption) {
+	_, _, conn := dialSession(t, hoststacktest.Echo, options...)
+	if addr := conn.RemoteAddr().String(); addr != "10.0.0.1:80" {
+		t.Errorf("Expected: 10.0.0.1:80; Current: %s", addr)
+	}
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); !ok || !addr.IP.Equal(net.IPv4(127, 0, 0, 1)) || addr.Port == 0 {
+		t.Errorf("Expected: a local address on 127.0.0.1; Current: %v", conn.LocalAddr())
+	}
+
+	// more than the fifos hold, so that both ends wait for room
+	data := make([]byte, 256<<10)
+	rand.New(rand.NewSource(1)).Read(data)
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(data)
+		writeErr <- err
+	}()
+	echo := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, echo); err != nil {
+		t.Fatalf("Read Error %v", err)
+	}
+	if err := <-writeErr; err != nil {
+		t.Fatalf("Write Error %v", err)
+	}
+	if !bytes.Equal(data, echo) {
+		t.Errorf("Expected: the data written to be echoed")
+	}
+
+	if err := conn.Close(); err != nil {
+		t.Errorf("Close Error %v", err)
+	}
+	if err := conn.Close(); err == nil {
+		t.Errorf("Expected: an error closing twice")
+	}
+	if _, err := conn.Read(echo); err == nil || errors.Is(err, io.EOF) {
+		t.Errorf("Expected: an error reading after Close; Current: %v", err)
+	}
+}
+
+func TestDialEcho(t *testing.T) {
+	testDialEcho(t)
+}
+
+func TestDialEchoNoEventFd(t *testing.T) {
+	testDialEcho(t, WithoutFlags(FlagEvtMqUseEventfd))
+}
+
+func TestDialErrors(t *testing.T) {
+	cases := []struct {
+		name    string
+		network string
+		address string
+		action  hoststacktest.Action
+		timeout time.Duration
+		want    error
+	}{
+		{name: "refused", network: "tcp", address: "10.0.0.1:80", action: hoststacktest.Action{Retval: int32(SessionErrRefused)}, want: SessionErrRefused},
+		{name: "timeout", network: "tcp", address: "10.0.0.1:80", action: hoststacktest.Action{NoReply: true}, timeout: 50 * time.Millisecond, want: context.DeadlineExceeded},
+		{name: "network", network: "unix", address: "10.0.0.1:80", want: net.UnknownNetworkError("unix")},
+		{name: "family", network: "tcp6", address: "10.0.0.1:80", want: &net.AddrError{Err: "address of the wrong family", Addr: "10.0.0.1"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			vpp := hoststacktest.NewServer(t, hoststacktest.WithSessionHandler(hoststacktest.Echo))
+			vpp.ScriptConnect(c.action)
+			attachment := attach(t, vpp)
+			timeout := c.timeout
+			if timeout == 0 {
+				timeout = 5 * time.Second
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			conn, err := attachment.Dial(ctx, c.network, c.address)
+			var opErr *net.OpError
+			if !errors.As(err, &opErr) || opErr.Op != "dial" {
+				t.Fatalf("Expected: a dial *net.OpError; Current: %v, %v", conn, err)
+			}
+			if addrErr, ok := c.want.(*net.AddrError); ok {
+				if !errors.As(err, &addrErr) {
+					t.Errorf("Expected: %v; Current: %v", c.want, err)
+				}
+			} else if !errors.Is(err, c.want) {
+				t.Errorf("Expected: errors.Is(err, %v); Current: %v", c.want, err)
+			}
+		})
+	}
+}
+
+func TestConnReadDeadline(t *testing.T) {
+	_, _, conn := dialSession(t, func(s *hoststacktest.Session) {
+		_, _ = io.Copy(ioutil.Discard, s)
+	})
+	_ = conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	start := time.Now()
+	_, err := conn.Read(make([]byte, 1))
+	var netErr net.Error
+	if !errors.Is(err, os.ErrDeadlineExceeded) || !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("Expected: a timeout error; Current: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected: the read to time out after 20ms; Current: %v", elapsed)
+	}
+
+	// moving the deadline unblocks a pending read
+	_ = conn.SetReadDeadline(time.Time{})
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		readErr <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	_ = conn.SetReadDeadline(time.Now())
+	if err := <-readErr; !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expected: errors.Is(err, os.ErrDeadlineExceeded); Current: %v", err)
+	}
+}
+
+func TestConnPeerClose(t *testing.T) {
+	_, _, conn := dialSession(t, func(s *hoststacktest.Session) {
+		_, _ = s.Write([]byte("bye"))
+	})
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err := ioutil.ReadAll(conn)
+	if err != nil || string(data) != "bye" {
+		t.Errorf("Expected: bye and io.EOF; Current: %q, %v", data, err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Errorf("Close Error %v", err)
+	}
+}
+
+func TestConnCloseWrite(t *testing.T) {
+	_, _, conn := dialSession(t, func(s *hoststacktest.Session) {
+		// the server answers once the application is done writing
+		data, _ := ioutil.ReadAll(s)
+		_, _ = s.Write(append([]byte("got "), data...))
+	})
+	halfCloser, ok := conn.(interface {
+		CloseWrite() error
+		CloseRead() error
+	})
+	if !ok {
+		t.Fatalf("Expected: CloseWrite and CloseRead; Current: %T", conn)
+	}
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write Error %v", err)
+	}
+	if err := halfCloser.CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite Error %v", err)
+	}
+	if _, err := conn.Write([]byte{1}); !errors.Is(err, syscall.EPIPE) {
+		t.Errorf("Expected: errors.Is(err, syscall.EPIPE); Current: %v", err)
+	}
+	data, err := ioutil.ReadAll(conn)
+	if err != nil || string(data) != "got hello" {
+		t.Errorf("Expected: got hello and io.EOF; Current: %q, %v", data, err)
+	}
+	if err := halfCloser.CloseRead(); err != nil {
+		t.Errorf("CloseRead Error %v", err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected: io.EOF; Current: %v", err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Errorf("Close Error %v", err)
+	}
+	if err := halfCloser.CloseWrite(); err == nil {
+		t.Errorf("Expected: an error half closing a closed connection")
+	}
+}
+
+func TestConnPeerReset(t *testing.T) {
+	_, _, conn := dialSession(t, func(s *hoststacktest.Session) {
+		_ = s.Reset()
+	})
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("Expected: errors.Is(err, syscall.ECONNRESET); Current: %v", err)
+	}
+	if _, err := conn.Write([]byte{1}); !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("Expected: errors.Is(err, syscall.ECONNRESET); Current: %v", err)
+	}
+}
+
+func TestConnDetach(t *testing.T) {
+	_, attachment, conn := dialSession(t, func(s *hoststacktest.Session) {
+		_, _ = io.Copy(ioutil.Discard, s)
+	})
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		readErr <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := attachment.Detach(context.Background()); err != nil {
+		t.Fatalf("Detach Error %v", err)
+	}
+	if err := <-readErr; !errors.Is(err, ErrWorkerClosed) {
+		t.Errorf("Expected: errors.Is(err, ErrWorkerClosed); Current: %v", err)
+	}
+}
+
+func TestDialCutThrough(t *testing.T) {
+	tests := []struct {
+		name       string
+		options    []AttachOption
+		cutThrough bool
+	}{
+		{name: "local scope", cutThrough: true},
+		{name: "global scope only", options: []AttachOption{WithoutFlags(FlagUseLocalScope)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handled := make(chan struct{}, 1)
+			vpp := hoststacktest.NewServer(t, hoststacktest.WithSessionHandler(func(s *hoststacktest.Session) {
+				handled <- struct{}{}
+				hoststacktest.Echo(s)
+			}))
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			server := attach(t, vpp)
+			l, err := server.Listen(ctx, "tcp", ":8080")
+			if err != nil {
+				t.Fatalf("Listen Error %v", err)
+			}
+			defer func() { _ = l.Close() }()
+			accepted := make(chan net.Conn, 1)
+			go func() {
+				peer, err := l.Accept()
+				if err != nil {
+					return
+				}
+				accepted <- peer
+				_, _ = io.Copy(peer, peer)
+				_ = peer.Close()
+			}()
+
+			ns := dial(t, vpp)
+			client, err := NewAttachment(ctx, ns, ns.udsConn, tt.options...)
+			if err != nil {
+				t.Fatalf("Attach Error %v", err)
+			}
+			c, err := client.Dial(ctx, "tcp", "127.0.0.1:8080")
+			if err != nil {
+				t.Fatalf("Dial Error %v", err)
+			}
+			defer func() { _ = c.Close() }()
+			s := c.(*conn).session
+			var peer net.Conn
+			select {
+			case peer = <-accepted:
+			case <-handled:
+			}
+			if !tt.cutThrough {
+				if peer != nil || s.segment != s.evtSegment {
+					t.Fatalf("Expected: a session through the transport of vpp")
+				}
+				return
+			}
+			if peer == nil || s.segment == s.evtSegment || peer.(*conn).session.segment != s.segment {
+				t.Fatalf("Expected: the fifos of both sessions in a cut-through segment")
+			}
+
+			// more than the fifos hold, so that both ends wait for room
+			data := make([]byte, 64<<10)
+			rand.New(rand.NewSource(1)).Read(data)
+			_ = c.SetDeadline(time.Now().Add(10 * time.Second))
+			writeErr := make(chan error, 1)
+			go func() {
+				_, err := c.Write(data)
+				writeErr <- err
+			}()
+			echo := make([]byte, len(data))
+			if _, err := io.ReadFull(c, echo); err != nil {
+				t.Fatalf("Read Error %v", err)
+			}
+			if err := <-writeErr; err != nil {
+				t.Fatalf("Write Error %v", err)
+			}
+			if !bytes.Equal(data, echo) {
+				t.Errorf("Expected: the data written to be echoed")
+			}
+
+			// the peer closes its end once it reads io.EOF, then vpp deletes
+			// the segment
+			if err := c.Close(); err != nil {
+				t.Errorf("Close Error %v", err)
+			}
+			for _, w := range []*Worker{client.Workers()[0], server.Workers()[0]} {
+				for w.segment(s.segment) != nil {
+					if ctx.Err() != nil {
+						t.Fatalf("Expected: segment %#x to be unmapped", s.segment)
+					}
+					time.Sleep(time.Millisecond)
+				}
+			}
+		})
+	}
+}
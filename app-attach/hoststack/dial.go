@@ -0,0 +1,262 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hoststack
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/godirect/hoststack/app-attach/hoststack/session"
+)
+
+// Dial connects to address over a session of the first worker of the
+// attachment, see Worker.Dial
+func (a *Attachment) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	workers := a.Workers()
+	if len(workers) == 0 {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: ErrDetached}
+	}
+	return workers[0].Dial(ctx, network, address)
+}
+
+// Dial connects to address over a VPP session of the worker. The network
+// must be "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6" or "tls". Reads and
+// writes on the returned connection go through the session fifos, VPP
+// disconnects the session when it is closed. UDP connections are connected
+// sessions of their own, reads and writes on them carry one datagram. TLS
+// connections are *TLSConns dialed with the defaults of DialTLS.
+func (w *Worker) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	if network == "tls" {
+		c, err := w.DialTLS(ctx, address, nil)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	proto, ok := transportProto(network)
+	if !ok || proto == session.TransportProtoQUIC {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+	ip, port, err := resolveAddr(ctx, network, address, false)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	raddr := sockAddr(network, ip, port)
+	s, reply, err := w.connect(ctx, &connectRequest{proto: proto, ip: ip, port: port})
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: raddr, Err: err}
+	}
+	laddr := endpointAddr(network, &reply.Lcl)
+	if proto == session.TransportProtoUDP {
+		return newPacketConn(s, nil, network, laddr, raddr), nil
+	}
+	return newConn(s, network, laddr, raddr), nil
+}
+
+// connectRequest is a session connect asks VPP for
+type connectRequest struct {
+	proto  uint8
+	ip     net.IP
+	port   int
+	cfg    *session.ExtConfig // the ext config of the session, if any
+	quic   *QUICSession       // the quic connection dialed, or the one of a stream
+	stream bool               // open a stream of quic instead of dialing it
+}
+
+// connect asks VPP to connect a session of the worker as req says, and
+// waits until ctx ends for the session to be connected
+func (w *Worker) connect(ctx context.Context, req *connectRequest) (*appSession, *session.ConnectedMsg, error) {
+	addr, isIP4 := session.NewIP46Address(req.ip)
+	msg := session.ConnectMsg{
+		ClientIndex:  w.apiClientHandle,
+		WrkIndex:     uint8(w.index),
+		IP:           addr,
+		Port:         session.Htons(uint16(req.port)),
+		Proto:        req.proto,
+		ParentHandle: session.InvalidHandle,
+	}
+	if isIP4 {
+		msg.IsIP4 = 1
+	}
+	if req.stream {
+		msg.ParentHandle = req.quic.session.handle
+	}
+	if req.cfg != nil {
+		offset, err := w.attachment.addExtConfig(req.cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		msg.CkpairIndex, msg.CryptoEngine, msg.ExtConfig = req.cfg.CkpairIndex, req.cfg.CryptoEngine, offset
+	}
+	s, event, err := w.request(ctx, nil, EventConnect, msg.ExtConfig, func(s *appSession) interface{} {
+		msg.Context = s.index
+		if req.quic != nil && !req.stream {
+			// the streams the peer opens are accepted on the connection
+			s.setQUIC(req.quic)
+		}
+		return &msg
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	var reply session.ConnectedMsg
+	if err := session.Unmarshal(event.Data, &reply); err != nil {
+		return nil, nil, err
+	}
+	if reply.Retval != 0 {
+		w.sessions.remove(s)
+		return nil, nil, errors.Wrap(SessionError(reply.Retval), "connect rejected by vpp")
+	}
+	if err := s.open(reply.SegmentHandle, reply.ServerRxFifo, reply.ServerTxFifo, reply.VppEventQueueAddress); err != nil {
+		_ = s.close()
+		return nil, nil, err
+	}
+	// VPP cuts through sessions to listeners in the same namespace, it
+	// added the segment of their fifos ahead of the reply
+	if reply.CtRxFifo != 0 {
+		if err := s.openCutThrough(reply.CtSegmentHandle, reply.CtRxFifo, reply.CtTxFifo); err != nil {
+			_ = s.close()
+			return nil, nil, err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		_ = s.close()
+		return nil, nil, err
+	}
+	return s, &reply, nil
+}
+
+// request creates a session and sends VPP the control message msg returns
+// for it, then waits until ctx ends for the reply. A
+// session given up on is closed once VPP replies. The ext config chunk at
+// extConfig, if any, is freed when the message cannot be sent, VPP frees it
+// otherwise.
+func (w *Worker) request(ctx context.Context, l *listener, eventType EventType, extConfig uint64, msg func(s *appSession) interface{}) (*appSession, *Event, error) {
+	w.startDispatch()
+	s := w.sessions.add(w, true, l)
+	data, err := session.Marshal(msg(s))
+	if err == nil {
+		err = w.Send(ctx, &Event{Type: eventType, Data: data})
+	}
+	if err != nil {
+		w.attachment.freeExtConfig(extConfig)
+		w.sessions.remove(s)
+		return nil, nil, err
+	}
+	select {
+	case event := <-s.reply:
+		return s, event, nil
+	case <-s.closing:
+		w.sessions.remove(s)
+		return nil, nil, ErrWorkerClosed
+	case <-ctx.Done():
+		if s.abandon() {
+			return nil, nil, ctx.Err()
+		}
+		// the reply arrived in the meantime, the caller sees ctx ended
+		return s, <-s.reply, nil
+	}
+}
+
+// resolveAddr splits address into an IP and a port, looking up host names
+// for an address of the family of network. A missing host stands for the
+// unspecified address when listening.
+func resolveAddr(ctx context.Context, network, address string, listen bool) (net.IP, int, error) {
+	host, service, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, 0, err
+	}
+	portNetwork := network
+	switch network {
+	case "tls":
+		portNetwork = "tcp"
+	case "quic":
+		portNetwork = "udp"
+	}
+	port, err := net.DefaultResolver.LookupPort(ctx, portNetwork, service)
+	if err != nil {
+		return nil, 0, err
+	}
+	if host == "" {
+		switch {
+		case !listen:
+			return nil, 0, &net.AddrError{Err: "missing host", Addr: address}
+		case strings.HasSuffix(network, "6"):
+			return net.IPv6unspecified, port, nil
+		}
+		return net.IPv4zero, port, nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if !matchesFamily(network, ip) {
+			return nil, 0, &net.AddrError{Err: "address of the wrong family", Addr: host}
+		}
+		return ip, port, nil
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, ip := range ips {
+		if matchesFamily(network, ip.IP) {
+			return ip.IP, port, nil
+		}
+	}
+	return nil, 0, &net.AddrError{Err: "no suitable address found", Addr: host}
+}
+
+// transportProto returns the transport protocol of network
+func transportProto(network string) (uint8, bool) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return session.TransportProtoTCP, true
+	case "udp", "udp4", "udp6":
+		return session.TransportProtoUDP, true
+	case "tls":
+		return session.TransportProtoTLS, true
+	case "quic":
+		return session.TransportProtoQUIC, true
+	}
+	return 0, false
+}
+
+// sockAddr returns the address of ip and port on network
+func sockAddr(network string, ip net.IP, port int) net.Addr {
+	if strings.HasPrefix(network, "udp") || network == "quic" {
+		return &net.UDPAddr{IP: ip, Port: port}
+	}
+	return &net.TCPAddr{IP: ip, Port: port}
+}
+
+// endpointAddr returns the address of a transport endpoint on network
+func endpointAddr(network string, ep *session.TransportEndpoint) net.Addr {
+	return sockAddr(network, ep.IP.IP(ep.IsIP4 != 0), int(session.Ntohs(ep.Port)))
+}
+
+// matchesFamily reports whether ip can be used on network, "tcp4" and
+// "udp4" only take IPv4 addresses, "tcp6" and "udp6" only IPv6 addresses
+func matchesFamily(network string, ip net.IP) bool {
+	switch {
+	case strings.HasSuffix(network, "4"):
+		return ip.To4() != nil
+	case strings.HasSuffix(network, "6"):
+		return ip.To4() == nil
+	}
+	return true
+}
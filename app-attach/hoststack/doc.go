@@ -0,0 +1,91 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package hoststack is a client for VPP's host stack. It attaches an
+// application to a VPP app namespace over the namespace's app socket and
+// maps the shared memory segments VPP hands back.
+//
+// A typical session looks like:
+//
+//	ns := hoststack.NewNamespace(vppConn, "my-namespace")
+//	if _, err := ns.Dial(ctx); err != nil {
+//		return err
+//	}
+//	defer ns.Close()
+//	attachment, err := ns.Attach(ctx)
+//	if err != nil {
+//		return err
+//	}
+//	conn, err := attachment.Dial(ctx, "tcp", "10.0.0.1:80")
+//
+// Connections returned by Dial are net.Conns over VPP sessions, their data
+// goes through the session fifos in the fifo segments of the worker. Once
+// those fill up VPP adds segments at runtime, the worker maps them as they
+// are announced and unmaps them when VPP deletes them. Listen returns a
+// net.Listener accepting the sessions VPP accepts, it can be handed to
+// http.Server.Serve:
+//
+//	l, err := attachment.Listen(ctx, "tcp", ":8080")
+//	if err != nil {
+//		return err
+//	}
+//	return http.Serve(l, handler)
+//
+// UDP is spoken over datagram sessions: Dial("udp", ...) connects a session
+// to a single peer, ListenPacket returns a net.PacketConn whose session is
+// shared by all peers and Listen("udp", ...) accepts a connected session per
+// peer.
+//
+// TLS is terminated by VPP: DialTLS and ListenTLS pass the certificate and
+// key pair registered with AddCertKey, the crypto engine and the SNI hostname
+// to VPP in the extended config of the session, and return *TLSConns whose
+// reads and writes carry plaintext. The extended config of VPP 21.06 does not
+// carry ALPN protocols, so TLSConfig has none.
+//
+// QUIC is terminated by VPP as well: DialQUIC and ListenQUIC take the same
+// TLSConfig and return QUICSessions, whose streams are net.Conns opened with
+// OpenStream or accepted from the peer with AcceptStream. Closing a
+// QUICSession closes its streams.
+//
+// Sessions between two applications attached to the same namespace with
+// FlagUseLocalScope are cut through by VPP: the fifos of both ends are shared
+// in a segment VPP adds to both workers, and the data never goes through a
+// transport protocol.
+//
+// Workers park in the Go runtime poller on the eventfd of their message queue
+// while it is empty, and drain the events VPP queued in a burst before
+// dispatching them. FlagEvtMqUseEventfd, which asks VPP for the eventfd, is
+// set by default; without it workers poll their queue.
+//
+// Instead of a goroutine per connection, an event loop can wait on many
+// sessions of a worker at once with a Poller, as with VCL's epoll sessions:
+//
+//	p := worker.NewPoller()
+//	_ = p.Add(l, hoststack.PollIn)
+//	events := make([]hoststack.PollEvent, 64)
+//	n, err := p.Wait(ctx, events)
+//
+// Sessions are level-triggered unless added with PollET.
+//
+// The app socket of a namespace is looked up at
+// /var/run/vpp/app_ns_sockets/<id> unless set with WithSocketPath,
+// WithRootDir or discovered from the VPP startup config with WithVppConfig.
+//
+// Dial first checks, over the VPP API connection, that VPP is one of the
+// SupportedVersions and that its session API matches the one the package was
+// built against, and fails with ErrUnsupportedVpp otherwise. A namespace
+// created with a nil connection skips the check and assumes VPP 21.06.
+package hoststack
@@ -0,0 +1,100 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hoststack
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrDial is returned when the app namespace socket cannot be connected
+	ErrDial = errors.New("cannot dial app namespace socket")
+	// ErrNotDialed is returned when attaching before Namespace.Dial succeeded
+	ErrNotDialed = errors.New("app namespace socket is not dialed")
+	// ErrSend is returned when a message cannot be written to the app socket
+	ErrSend = errors.New("cannot send message over app socket")
+	// ErrRecv is returned when a reply cannot be read from the app socket
+	ErrRecv = errors.New("cannot receive message over app socket")
+	// ErrShortReply is returned when a reply is smaller than its message type
+	ErrShortReply = errors.New("short reply from app socket")
+	// ErrBadFdCount is returned when a reply does not carry the file
+	// descriptors it announces
+	ErrBadFdCount = errors.New("unexpected number of file descriptors")
+	// ErrMapSegment is returned when a shared memory segment cannot be mapped
+	ErrMapSegment = errors.New("cannot map memory segment")
+	// ErrAttached is returned when dialing a namespace with a live
+	// attachment
+	ErrAttached = errors.New("application is attached")
+	// ErrDetached is returned when using an attachment after Detach
+	ErrDetached = errors.New("application is detached")
+	// ErrWorkerClosed is returned when closing a worker twice or using it
+	// after it is closed
+	ErrWorkerClosed = errors.New("worker is closed")
+	// ErrFirstWorker is returned when closing the first worker of an
+	// attachment, which is released by Attachment.Detach
+	ErrFirstWorker = errors.New("the first worker is released by Attachment.Detach")
+	// ErrPollerClosed is returned when using a Poller after Close
+	ErrPollerClosed = errors.New("poller is closed")
+	// ErrMsgQueue is returned when a message queue cannot be opened or is
+	// corrupt
+	ErrMsgQueue = errors.New("message queue error")
+	// ErrVersion is returned when the version of VPP cannot be queried
+	ErrVersion = errors.New("cannot query vpp version")
+	// ErrUnsupportedVpp is returned when the running VPP is not a supported
+	// release or its session API differs from the one the package expects
+	ErrUnsupportedVpp = errors.New("unsupported vpp")
+)
+
+// opError ties one of the sentinel errors above to the error that caused it,
+// so callers can match either of them with errors.Is and errors.As.
+type opError struct {
+	kind  error
+	cause error
+}
+
+func wrapErr(kind, cause error) error {
+	return &opError{kind: kind, cause: cause}
+}
+
+func (e *opError) Error() string {
+	return e.kind.Error() + ": " + e.cause.Error()
+}
+
+func (e *opError) Is(target error) bool {
+	return target == e.kind
+}
+
+func (e *opError) Unwrap() error {
+	return e.cause
+}
+
+// ErrAttachRejected is returned when VPP answers an attach request with a
+// non zero retval
+type ErrAttachRejected struct {
+	Retval int32
+}
+
+func (e *ErrAttachRejected) Error() string {
+	return fmt.Sprintf("attach rejected by vpp: %v", SessionError(e.Retval))
+}
+
+// Unwrap returns the SessionError matching Retval
+func (e *ErrAttachRejected) Unwrap() error {
+	return SessionError(e.Retval)
+}
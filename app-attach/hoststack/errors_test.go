@@ -0,0 +1,60 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hoststack
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestDialErrorWrapsCause(t *testing.T) {
+	ns := NewNamespace(nil, "does-not-exist")
+	_, err := ns.Dial(context.Background())
+	if !errors.Is(err, ErrDial) {
+		t.Errorf("Expected: errors.Is(err, ErrDial); Current: %v", err)
+	}
+	if !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("Expected the dial cause to be wrapped; Current: %v", err)
+	}
+}
+
+func TestAttachRejected(t *testing.T) {
+	var err error = &ErrAttachRejected{Retval: int32(SessionErrInvalidNs)}
+	var rejected *ErrAttachRejected
+	if !errors.As(err, &rejected) || rejected.Retval != -19 {
+		t.Errorf("Expected: errors.As to find Retval -19; Current: %v", err)
+	}
+	if !errors.Is(err, SessionErrInvalidNs) {
+		t.Errorf("Expected: errors.Is(err, SessionErrInvalidNs); Current: %v", err)
+	}
+	if err.Error() != "attach rejected by vpp: invalid namespace (-19)" {
+		t.Errorf("Unexpected error string: %v", err)
+	}
+	if SessionError(-100).Error() != "unknown session error (-100)" {
+		t.Errorf("Unexpected error string: %v", SessionError(-100))
+	}
+}
+
+func TestAttachNotDialed(t *testing.T) {
+	_, err := NewAttachment(context.Background(), NewNamespace(nil, "0"), nil)
+	if !errors.Is(err, ErrNotDialed) {
+		t.Errorf("Expected: errors.Is(err, ErrNotDialed); Current: %v", err)
+	}
+}
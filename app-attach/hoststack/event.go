@@ -0,0 +1,115 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hoststack
+
+import (
+	"github.com/pkg/errors"
+)
+
+// EventType is the type of a session event, as VPP's session_evt_type_t
+type EventType uint8
+
+// Session event types. IO events carry a session index or handle, control
+// events carry a control message.
+const (
+	EventIORx EventType = iota
+	EventIOTx
+	EventIOTxFlush
+	EventIOBuiltinRx
+	EventIOBuiltinTx
+	EventRPC
+	EventHalfClose
+	EventClose
+	EventReset
+	EventBound
+	EventUnlistenReply
+	EventAccepted
+	EventAcceptedReply
+	EventConnected
+	EventDisconnected
+	EventDisconnectedReply
+	EventResetReply
+	EventReqWorkerUpdate
+	EventWorkerUpdate
+	EventWorkerUpdateReply
+	EventShutdown
+	EventDisconnect
+	EventConnect
+	EventConnectURI
+	EventListen
+	EventListenURI
+	EventUnlisten
+	EventAppDetach
+	EventAppAddSegment
+	EventAppDelSegment
+	EventMigrated
+	EventCleanup
+	EventAppWrkRPC
+)
+
+// Rings of the session message queues, as VPP's SESSION_MQ_*_RING
+const (
+	ioEventRing   = 0
+	ctrlEventRing = 1
+)
+
+// sessionEventHeaderSize is the size of the event_type and postponed fields
+// of VPP's session_event_t, the event data follows them
+const sessionEventHeaderSize = 2
+
+// IsIO reports whether t is an IO event
+func (t EventType) IsIO() bool {
+	return t < EventRPC
+}
+
+// Event is a session event exchanged over a message queue
+type Event struct {
+	Type      EventType
+	Postponed bool
+	// Data is the session index or handle of IO events and the message of
+	// control events
+	Data []byte
+}
+
+// ring returns the ring of a session message queue the event goes on
+func (e *Event) ring() int {
+	if e.Type.IsIO() {
+		return ioEventRing
+	}
+	return ctrlEventRing
+}
+
+func (e *Event) marshal() []byte {
+	buf := make([]byte, sessionEventHeaderSize+len(e.Data))
+	buf[0] = byte(e.Type)
+	if e.Postponed {
+		buf[1] = 1
+	}
+	copy(buf[sessionEventHeaderSize:], e.Data)
+	return buf
+}
+
+func unmarshalEvent(data []byte) (*Event, error) {
+	if len(data) < sessionEventHeaderSize {
+		return nil, errors.Errorf("session event of %d bytes", len(data))
+	}
+	return &Event{
+		Type:      EventType(data[0]),
+		Postponed: data[1] != 0,
+		Data:      data[sessionEventHeaderSize:],
+	}, nil
+}
@@ -0,0 +1,578 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fifo
+
+import (
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/pkg/errors"
+
+	"github.com/godirect/hoststack/app-attach/hoststack/internal/svm"
+)
+
+var (
+	// ErrEmpty is returned by Dequeue when the fifo holds no data
+	ErrEmpty = errors.New("fifo is empty")
+	// ErrFull is returned by Enqueue when the fifo has no room left
+	ErrFull = errors.New("fifo is full")
+)
+
+// Dequeue notification requests of the producer, as in VPP's
+// SVM_FIFO_WANT_DEQ_NOTIF*
+const (
+	WantDeqNtf        uint32 = 1
+	WantDeqNtfIfFull  uint32 = 2
+	WantDeqNtfIfEmpty uint32 = 4
+)
+
+// Fifo is a svm_fifo_t. The consumer calls Dequeue, Peek and Drop, the
+// producer Enqueue and EnqueueWithOffset; each end may be used by a single
+// goroutine at a time. The out of order segments of the producer are kept
+// by the Fifo, as VPP keeps them out of the shared part of a fifo.
+type Fifo struct {
+	seg    *Segment
+	offset uint64
+	shr    []byte
+	ooo    []oooSegment // sorted by start
+}
+
+// Offset returns the offset of the fifo in its segment
+func (f *Fifo) Offset() uint64 {
+	return f.offset
+}
+
+// Size returns the number of bytes the fifo holds when full
+func (f *Fifo) Size() uint32 {
+	return f.load32(svm.SharedFifoSize)
+}
+
+// MasterSessionIndex returns the index of the session in VPP
+func (f *Fifo) MasterSessionIndex() uint32 {
+	return f.load32(svm.SharedMasterSessionIndex)
+}
+
+// SetMasterSessionIndex sets the index of the session in VPP
+func (f *Fifo) SetMasterSessionIndex(index uint32) {
+	f.store32(svm.SharedMasterSessionIndex, index)
+}
+
+// ClientSessionIndex returns the index of the session in the application,
+// VPP tags the io events of the fifo with it
+func (f *Fifo) ClientSessionIndex() uint32 {
+	return f.load32(svm.SharedClientSessionIndex)
+}
+
+// SetClientSessionIndex sets the index of the session in the application
+func (f *Fifo) SetClientSessionIndex(index uint32) {
+	f.store32(svm.SharedClientSessionIndex, index)
+}
+
+// MaxDequeue returns the number of bytes the fifo holds
+func (f *Fifo) MaxDequeue() uint32 {
+	head := f.load32(svm.SharedHead)
+	tail := f.load32(svm.SharedTail)
+	return f.cursize(head, tail)
+}
+
+// MaxEnqueue returns the number of bytes that fit in the fifo
+func (f *Fifo) MaxEnqueue() uint32 {
+	head := f.load32(svm.SharedHead)
+	tail := f.load32(svm.SharedTail)
+	return f.Size() - f.cursize(head, tail)
+}
+
+// Enqueue appends up to len(b) bytes to the fifo, growing it by a chunk
+// when its tail moves past the last one, as VPP's svm_fifo_enqueue. It
+// returns the number of bytes written, ErrFull when there is no room. The
+// tail also moves past the out of order data the written bytes connect to,
+// MaxDequeue tells how much the consumer can read.
+func (f *Fifo) Enqueue(b []byte) (int, error) {
+	head := f.load32(svm.SharedHead)
+	tail := f.load32(svm.SharedTail)
+	free := f.Size() - f.cursize(head, tail)
+	if free == 0 || len(b) == 0 {
+		if len(b) == 0 {
+			return 0, nil
+		}
+		return 0, ErrFull
+	}
+	n := free
+	if uint32(len(b)) < n {
+		n = uint32(len(b))
+	}
+
+	end, err := f.seg.chunk(f.load64(svm.SharedEndChunk))
+	if err != nil {
+		return 0, err
+	}
+	if posGt(tail+n, end.end()) {
+		if err := f.grow(head, tail, n); err != nil {
+			if n = end.end() - tail; n == 0 {
+				return 0, errors.WithMessage(ErrFull, err.Error())
+			}
+		}
+	}
+
+	tailChunk := f.load64(svm.SharedTailChunk)
+	if tailChunk == 0 {
+		if tailChunk, err = f.findChunk(tail); err != nil {
+			return 0, err
+		}
+	}
+	last, err := f.copyToChunks(tailChunk, tail, b[:n])
+	if err != nil {
+		return 0, err
+	}
+	newTail := tail + n
+	if len(f.ooo) > 0 {
+		// data enqueued out of order may now follow the tail
+		newTail = f.collectOOO(newTail)
+		if last, err = f.seekChunk(tailChunk, newTail); err != nil {
+			return 0, err
+		}
+	}
+	f.store64(svm.SharedTailChunk, last)
+	f.store32(svm.SharedTail, newTail)
+	return int(n), nil
+}
+
+// EnqueueSegments writes the segments as one piece of data, as VPP's
+// svm_fifo_enqueue_segments without partial writes: all of them are written
+// or, with ErrFull, none. Datagrams are written with their header this way.
+func (f *Fifo) EnqueueSegments(segs ...[]byte) (int, error) {
+	head := f.load32(svm.SharedHead)
+	tail := f.load32(svm.SharedTail)
+	total := 0
+	for _, seg := range segs {
+		total += len(seg)
+	}
+	if total == 0 {
+		return 0, nil
+	}
+	if uint64(total) > uint64(f.Size()-f.cursize(head, tail)) {
+		return 0, ErrFull
+	}
+	n := uint32(total)
+
+	end, err := f.seg.chunk(f.load64(svm.SharedEndChunk))
+	if err != nil {
+		return 0, err
+	}
+	if posGt(tail+n, end.end()) {
+		if err := f.grow(head, tail, n); err != nil {
+			return 0, errors.WithMessage(ErrFull, err.Error())
+		}
+	}
+
+	tailChunk := f.load64(svm.SharedTailChunk)
+	if tailChunk == 0 {
+		if tailChunk, err = f.findChunk(tail); err != nil {
+			return 0, err
+		}
+	}
+	pos := tail
+	for _, seg := range segs {
+		if len(seg) == 0 {
+			continue
+		}
+		if tailChunk, err = f.copyToChunks(tailChunk, pos, seg); err != nil {
+			return 0, err
+		}
+		pos += uint32(len(seg))
+	}
+	f.store64(svm.SharedTailChunk, tailChunk)
+	f.store32(svm.SharedTail, pos)
+	return total, nil
+}
+
+// Dequeue reads up to len(b) bytes from the fifo and gives the chunks the
+// head moved past back to the segment, as VPP's svm_fifo_dequeue. It returns
+// the number of bytes read, ErrEmpty when the fifo holds no data.
+func (f *Fifo) Dequeue(b []byte) (int, error) {
+	tail := f.load32(svm.SharedTail)
+	head := f.load32(svm.SharedHead)
+	cursize := f.cursize(head, tail)
+	if cursize == 0 || len(b) == 0 {
+		if len(b) == 0 {
+			return 0, nil
+		}
+		return 0, ErrEmpty
+	}
+	n := cursize
+	if uint32(len(b)) < n {
+		n = uint32(len(b))
+	}
+
+	headChunk := f.load64(svm.SharedHeadChunk)
+	var err error
+	if headChunk == 0 {
+		if headChunk, err = f.findChunk(head); err != nil {
+			return 0, err
+		}
+	}
+	last, err := f.copyFromChunks(headChunk, head, b[:n])
+	if err != nil {
+		return 0, err
+	}
+	if err := f.moveHead(head+n, last); err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+// Peek reads up to len(b) bytes from offset past the head of the fifo
+// without consuming them, as VPP's svm_fifo_peek. It returns ErrEmpty when
+// the fifo holds no data past offset.
+func (f *Fifo) Peek(offset uint32, b []byte) (int, error) {
+	tail := f.load32(svm.SharedTail)
+	head := f.load32(svm.SharedHead)
+	cursize := f.cursize(head, tail)
+	if cursize <= offset || len(b) == 0 {
+		if len(b) == 0 {
+			return 0, nil
+		}
+		return 0, ErrEmpty
+	}
+	n := cursize - offset
+	if uint32(len(b)) < n {
+		n = uint32(len(b))
+	}
+	c, err := f.seekChunk(f.load64(svm.SharedHeadChunk), head+offset)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.copyFromChunks(c, head+offset, b[:n]); err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+// Drop consumes up to n bytes without reading them, as VPP's
+// svm_fifo_dequeue_drop. It returns the number of bytes dropped, ErrEmpty
+// when the fifo holds no data.
+func (f *Fifo) Drop(n uint32) (int, error) {
+	tail := f.load32(svm.SharedTail)
+	head := f.load32(svm.SharedHead)
+	cursize := f.cursize(head, tail)
+	if cursize == 0 || n == 0 {
+		if n == 0 {
+			return 0, nil
+		}
+		return 0, ErrEmpty
+	}
+	if cursize < n {
+		n = cursize
+	}
+	headChunk, err := f.seekChunk(f.load64(svm.SharedHeadChunk), head+n)
+	if err != nil {
+		return 0, err
+	}
+	if err := f.moveHead(head+n, headChunk); err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+// DropAll consumes all data of the fifo, as VPP's
+// svm_fifo_dequeue_drop_all
+func (f *Fifo) DropAll() error {
+	tail := f.load32(svm.SharedTail)
+	headChunk, err := f.seekChunk(f.load64(svm.SharedHeadChunk), tail)
+	if err != nil {
+		return err
+	}
+	return f.moveHead(tail, headChunk)
+}
+
+// moveHead publishes the new head of the consumer and the chunk holding it,
+// after giving the chunks the head moved past back to the segment
+func (f *Fifo) moveHead(head uint32, headChunk uint64) error {
+	f.store64(svm.SharedHeadChunk, headChunk)
+	start, err := f.seg.chunk(f.load64(svm.SharedStartChunk))
+	if err != nil {
+		return err
+	}
+	if posGeq(head, start.end()) {
+		unlinked, err := f.unlinkChunks(head)
+		if err != nil {
+			return err
+		}
+		if err := f.seg.collectChunks(int(f.shr[svm.SharedSliceIndex]), unlinked); err != nil {
+			return err
+		}
+	}
+	f.store32(svm.SharedHead, head)
+	return nil
+}
+
+// SetEvent flags the fifo as having an io event pending. It returns true
+// when no event was pending, in which case the caller sends one to the peer.
+func (f *Fifo) SetEvent() bool {
+	return atomic.SwapUint32(f.field32(svm.SharedHasEvent), 1) == 0
+}
+
+// UnsetEvent clears the pending io event. The consumer calls it before it
+// last checks the fifo for data, so that the producer's next SetEvent
+// succeeds.
+func (f *Fifo) UnsetEvent() {
+	f.store32(svm.SharedHasEvent, 0)
+}
+
+// HasEvent reports whether an io event is pending
+func (f *Fifo) HasEvent() bool {
+	return f.load32(svm.SharedHasEvent) != 0
+}
+
+// AddWantDeqNtf asks the consumer to notify the producer on dequeue
+func (f *Fifo) AddWantDeqNtf(flags uint32) {
+	for {
+		old := f.load32(svm.SharedWantDeqNtf)
+		if atomic.CompareAndSwapUint32(f.field32(svm.SharedWantDeqNtf), old, old|flags) {
+			return
+		}
+	}
+}
+
+// DelWantDeqNtf withdraws dequeue notification requests
+func (f *Fifo) DelWantDeqNtf(flags uint32) {
+	for {
+		old := f.load32(svm.SharedWantDeqNtf)
+		if atomic.CompareAndSwapUint32(f.field32(svm.SharedWantDeqNtf), old, old&^flags) {
+			return
+		}
+	}
+}
+
+// NeedsDeqNtf reports whether the consumer, having just dequeued n bytes,
+// must notify the producer, as VPP's svm_fifo_needs_deq_ntf
+func (f *Fifo) NeedsDeqNtf(n uint32) bool {
+	want := f.load32(svm.SharedWantDeqNtf)
+	if want == 0 {
+		return false
+	}
+	if want&WantDeqNtf != 0 {
+		return true
+	}
+	hasNtf := f.load32(svm.SharedHasDeqNtf) != 0
+	if want&WantDeqNtfIfFull != 0 {
+		maxDeq := f.MaxDequeue()
+		if !hasNtf && maxDeq < f.Size() && maxDeq+n >= f.Size() {
+			return true
+		}
+	}
+	if want&WantDeqNtfIfEmpty != 0 {
+		if !hasNtf && f.MaxDequeue() == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ClearDeqNtf records that the producer was notified, as VPP's
+// svm_fifo_clear_deq_ntf
+func (f *Fifo) ClearDeqNtf() {
+	var hasNtf uint32
+	if f.load32(svm.SharedWantDeqNtf) == WantDeqNtfIfFull {
+		hasNtf = 1
+	}
+	f.store32(svm.SharedHasDeqNtf, hasNtf)
+	f.DelWantDeqNtf(WantDeqNtf)
+}
+
+// grow links a chunk to the end of the fifo so that n more bytes fit past
+// tail, as VPP's f_try_chunk_alloc
+func (f *Fifo) grow(head, tail, n uint32) error {
+	endOffset := f.load64(svm.SharedEndChunk)
+	end, err := f.seg.chunk(endOffset)
+	if err != nil {
+		return err
+	}
+	freeAllocated := end.end() - tail
+	size := f.Size() - f.cursize(head, tail)
+	if minAlloc := f.load32(svm.SharedMinAlloc); minAlloc < size {
+		size = minAlloc
+	}
+	if n-freeAllocated > size {
+		size = n - freeAllocated
+	}
+	offset, err := f.seg.allocChunk(int(f.shr[svm.SharedSliceIndex]), size)
+	if err != nil {
+		return err
+	}
+	c, err := f.seg.chunk(offset)
+	if err != nil {
+		return err
+	}
+	c.setStartByte(end.end())
+	c.setNext(0)
+	end.setNext(offset)
+	f.store64(svm.SharedEndChunk, offset)
+	if f.load64(svm.SharedTailChunk) == 0 {
+		f.store64(svm.SharedTailChunk, offset)
+	}
+	return nil
+}
+
+// unlinkChunks detaches the chunks preceding the one holding pos from the
+// start of the fifo, keeping at least the last chunk, as VPP's
+// f_unlink_chunks. It returns the offset of the first detached chunk.
+func (f *Fifo) unlinkChunks(pos uint32) (uint64, error) {
+	startOffset := f.load64(svm.SharedStartChunk)
+	offset := startOffset
+	var prev chunk
+	havePrev := false
+	for n := 0; ; n++ {
+		c, err := f.seg.chunk(offset)
+		if err != nil {
+			return 0, err
+		}
+		if n > 0 && c.includes(pos) {
+			break
+		}
+		next := c.next()
+		if next == 0 {
+			break
+		}
+		if n > len(f.seg.fsh)/svm.ChunkHeaderSize {
+			return 0, corrupt("chunk list of fifo at %#x loops", f.offset)
+		}
+		prev, havePrev = c, true
+		offset = next
+	}
+	if !havePrev {
+		return 0, nil
+	}
+	prev.setNext(0)
+	f.store64(svm.SharedStartChunk, offset)
+	return startOffset, nil
+}
+
+// findChunk returns the offset of the chunk holding pos
+func (f *Fifo) findChunk(pos uint32) (uint64, error) {
+	offset := f.load64(svm.SharedStartChunk)
+	for n := 0; offset != 0 && n <= len(f.seg.fsh)/svm.ChunkHeaderSize; n++ {
+		c, err := f.seg.chunk(offset)
+		if err != nil {
+			return 0, err
+		}
+		if c.includes(pos) {
+			return offset, nil
+		}
+		offset = c.next()
+	}
+	return 0, corrupt("no chunk of fifo at %#x holds position %d", f.offset, pos)
+}
+
+// seekChunk returns the offset of the chunk holding pos, looking from the
+// chunk at offset on, or from the start of the fifo when offset is zero. It
+// returns zero when pos is the end of the last chunk.
+func (f *Fifo) seekChunk(offset uint64, pos uint32) (uint64, error) {
+	if offset == 0 {
+		offset = f.load64(svm.SharedStartChunk)
+	}
+	for n := 0; offset != 0; n++ {
+		c, err := f.seg.chunk(offset)
+		if err != nil {
+			return 0, err
+		}
+		if c.includes(pos) {
+			return offset, nil
+		}
+		if n > len(f.seg.fsh)/svm.ChunkHeaderSize {
+			return 0, corrupt("chunk list of fifo at %#x loops", f.offset)
+		}
+		next := c.next()
+		if next == 0 && pos == c.end() {
+			return 0, nil
+		}
+		offset = next
+	}
+	return 0, corrupt("no chunk of fifo at %#x holds position %d", f.offset, pos)
+}
+
+// copyToChunks copies b to the chunks starting at the one at offset, which
+// holds pos. It returns the offset of the chunk the copy ends in, zero when
+// it ends with the last chunk.
+func (f *Fifo) copyToChunks(offset uint64, pos uint32, b []byte) (uint64, error) {
+	return f.walkChunks(offset, pos, len(b), func(data []byte, done int) {
+		copy(data, b[done:])
+	})
+}
+
+// copyFromChunks is the dequeue counterpart of copyToChunks
+func (f *Fifo) copyFromChunks(offset uint64, pos uint32, b []byte) (uint64, error) {
+	return f.walkChunks(offset, pos, len(b), func(data []byte, done int) {
+		copy(b[done:], data)
+	})
+}
+
+func (f *Fifo) walkChunks(offset uint64, pos uint32, n int, fn func(data []byte, done int)) (uint64, error) {
+	for done := 0; done < n; {
+		c, err := f.seg.chunk(offset)
+		if err != nil {
+			return 0, err
+		}
+		if !c.includes(pos) {
+			return 0, corrupt("chunk at %#x does not hold position %d", offset, pos)
+		}
+		data := c.data[pos-c.startByte():]
+		if len(data) > n-done {
+			data = data[:n-done]
+		}
+		fn(data, done)
+		done += len(data)
+		pos += uint32(len(data))
+		if pos == c.end() {
+			offset = c.next()
+		}
+	}
+	return offset, nil
+}
+
+func (f *Fifo) cursize(head, tail uint32) uint32 {
+	return tail - head
+}
+
+func (f *Fifo) field32(offset int) *uint32 {
+	return (*uint32)(unsafe.Pointer(&f.shr[offset]))
+}
+
+func (f *Fifo) load32(offset int) uint32 {
+	return atomic.LoadUint32(f.field32(offset))
+}
+
+func (f *Fifo) store32(offset int, v uint32) {
+	atomic.StoreUint32(f.field32(offset), v)
+}
+
+func (f *Fifo) load64(offset int) uint64 {
+	return atomic.LoadUint64((*uint64)(unsafe.Pointer(&f.shr[offset])))
+}
+
+func (f *Fifo) store64(offset int, v uint64) {
+	atomic.StoreUint64((*uint64)(unsafe.Pointer(&f.shr[offset])), v)
+}
+
+// posGt compares fifo positions, which wrap around
+func posGt(a, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+func posGeq(a, b uint32) bool {
+	return int32(a-b) >= 0
+}
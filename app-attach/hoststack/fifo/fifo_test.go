@@ -0,0 +1,305 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fifo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/godirect/hoststack/app-attach/hoststack/internal/svm"
+)
+
+// testSegment returns a fifo segment of size bytes with a single slice
+func testSegment(t *testing.T, size int) *Segment {
+	fsh := make([]byte, size)
+	fsh[svm.FshNSlices] = 1
+	binary.LittleEndian.PutUint64(fsh[svm.FshByteIndex:], uint64(128+192))
+	binary.LittleEndian.PutUint64(fsh[svm.FshMaxByteIndex:], uint64(size))
+	seg, err := NewSegment(fsh)
+	if err != nil {
+		t.Fatalf("Expected: no error; Current: %v", err)
+	}
+	return seg
+}
+
+func testFifo(t *testing.T, seg *Segment, size uint32) *Fifo {
+	offset, err := seg.AllocFifo(0, size)
+	if err != nil {
+		t.Fatalf("Expected: no error; Current: %v", err)
+	}
+	f, err := seg.Fifo(offset)
+	if err != nil {
+		t.Fatalf("Expected: no error; Current: %v", err)
+	}
+	return f
+}
+
+func TestEnqueueDequeue(t *testing.T) {
+	seg := testSegment(t, 1<<20)
+	f := testFifo(t, seg, 8192)
+	if n, err := f.Dequeue(make([]byte, 1)); !errors.Is(err, ErrEmpty) {
+		t.Errorf("Expected: %v; Current: %d, %v", ErrEmpty, n, err)
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	var in, out bytes.Buffer
+	for i := 0; i < 2000; i++ {
+		b := make([]byte, rnd.Intn(5000))
+		rnd.Read(b)
+		n, err := f.Enqueue(b)
+		if err != nil && !errors.Is(err, ErrFull) {
+			t.Fatalf("Expected: no error; Current: %v", err)
+		}
+		in.Write(b[:n])
+		if got := in.Len() - out.Len(); uint32(got) != f.MaxDequeue() {
+			t.Fatalf("Expected: %d bytes queued; Current: %d", got, f.MaxDequeue())
+		}
+		b = make([]byte, rnd.Intn(5000))
+		n, err = f.Dequeue(b)
+		if err != nil && !errors.Is(err, ErrEmpty) {
+			t.Fatalf("Expected: no error; Current: %v", err)
+		}
+		out.Write(b[:n])
+	}
+	for {
+		b := make([]byte, 4096)
+		n, err := f.Dequeue(b)
+		if errors.Is(err, ErrEmpty) {
+			break
+		}
+		out.Write(b[:n])
+	}
+	if !bytes.Equal(in.Bytes(), out.Bytes()) {
+		t.Errorf("Expected: the %d bytes enqueued; Current: %d different bytes", in.Len(), out.Len())
+	}
+	if byteIndex := binary.LittleEndian.Uint64(seg.fsh[svm.FshByteIndex:]); byteIndex > 64<<10 {
+		t.Errorf("Expected: chunks to be reused; Current: %d bytes allocated", byteIndex)
+	}
+}
+
+func TestPeekDrop(t *testing.T) {
+	f := testFifo(t, testSegment(t, 1<<20), 8192)
+	if n, err := f.Drop(1); !errors.Is(err, ErrEmpty) {
+		t.Errorf("Expected: %v; Current: %d, %v", ErrEmpty, n, err)
+	}
+	rnd := rand.New(rand.NewSource(2))
+	var queued []byte
+	for i := 0; i < 1000; i++ {
+		b := make([]byte, rnd.Intn(3000))
+		rnd.Read(b)
+		n, _ := f.Enqueue(b)
+		queued = append(queued, b[:n]...)
+
+		if len(queued) > 0 {
+			offset := rnd.Intn(len(queued))
+			peeked := make([]byte, rnd.Intn(3000)+1)
+			n, err := f.Peek(uint32(offset), peeked)
+			if err != nil || !bytes.Equal(peeked[:n], queued[offset:offset+n]) {
+				t.Fatalf("Expected: %d bytes peeked at %d; Current: %d, %v", len(queued[offset:]), offset, n, err)
+			}
+		}
+		n, err := f.Drop(uint32(rnd.Intn(3000)))
+		if err != nil && !errors.Is(err, ErrEmpty) {
+			t.Fatalf("Expected: no error; Current: %v", err)
+		}
+		queued = queued[n:]
+		if f.MaxDequeue() != uint32(len(queued)) {
+			t.Fatalf("Expected: %d bytes queued; Current: %d", len(queued), f.MaxDequeue())
+		}
+	}
+	if n, err := f.Peek(f.MaxDequeue(), make([]byte, 1)); !errors.Is(err, ErrEmpty) {
+		t.Errorf("Expected: %v peeking past the tail; Current: %d, %v", ErrEmpty, n, err)
+	}
+	if err := f.DropAll(); err != nil || f.MaxDequeue() != 0 {
+		t.Errorf("Expected: an empty fifo; Current: %d queued, %v", f.MaxDequeue(), err)
+	}
+}
+
+func TestEnqueueWithOffset(t *testing.T) {
+	f := testFifo(t, testSegment(t, 1<<20), 8192)
+	// start close to the end of the first chunk, so that the data spans chunks
+	if _, err := f.Enqueue(make([]byte, 7000)); err != nil {
+		t.Fatalf("Expected: no error; Current: %v", err)
+	}
+	if _, err := f.Drop(7000); err != nil {
+		t.Fatalf("Expected: no error; Current: %v", err)
+	}
+	data := make([]byte, 6000)
+	rand.New(rand.NewSource(3)).Read(data)
+	for _, seg := range [][2]int{{100, 200}, {300, 400}, {150, 350}, {5000, 6000}} {
+		if err := f.EnqueueWithOffset(uint32(seg[0]), data[seg[0]:seg[1]]); err != nil {
+			t.Fatalf("Expected: no error; Current: %v", err)
+		}
+	}
+	want := []OOOSegment{{Offset: 100, Length: 300}, {Offset: 5000, Length: 1000}}
+	if got := f.OOOSegments(); len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("Expected: %v; Current: %v", want, got)
+	}
+	if f.MaxDequeue() != 0 {
+		t.Errorf("Expected: no data before the gap is filled; Current: %d", f.MaxDequeue())
+	}
+	if err := f.EnqueueWithOffset(8000, data[:500]); !errors.Is(err, ErrFull) {
+		t.Errorf("Expected: %v; Current: %v", ErrFull, err)
+	}
+
+	if n, err := f.Enqueue(data[:50]); err != nil || n != 50 || f.MaxDequeue() != 50 {
+		t.Fatalf("Expected: 50 bytes queued; Current: %d, %v, %d", n, err, f.MaxDequeue())
+	}
+	if n, err := f.Enqueue(data[50:120]); err != nil || n != 70 || f.MaxDequeue() != 400 {
+		t.Fatalf("Expected: 400 bytes queued; Current: %d, %v, %d", n, err, f.MaxDequeue())
+	}
+	if n, err := f.Enqueue(data[400:5000]); err != nil || n != 4600 || f.MaxDequeue() != 6000 {
+		t.Fatalf("Expected: 6000 bytes queued; Current: %d, %v, %d", n, err, f.MaxDequeue())
+	}
+	if len(f.OOOSegments()) != 0 {
+		t.Errorf("Expected: no out of order segments; Current: %v", f.OOOSegments())
+	}
+	b := make([]byte, 6000)
+	if n, err := f.Dequeue(b); err != nil || n != 6000 || !bytes.Equal(b, data) {
+		t.Errorf("Expected: the data in order; Current: %d, %v", n, err)
+	}
+}
+
+func TestEnqueueFull(t *testing.T) {
+	f := testFifo(t, testSegment(t, 1<<20), 4096)
+	n, err := f.Enqueue(make([]byte, 5000))
+	if err != nil || n != 4096 {
+		t.Errorf("Expected: 4096 bytes enqueued; Current: %d, %v", n, err)
+	}
+	if n, err := f.Enqueue([]byte{1}); !errors.Is(err, ErrFull) {
+		t.Errorf("Expected: %v; Current: %d, %v", ErrFull, n, err)
+	}
+	if f.MaxEnqueue() != 0 || f.MaxDequeue() != 4096 {
+		t.Errorf("Expected: a full fifo; Current: %d free, %d queued", f.MaxEnqueue(), f.MaxDequeue())
+	}
+}
+
+func TestEnqueueSegments(t *testing.T) {
+	f := testFifo(t, testSegment(t, 1<<20), 4096)
+	hdr, data := []byte("header"), bytes.Repeat([]byte{7}, 4000)
+	if n, err := f.EnqueueSegments(hdr, data); err != nil || n != len(hdr)+len(data) {
+		t.Fatalf("Expected: %d bytes enqueued; Current: %d, %v", len(hdr)+len(data), n, err)
+	}
+	// all or nothing
+	if n, err := f.EnqueueSegments(hdr, data[:100]); !errors.Is(err, ErrFull) || f.MaxDequeue() != 4006 {
+		t.Errorf("Expected: %v and nothing enqueued; Current: %d, %v, %d queued", ErrFull, n, err, f.MaxDequeue())
+	}
+	b := make([]byte, 4006)
+	if n, err := f.Dequeue(b); err != nil || n != len(b) {
+		t.Fatalf("Expected: %d bytes dequeued; Current: %d, %v", len(b), n, err)
+	}
+	if !bytes.Equal(b[:6], hdr) || !bytes.Equal(b[6:], data) {
+		t.Errorf("Expected: the segments in order")
+	}
+	// wraps around the end of the chunk
+	if n, err := f.EnqueueSegments(hdr, data[:100]); err != nil || n != 106 {
+		t.Errorf("Expected: 106 bytes enqueued; Current: %d, %v", n, err)
+	}
+}
+
+func TestEnqueueNoSpace(t *testing.T) {
+	seg := testSegment(t, 128+192+192+24+4096)
+	f := testFifo(t, seg, 4096)
+	if n, err := f.Enqueue(make([]byte, 4000)); err != nil || n != 4000 {
+		t.Fatalf("Expected: 4000 bytes enqueued; Current: %d, %v", n, err)
+	}
+	if n, err := f.Dequeue(make([]byte, 4000)); err != nil || n != 4000 {
+		t.Fatalf("Expected: 4000 bytes dequeued; Current: %d, %v", n, err)
+	}
+	// the fifo can not grow past its only chunk
+	if n, err := f.Enqueue(make([]byte, 1000)); err != nil || n != 96 {
+		t.Errorf("Expected: 96 bytes enqueued; Current: %d, %v", n, err)
+	}
+	if n, err := f.Enqueue(make([]byte, 1000)); !errors.Is(err, ErrFull) {
+		t.Errorf("Expected: %v; Current: %d, %v", ErrFull, n, err)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	f := testFifo(t, testSegment(t, 1<<20), 4096)
+	if !f.SetEvent() || f.SetEvent() || !f.HasEvent() {
+		t.Errorf("Expected: only the first SetEvent to succeed")
+	}
+	f.UnsetEvent()
+	if !f.SetEvent() {
+		t.Errorf("Expected: SetEvent to succeed after UnsetEvent")
+	}
+
+	if f.NeedsDeqNtf(10) {
+		t.Errorf("Expected: no dequeue notification when none is wanted")
+	}
+	f.AddWantDeqNtf(WantDeqNtf)
+	if !f.NeedsDeqNtf(10) {
+		t.Errorf("Expected: a dequeue notification when one is wanted")
+	}
+	f.ClearDeqNtf()
+	if f.NeedsDeqNtf(10) {
+		t.Errorf("Expected: no dequeue notification once cleared")
+	}
+
+	f.AddWantDeqNtf(WantDeqNtfIfFull)
+	if _, err := f.Enqueue(make([]byte, 4096)); err != nil {
+		t.Fatalf("Expected: no error; Current: %v", err)
+	}
+	n, _ := f.Dequeue(make([]byte, 100))
+	if !f.NeedsDeqNtf(uint32(n)) {
+		t.Errorf("Expected: a dequeue notification once a full fifo has room")
+	}
+	f.ClearDeqNtf()
+	if f.NeedsDeqNtf(uint32(n)) {
+		t.Errorf("Expected: a single notification per full fifo")
+	}
+}
+
+func TestCorruptFifo(t *testing.T) {
+	seg := testSegment(t, 1<<20)
+	if _, err := seg.Fifo(1 << 20); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Expected: %v; Current: %v", ErrCorrupt, err)
+	}
+	f := testFifo(t, seg, 4096)
+	binary.LittleEndian.PutUint64(f.shr[svm.SharedEndChunk:], 1<<30)
+	if _, err := f.Enqueue([]byte{1}); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Expected: %v; Current: %v", ErrCorrupt, err)
+	}
+}
+
+func TestAllocChunk(t *testing.T) {
+	seg := testSegment(t, 128+192+2*(24+4096))
+	offset, data, err := seg.AllocChunk(0, 268)
+	if err != nil || len(data) != 268 {
+		t.Fatalf("Expected: a chunk of 268 bytes; Current: %d bytes, %v", len(data), err)
+	}
+	copy(data, "ext config")
+	read, err := seg.ChunkData(offset)
+	if err != nil || !bytes.HasPrefix(read, []byte("ext config")) {
+		t.Errorf("Expected: the data written to the chunk; Current: %q, %v", read[:10], err)
+	}
+	if err := seg.FreeChunk(0, offset); err != nil {
+		t.Fatalf("Expected: no error; Current: %v", err)
+	}
+	// the freed chunk is reused before carving a new one
+	if again, _, err := seg.AllocChunk(0, 100); err != nil || again != offset {
+		t.Errorf("Expected: chunk at %#x; Current: %#x, %v", offset, again, err)
+	}
+	if _, _, err := seg.AllocChunk(1, 100); err == nil {
+		t.Errorf("Expected: an error for a slice out of range; Current: nil")
+	}
+}
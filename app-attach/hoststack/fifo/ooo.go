@@ -0,0 +1,131 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fifo
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/godirect/hoststack/app-attach/hoststack/internal/svm"
+)
+
+// oooSegment is data the producer enqueued past the tail, as VPP's
+// ooo_segment_t. Start is a fifo position.
+type oooSegment struct {
+	start  uint32
+	length uint32
+}
+
+func (s oooSegment) end() uint32 {
+	return s.start + s.length
+}
+
+// OOOSegment is data enqueued out of order, Offset bytes past the tail
+type OOOSegment struct {
+	Offset uint32
+	Length uint32
+}
+
+// EnqueueWithOffset writes b offset bytes past the tail of the fifo without
+// moving the tail, as VPP's svm_fifo_enqueue_with_offset. The data becomes
+// readable once Enqueue fills the gap to it. It returns ErrFull when b does
+// not fit.
+func (f *Fifo) EnqueueWithOffset(offset uint32, b []byte) error {
+	head := f.load32(svm.SharedHead)
+	tail := f.load32(svm.SharedTail)
+	if len(b) == 0 {
+		return nil
+	}
+	if uint64(offset)+uint64(len(b)) > uint64(f.Size()-f.cursize(head, tail)) {
+		return ErrFull
+	}
+	n := offset + uint32(len(b))
+	end, err := f.seg.chunk(f.load64(svm.SharedEndChunk))
+	if err != nil {
+		return err
+	}
+	if posGt(tail+n, end.end()) {
+		if err := f.grow(head, tail, n); err != nil {
+			return errors.WithMessage(ErrFull, err.Error())
+		}
+	}
+	c, err := f.seekChunk(f.load64(svm.SharedTailChunk), tail+offset)
+	if err != nil {
+		return err
+	}
+	if _, err := f.copyToChunks(c, tail+offset, b); err != nil {
+		return err
+	}
+	f.addOOO(oooSegment{start: tail + offset, length: uint32(len(b))})
+	return nil
+}
+
+// OOOSegments returns the data enqueued out of order, in fifo order
+func (f *Fifo) OOOSegments() []OOOSegment {
+	tail := f.load32(svm.SharedTail)
+	segs := make([]OOOSegment, 0, len(f.ooo))
+	for _, s := range f.ooo {
+		segs = append(segs, OOOSegment{Offset: s.start - tail, Length: s.length})
+	}
+	return segs
+}
+
+// addOOO records an out of order segment, merging it with the segments it
+// overlaps or touches, as VPP's ooo_segment_add
+func (f *Fifo) addOOO(seg oooSegment) {
+	merged := make([]oooSegment, 0, len(f.ooo)+1)
+	inserted := false
+	for _, s := range f.ooo {
+		switch {
+		case posGt(seg.start, s.end()):
+			merged = append(merged, s)
+		case posGt(s.start, seg.end()):
+			if !inserted {
+				merged = append(merged, seg)
+				inserted = true
+			}
+			merged = append(merged, s)
+		default:
+			start, end := seg.start, seg.end()
+			if posGt(start, s.start) {
+				start = s.start
+			}
+			if posGt(s.end(), end) {
+				end = s.end()
+			}
+			seg = oooSegment{start: start, length: end - start}
+		}
+	}
+	if !inserted {
+		merged = append(merged, seg)
+	}
+	f.ooo = merged
+}
+
+// collectOOO returns the new tail once the tail moved to tail, past the out
+// of order segments it reaches, as VPP's ooo_segment_try_collect
+func (f *Fifo) collectOOO(tail uint32) uint32 {
+	for len(f.ooo) > 0 && posGeq(tail, f.ooo[0].start) {
+		if end := f.ooo[0].end(); posGt(end, tail) {
+			tail = end
+		}
+		f.ooo = f.ooo[1:]
+	}
+	if len(f.ooo) == 0 {
+		f.ooo = nil
+	}
+	return tail
+}
@@ -0,0 +1,356 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fifo implements VPP's svm_fifo, the shared memory byte stream a
+// session exchanges data over. Fifos are made of chunks carved out of their
+// fifo segment. The producer links new chunks to the end of a fifo as its
+// tail moves past them, the consumer gives consumed chunks back to the free
+// lists of the segment slice the fifo belongs to. Offsets of fifos and chunks
+// are relative to the fifo segment header, as in VPP's fs_sptr_t.
+//
+// As VPP does with its acquire and release accesses, each end publishes its
+// position with an atomic store once the data it covers is copied, and
+// loads the position of the other end atomically before touching the data.
+package fifo
+
+import (
+	"encoding/binary"
+	"runtime"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/pkg/errors"
+
+	"github.com/godirect/hoststack/app-attach/hoststack/internal/svm"
+	"github.com/godirect/hoststack/app-attach/hoststack/memseg"
+)
+
+var (
+	// ErrCorrupt is returned when a fifo or chunk points outside of its
+	// segment or its positions are inconsistent
+	ErrCorrupt = errors.New("corrupt fifo")
+	// ErrNoSpace is returned when the segment has no memory left for a chunk
+	ErrNoSpace = errors.New("no space left in fifo segment")
+)
+
+// cacheLineSize is VPP's CACHE_LINE_BYTES, the alignment of fifo headers
+const cacheLineSize = 64
+
+// Segment is the fifo segment fifos and chunks are allocated from
+type Segment struct {
+	fsh     []byte
+	nSlices int
+}
+
+// NewSegment wraps fsh, the bytes of a segment from its fifo segment header
+// on, see memseg.SegmentInfo.HeaderOffset
+func NewSegment(fsh []byte) (*Segment, error) {
+	if len(fsh) < memseg.FifoSegmentHeaderSize {
+		return nil, corrupt("fifo segment header does not fit in %d bytes", len(fsh))
+	}
+	nSlices := int(fsh[svm.FshNSlices])
+	if nSlices == 0 || memseg.FifoSegmentHeaderSize+nSlices*memseg.SliceSize > len(fsh) {
+		return nil, corrupt("%d slices do not fit in %d bytes", nSlices, len(fsh))
+	}
+	return &Segment{fsh: fsh, nSlices: nSlices}, nil
+}
+
+// Fifo returns the fifo at offset
+func (s *Segment) Fifo(offset uint64) (*Fifo, error) {
+	if offset < s.dataStart() || offset > uint64(len(s.fsh))-svm.FifoSharedSize {
+		return nil, corrupt("fifo at %#x is outside of the segment", offset)
+	}
+	f := &Fifo{seg: s, offset: offset, shr: s.fsh[offset : offset+svm.FifoSharedSize]}
+	if slice := int(f.shr[svm.SharedSliceIndex]); slice >= s.nSlices {
+		return nil, corrupt("fifo at %#x in slice %d of %d", offset, slice, s.nSlices)
+	}
+	return f, nil
+}
+
+// AllocFifo allocates a fifo of size bytes in slice, as VPP does for the
+// sessions of an application. It returns the offset of the fifo.
+func (s *Segment) AllocFifo(slice int, size uint32) (uint64, error) {
+	if slice < 0 || slice >= s.nSlices || size == 0 {
+		return 0, errors.Errorf("invalid fifo of %d bytes in slice %d", size, slice)
+	}
+	s.lockSlice(slice)
+	offset, err := s.popFreeFifo(slice)
+	s.unlockSlice(slice)
+	if err != nil {
+		return 0, err
+	}
+	if offset == 0 {
+		if offset, err = s.alloc(svm.FifoSharedSize, cacheLineSize); err != nil {
+			return 0, err
+		}
+	}
+	chunk, err := s.allocChunk(slice, size)
+	if err != nil {
+		return 0, err
+	}
+	shr := s.fsh[offset : offset+svm.FifoSharedSize]
+	for i := range shr {
+		shr[i] = 0
+	}
+	le := binary.LittleEndian
+	minAlloc := uint32(4096)
+	if size > 32<<10 {
+		minAlloc = size >> 3
+	}
+	if minAlloc > 64<<10 {
+		minAlloc = 64 << 10
+	}
+	le.PutUint64(shr[svm.SharedStartChunk:], chunk)
+	le.PutUint64(shr[svm.SharedEndChunk:], chunk)
+	le.PutUint64(shr[svm.SharedHeadChunk:], chunk)
+	le.PutUint64(shr[svm.SharedTailChunk:], chunk)
+	le.PutUint32(shr[svm.SharedMinAlloc:], minAlloc)
+	le.PutUint32(shr[svm.SharedFifoSize:], size)
+	shr[svm.SharedSliceIndex] = uint8(slice)
+	atomic.AddUint32(s.field32(svm.FshActiveFifos), 1)
+	return offset, nil
+}
+
+// AllocChunk allocates a chunk of at least size bytes in slice for data
+// other than fifo bytes, like the extended config of a connect or listen
+// message. It returns the offset of the chunk and its data.
+func (s *Segment) AllocChunk(slice int, size uint32) (uint64, []byte, error) {
+	if slice < 0 || slice >= s.nSlices || size == 0 {
+		return 0, nil, errors.Errorf("invalid chunk of %d bytes in slice %d", size, slice)
+	}
+	offset, err := s.allocChunk(slice, size)
+	if err != nil {
+		return 0, nil, err
+	}
+	c, err := s.chunk(offset)
+	if err != nil {
+		return 0, nil, err
+	}
+	return offset, c.data[:size], nil
+}
+
+// ChunkData returns the data of the chunk at offset
+func (s *Segment) ChunkData(offset uint64) ([]byte, error) {
+	c, err := s.chunk(offset)
+	if err != nil {
+		return nil, err
+	}
+	return c.data, nil
+}
+
+// FreeChunk gives the chunk at offset back to the free lists of slice, as
+// VPP's fifo_segment_collect_chunk
+func (s *Segment) FreeChunk(slice int, offset uint64) error {
+	if slice < 0 || slice >= s.nSlices {
+		return errors.Errorf("invalid slice %d", slice)
+	}
+	c, err := s.chunk(offset)
+	if err != nil {
+		return err
+	}
+	c.setNext(0)
+	return s.collectChunks(slice, offset)
+}
+
+// popFreeFifo takes a fifo header off the free list of slice, the slice lock
+// must be held
+func (s *Segment) popFreeFifo(slice int) (uint64, error) {
+	head := s.field64(s.sliceOffset(slice) + svm.SliceFreeFifos)
+	offset := atomic.LoadUint64(head)
+	if offset == 0 {
+		return 0, nil
+	}
+	if offset < s.dataStart() || offset > uint64(len(s.fsh))-svm.FifoSharedSize {
+		return 0, corrupt("free fifo at %#x is outside of the segment", offset)
+	}
+	atomic.StoreUint64(head, binary.LittleEndian.Uint64(s.fsh[offset+svm.SharedNext:]))
+	return offset, nil
+}
+
+// chunkSizeClass returns the free list holding chunks of at least size
+// bytes, as VPP's fs_freelist_for_size
+func chunkSizeClass(size uint32) int {
+	class := 0
+	for class < memseg.NumChunkSizes-1 && memseg.ChunkSize(class) < size {
+		class++
+	}
+	return class
+}
+
+// allocChunk allocates a chunk of at least size bytes from the free lists of
+// slice or from the segment, as VPP's fsh_alloc_chunk
+func (s *Segment) allocChunk(slice int, size uint32) (uint64, error) {
+	class := chunkSizeClass(size)
+	chunkSize := memseg.ChunkSize(class)
+	sliceOffset := s.sliceOffset(slice)
+	s.lockSlice(slice)
+	defer s.unlockSlice(slice)
+
+	head := s.field64(sliceOffset + svm.SliceFreeChunks + 8*class)
+	if offset := atomic.LoadUint64(head); offset != 0 {
+		c, err := s.chunk(offset)
+		if err != nil {
+			return 0, err
+		}
+		atomic.StoreUint64(head, c.next())
+		c.setNext(0)
+		atomic.AddUint64(s.field64(sliceOffset+svm.SliceFlChunkBytes), ^uint64(chunkSize-1))
+		atomic.AddUint64(s.field64(svm.FshCachedBytes), ^uint64(chunkSize-1))
+		return offset, nil
+	}
+
+	offset, err := s.alloc(svm.ChunkHeaderSize+uint64(chunkSize), 8)
+	if err != nil {
+		return 0, err
+	}
+	le := binary.LittleEndian
+	hdr := s.fsh[offset : offset+svm.ChunkHeaderSize]
+	for i := range hdr {
+		hdr[i] = 0
+	}
+	le.PutUint32(hdr[svm.ChunkLength:], chunkSize)
+	atomic.AddUint32(s.field32(sliceOffset+svm.SliceNumChunks+4*class), 1)
+	return offset, nil
+}
+
+// collectChunks gives the list of chunks starting at offset back to the free
+// lists of slice, as VPP's fsh_collect_chunks
+func (s *Segment) collectChunks(slice int, offset uint64) error {
+	sliceOffset := s.sliceOffset(slice)
+	s.lockSlice(slice)
+	var collected uint64
+	var err error
+	for offset != 0 {
+		var c chunk
+		if c, err = s.chunk(offset); err != nil {
+			break
+		}
+		next := c.next()
+		class := chunkSizeClass(c.length())
+		head := s.field64(sliceOffset + svm.SliceFreeChunks + 8*class)
+		c.setNext(atomic.LoadUint64(head))
+		atomic.StoreUint64(head, offset)
+		collected += uint64(memseg.ChunkSize(class))
+		offset = next
+	}
+	s.unlockSlice(slice)
+	atomic.AddUint64(s.field64(sliceOffset+svm.SliceFlChunkBytes), collected)
+	atomic.AddUint64(s.field64(svm.FshCachedBytes), collected)
+	return err
+}
+
+// alloc carves size bytes aligned to align out of the segment, as VPP's
+// fsh_alloc_aligned
+func (s *Segment) alloc(size, align uint64) (uint64, error) {
+	byteIndex := s.field64(svm.FshByteIndex)
+	maxByteIndex := atomic.LoadUint64(s.field64(svm.FshMaxByteIndex))
+	if maxByteIndex > uint64(len(s.fsh)) {
+		maxByteIndex = uint64(len(s.fsh))
+	}
+	for {
+		cur := atomic.LoadUint64(byteIndex)
+		start := (cur + align - 1) &^ (align - 1)
+		if start+size > maxByteIndex {
+			return 0, errors.Wrapf(ErrNoSpace, "%d bytes", size)
+		}
+		if atomic.CompareAndSwapUint64(byteIndex, cur, start+size) {
+			return start, nil
+		}
+	}
+}
+
+// chunk returns the chunk at offset, checking that it fits in the segment
+func (s *Segment) chunk(offset uint64) (chunk, error) {
+	if offset < s.dataStart() || offset > uint64(len(s.fsh))-svm.ChunkHeaderSize {
+		return chunk{}, corrupt("chunk at %#x is outside of the segment", offset)
+	}
+	c := chunk{hdr: s.fsh[offset : offset+svm.ChunkHeaderSize]}
+	end := offset + svm.ChunkHeaderSize + uint64(c.length())
+	if c.length() == 0 || end > uint64(len(s.fsh)) {
+		return chunk{}, corrupt("chunk at %#x of %d bytes does not fit in the segment", offset, c.length())
+	}
+	c.data = s.fsh[offset+svm.ChunkHeaderSize : end]
+	return c, nil
+}
+
+// lockSlice takes the chunk_lock spinlock of slice
+func (s *Segment) lockSlice(slice int) {
+	lock := s.field32(s.sliceOffset(slice) + svm.SliceChunkLock)
+	for !atomic.CompareAndSwapUint32(lock, 0, 1) {
+		runtime.Gosched()
+	}
+}
+
+func (s *Segment) unlockSlice(slice int) {
+	atomic.StoreUint32(s.field32(s.sliceOffset(slice)+svm.SliceChunkLock), 0)
+}
+
+func (s *Segment) sliceOffset(slice int) int {
+	return memseg.FifoSegmentHeaderSize + slice*memseg.SliceSize
+}
+
+// dataStart is the offset of the first byte past the slices
+func (s *Segment) dataStart() uint64 {
+	return uint64(memseg.FifoSegmentHeaderSize + s.nSlices*memseg.SliceSize)
+}
+
+func (s *Segment) field32(offset int) *uint32 {
+	return (*uint32)(unsafe.Pointer(&s.fsh[offset]))
+}
+
+func (s *Segment) field64(offset int) *uint64 {
+	return (*uint64)(unsafe.Pointer(&s.fsh[offset]))
+}
+
+// chunk is a svm_fifo_chunk_t
+type chunk struct {
+	hdr  []byte
+	data []byte
+}
+
+func (c chunk) startByte() uint32 {
+	return atomic.LoadUint32((*uint32)(unsafe.Pointer(&c.hdr[svm.ChunkStartByte])))
+}
+
+func (c chunk) setStartByte(pos uint32) {
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&c.hdr[svm.ChunkStartByte])), pos)
+}
+
+func (c chunk) length() uint32 {
+	return atomic.LoadUint32((*uint32)(unsafe.Pointer(&c.hdr[svm.ChunkLength])))
+}
+
+func (c chunk) next() uint64 {
+	return atomic.LoadUint64((*uint64)(unsafe.Pointer(&c.hdr[svm.ChunkNext])))
+}
+
+func (c chunk) setNext(offset uint64) {
+	atomic.StoreUint64((*uint64)(unsafe.Pointer(&c.hdr[svm.ChunkNext])), offset)
+}
+
+// end returns the position following the last byte of the chunk
+func (c chunk) end() uint32 {
+	return c.startByte() + c.length()
+}
+
+// includes reports whether the chunk holds the byte at pos
+func (c chunk) includes(pos uint32) bool {
+	return pos-c.startByte() < c.length()
+}
+
+func corrupt(format string, args ...interface{}) error {
+	return errors.Wrapf(ErrCorrupt, format, args...)
+}
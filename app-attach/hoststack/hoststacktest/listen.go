@@ -0,0 +1,267 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hoststacktest
+
+import (
+	"context"
+	"net"
+	"strconv"
+
+	"github.com/pkg/errors"
+
+	"github.com/godirect/hoststack/app-attach/hoststack/fifo"
+	"github.com/godirect/hoststack/app-attach/hoststack/session"
+)
+
+// vppListener is a listener an application worker bound
+type vppListener struct {
+	worker  *worker
+	handle  uint64
+	context uint32
+	proto   uint8
+	ip      net.IP
+	port    uint16
+	rxSize  uint32
+	txSize  uint32
+	shared  *Session   // the fifos of a UDP listener not accepting sessions
+	tls     *TLSParams // the crypto config of a tls listener
+	local   bool       // in the local table, applications of the namespace connect to it through
+}
+
+// listen binds a listener for the worker asking for it and answers with a
+// bound event, a port taken by another listener is rejected. UDP listeners
+// not asking for connected sessions get fifos of their own.
+func (s *Server) listen(data []byte) {
+	var msg session.ListenMsg
+	if err := session.Unmarshal(data, &msg); err != nil {
+		s.tb.Errorf("Listen Error %v", err)
+		return
+	}
+	s.mu.Lock()
+	var l *vppListener
+	if a, ok := s.apps[msg.ClientIndex]; ok && a.workers[msg.WrkIndex] != nil {
+		l = &vppListener{
+			worker:  a.workers[msg.WrkIndex],
+			context: msg.Context,
+			proto:   msg.Proto,
+			ip:      msg.IP.IP(msg.IsIP4 != 0),
+			port:    session.Ntohs(msg.Port),
+			rxSize:  a.rxFifoSize,
+			txSize:  a.txFifoSize,
+			local:   a.localScope,
+		}
+	}
+	s.mu.Unlock()
+	tls, retval := s.tlsParams(msg.Proto, msg.ExtConfig)
+	if l == nil {
+		s.tb.Errorf("Listen Error no worker %d for client %d", msg.WrkIndex, msg.ClientIndex)
+		return
+	}
+	reply := session.BoundMsg{Context: msg.Context, Retval: retval, LclIsIP4: msg.IsIP4, LclIP: msg.IP}
+	if retval != 0 {
+		s.sendCtrl(l.worker.appMq, evtBound, &reply)
+		return
+	}
+	l.tls = tls
+	if l.proto == session.TransportProtoUDP && msg.Flags&session.TransportCfgFlagConnected == 0 {
+		shared, err := s.newSession(l.worker, nil, l.rxSize, l.txSize, true)
+		if err != nil {
+			s.tb.Errorf("Listen Error %v", err)
+			return
+		}
+		shared.shared = true
+		for _, f := range []*fifo.Fifo{shared.rx, shared.tx} {
+			f.SetClientSessionIndex(msg.Context)
+		}
+		l.shared = shared
+		reply.RxFifo = shared.rx.Offset()
+		reply.TxFifo = shared.tx.Offset()
+	}
+
+	s.mu.Lock()
+	if l.port == 0 {
+		l.port = uint16(ephemeralPort + s.nextSessionIndex%16384)
+	}
+	if s.listenerOn(l.proto, l.port) != nil {
+		reply.Retval = sessionErrPortInUse
+	} else {
+		if l.shared != nil {
+			l.handle = l.shared.handle
+		} else {
+			l.handle = uint64(s.nextSessionIndex)
+			s.nextSessionIndex++
+		}
+		s.listeners[l.handle] = l
+		reply.Handle = l.handle
+		reply.LclPort = session.Htons(l.port)
+		reply.VppEvtQ = s.ctrlMqOffset
+		reply.SegmentHandle = l.worker.segmentHandle
+		if l.shared != nil {
+			reply.SegmentHandle = l.shared.segmentHandle
+		}
+	}
+	if reply.Retval != 0 && l.shared != nil {
+		delete(s.sessions, l.shared.index)
+	}
+	s.mu.Unlock()
+	s.sendCtrl(l.worker.appMq, evtBound, &reply)
+}
+
+// unlisten removes a listener and answers with an unlisten reply
+func (s *Server) unlisten(data []byte) {
+	var msg session.UnlistenMsg
+	if err := session.Unmarshal(data, &msg); err != nil {
+		s.tb.Errorf("Unlisten Error %v", err)
+		return
+	}
+	s.mu.Lock()
+	var w *worker
+	if a, ok := s.apps[msg.ClientIndex]; ok {
+		w = a.workers[msg.WrkIndex]
+	}
+	reply := session.UnlistenReplyMsg{Context: msg.Context, Handle: msg.Handle}
+	l, ok := s.listeners[msg.Handle]
+	if ok {
+		delete(s.listeners, msg.Handle)
+		if l.shared != nil {
+			delete(s.sessions, l.shared.index)
+		}
+	} else {
+		reply.Retval = sessionErrNoSession
+	}
+	s.mu.Unlock()
+	if ok && l.shared != nil {
+		l.shared.closeApp()
+	}
+	if w == nil {
+		s.tb.Errorf("Unlisten Error no worker %d for client %d", msg.WrkIndex, msg.ClientIndex)
+		return
+	}
+	s.sendCtrl(w.appMq, evtUnlistenReply, &reply)
+}
+
+// listenerOn returns the listener bound to port, s.mu must be held
+func (s *Server) listenerOn(proto uint8, port uint16) *vppListener {
+	for _, l := range s.listeners {
+		if l.proto == proto && l.port == port {
+			return l
+		}
+	}
+	return nil
+}
+
+// Connect plays a peer connecting to the application listening on the port
+// of addr, over network "tcp", "udp", "tls" or "quic". It returns the VPP
+// side of the session once the application accepted it, the session is
+// cleaned up when the application closes it. The session of a quic
+// connection carries no data, see OpenStream. A UDP listener not accepting sessions shares
+// its fifos among all peers: writes to the returned session reach the
+// application from the address of the peer, reads return any datagram the
+// application sent.
+func (s *Server) Connect(ctx context.Context, network, addr string) (*Session, error) {
+	proto := session.TransportProtoTCP
+	switch network {
+	case "udp":
+		proto = session.TransportProtoUDP
+	case "tls":
+		proto = session.TransportProtoTLS
+	case "quic":
+		proto = session.TransportProtoQUIC
+	}
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	l := s.listenerOn(proto, uint16(port))
+	index := s.nextSessionIndex
+	s.mu.Unlock()
+	if l == nil {
+		return nil, errors.Errorf("no %s listener on port %d", network, port)
+	}
+	isIP4 := l.ip.To4() != nil
+	isUDP := proto == session.TransportProtoUDP
+	isQUIC := proto == session.TransportProtoQUIC
+	peer := loopbackEndpoint(isIP4, uint16(ephemeralPort+index%16384))
+	peerAddr := sockAddr(isUDP || isQUIC, peer.IP.IP(isIP4), session.Ntohs(peer.Port))
+	if l.shared != nil {
+		return &Session{
+			server:      s,
+			index:       l.shared.index,
+			handle:      l.shared.handle,
+			appMq:       l.shared.appMq,
+			rx:          l.shared.rx,
+			tx:          l.shared.tx,
+			addr:        peerAddr,
+			rxEvent:     l.shared.rxEvent,
+			txEvent:     l.shared.txEvent,
+			appClosed:   l.shared.appClosed,
+			appShutdown: l.shared.appShutdown,
+			dgram:       true,
+			shared:      true,
+		}, nil
+	}
+
+	sess, err := s.newSession(l.worker, peerAddr, l.rxSize, l.txSize, isUDP)
+	if err != nil {
+		return nil, err
+	}
+	sess.tls = l.tls
+	sess.quic = isQUIC
+	lcl := loopbackEndpoint(isIP4, l.port)
+	if !l.ip.IsUnspecified() {
+		lcl.IP, _ = session.NewIP46Address(l.ip)
+	}
+	err = s.acceptSession(ctx, sess, &session.AcceptedMsg{
+		Context:        l.context,
+		ListenerHandle: l.handle,
+		Lcl:            lcl,
+		Rmt:            peer,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sess, nil
+}
+
+// acceptSession reports sess to the application as accepted on the listener or
+// quic connection of msg, and starts it once the application accepted it
+func (s *Server) acceptSession(ctx context.Context, sess *Session, msg *session.AcceptedMsg) error {
+	msg.Handle = sess.handle
+	msg.ServerRxFifo = sess.rx.Offset()
+	msg.ServerTxFifo = sess.tx.Offset()
+	msg.SegmentHandle = sess.segmentHandle
+	msg.VppEventQueueAddress = s.ctrlMqOffset
+	s.sendCtrl(sess.appMq, evtAccepted, msg)
+	select {
+	case retval := <-sess.accepted:
+		if retval != 0 {
+			s.mu.Lock()
+			delete(s.sessions, sess.index)
+			s.mu.Unlock()
+			return errors.Errorf("session rejected by the application: %d", retval)
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	s.startSession(sess, nil)
+	return nil
+}
@@ -0,0 +1,163 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hoststacktest
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/godirect/hoststack/app-attach/hoststack/fifo"
+	"github.com/godirect/hoststack/app-attach/hoststack/session"
+)
+
+// localListener returns the listener in the local table of the namespace a
+// connect is cut through to, if any, s.mu must be held. As VPP's cut-through
+// transport, only tcp sessions and connected udp sessions are cut through.
+func (s *Server) localListener(msg *session.ConnectMsg) *vppListener {
+	if msg.Proto != session.TransportProtoTCP && msg.Proto != session.TransportProtoUDP {
+		return nil
+	}
+	l := s.listenerOn(msg.Proto, session.Ntohs(msg.Port))
+	if l == nil || !l.local || l.shared != nil {
+		return nil
+	}
+	if ip := msg.IP.IP(msg.IsIP4 != 0); !l.ip.IsUnspecified() && !l.ip.Equal(ip) {
+		return nil
+	}
+	return l
+}
+
+// connectLocal cuts a session of worker w through to the local listener l,
+// as VPP's cut-through transport does. The session of the listener gets its
+// fifos in a segment added to both workers and is accepted first, then the
+// connecting application gets the same fifos the other way around. The
+// fifos of the connecting session in its own segment only carry io events,
+// the server forwards the io events of each application to the other. The
+// segment is deleted once both applications closed their session.
+func (s *Server) connectLocal(w *worker, l *vppListener, msg *session.ConnectMsg, reply *session.ConnectedMsg, rxFifoSize, txFifoSize uint32) {
+	defer s.wg.Done()
+	refuse := func(err error) {
+		s.tb.Logf("Connect Error %v", err)
+		reply.Retval = sessionErrRefused
+		s.sendCtrl(w.appMq, evtConnected, reply)
+	}
+	workers := []*worker{l.worker}
+	if w != l.worker {
+		workers = append(workers, w)
+	}
+	size := int64(DefaultSegmentSize) + int64(l.rxSize) + int64(l.txSize)
+	seg, err := newSegment(size)
+	if err != nil {
+		refuse(err)
+		return
+	}
+	defer seg.close()
+	fifos, err := fifo.NewSegment(seg.fsh)
+	if err != nil {
+		refuse(err)
+		return
+	}
+	s.mu.Lock()
+	handle := s.nextSegmentHandle
+	s.nextSegmentHandle++
+	s.mu.Unlock()
+	for _, wrk := range workers {
+		if err := s.announceSegment(wrk, seg, handle, size); err != nil {
+			refuse(err)
+			return
+		}
+	}
+	defer func() {
+		if s.ctx.Err() != nil {
+			return
+		}
+		for _, wrk := range workers {
+			s.sendCtrl(wrk.appMq, evtAppDelSegment, &session.AppDelSegmentMsg{SegmentHandle: handle})
+		}
+	}()
+
+	isIP4 := msg.IsIP4 != 0
+	isUDP := msg.Proto == session.TransportProtoUDP
+	cs, err := s.newSession(w, sockAddr(isUDP, msg.IP.IP(isIP4), session.Ntohs(msg.Port)), rxFifoSize, txFifoSize, isUDP)
+	if err != nil {
+		refuse(err)
+		return
+	}
+	rmt := loopbackEndpoint(isIP4, uint16(ephemeralPort+cs.index%16384))
+	ss, err := s.newSessionIn(l.worker, fifos, handle, sockAddr(isUDP, rmt.IP.IP(isIP4), session.Ntohs(rmt.Port)), l.rxSize, l.txSize, isUDP)
+	if err != nil {
+		s.dropSession(cs)
+		refuse(err)
+		return
+	}
+	s.mu.Lock()
+	cs.peer, ss.peer = ss, cs
+	s.mu.Unlock()
+	lcl := loopbackEndpoint(isIP4, l.port)
+	if !l.ip.IsUnspecified() {
+		lcl.IP, _ = session.NewIP46Address(l.ip)
+	}
+	err = s.acceptSession(s.ctx, ss, &session.AcceptedMsg{Context: l.context, ListenerHandle: l.handle, Lcl: lcl, Rmt: rmt})
+	if err != nil {
+		s.dropSession(cs)
+		s.dropSession(ss)
+		refuse(errors.WithMessage(err, "cut-through session"))
+		return
+	}
+
+	reply.Handle = cs.handle
+	reply.ServerRxFifo = cs.rx.Offset()
+	reply.ServerTxFifo = cs.tx.Offset()
+	reply.SegmentHandle = cs.segmentHandle
+	reply.CtRxFifo = ss.tx.Offset()
+	reply.CtTxFifo = ss.rx.Offset()
+	reply.CtSegmentHandle = handle
+	reply.VppEventQueueAddress = s.ctrlMqOffset
+	reply.Lcl = rmt
+	for _, f := range []*fifo.Fifo{cs.rx, cs.tx} {
+		f.SetClientSessionIndex(msg.Context)
+	}
+	s.sendCtrl(w.appMq, evtConnected, reply)
+	s.startSession(cs, nil)
+	for _, sess := range []*Session{cs, ss} {
+		select {
+		case <-sess.appClosed:
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// dropSession forgets a session the application never learnt of
+func (s *Server) dropSession(sess *Session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, sess.index)
+}
+
+// forwardIO hands an io event the application sent for a cut-through
+// session to the application of the peer: the data it wrote is signalled to
+// the reader, the room it made by reading to the writer
+func (s *Session) forwardIO(eventType uint8) {
+	if eventType == evtIOTx {
+		s.tx.UnsetEvent()
+		if s.peer.rx.SetEvent() {
+			s.peer.sendIO(evtIORx, s.peer.rx)
+		}
+		return
+	}
+	s.peer.sendIO(evtIOTx, s.peer.tx)
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hoststacktest
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+
+	"github.com/godirect/hoststack/app-attach/hoststack/session"
+)
+
+// OpenStream plays the peer of a quic connection opening a stream on it. It
+// returns the VPP side of the stream once the application accepted it.
+func (s *Session) OpenStream(ctx context.Context) (*Session, error) {
+	if !s.quic {
+		return nil, errors.New("not a quic connection")
+	}
+	if isDone(s.appClosed) {
+		return nil, errors.New("quic connection closed by the application")
+	}
+	stream, err := s.server.newSession(s.worker, s.addr, s.rx.Size(), s.tx.Size(), false)
+	if err != nil {
+		return nil, err
+	}
+	stream.tls = s.tls
+	s.addStream(stream)
+	if err := s.server.acceptSession(ctx, stream, &session.AcceptedMsg{ListenerHandle: s.handle}); err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// addStream adds a stream to the quic connection
+func (s *Session) addStream(stream *Session) {
+	s.server.mu.Lock()
+	defer s.server.mu.Unlock()
+	s.streams = append(s.streams, stream)
+}
+
+// streamList returns the streams of a quic connection
+func (s *Session) streamList() []*Session {
+	s.server.mu.Lock()
+	defer s.server.mu.Unlock()
+	return append([]*Session(nil), s.streams...)
+}
@@ -0,0 +1,304 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hoststacktest
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"github.com/justincormack/go-memfd"
+	"github.com/pkg/errors"
+
+	"github.com/godirect/hoststack/app-attach/hoststack/appsock"
+	"github.com/godirect/hoststack/app-attach/hoststack/fifo"
+	"github.com/godirect/hoststack/app-attach/hoststack/internal/svm"
+	"github.com/godirect/hoststack/app-attach/hoststack/memseg"
+	"github.com/godirect/hoststack/app-attach/hoststack/msgq"
+	"github.com/godirect/hoststack/app-attach/hoststack/session"
+)
+
+// segmentHeaderOffset is the offset of the fifo segment header in the
+// segments of the server, the ssvm header comes first
+const segmentHeaderOffset = 2 * 4096
+
+// Sizes of the session message queues, as VPP's session layer sets them up
+const (
+	defaultEvtQueueSize = 128
+	sessionEventSize    = 18
+	ctrlEventSize       = 256
+)
+
+// sessionQueueConfig returns the config of a session message queue of
+// evtQueueSize messages, with a ring for IO events and one for control events
+func sessionQueueConfig(evtQueueSize uint32) msgq.Config {
+	ctrlItems := evtQueueSize >> 4
+	if ctrlItems < 16 {
+		ctrlItems = 16
+	}
+	return msgq.Config{
+		QueueItems: evtQueueSize,
+		Rings: []msgq.RingConfig{
+			{NItems: evtQueueSize, ElemSize: sessionEventSize},
+			{NItems: ctrlItems, ElemSize: ctrlEventSize},
+		},
+	}
+}
+
+// segment is a memfd fifo segment laid out as VPP's fifo_segment_init does
+type segment struct {
+	mfd *memfd.Memfd
+	b   []byte
+	fsh []byte
+}
+
+func newSegment(size int64) (*segment, error) {
+	if size < segmentHeaderOffset+memseg.FifoSegmentHeaderSize+memseg.SliceSize {
+		return nil, errors.Errorf("segment of %d bytes is too small", size)
+	}
+	mfd, err := memfd.Create()
+	if err != nil {
+		return nil, err
+	}
+	if err := mfd.SetSize(size); err != nil {
+		_ = mfd.Close()
+		return nil, err
+	}
+	b, err := mfd.Map()
+	if err != nil {
+		_ = mfd.Close()
+		return nil, err
+	}
+	le := binary.LittleEndian
+	le.PutUint64(b[svm.SsvmVa:], uint64(uintptr(unsafe.Pointer(&b[0]))))
+	le.PutUint64(b[svm.SsvmSize:], uint64(size))
+	le.PutUint64(b[svm.SsvmOpaque0:], segmentHeaderOffset)
+	fsh := b[segmentHeaderOffset:]
+	byteIndex := uint64(memseg.FifoSegmentHeaderSize + memseg.SliceSize)
+	fsh[svm.FshNSlices] = 1
+	le.PutUint32(fsh[svm.FshReservedBytes:], uint32(byteIndex))
+	le.PutUint32(fsh[svm.FshMaxLog2FifoSize:], 20)
+	le.PutUint64(fsh[svm.FshByteIndex:], byteIndex)
+	le.PutUint64(fsh[svm.FshMaxByteIndex:], uint64(len(fsh)))
+	return &segment{mfd: mfd, b: b, fsh: fsh}, nil
+}
+
+// fd returns the memfd of the segment
+func (s *segment) fd() int {
+	return int(s.mfd.Fd())
+}
+
+// alloc carves size bytes out of the segment, it returns their offset
+// relative to the fifo segment header
+func (s *segment) alloc(size int) (uint64, error) {
+	le := binary.LittleEndian
+	offset := (le.Uint64(s.fsh[svm.FshByteIndex:]) + 7) &^ 7
+	end := offset + uint64(size)
+	if end > le.Uint64(s.fsh[svm.FshMaxByteIndex:]) {
+		return 0, errors.Errorf("no room for %d bytes in segment", size)
+	}
+	le.PutUint64(s.fsh[svm.FshByteIndex:], end)
+	return offset, nil
+}
+
+// allocQueue lays out a message queue in the segment and opens it
+func (s *segment) allocQueue(cfg msgq.Config, eventFd int) (uint64, *msgq.Queue, error) {
+	offset, err := s.alloc(msgq.Size(cfg))
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := msgq.Init(s.fsh[offset:], cfg); err != nil {
+		return 0, nil, err
+	}
+	queue, err := msgq.Open(s.fsh[offset:], eventFd)
+	if err != nil {
+		return 0, nil, err
+	}
+	s.fsh[svm.FshNMqs]++
+	return offset, queue, nil
+}
+
+func (s *segment) close() {
+	_ = s.mfd.Unmap()
+	_ = s.mfd.Close()
+}
+
+// worker is the VPP side of an application worker
+type worker struct {
+	segment       *segment
+	segmentHandle uint64
+	fifos         *fifo.Segment // the fifos of segment
+	added         map[uint64]*addedSegment
+	allocIn       uint64 // the handle of the added segment new session fifos are allocated in, if any
+	appMq         *msgq.Queue
+	eventFd       int           // signals appMq, the server produces on it with a process local lock
+	passEventFd   bool          // whether the application is passed eventFd or polls appMq
+	conn          *net.UnixConn // the app socket connection of the worker
+}
+
+// newWorker creates the fifo segment and app message queue of a worker. The
+// queue signals over a new eventfd, which is passed to the application if
+// useEventFd is set.
+func newWorker(segmentSize int64, evtQueueSize uint32, useEventFd bool) (*worker, uint64, error) {
+	w := &worker{eventFd: -1, passEventFd: useEventFd, added: make(map[uint64]*addedSegment)}
+	fd, err := msgq.NewEventFd()
+	if err != nil {
+		return nil, 0, err
+	}
+	w.eventFd = fd
+	seg, err := newSegment(segmentSize)
+	if err != nil {
+		w.close()
+		return nil, 0, err
+	}
+	w.segment = seg
+	offset, appMq, err := seg.allocQueue(sessionQueueConfig(evtQueueSize), w.eventFd)
+	if err != nil {
+		w.close()
+		return nil, 0, err
+	}
+	w.appMq = appMq
+	if w.fifos, err = fifo.NewSegment(seg.fsh); err != nil {
+		w.close()
+		return nil, 0, err
+	}
+	return w, offset, nil
+}
+
+// addedSegment is a segment added to a worker with AddSegment
+type addedSegment struct {
+	segment *segment
+	fifos   *fifo.Segment
+}
+
+// allocSegment returns the fifo segment new session fifos are allocated in,
+// and its handle
+func (w *worker) allocSegment() (*fifo.Segment, uint64) {
+	if a, ok := w.added[w.allocIn]; ok {
+		return a.fifos, w.allocIn
+	}
+	return w.fifos, w.segmentHandle
+}
+
+// fds returns the segment fd and, if it is passed to the application, the
+// eventfd of the worker along with their fd flags
+func (w *worker) fds() ([]int, uint8) {
+	fds := []int{w.segment.fd()}
+	flags := appsock.FdFlagMemfdSegment
+	if w.passEventFd {
+		fds = append(fds, w.eventFd)
+		flags |= appsock.FdFlagMqEventfd
+	}
+	return fds, flags
+}
+
+func (w *worker) close() {
+	if w.segment != nil {
+		w.segment.close()
+	}
+	for _, a := range w.added {
+		a.segment.close()
+	}
+	if w.appMq != nil {
+		_ = w.appMq.Close()
+	}
+	if w.eventFd >= 0 {
+		_ = syscall.Close(w.eventFd)
+	}
+}
+
+// AddSegment adds a fifo segment of size bytes to a worker of an
+// application, as VPP does when the segments of the worker are full. Its
+// memfd is passed over the app socket connection of the worker ahead of the
+// add segment event. The fifos of the sessions connected or accepted next
+// are allocated in it. It returns the handle of the segment.
+func (s *Server) AddSegment(appIndex, wrkIndex uint32, size int64) (uint64, error) {
+	seg, err := newSegment(size)
+	if err != nil {
+		return 0, err
+	}
+	fifos, err := fifo.NewSegment(seg.fsh)
+	if err != nil {
+		seg.close()
+		return 0, err
+	}
+	s.mu.Lock()
+	w := s.worker(appIndex, wrkIndex)
+	if w == nil {
+		s.mu.Unlock()
+		seg.close()
+		return 0, errors.Errorf("no worker %d for app %d", wrkIndex, appIndex)
+	}
+	handle := s.nextSegmentHandle
+	s.nextSegmentHandle++
+	w.added[handle] = &addedSegment{segment: seg, fifos: fifos}
+	s.mu.Unlock()
+	if err := s.announceSegment(w, seg, handle, size); err != nil {
+		return 0, err
+	}
+
+	// the application maps the segment before it gets the events of the
+	// sessions in it, the events are sent in order
+	s.mu.Lock()
+	w.allocIn = handle
+	s.mu.Unlock()
+	return handle, nil
+}
+
+// announceSegment passes the memfd of seg over the app socket connection of
+// a worker, followed by the add segment event
+func (s *Server) announceSegment(w *worker, seg *segment, handle uint64, size int64) error {
+	buf, err := (&appsock.AppSapiMsgSendFds{MsgType: appsock.MsgTypeSendFds}).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	s.send(w.conn, buf, []int{seg.fd()})
+	msg := session.AppAddSegmentMsg{FdFlags: appsock.FdFlagMemfdSegment, SegmentSize: uint32(size), SegmentHandle: handle}
+	copy(msg.SegmentName[:], fmt.Sprintf("segment-%d", handle))
+	s.sendCtrl(w.appMq, evtAppAddSegment, &msg)
+	return nil
+}
+
+// DelSegment deletes a segment added with AddSegment, once no session has
+// its fifos in it anymore. The fifos of the sessions connected or accepted
+// next are allocated in the segment of the worker again.
+func (s *Server) DelSegment(appIndex, wrkIndex uint32, handle uint64) error {
+	s.mu.Lock()
+	w := s.worker(appIndex, wrkIndex)
+	if w == nil {
+		s.mu.Unlock()
+		return errors.Errorf("no worker %d for app %d", wrkIndex, appIndex)
+	}
+	a, ok := w.added[handle]
+	if !ok {
+		s.mu.Unlock()
+		return errors.Errorf("no segment %#x", handle)
+	}
+	for _, sess := range s.sessions {
+		if sess.segmentHandle == handle {
+			s.mu.Unlock()
+			return errors.Errorf("session %d has its fifos in segment %#x", sess.index, handle)
+		}
+	}
+	delete(w.added, handle)
+	s.mu.Unlock()
+	s.sendCtrl(w.appMq, evtAppDelSegment, &session.AppDelSegmentMsg{SegmentHandle: handle})
+	a.segment.close()
+	return nil
+}
@@ -0,0 +1,527 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package hoststacktest provides a fake VPP app socket server, so the attach
+// path of package hoststack can be tested without a running VPP. The server
+// hands out fifo segments laid out like VPP's, with the session message
+// queues in them, so tests can play VPP's part on the queues too.
+package hoststacktest
+
+import (
+	"context"
+	"encoding"
+	"net"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/godirect/hoststack/app-attach/hoststack/appsock"
+	"github.com/godirect/hoststack/app-attach/hoststack/fifo"
+	"github.com/godirect/hoststack/app-attach/hoststack/msgq"
+)
+
+// DefaultSegmentSize is the size of the memfd segments passed by a Server
+const DefaultSegmentSize = 64 << 10
+
+// Action scripts how the server answers one request. The zero Action
+// answers successfully.
+type Action struct {
+	Retval     int32 // retval of the reply, no fds are passed when it is not 0
+	MissingFds bool  // announce the fds of the reply without passing them
+	Truncate   int   // send only the first Truncate bytes of the reply
+	Pad        int   // append Pad bytes to the reply
+	ExtraFds   int   // pass ExtraFds more fds than the reply announces
+	NoReply    bool  // read the request and never answer it
+	Close      bool  // close the connection instead of answering
+}
+
+// Request is a message received by the server
+type Request struct {
+	MsgType appsock.AppSapiMsgType
+	Msg     []byte
+	Payload []byte // certificate and key following an AddDelCertKey request
+}
+
+// Option configures a Server
+type Option func(*Server)
+
+// WithSegmentSize sets the size of the memfd segments passed with replies
+func WithSegmentSize(size int64) Option {
+	return func(s *Server) {
+		s.segmentSize = size
+	}
+}
+
+// WithSocketPath sets the path of the app socket instead of a socket in a
+// temporary directory. A path starting with @ is in the abstract namespace.
+func WithSocketPath(path string) Option {
+	return func(s *Server) {
+		s.path = path
+	}
+}
+
+// Server listens on a unixpacket socket and speaks VPP's app socket API.
+// Attach and worker add replies carry a fresh fifo segment holding the app
+// message queue of the worker, attach replies also carry the segment of the
+// control message queue of VPP.
+type Server struct {
+	tb           testing.TB
+	path         string
+	listener     *net.UnixListener
+	segmentSize  int64
+	wg           sync.WaitGroup
+	vppSegment   *segment
+	vppFifos     *fifo.Segment // chunks of the vpp segment applications pass ext configs in
+	ctrlMq       *msgq.Queue
+	ctrlMqOffset uint64
+	ctrlEventFd  int // signals ctrlMq, applications produce on it with a process local lock
+	handler      SessionHandler
+	ctx          context.Context // ends when the server is closed
+	cancel       context.CancelFunc
+
+	mu                sync.Mutex
+	closed            bool
+	conns             map[*net.UnixConn]struct{}
+	scripts           map[appsock.AppSapiMsgType][]Action
+	requests          []Request
+	apps              map[uint32]*app
+	nextAppIndex      uint32
+	nextWrkIndex      uint32
+	certKeys          map[uint32]struct{}
+	nextCertKeyIndex  uint32
+	nextSegmentHandle uint64
+	connectScript     []Action
+	sessions          map[uint32]*Session
+	listeners         map[uint64]*vppListener
+	nextSessionIndex  uint32
+	dropped           []*worker // the workers of closed connections, released with the server
+}
+
+// NewServer starts a Server on a socket in a temporary directory. Failures
+// are reported to tb and the server is closed when the test finishes.
+func NewServer(tb testing.TB, options ...Option) *Server {
+	s := &Server{
+		tb:                tb,
+		segmentSize:       DefaultSegmentSize,
+		conns:             make(map[*net.UnixConn]struct{}),
+		scripts:           make(map[appsock.AppSapiMsgType][]Action),
+		apps:              make(map[uint32]*app),
+		nextWrkIndex:      1,
+		certKeys:          map[uint32]struct{}{0: {}}, // VPP's built-in test pair
+		nextCertKeyIndex:  1,
+		nextSegmentHandle: 1,
+		sessions:          make(map[uint32]*Session),
+		listeners:         make(map[uint64]*vppListener),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	for _, option := range options {
+		option(s)
+	}
+	if s.path == "" {
+		s.path = filepath.Join(tb.TempDir(), "app_ns_socket")
+	}
+	vppSegment, err := newSegment(s.segmentSize)
+	if err != nil {
+		tb.Fatalf("Segment Error %v", err)
+	}
+	s.vppSegment = vppSegment
+	if s.vppFifos, err = fifo.NewSegment(vppSegment.fsh); err != nil {
+		vppSegment.close()
+		tb.Fatalf("Segment Error %v", err)
+	}
+	if s.ctrlEventFd, err = msgq.NewEventFd(); err != nil {
+		vppSegment.close()
+		tb.Fatalf("EventFd Error %v", err)
+	}
+	s.ctrlMqOffset, s.ctrlMq, err = vppSegment.allocQueue(sessionQueueConfig(defaultEvtQueueSize), s.ctrlEventFd)
+	if err != nil {
+		vppSegment.close()
+		_ = syscall.Close(s.ctrlEventFd)
+		tb.Fatalf("Message Queue Error %v", err)
+	}
+	listener, err := net.ListenUnix("unixpacket", &net.UnixAddr{Name: s.path, Net: "unixpacket"})
+	if err != nil {
+		vppSegment.close()
+		_ = s.ctrlMq.Close()
+		_ = syscall.Close(s.ctrlEventFd)
+		tb.Fatalf("Listen Error %v", err)
+	}
+	s.listener = listener
+	s.wg.Add(1)
+	go s.accept()
+	if s.handler != nil {
+		s.wg.Add(1)
+		go s.serveSessions()
+	}
+	tb.Cleanup(s.Close)
+	return s
+}
+
+// Path returns the path of the app socket
+func (s *Server) Path() string {
+	return s.path
+}
+
+// Script queues actions for the next requests of type msgType, requests
+// without a queued action are answered successfully
+func (s *Server) Script(msgType appsock.AppSapiMsgType, actions ...Action) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scripts[msgType] = append(s.scripts[msgType], actions...)
+}
+
+// Requests returns the requests received so far
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// CtrlQueue returns the control message queue of VPP. Tests play VPP's part
+// and consume it, unless the server serves sessions.
+func (s *Server) CtrlQueue() *msgq.Queue {
+	return s.ctrlMq
+}
+
+// AppQueue returns the app message queue of a worker, the server plays VPP's
+// part and produces on it. It returns nil for unknown workers.
+func (s *Server) AppQueue(appIndex, wrkIndex uint32) *msgq.Queue {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if w := s.worker(appIndex, wrkIndex); w != nil {
+		return w.appMq
+	}
+	return nil
+}
+
+// Attached reports whether a worker of an application is attached. VPP
+// detaches an application when its attach connection closes and deletes a
+// worker when the connection of the worker closes.
+func (s *Server) Attached(appIndex, wrkIndex uint32) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.worker(appIndex, wrkIndex) != nil
+}
+
+// dropConn detaches the applications attached over conn and deletes the
+// workers added over it, as VPP does once an app socket connection closes.
+// Their segments stay mapped until the server is closed, sessions may still
+// use them. s.mu must be held.
+func (s *Server) dropConn(conn *net.UnixConn) {
+	for appIndex, a := range s.apps {
+		if w := a.workers[0]; w != nil && w.conn == conn {
+			delete(s.apps, appIndex)
+			for _, w := range a.workers {
+				s.dropped = append(s.dropped, w)
+			}
+			continue
+		}
+		for wrkIndex, w := range a.workers {
+			if w.conn == conn {
+				delete(a.workers, wrkIndex)
+				s.dropped = append(s.dropped, w)
+			}
+		}
+	}
+}
+
+// worker returns a worker of an application, or nil. s.mu must be held.
+func (s *Server) worker(appIndex, wrkIndex uint32) *worker {
+	if a, ok := s.apps[appIndex]; ok {
+		return a.workers[wrkIndex]
+	}
+	return nil
+}
+
+// Close stops the server, closes its connections and waits for them to be
+// done
+func (s *Server) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	s.cancel()
+	_ = s.listener.Close()
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	for _, a := range s.apps {
+		for _, w := range a.workers {
+			w.close()
+		}
+	}
+	for _, w := range s.dropped {
+		w.close()
+	}
+	_ = s.ctrlMq.Close()
+	_ = syscall.Close(s.ctrlEventFd)
+	s.vppSegment.close()
+}
+
+func (s *Server) accept() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.AcceptUnix()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			_ = conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.serve(conn)
+	}
+}
+
+// serve answers the requests of one connection until it is closed
+func (s *Server) serve(conn *net.UnixConn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.dropConn(conn)
+		s.mu.Unlock()
+		_ = conn.Close()
+	}()
+	for {
+		buf := make([]byte, appsock.MsgSize)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		req := Request{MsgType: appsock.PeekMsgType(buf[:n]), Msg: buf[:n]}
+		if req.MsgType == appsock.MsgTypeAddDelCertKey {
+			var msg appsock.AppSapiMsgCertKeyAddDel
+			if err := msg.UnmarshalBinary(req.Msg); err == nil && msg.Msg.IsAdd == 1 {
+				req.Payload = make([]byte, int(msg.Msg.CertkeyLen)+1)
+				n, err := conn.Read(req.Payload)
+				if err != nil {
+					return
+				}
+				req.Payload = req.Payload[:n]
+			}
+		}
+		action := s.record(req)
+		if action.Close {
+			return
+		}
+		if action.NoReply {
+			continue
+		}
+		reply, fds := s.reply(conn, req, action.Retval)
+		if reply == nil {
+			continue
+		}
+		if action.MissingFds {
+			fds = nil
+		}
+		if action.Truncate > 0 && action.Truncate < len(reply) {
+			reply = reply[:action.Truncate]
+		}
+		reply = append(reply, make([]byte, action.Pad)...)
+		for i := 0; i < action.ExtraFds; i++ {
+			fds = append(fds, s.vppSegment.fd())
+		}
+		s.send(conn, reply, fds)
+	}
+}
+
+// record stores req and returns the action scripted for it
+func (s *Server) record(req Request) Action {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, req)
+	var action Action
+	if actions := s.scripts[req.MsgType]; len(actions) > 0 {
+		action = actions[0]
+		s.scripts[req.MsgType] = actions[1:]
+	}
+	return action
+}
+
+// app is the VPP side of an attached application
+type app struct {
+	segmentSize  int64
+	evtQueueSize uint32
+	useEventFd   bool
+	localScope   bool // its sessions and listeners are in the local table of the namespace
+	rxFifoSize   uint32
+	txFifoSize   uint32
+	workers      map[uint32]*worker
+}
+
+// reply builds the answer to req, received over conn, along with the fds to
+// pass, it returns nil for requests that have no reply. The fds stay owned by
+// the server.
+func (s *Server) reply(conn *net.UnixConn, req Request, retval int32) ([]byte, []int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var replyMsg encoding.BinaryMarshaler
+	var fds []int
+	switch req.MsgType {
+	case appsock.MsgTypeAttach:
+		var msg appsock.AppSapiMsgAttach
+		if !s.decode(req, &msg) {
+			return nil, nil
+		}
+		attachReply := &appsock.AppSapiMsgAttachReply{MsgType: appsock.MsgTypeAttachReply, Msg: appsock.AppAttachReplyMsg{Retval: retval}}
+		if retval == 0 {
+			a := s.newApp(msg.Msg.Options)
+			w, appMq, err := newWorker(a.segmentSize, a.evtQueueSize, a.useEventFd)
+			if err != nil {
+				s.tb.Errorf("Worker Error %v", err)
+				return nil, nil
+			}
+			w.segmentHandle = s.nextSegmentHandle
+			w.conn = conn
+			a.workers[0] = w
+			s.apps[s.nextAppIndex] = a
+			workerFds, fdFlags := w.fds()
+			// in the order of the fd flags
+			fds = append([]int{s.vppSegment.fd(), workerFds[0], s.ctrlEventFd}, workerFds[1:]...)
+			attachReply.Msg.AppIndex = s.nextAppIndex
+			attachReply.Msg.AppMq = appMq
+			attachReply.Msg.VppCtrlMq = s.ctrlMqOffset
+			attachReply.Msg.SegmentHandle = s.nextSegmentHandle
+			attachReply.Msg.APIClientHandle = s.nextAppIndex
+			attachReply.Msg.NFds = uint8(len(fds))
+			attachReply.Msg.FdFlags = appsock.FdFlagVppMqSegment | appsock.FdFlagVppMqEventfd | fdFlags
+			s.nextAppIndex++
+			s.nextSegmentHandle++
+		}
+		replyMsg = attachReply
+	case appsock.MsgTypeAddDelWorker:
+		var msg appsock.AppSapiMsgWorkerAddDel
+		if !s.decode(req, &msg) {
+			return nil, nil
+		}
+		workerReply := &appsock.AppSapiMsgWorkerAddDelReply{MsgType: appsock.MsgTypeAddDelWorkerReply, Msg: appsock.AppWorkerAddDelReplyMsg{
+			Retval:   retval,
+			WrkIndex: msg.Msg.WrkIndex,
+			IsAdd:    msg.Msg.IsAdd,
+		}}
+		a, ok := s.apps[msg.Msg.AppIndex]
+		if !ok && retval == 0 {
+			workerReply.Msg.Retval = int32(sessionErrNoApp)
+		} else if msg.Msg.IsAdd == 1 && retval == 0 {
+			w, appMq, err := newWorker(a.segmentSize, a.evtQueueSize, a.useEventFd)
+			if err != nil {
+				s.tb.Errorf("Worker Error %v", err)
+				return nil, nil
+			}
+			w.segmentHandle = s.nextSegmentHandle
+			w.conn = conn
+			a.workers[s.nextWrkIndex] = w
+			var fdFlags uint8
+			fds, fdFlags = w.fds()
+			workerReply.Msg.WrkIndex = s.nextWrkIndex
+			workerReply.Msg.AppEventQueueAddress = appMq
+			workerReply.Msg.SegmentHandle = s.nextSegmentHandle
+			workerReply.Msg.APIClientHandle = msg.Msg.AppIndex
+			workerReply.Msg.NFds = uint8(len(fds))
+			workerReply.Msg.FdFlags = fdFlags
+			s.nextWrkIndex++
+			s.nextSegmentHandle++
+		}
+		replyMsg = workerReply
+	case appsock.MsgTypeAddDelCertKey:
+		var msg appsock.AppSapiMsgCertKeyAddDel
+		if !s.decode(req, &msg) {
+			return nil, nil
+		}
+		certKeyReply := &appsock.AppSapiMsgCertKeyAddDelReply{MsgType: appsock.MsgTypeAddDelCertKeyReply, Msg: appsock.AppCertKeyAddDelReplyMsg{
+			Context: msg.Msg.Context,
+			Retval:  retval,
+			Index:   msg.Msg.Index,
+		}}
+		switch {
+		case retval != 0:
+		case msg.Msg.IsAdd == 1:
+			certKeyReply.Msg.Index = s.nextCertKeyIndex
+			s.certKeys[s.nextCertKeyIndex] = struct{}{}
+			s.nextCertKeyIndex++
+		default:
+			delete(s.certKeys, msg.Msg.Index)
+		}
+		replyMsg = certKeyReply
+	default:
+		return nil, nil
+	}
+	buf, err := replyMsg.MarshalBinary()
+	if err != nil {
+		s.tb.Errorf("BinaryMarshaling Error %v", err)
+		return nil, nil
+	}
+	return buf, fds
+}
+
+// sessionErrNoApp is VPP's SESSION_E_NOAPP
+const sessionErrNoApp = -13
+
+// newApp applies the attach options VPP honours for the segments and queues
+// of an application
+func (s *Server) newApp(options [appsock.AppOptionsNOptions]uint64) *app {
+	a := &app{
+		segmentSize:  s.segmentSize,
+		evtQueueSize: defaultEvtQueueSize,
+		useEventFd:   options[appsock.AppOptionsFlags]&appsock.AppOptionsFlagsEvtMqUseEventfd != 0,
+		localScope:   options[appsock.AppOptionsFlags]&appsock.AppOptionsFlagsUseLocalScope != 0,
+		rxFifoSize:   defaultFifoSize,
+		txFifoSize:   defaultFifoSize,
+		workers:      make(map[uint32]*worker),
+	}
+	if size := options[appsock.AppOptionsRxFifoSize]; size != 0 {
+		a.rxFifoSize = uint32(size)
+	}
+	if size := options[appsock.AppOptionsTxFifoSize]; size != 0 {
+		a.txFifoSize = uint32(size)
+	}
+	if size := options[appsock.AppOptionsSegmentSize]; size != 0 {
+		a.segmentSize = int64(size)
+	}
+	if size := options[appsock.AppOptionsEvtQueueSize]; size != 0 {
+		a.evtQueueSize = uint32(size)
+	}
+	return a
+}
+
+func (s *Server) decode(req Request, msg encoding.BinaryUnmarshaler) bool {
+	if err := msg.UnmarshalBinary(req.Msg); err != nil {
+		s.tb.Errorf("BinaryUnMarshaling Error %v", err)
+		return false
+	}
+	return true
+}
+
+// send writes buf to conn along with fds
+func (s *Server) send(conn *net.UnixConn, buf []byte, fds []int) {
+	var oob []byte
+	if len(fds) > 0 {
+		oob = syscall.UnixRights(fds...)
+	}
+	// the client may be gone already, e.g. after a timed out request
+	_, _, _ = conn.WriteMsgUnix(buf, oob, nil)
+}
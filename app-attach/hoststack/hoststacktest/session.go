@@ -0,0 +1,613 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hoststacktest
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/godirect/hoststack/app-attach/hoststack/fifo"
+	"github.com/godirect/hoststack/app-attach/hoststack/msgq"
+	"github.com/godirect/hoststack/app-attach/hoststack/session"
+)
+
+// Session event types the server handles, as VPP's session_evt_type_t
+const (
+	evtIORx              = 0
+	evtIOTx              = 1
+	evtReset             = 8
+	evtBound             = 9
+	evtUnlistenReply     = 10
+	evtAccepted          = 11
+	evtAcceptedReply     = 12
+	evtConnected         = 13
+	evtDisconnected      = 14
+	evtDisconnectedReply = 15
+	evtResetReply        = 16
+	evtShutdown          = 20
+	evtDisconnect        = 21
+	evtConnect           = 22
+	evtListen            = 24
+	evtUnlisten          = 26
+	evtAppAddSegment     = 28
+	evtAppDelSegment     = 29
+	evtCleanup           = 31
+)
+
+// Rings of the session message queues
+const (
+	ioEventRing   = 0
+	ctrlEventRing = 1
+)
+
+// defaultFifoSize is the size of session fifos when the attach options do
+// not set one
+const defaultFifoSize = 8192
+
+// VPP's session_error_t codes the server replies with
+const (
+	sessionErrRefused     = -2
+	sessionErrNoSession   = -12
+	sessionErrPortInUse   = -14
+	sessionErrNoExtCfg    = -31
+	sessionErrNoCryptoCkp = -33
+)
+
+// ephemeralPort is the first port the server picks for listeners on port 0
+// and for the peers of the sessions it connects
+const ephemeralPort = 49152
+
+// SessionHandler serves a session an application connected, in a goroutine
+// of its own. The session is disconnected when the handler returns.
+type SessionHandler func(s *Session)
+
+// WithSessionHandler makes the server play VPP's session layer: it consumes
+// the control message queue of VPP, connects the sessions applications ask
+// for to handler and binds the listeners Connect connects to
+func WithSessionHandler(handler SessionHandler) Option {
+	return func(s *Server) {
+		s.handler = handler
+	}
+}
+
+// Echo is a SessionHandler writing back what it reads
+func Echo(s *Session) {
+	_, _ = io.Copy(s, s)
+}
+
+// ScriptConnect queues actions for the next connect requests, Retval and
+// NoReply are honoured
+func (s *Server) ScriptConnect(actions ...Action) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connectScript = append(s.connectScript, actions...)
+}
+
+// Session is the VPP side of a session, reads and writes go through the
+// session fifos in the segment of the application worker. Reads and writes
+// on a UDP session carry one datagram.
+type Session struct {
+	server        *Server
+	index         uint32
+	handle        uint64
+	appMq         *msgq.Queue
+	segmentHandle uint64     // the handle of the segment of the fifos
+	rx            *fifo.Fifo // the application reads from it
+	tx            *fifo.Fifo // the application writes to it
+	addr          net.Addr
+	rxEvent       chan struct{}
+	txEvent       chan struct{}
+	appClosed     chan struct{} // closed once the application closed the session
+	appShutdown   chan struct{} // closed once the application shut down its sending side
+	accepted      chan int32    // receives the accept reply to Connect
+	dgram         bool
+	shared        bool       // the session of a listener, shared by all peers
+	tls           *TLSParams // the crypto config of a tls or quic session
+	worker        *worker
+	quic          bool       // a quic connection, carrying streams
+	streams       []*Session // the streams of a quic connection, guarded by the server mutex
+	peer          *Session   // the session of the other application of a cut-through session
+	closeOnce     sync.Once
+	appOnce       sync.Once
+	shutdownOnce  sync.Once
+}
+
+// Addr returns the address of the peer the server plays: the address the
+// application connected to, or the address Connect connected from
+func (s *Session) Addr() net.Addr {
+	return s.addr
+}
+
+// Read reads what the application wrote. It returns io.EOF once the
+// application closed or shut down the session and all of its data is read.
+func (s *Session) Read(b []byte) (int, error) {
+	for {
+		closed := isDone(s.appClosed) || isDone(s.appShutdown)
+		n, deq, err := s.dequeue(b)
+		if errors.Is(err, fifo.ErrEmpty) {
+			s.tx.UnsetEvent()
+			n, deq, err = s.dequeue(b)
+		}
+		if deq > 0 {
+			if s.tx.NeedsDeqNtf(deq) {
+				s.tx.ClearDeqNtf()
+				s.sendIO(evtIOTx, s.tx)
+			}
+			return n, nil
+		}
+		if err != nil && !errors.Is(err, fifo.ErrEmpty) {
+			return 0, err
+		}
+		if closed {
+			return 0, io.EOF
+		}
+		select {
+		case <-s.txEvent:
+		case <-s.appClosed:
+		case <-s.appShutdown:
+		case <-s.server.ctx.Done():
+			return 0, io.ErrClosedPipe
+		}
+	}
+}
+
+// Write writes data for the application to read, waiting for room in the
+// rx fifo until all of b is written
+func (s *Session) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		if isDone(s.appClosed) {
+			return written, io.ErrClosedPipe
+		}
+		n, err := s.enqueue(b[written:])
+		if errors.Is(err, fifo.ErrFull) {
+			s.rx.AddWantDeqNtf(fifo.WantDeqNtf)
+			n, err = s.enqueue(b[written:])
+		}
+		if n > 0 {
+			written += n
+			if s.rx.SetEvent() {
+				s.sendIO(evtIORx, s.rx)
+			}
+			continue
+		}
+		if err != nil && !errors.Is(err, fifo.ErrFull) {
+			return written, err
+		}
+		select {
+		case <-s.rxEvent:
+		case <-s.appClosed:
+		case <-s.server.ctx.Done():
+			return written, io.ErrClosedPipe
+		}
+	}
+	return written, nil
+}
+
+// dequeue reads from the tx fifo, a datagram for UDP sessions. It also
+// returns the number of bytes it dequeued.
+func (s *Session) dequeue(b []byte) (int, uint32, error) {
+	if !s.dgram {
+		n, err := s.tx.Dequeue(b)
+		return n, uint32(n), err
+	}
+	if s.tx.MaxDequeue() == 0 {
+		return 0, 0, fifo.ErrEmpty
+	}
+	buf := make([]byte, session.DgramHdrSize)
+	if _, err := s.tx.Dequeue(buf); err != nil {
+		return 0, 0, err
+	}
+	var hdr session.DgramHdr
+	if err := session.Unmarshal(buf, &hdr); err != nil {
+		return 0, 0, err
+	}
+	data := make([]byte, hdr.DataLength)
+	if _, err := s.tx.Dequeue(data); err != nil && len(data) > 0 {
+		return 0, 0, err
+	}
+	return copy(b, data), session.DgramHdrSize + hdr.DataLength, nil
+}
+
+// enqueue writes to the rx fifo, a datagram from the peer for UDP sessions
+func (s *Session) enqueue(b []byte) (int, error) {
+	if !s.dgram {
+		return s.rx.Enqueue(b)
+	}
+	if session.DgramHdrSize+len(b) > int(s.rx.Size()) {
+		return 0, io.ErrShortWrite
+	}
+	hdr := session.DgramHdr{DataLength: uint32(len(b))}
+	if addr, ok := s.addr.(*net.UDPAddr); ok {
+		var isIP4 bool
+		hdr.RmtIP, isIP4 = session.NewIP46Address(addr.IP)
+		hdr.RmtPort = session.Htons(uint16(addr.Port))
+		if isIP4 {
+			hdr.IsIP4 = 1
+		}
+	}
+	data, err := session.Marshal(&hdr)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := s.rx.EnqueueSegments(data, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close disconnects the session, as VPP does when the peer closes it. The
+// session of a listener is left alone, the streams of a quic connection are
+// disconnected before it.
+func (s *Session) Close() error {
+	if s.shared {
+		return nil
+	}
+	for _, stream := range s.streamList() {
+		_ = stream.Close()
+	}
+	s.closeOnce.Do(func() {
+		s.sendCtrl(evtDisconnected, &session.DisconnectedMsg{Handle: s.handle})
+	})
+	return nil
+}
+
+// Reset resets the session, as VPP does when the peer resets it, and the
+// streams of a quic connection
+func (s *Session) Reset() error {
+	for _, stream := range s.streamList() {
+		_ = stream.Reset()
+	}
+	s.closeOnce.Do(func() {
+		s.sendCtrl(evtReset, &session.ResetMsg{Handle: s.handle})
+	})
+	return nil
+}
+
+// sendIO sends an io event for the fifo f to the application
+func (s *Session) sendIO(eventType uint8, f *fifo.Fifo) {
+	data := make([]byte, 6)
+	data[0] = eventType
+	binary.LittleEndian.PutUint32(data[2:], f.ClientSessionIndex())
+	_ = s.appMq.Send(s.server.ctx, ioEventRing, data)
+}
+
+func (s *Session) sendCtrl(eventType uint8, msg interface{}) {
+	s.server.sendCtrl(s.appMq, eventType, msg)
+}
+
+// shutdownApp records that the application shut down its sending side
+func (s *Session) shutdownApp() {
+	s.shutdownOnce.Do(func() {
+		close(s.appShutdown)
+	})
+}
+
+// closeApp records that the application closed the session
+func (s *Session) closeApp() {
+	s.appOnce.Do(func() {
+		close(s.appClosed)
+	})
+}
+
+// serveSessions consumes the control message queue of VPP
+func (s *Server) serveSessions() {
+	defer s.wg.Done()
+	for {
+		msg, err := s.ctrlMq.Recv(s.ctx)
+		if err != nil {
+			return
+		}
+		if len(msg.Data) < 2 {
+			continue
+		}
+		data := msg.Data[2:]
+		switch msg.Data[0] {
+		case evtConnect:
+			s.connect(data)
+		case evtListen:
+			s.listen(data)
+		case evtUnlisten:
+			s.unlisten(data)
+		case evtAcceptedReply:
+			var reply session.AcceptedReplyMsg
+			if err := session.Unmarshal(data, &reply); err != nil {
+				s.tb.Errorf("Accepted Reply Error %v", err)
+				continue
+			}
+			if sess := s.sessionByHandle(reply.Handle); sess != nil {
+				sess.accepted <- reply.Retval
+			}
+		case evtShutdown:
+			// the application is done writing, a cut-through peer reads
+			// what is left in the fifo and then io.EOF
+			if sess := s.sessionByHandle(binary.LittleEndian.Uint64(data[8:])); sess != nil {
+				sess.shutdownApp()
+				if sess.peer != nil {
+					_ = sess.peer.Close()
+				}
+			}
+		case evtDisconnect, evtDisconnectedReply, evtResetReply:
+			// the handle follows the client index or retval and the context
+			if sess := s.sessionByHandle(binary.LittleEndian.Uint64(data[8:])); sess != nil {
+				sess.closeApp()
+				if sess.peer != nil && msg.Data[0] == evtDisconnect {
+					_ = sess.peer.Close()
+				}
+			}
+		case evtIORx, evtIOTx:
+			sess := s.session(binary.LittleEndian.Uint32(data))
+			if sess == nil {
+				continue
+			}
+			if sess.peer != nil {
+				sess.forwardIO(msg.Data[0])
+				continue
+			}
+			if msg.Data[0] == evtIOTx {
+				notify(sess.txEvent)
+			} else {
+				notify(sess.rxEvent)
+			}
+		}
+	}
+}
+
+// connect allocates the fifos of a session in the segment of the worker
+// asking for it and answers with a connected event
+func (s *Server) connect(data []byte) {
+	var msg session.ConnectMsg
+	if err := session.Unmarshal(data, &msg); err != nil {
+		s.tb.Errorf("Connect Error %v", err)
+		return
+	}
+	s.mu.Lock()
+	var action Action
+	if len(s.connectScript) > 0 {
+		action = s.connectScript[0]
+		s.connectScript = s.connectScript[1:]
+	}
+	var w *worker
+	var rxFifoSize, txFifoSize uint32
+	var local *vppListener
+	if a, ok := s.apps[msg.ClientIndex]; ok {
+		w = a.workers[uint32(msg.WrkIndex)]
+		rxFifoSize, txFifoSize = a.rxFifoSize, a.txFifoSize
+		if a.localScope {
+			local = s.localListener(&msg)
+		}
+	}
+	s.mu.Unlock()
+	if w == nil {
+		s.tb.Errorf("Connect Error no worker %d for client %d", msg.WrkIndex, msg.ClientIndex)
+		return
+	}
+	// a quic stream is connected on the connection of its parent handle and
+	// shares its crypto config
+	isQUIC := msg.Proto == session.TransportProtoQUIC
+	var parent *Session
+	proto := msg.Proto
+	if isQUIC && msg.ParentHandle != session.InvalidHandle {
+		parent = s.sessionByHandle(msg.ParentHandle)
+		proto = session.TransportProtoNone
+	}
+	tls, retval := s.tlsParams(proto, msg.ExtConfig)
+	if action.NoReply {
+		return
+	}
+	reply := session.ConnectedMsg{Context: msg.Context, Retval: action.Retval}
+	if reply.Retval == 0 {
+		reply.Retval = retval
+	}
+	if reply.Retval == 0 && proto == session.TransportProtoNone && (parent == nil || !parent.quic) {
+		reply.Retval = sessionErrNoSession
+	}
+	if reply.Retval != 0 {
+		s.sendCtrl(w.appMq, evtConnected, &reply)
+		return
+	}
+	if local != nil {
+		// the listener accepts the session, it cannot be waited for here
+		s.wg.Add(1)
+		go s.connectLocal(w, local, &msg, &reply, rxFifoSize, txFifoSize)
+		return
+	}
+	isUDP := msg.Proto == session.TransportProtoUDP
+	addr := sockAddr(isUDP || isQUIC, msg.IP.IP(msg.IsIP4 != 0), session.Ntohs(msg.Port))
+	sess, err := s.newSession(w, addr, rxFifoSize, txFifoSize, isUDP)
+	if err != nil {
+		s.tb.Logf("Connect Error %v", err)
+		reply.Retval = sessionErrRefused
+		s.sendCtrl(w.appMq, evtConnected, &reply)
+		return
+	}
+	lclIndex := sess.index
+	if parent != nil {
+		lclIndex = parent.index
+		sess.tls = parent.tls
+		parent.addStream(sess)
+	} else {
+		sess.tls = tls
+		sess.quic = isQUIC
+	}
+	reply.Handle = sess.handle
+	reply.ServerRxFifo = sess.rx.Offset()
+	reply.ServerTxFifo = sess.tx.Offset()
+	reply.SegmentHandle = sess.segmentHandle
+	reply.VppEventQueueAddress = s.ctrlMqOffset
+	reply.Lcl = loopbackEndpoint(msg.IsIP4 != 0, uint16(ephemeralPort+lclIndex%16384))
+	for _, f := range []*fifo.Fifo{sess.rx, sess.tx} {
+		f.SetClientSessionIndex(msg.Context)
+	}
+	s.sendCtrl(w.appMq, evtConnected, &reply)
+	if sess.quic {
+		// the handler serves the streams of the connection
+		s.startSession(sess, nil)
+		return
+	}
+	s.startSession(sess, s.handler)
+}
+
+// newSession allocates the fifos of a session with the peer at addr, dgram
+// sessions carry datagrams
+func (s *Server) newSession(w *worker, addr net.Addr, rxFifoSize, txFifoSize uint32, dgram bool) (*Session, error) {
+	s.mu.Lock()
+	fifos, segmentHandle := w.allocSegment()
+	s.mu.Unlock()
+	return s.newSessionIn(w, fifos, segmentHandle, addr, rxFifoSize, txFifoSize, dgram)
+}
+
+// newSessionIn allocates the fifos of a session in the fifo segment of
+// segmentHandle
+func (s *Server) newSessionIn(w *worker, fifos *fifo.Segment, segmentHandle uint64, addr net.Addr, rxFifoSize, txFifoSize uint32, dgram bool) (*Session, error) {
+	rxOffset, err := fifos.AllocFifo(0, rxFifoSize)
+	if err != nil {
+		return nil, err
+	}
+	txOffset, err := fifos.AllocFifo(0, txFifoSize)
+	if err != nil {
+		return nil, err
+	}
+	rx, err := fifos.Fifo(rxOffset)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := fifos.Fifo(txOffset)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess := &Session{
+		server:        s,
+		worker:        w,
+		index:         s.nextSessionIndex,
+		handle:        uint64(s.nextSessionIndex),
+		appMq:         w.appMq,
+		segmentHandle: segmentHandle,
+		rx:            rx,
+		tx:            tx,
+		addr:          addr,
+		rxEvent:       make(chan struct{}, 1),
+		txEvent:       make(chan struct{}, 1),
+		appClosed:     make(chan struct{}),
+		appShutdown:   make(chan struct{}),
+		accepted:      make(chan int32, 1),
+		dgram:         dgram,
+	}
+	s.nextSessionIndex++
+	for _, f := range []*fifo.Fifo{rx, tx} {
+		f.SetMasterSessionIndex(sess.index)
+	}
+	s.sessions[sess.index] = sess
+	return sess, nil
+}
+
+// startSession runs a session unless the server is closed
+func (s *Server) startSession(sess *Session, handler SessionHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.wg.Add(1)
+	go s.runSession(sess, handler)
+}
+
+// runSession serves a session with handler, then cleans it up once the
+// application closed it too. Without a handler the session is left to the
+// caller of Connect.
+func (s *Server) runSession(sess *Session, handler SessionHandler) {
+	defer s.wg.Done()
+	if handler != nil {
+		handler(sess)
+		if !isDone(sess.appClosed) {
+			_ = sess.Close()
+		}
+	}
+	select {
+	case <-sess.appClosed:
+	case <-s.ctx.Done():
+		return
+	}
+	s.mu.Lock()
+	delete(s.sessions, sess.index)
+	s.mu.Unlock()
+	for _, cleanupType := range []uint8{session.CleanupTransport, session.CleanupSession} {
+		sess.sendCtrl(evtCleanup, &session.CleanupMsg{Handle: sess.handle, Type: cleanupType})
+	}
+}
+
+// sockAddr returns the UDP or TCP address of ip and port
+func sockAddr(isUDP bool, ip net.IP, port uint16) net.Addr {
+	if isUDP {
+		return &net.UDPAddr{IP: ip, Port: int(port)}
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}
+}
+
+// loopbackEndpoint returns the endpoint of port on the loopback address
+func loopbackEndpoint(isIP4 bool, port uint16) session.TransportEndpoint {
+	ep := session.TransportEndpoint{Port: session.Htons(port)}
+	if isIP4 {
+		ep.IsIP4 = 1
+		ep.IP, _ = session.NewIP46Address(net.IPv4(127, 0, 0, 1))
+	} else {
+		ep.IP, _ = session.NewIP46Address(net.IPv6loopback)
+	}
+	return ep
+}
+
+func (s *Server) session(index uint32) *Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sessions[index]
+}
+
+func (s *Server) sessionByHandle(handle uint64) *Session {
+	return s.session(uint32(handle))
+}
+
+// sendCtrl sends a control event to an application worker
+func (s *Server) sendCtrl(appMq *msgq.Queue, eventType uint8, msg interface{}) {
+	data, err := session.Marshal(msg)
+	if err != nil {
+		s.tb.Errorf("Marshal Error %v", err)
+		return
+	}
+	_ = appMq.Send(s.ctx, ctrlEventRing, append([]byte{eventType, 0}, data...))
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func isDone(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
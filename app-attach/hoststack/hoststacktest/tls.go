@@ -0,0 +1,79 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hoststacktest
+
+import (
+	"bytes"
+
+	"github.com/godirect/hoststack/app-attach/hoststack/session"
+)
+
+// TLSParams is the crypto config an application opened a tls session with
+type TLSParams struct {
+	CertKey    uint32
+	Engine     uint8
+	ServerName string
+}
+
+// TLS returns the crypto config of a tls session, ok is false for sessions
+// of other transports
+func (s *Session) TLS() (params TLSParams, ok bool) {
+	if s.tls == nil {
+		return TLSParams{}, false
+	}
+	return *s.tls, true
+}
+
+// tlsParams takes the ext config at offset in the vpp segment off a connect
+// or listen request for proto, as VPP's session_mq_get_ext_config and
+// session_mq_free_ext_config do. It returns the crypto config of a tls or
+// quic request, or the retval rejecting the request.
+func (s *Server) tlsParams(proto uint8, offset uint64) (*TLSParams, int32) {
+	var cfg *session.ExtConfig
+	if offset != 0 {
+		s.mu.Lock()
+		data, err := s.vppFifos.ChunkData(offset)
+		if err == nil {
+			cfg = new(session.ExtConfig)
+			if err = session.Unmarshal(data, cfg); err != nil {
+				cfg = nil
+			}
+			err = s.vppFifos.FreeChunk(0, offset)
+		}
+		s.mu.Unlock()
+		if err != nil {
+			s.tb.Errorf("Ext Config Error %v", err)
+		}
+	}
+	if proto != session.TransportProtoTLS && proto != session.TransportProtoQUIC {
+		return nil, 0
+	}
+	if cfg == nil || cfg.Type != session.ExtConfigTypeCrypto {
+		return nil, sessionErrNoExtCfg
+	}
+	s.mu.Lock()
+	_, ok := s.certKeys[cfg.CkpairIndex]
+	s.mu.Unlock()
+	if !ok {
+		return nil, sessionErrNoCryptoCkp
+	}
+	params := &TLSParams{CertKey: cfg.CkpairIndex, Engine: cfg.CryptoEngine}
+	if n := bytes.IndexByte(cfg.Hostname[:], 0); n >= 0 {
+		params.ServerName = string(cfg.Hostname[:n])
+	}
+	return params, 0
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package svm holds the layout of the structures of VPP's svm library that
+// are shared with VPP: the ssvm header starting a segment, the fifo segment
+// header and its slices, fifo chunks and the shared part of fifos. Offsets
+// are in bytes from the start of each structure, as VPP 21.06 lays them out
+// on 64-bit hosts.
+package svm
+
+// Layout of ssvm_shared_header_t
+const (
+	SsvmVa         = 24 // the address VPP mapped the segment at
+	SsvmSize       = 32 // the size of the segment
+	SsvmOpaque0    = 56 // the offset of the fifo segment header
+	SsvmHeaderSize = 128
+)
+
+// Layout of fifo_segment_header_t, the slices follow it
+const (
+	FshCachedBytes        = 0
+	FshActiveFifos        = 8
+	FshReservedBytes      = 12
+	FshMaxLog2FifoSize    = 16
+	FshFlags              = 20
+	FshNSlices            = 21
+	FshHighWatermark      = 22
+	FshLowWatermark       = 23
+	FshPctFirstAlloc      = 24
+	FshNMqs               = 25
+	FshByteIndex          = 64
+	FshMaxByteIndex       = 72
+	FifoSegmentHeaderSize = 128
+)
+
+// Layout of fifo_segment_slice_t
+const (
+	SliceFreeChunks   = 0
+	SliceFreeFifos    = 88
+	SliceFlChunkBytes = 96
+	SliceVirtualMem   = 104
+	SliceNumChunks    = 112
+	SliceChunkLock    = 156
+	SliceSize         = 192
+)
+
+// NumChunkSizes is the number of chunk size classes of a slice, class i
+// holds chunks of 1 << (MinLog2ChunkSize + i) bytes
+const NumChunkSizes = 11
+
+// Layout of svm_fifo_chunk_t, the data of the chunk follows it
+const (
+	ChunkStartByte   = 0
+	ChunkLength      = 4
+	ChunkNext        = 8
+	ChunkHeaderSize  = 24
+	MinLog2ChunkSize = 12
+)
+
+// Layout of svm_fifo_shared_t, with the consumer and producer fields on
+// their own cache lines
+const (
+	SharedStartChunk         = 0
+	SharedEndChunk           = 8
+	SharedHasEvent           = 16
+	SharedMinAlloc           = 20
+	SharedFifoSize           = 24
+	SharedMasterSessionIndex = 28
+	SharedClientSessionIndex = 32
+	SharedSliceIndex         = 36
+	SharedNext               = 40
+	SharedHeadChunk          = 64
+	SharedHead               = 72
+	SharedWantDeqNtf         = 76
+	SharedHasDeqNtf          = 80
+	SharedTail               = 128
+	SharedTailChunk          = 136
+	FifoSharedSize           = 192
+)
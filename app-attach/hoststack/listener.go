@@ -0,0 +1,329 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hoststack
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/godirect/hoststack/app-attach/hoststack/session"
+)
+
+// listenBacklog is the number of accepted sessions a listener holds on to
+// until Accept returns them, VPP is told to drop further sessions
+const listenBacklog = 128
+
+// listener is a net.Listener over a listening session. VPP reports the
+// sessions it accepts with accepted events, the listener replies to them and
+// hands them to Accept.
+type listener struct {
+	worker    *Worker
+	session   *appSession
+	network   string
+	addr      net.Addr
+	backlog   chan io.Closer // net.Conns, *QUICSessions for quic listeners
+	mu        sync.Mutex     // serializes additions to the backlog with Close
+	closed    chan struct{}
+	closeOnce sync.Once
+	tls       *TLSSessionConfig // the config of the sessions of a tls or quic listener
+}
+
+// Listen listens on address over a session of the first worker of the
+// attachment, see Worker.Listen
+func (a *Attachment) Listen(ctx context.Context, network, address string) (net.Listener, error) {
+	workers := a.Workers()
+	if len(workers) == 0 {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: ErrDetached}
+	}
+	return workers[0].Listen(ctx, network, address)
+}
+
+// Listen asks VPP to listen on address for the worker. The network must be
+// "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6" or "tls", an address without
+// a host listens on all addresses. The returned listener can be handed to
+// http.Server.Serve. UDP listeners accept a connected session per peer,
+// ListenPacket shares a session among all peers instead. TLS listeners use
+// the defaults of ListenTLS.
+func (w *Worker) Listen(ctx context.Context, network, address string) (net.Listener, error) {
+	if network == "tls" {
+		return w.ListenTLS(ctx, address, nil)
+	}
+	proto, ok := transportProto(network)
+	if !ok || proto == session.TransportProtoQUIC {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+	var flags uint8
+	if proto == session.TransportProtoUDP {
+		flags = session.TransportCfgFlagConnected
+	}
+	l, _, err := w.listen(ctx, network, address, flags, nil)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// listen sends a listen request for address, with the ext config cfg if not
+// nil, and waits for VPP to bind the listener
+func (w *Worker) listen(ctx context.Context, network, address string, flags uint8, cfg *session.ExtConfig) (*listener, *session.BoundMsg, error) {
+	proto, _ := transportProto(network)
+	ip, port, err := resolveAddr(ctx, network, address, true)
+	if err != nil {
+		return nil, nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+	l := &listener{
+		worker:  w,
+		network: network,
+		backlog: make(chan io.Closer, listenBacklog),
+		closed:  make(chan struct{}),
+	}
+	addr, isIP4 := session.NewIP46Address(ip)
+	msg := session.ListenMsg{
+		ClientIndex: w.apiClientHandle,
+		WrkIndex:    w.index,
+		Port:        session.Htons(uint16(port)),
+		Proto:       proto,
+		IP:          addr,
+		Flags:       flags,
+	}
+	if isIP4 {
+		msg.IsIP4 = 1
+	}
+	if cfg != nil {
+		offset, err := w.attachment.addExtConfig(cfg)
+		if err != nil {
+			return nil, nil, &net.OpError{Op: "listen", Net: network, Addr: sockAddr(network, ip, port), Err: err}
+		}
+		msg.CkpairIndex, msg.CryptoEngine, msg.ExtConfig = cfg.CkpairIndex, cfg.CryptoEngine, offset
+		l.tls = sessionConfig(cfg)
+	}
+	reply, err := l.bind(ctx, &msg)
+	if err != nil {
+		return nil, nil, &net.OpError{Op: "listen", Net: network, Addr: sockAddr(network, ip, port), Err: err}
+	}
+	return l, reply, nil
+}
+
+// bind sends the listen request and waits for the reply of VPP
+func (l *listener) bind(ctx context.Context, msg *session.ListenMsg) (*session.BoundMsg, error) {
+	w := l.worker
+	s, event, err := w.request(ctx, l, EventListen, msg.ExtConfig, func(s *appSession) interface{} {
+		msg.Context = s.index
+		return msg
+	})
+	if err != nil {
+		return nil, err
+	}
+	var reply session.BoundMsg
+	if err := session.Unmarshal(event.Data, &reply); err != nil {
+		return nil, err
+	}
+	if reply.Retval != 0 {
+		w.sessions.remove(s)
+		return nil, errors.Wrap(SessionError(reply.Retval), "listen rejected by vpp")
+	}
+	if err := ctx.Err(); err != nil {
+		_ = s.close()
+		return nil, err
+	}
+	l.session = s
+	l.addr = sockAddr(l.network, reply.LclIP.IP(reply.LclIsIP4 != 0), int(session.Ntohs(reply.LclPort)))
+	return &reply, nil
+}
+
+// Accept waits for a session VPP accepted on the listener
+func (l *listener) Accept() (net.Conn, error) {
+	c, err := l.accept(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return c.(net.Conn), nil
+}
+
+// accept waits until ctx ends for a session VPP accepted on the listener
+func (l *listener) accept(ctx context.Context) (io.Closer, error) {
+	select {
+	case c := <-l.backlog:
+		return c, nil
+	case <-l.closed:
+		return nil, l.opError("accept", errConnClosed)
+	case <-l.session.closing:
+		return nil, l.opError("accept", ErrWorkerClosed)
+	case <-ctx.Done():
+		return nil, l.opError("accept", ctx.Err())
+	}
+}
+
+// Close asks VPP to stop listening and closes the accepted sessions Accept
+// did not return yet
+func (l *listener) Close() error {
+	if err := l.close(); err != nil {
+		return l.opError("close", err)
+	}
+	return nil
+}
+
+func (l *listener) close() error {
+	err := errConnClosed
+	l.closeOnce.Do(func() {
+		l.mu.Lock()
+		close(l.closed)
+		l.mu.Unlock()
+		if err = l.session.close(); err == nil {
+			err = l.waitUnlisten()
+		}
+		if errors.Is(err, ErrWorkerClosed) {
+			err = nil
+		}
+		for {
+			select {
+			case c := <-l.backlog:
+				_ = c.Close()
+				continue
+			default:
+			}
+			break
+		}
+	})
+	return err
+}
+
+// waitUnlisten waits for VPP to reply to the unlisten request
+func (l *listener) waitUnlisten() error {
+	timer := time.NewTimer(replyTimeout)
+	defer timer.Stop()
+	var event *Event
+	select {
+	case event = <-l.session.reply:
+	case <-l.session.closing:
+		select {
+		case event = <-l.session.reply:
+		default:
+			return nil
+		}
+	case <-timer.C:
+		return errors.Wrap(context.DeadlineExceeded, "no unlisten reply from vpp")
+	}
+	var reply session.UnlistenReplyMsg
+	if err := session.Unmarshal(event.Data, &reply); err != nil {
+		return err
+	}
+	if reply.Retval != 0 {
+		return errors.Wrap(SessionError(reply.Retval), "unlisten rejected by vpp")
+	}
+	return nil
+}
+
+// Addr returns the address VPP listens on
+func (l *listener) Addr() net.Addr {
+	return l.addr
+}
+
+// accepted takes over a session VPP accepted on the listener. It replies to
+// VPP before handing the session to Accept, sessions the listener cannot
+// take are rejected. It runs off the dispatcher, the reply waits for room in
+// the queue of VPP.
+func (l *listener) accepted(s *appSession, msg *session.AcceptedMsg) {
+	if !l.worker.acceptSession(s, msg) {
+		return
+	}
+	var c io.Closer
+	laddr, raddr := endpointAddr(l.network, &msg.Lcl), endpointAddr(l.network, &msg.Rmt)
+	switch {
+	case strings.HasPrefix(l.network, "udp"):
+		c = newPacketConn(s, nil, l.network, laddr, raddr)
+	case l.network == "quic":
+		q := newQUICSession(l.worker, s, laddr, raddr, l.tls)
+		// the streams the peer opens next are accepted on the connection
+		s.setQUIC(q)
+		c = q
+	case l.tls != nil:
+		c = &TLSConn{conn: newConn(s, l.network, laddr, raddr), config: *l.tls}
+	default:
+		c = newConn(s, l.network, laddr, raddr)
+	}
+	if !l.enqueue(c) {
+		log.Warnf("listener %v drops session %#x, Accept is not keeping up", l.addr, msg.Handle)
+		_ = c.Close()
+		return
+	}
+	l.session.pollNotify(PollIn)
+}
+
+// acceptedSession adds a session VPP accepted to the sessions of the worker
+func (w *Worker) acceptedSession(msg *session.AcceptedMsg) *appSession {
+	s := w.sessions.add(w, false, nil)
+	w.sessions.setHandle(s, msg.Handle)
+	return s
+}
+
+// acceptSession opens the fifos of a session VPP accepted and replies to
+// VPP. It reports false for a session the worker rejected.
+func (w *Worker) acceptSession(s *appSession, msg *session.AcceptedMsg) bool {
+	err := s.open(msg.SegmentHandle, msg.ServerRxFifo, msg.ServerTxFifo, msg.VppEventQueueAddress)
+	reply := session.AcceptedReplyMsg{Context: msg.Context, Handle: msg.Handle}
+	if err != nil {
+		log.Warnf("rejecting session %#x: %v", msg.Handle, err)
+		reply.Retval = int32(SessionErrAlloc)
+	}
+	data, marshalErr := session.Marshal(&reply)
+	if marshalErr != nil {
+		err = marshalErr
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), replyTimeout)
+		event := &Event{Type: EventAcceptedReply, Data: data}
+		if s.vppEvtQ != nil {
+			err = w.sendTo(ctx, s.vppEvtQ, event)
+		} else {
+			err = w.Send(ctx, event)
+		}
+		cancel()
+	}
+	if reply.Retval != 0 || err != nil {
+		w.sessions.remove(s)
+		s.end(func() { s.gone = true })
+		return false
+	}
+	return true
+}
+
+// enqueue adds c to the backlog, it fails once the listener is closed or
+// when the backlog is full
+func (l *listener) enqueue(c io.Closer) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if isClosedChan(l.closed) {
+		return false
+	}
+	select {
+	case l.backlog <- c:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *listener) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: l.network, Addr: l.addr, Err: err}
+}
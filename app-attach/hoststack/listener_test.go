@@ -0,0 +1,234 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hoststack
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/godirect/hoststack/app-attach/hoststack/hoststacktest"
+	"github.com/godirect/hoststack/app-attach/hoststack/session"
+)
+
+// listenSession attaches to a server serving sessions and listens on
+// address
+func listenSession(t *testing.T, network, address string) (*hoststacktest.Server, *Attachment, net.Listener) {
+	vpp := hoststacktest.NewServer(t, hoststacktest.WithSessionHandler(hoststacktest.Echo))
+	ns := dial(t, vpp)
+	attachment, err := NewAttachment(context.Background(), ns, ns.udsConn)
+	if err != nil {
+		t.Fatalf("Attach Error %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	l, err := attachment.Listen(ctx, network, address)
+	if err != nil {
+		t.Fatalf("Listen Error %v", err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	return vpp, attachment, l
+}
+
+// connect connects a peer of the server to the listener and accepts the
+// session
+func connect(t *testing.T, vpp *hoststacktest.Server, network string, l net.Listener) (*hoststacktest.Session, net.Conn) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	sessc := make(chan *hoststacktest.Session, 1)
+	go func() {
+		sess, err := vpp.Connect(ctx, network, l.Addr().String())
+		if err != nil {
+			t.Errorf("Connect Error %v", err)
+		}
+		sessc <- sess
+	}()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept Error %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	sess := <-sessc
+	if sess == nil {
+		t.FailNow()
+	}
+	return sess, conn
+}
+
+func TestListenAccept(t *testing.T) {
+	vpp, _, l := listenSession(t, "tcp", ":8080")
+	if addr := l.Addr().String(); addr != "0.0.0.0:8080" {
+		t.Errorf("Expected: 0.0.0.0:8080; Current: %s", addr)
+	}
+	sess, conn := connect(t, vpp, "tcp", l)
+	if conn.LocalAddr().(*net.TCPAddr).Port != 8080 {
+		t.Errorf("Expected: a local address on port 8080; Current: %v", conn.LocalAddr())
+	}
+	if conn.RemoteAddr().String() != sess.Addr().String() {
+		t.Errorf("Expected: %v; Current: %v", sess.Addr(), conn.RemoteAddr())
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := sess.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write Error %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("Expected: ping; Current: %q, %v", buf, err)
+	}
+	if _, err := conn.Write([]byte("pong")); err != nil {
+		t.Fatalf("Write Error %v", err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Errorf("Close Error %v", err)
+	}
+	if data, err := ioutil.ReadAll(sess); err != nil || string(data) != "pong" {
+		t.Errorf("Expected: pong; Current: %q, %v", data, err)
+	}
+}
+
+func TestAcceptReplyOffDispatcher(t *testing.T) {
+	vpp := hoststacktest.NewServer(t)
+	attachment := attach(t, vpp)
+	worker := attachment.Workers()[0]
+	appMq := vpp.AppQueue(attachment.AppIndex(), worker.Index())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// play VPP binding the listener
+	listenErr := make(chan error, 1)
+	go func() {
+		_, err := attachment.Listen(ctx, "tcp", ":8080")
+		listenErr <- err
+	}()
+	msg, err := vpp.CtrlQueue().Recv(ctx)
+	var listen session.ListenMsg
+	if err != nil || session.Unmarshal(msg.Data[2:], &listen) != nil {
+		t.Fatalf("Expected: a listen request; Current: %+v, %v", msg, err)
+	}
+	bound, _ := session.Marshal(&session.BoundMsg{Context: listen.Context, Handle: 0x100})
+	if err := appMq.TrySend(ctrlEventRing, (&Event{Type: EventBound, Data: bound}).marshal()); err != nil {
+		t.Fatalf("TrySend Error %v", err)
+	}
+	if err := <-listenErr; err != nil {
+		t.Fatalf("Listen Error %v", err)
+	}
+
+	// VPP accepts a session while its control queue is full
+	for vpp.CtrlQueue().TrySend(ctrlEventRing, nil) == nil {
+	}
+	accepted, _ := session.Marshal(&session.AcceptedMsg{ListenerHandle: 0x100, Handle: 0x200, SegmentHandle: 0xdead})
+	if err := appMq.TrySend(ctrlEventRing, (&Event{Type: EventAccepted, Data: accepted}).marshal()); err != nil {
+		t.Fatalf("TrySend Error %v", err)
+	}
+	if err := appMq.TrySend(ctrlEventRing, []byte{byte(EventConnected), 0}); err != nil {
+		t.Fatalf("TrySend Error %v", err)
+	}
+	recvCtx, recvCancel := context.WithTimeout(ctx, replyTimeout/2)
+	defer recvCancel()
+	if event, err := worker.Recv(recvCtx); err != nil || event.Type != EventConnected {
+		t.Errorf("Expected: the next event while the accept reply waits; Current: %+v, %v", event, err)
+	}
+	// the session is rejected once there is room
+	for {
+		if _, err := vpp.CtrlQueue().TryRecv(); err != nil {
+			break
+		}
+	}
+	msg, err = vpp.CtrlQueue().Recv(ctx)
+	var reply session.AcceptedReplyMsg
+	if err != nil || EventType(msg.Data[0]) != EventAcceptedReply || session.Unmarshal(msg.Data[2:], &reply) != nil || reply.Retval == 0 {
+		t.Errorf("Expected: an accept reply rejecting the session; Current: %+v, %v", msg, err)
+	}
+}
+
+func TestListenPortInUse(t *testing.T) {
+	_, attachment, _ := listenSession(t, "tcp", ":8080")
+	_, err := attachment.Listen(context.Background(), "tcp", ":8080")
+	if !errors.Is(err, SessionErrPortInUse) {
+		t.Errorf("Expected: errors.Is(err, SessionErrPortInUse); Current: %v", err)
+	}
+}
+
+func TestListenerClose(t *testing.T) {
+	vpp, attachment, l := listenSession(t, "tcp", ":0")
+	acceptErr := make(chan error, 1)
+	go func() {
+		_, err := l.Accept()
+		acceptErr <- err
+	}()
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close Error %v", err)
+	}
+	if err := <-acceptErr; err == nil {
+		t.Errorf("Expected: Accept to fail once the listener is closed")
+	}
+	if err := l.Close(); err == nil {
+		t.Errorf("Expected: an error closing twice")
+	}
+	if _, err := vpp.Connect(context.Background(), "tcp", l.Addr().String()); err == nil {
+		t.Errorf("Expected: no listener after Close")
+	}
+	// the port is free again
+	l, err := attachment.Listen(context.Background(), "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Listen Error %v", err)
+	}
+	_ = l.Close()
+}
+
+func TestListenHTTP(t *testing.T) {
+	vpp, _, l := listenSession(t, "tcp", "127.0.0.1:8080")
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "hello "+r.URL.Path)
+	})}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(l)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	sess, err := vpp.Connect(ctx, "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Connect Error %v", err)
+	}
+	if _, err := io.WriteString(sess, "GET /hoststack HTTP/1.0\r\nHost: vpp\r\n\r\n"); err != nil {
+		t.Fatalf("Write Error %v", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(sess), nil)
+	if err != nil {
+		t.Fatalf("Response Error %v", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil || string(body) != "hello /hoststack" {
+		t.Errorf("Expected: hello /hoststack; Current: %q, %v", body, err)
+	}
+
+	if err := srv.Close(); err != nil {
+		t.Errorf("Close Error %v", err)
+	}
+	if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+		t.Errorf("Expected: http.ErrServerClosed; Current: %v", err)
+	}
+}
@@ -14,11 +14,15 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+// Package memseg maps the memfd backed shared memory segments VPP hands to
+// an attached application.
+package memseg
 
 import (
+	"syscall"
+
 	"github.com/justincormack/go-memfd"
-	log "github.com/sirupsen/logrus"
+	"github.com/pkg/errors"
 )
 
 // MemorySegment struct
@@ -27,18 +31,37 @@ type MemorySegment struct {
 	mappedBytes []byte
 }
 
-// NewMemorySegment function
-func NewMemorySegment(fd int) *MemorySegment {
+// NewMemorySegment maps the memfd fd. It takes ownership of fd, which is
+// closed if the segment cannot be mapped.
+func NewMemorySegment(fd int) (*MemorySegment, error) {
 	mfdPtr, newMfdErr := memfd.New(uintptr(fd))
 	if newMfdErr != nil {
-		log.Fatalf("Error while creating memfd: %v", newMfdErr)
+		_ = syscall.Close(fd)
+		return nil, errors.Wrapf(newMfdErr, "error while creating memfd from fd %d", fd)
 	}
 	memSegment, memSegmentErr := mfdPtr.Map()
 	if memSegmentErr != nil {
-		log.Fatalf("Error while creating memfd: %v", memSegmentErr)
+		_ = mfdPtr.Close()
+		return nil, errors.Wrapf(memSegmentErr, "error while mapping memfd %d", fd)
 	}
 	return &MemorySegment{
 		memfd:       mfdPtr,
 		mappedBytes: memSegment,
+	}, nil
+}
+
+// Bytes returns the mapped segment
+func (m *MemorySegment) Bytes() []byte {
+	return m.mappedBytes
+}
+
+// Close unmaps the segment and closes its memfd
+func (m *MemorySegment) Close() error {
+	m.mappedBytes = nil
+	unmapErr := m.memfd.Unmap()
+	closeErr := m.memfd.Close()
+	if unmapErr != nil {
+		return errors.Wrap(unmapErr, "error while unmapping memfd")
 	}
+	return errors.Wrap(closeErr, "error while closing memfd")
 }
@@ -0,0 +1,224 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memseg
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+
+	"github.com/godirect/hoststack/app-attach/hoststack/internal/svm"
+)
+
+// ErrCorruptSegment is returned when the headers of a segment do not fit in
+// it or point outside of it
+var ErrCorruptSegment = errors.New("corrupt memory segment")
+
+// FifoSegmentHeaderSize is the size of VPP's fifo_segment_header_t, the
+// slices follow it
+const FifoSegmentHeaderSize = svm.FifoSegmentHeaderSize
+
+// SliceSize is the size of VPP's fifo_segment_slice_t
+const SliceSize = svm.SliceSize
+
+// NumChunkSizes is the number of chunk size classes of a slice, class i
+// holds chunks of 4096 << i bytes
+const NumChunkSizes = svm.NumChunkSizes
+
+// ChunkSize returns the size of the chunks of size class i
+func ChunkSize(i int) uint32 {
+	return 1 << uint(svm.MinLog2ChunkSize+i)
+}
+
+// SliceInfo is a view of a fifo segment slice, each worker thread of VPP
+// allocates fifos from its own slice
+type SliceInfo struct {
+	// FreeChunks counts the chunks on the free list of each size class
+	FreeChunks [NumChunkSizes]int
+	// NumChunks counts the chunks allocated for each size class
+	NumChunks [NumChunkSizes]uint32
+	// FreeFifos counts the fifo headers on the free list
+	FreeFifos int
+	// FreeChunkBytes is the size of all free chunks
+	FreeChunkBytes uint64
+	// VirtualMem is the memory the slice has handed out to fifos
+	VirtualMem uint64
+}
+
+// SegmentInfo is a view of the headers of a fifo segment
+type SegmentInfo struct {
+	// Size is the size of the segment as created by VPP
+	Size uint64
+	// BaseVa is the address VPP mapped the segment at
+	BaseVa uint64
+	// HeaderOffset is the offset of the fifo segment header within the
+	// segment, fifo and message queue offsets are relative to it
+	HeaderOffset uint64
+
+	CachedBytes     uint64
+	ActiveFifos     uint32
+	ReservedBytes   uint32
+	MaxLog2FifoSize uint32
+	Flags           uint8
+	HighWatermark   uint8
+	LowWatermark    uint8
+	PctFirstAlloc   uint8
+	NMqs            uint8
+
+	// AllocatedBytes is how far the segment allocator has carved out
+	// memory, relative to HeaderOffset
+	AllocatedBytes uint64
+	// MaxByteIndex is the end of the memory the allocator may hand out
+	MaxByteIndex uint64
+	Slices       []SliceInfo
+}
+
+// FreeBytes returns the memory left to the segment allocator plus the size of
+// the free chunks of all slices
+func (info *SegmentInfo) FreeBytes() uint64 {
+	free := info.MaxByteIndex - info.AllocatedBytes
+	for i := range info.Slices {
+		free += info.Slices[i].FreeChunkBytes
+	}
+	return free
+}
+
+// Info parses the headers of the segment
+func (m *MemorySegment) Info() (*SegmentInfo, error) {
+	return ParseSegment(m.mappedBytes)
+}
+
+// ParseSegment parses the headers of a fifo segment. Offsets read from the
+// segment are checked against its size, a corrupt segment returns an error
+// wrapping ErrCorruptSegment.
+func ParseSegment(b []byte) (*SegmentInfo, error) {
+	if len(b) < svm.SsvmHeaderSize {
+		return nil, corrupt("segment of %d bytes is smaller than its header", len(b))
+	}
+	le := binary.LittleEndian
+	info := &SegmentInfo{
+		Size:   le.Uint64(b[svm.SsvmSize:]),
+		BaseVa: le.Uint64(b[svm.SsvmVa:]),
+	}
+	if info.Size > uint64(len(b)) || info.Size < svm.SsvmHeaderSize {
+		return nil, corrupt("segment size %d does not match mapping of %d bytes", info.Size, len(b))
+	}
+	b = b[:info.Size]
+
+	// VPP keeps the offset of the fifo segment header in opaque[0], older
+	// releases keep its address
+	opaque := le.Uint64(b[svm.SsvmOpaque0:])
+	switch {
+	case opaque >= svm.SsvmHeaderSize && opaque < info.Size:
+		info.HeaderOffset = opaque
+	case opaque-info.BaseVa >= svm.SsvmHeaderSize && opaque-info.BaseVa < info.Size:
+		info.HeaderOffset = opaque - info.BaseVa
+	default:
+		return nil, corrupt("fifo segment header at %#x is outside of the segment", opaque)
+	}
+	if info.HeaderOffset+FifoSegmentHeaderSize > info.Size {
+		return nil, corrupt("fifo segment header at %#x does not fit in the segment", info.HeaderOffset)
+	}
+	fsh := b[info.HeaderOffset:]
+	info.CachedBytes = le.Uint64(fsh[svm.FshCachedBytes:])
+	info.ActiveFifos = le.Uint32(fsh[svm.FshActiveFifos:])
+	info.ReservedBytes = le.Uint32(fsh[svm.FshReservedBytes:])
+	info.MaxLog2FifoSize = le.Uint32(fsh[svm.FshMaxLog2FifoSize:])
+	info.Flags = fsh[svm.FshFlags]
+	info.HighWatermark = fsh[svm.FshHighWatermark]
+	info.LowWatermark = fsh[svm.FshLowWatermark]
+	info.PctFirstAlloc = fsh[svm.FshPctFirstAlloc]
+	info.NMqs = fsh[svm.FshNMqs]
+	info.AllocatedBytes = le.Uint64(fsh[svm.FshByteIndex:])
+	info.MaxByteIndex = le.Uint64(fsh[svm.FshMaxByteIndex:])
+
+	nSlices := int(fsh[svm.FshNSlices])
+	if nSlices == 0 {
+		return nil, corrupt("fifo segment has no slices")
+	}
+	slicesEnd := uint64(FifoSegmentHeaderSize + nSlices*SliceSize)
+	if slicesEnd > uint64(len(fsh)) {
+		return nil, corrupt("%d slices do not fit in the segment", nSlices)
+	}
+	if info.MaxByteIndex > uint64(len(fsh)) || info.AllocatedBytes < slicesEnd || info.AllocatedBytes > info.MaxByteIndex {
+		return nil, corrupt("allocated bytes %d out of [%d, %d]", info.AllocatedBytes, slicesEnd, info.MaxByteIndex)
+	}
+	info.Slices = make([]SliceInfo, nSlices)
+	for i := range info.Slices {
+		if err := parseSlice(fsh, fsh[FifoSegmentHeaderSize+i*SliceSize:], &info.Slices[i]); err != nil {
+			return nil, errors.WithMessagef(err, "slice %d", i)
+		}
+	}
+	return info, nil
+}
+
+// parseSlice fills in info from the slice header and walks its free lists,
+// fsh is the segment from the fifo segment header on
+func parseSlice(fsh, slice []byte, info *SliceInfo) error {
+	le := binary.LittleEndian
+	info.FreeChunkBytes = le.Uint64(slice[svm.SliceFlChunkBytes:])
+	info.VirtualMem = le.Uint64(slice[svm.SliceVirtualMem:])
+	var freeBytes uint64
+	for i := 0; i < NumChunkSizes; i++ {
+		info.NumChunks[i] = le.Uint32(slice[svm.SliceNumChunks+4*i:])
+		n, err := walkList(fsh, le.Uint64(slice[svm.SliceFreeChunks+8*i:]), svm.ChunkHeaderSize, svm.ChunkNext, func(chunk []byte) error {
+			if length := le.Uint32(chunk[svm.ChunkLength:]); length != ChunkSize(i) {
+				return corrupt("chunk of %d bytes on the free list of %d bytes chunks", length, ChunkSize(i))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		info.FreeChunks[i] = n
+		freeBytes += uint64(n) * uint64(ChunkSize(i))
+	}
+	if freeBytes != info.FreeChunkBytes {
+		return corrupt("free lists hold %d bytes, slice accounts for %d", freeBytes, info.FreeChunkBytes)
+	}
+	n, err := walkList(fsh, le.Uint64(slice[svm.SliceFreeFifos:]), svm.FifoSharedSize, svm.SharedNext, nil)
+	if err != nil {
+		return err
+	}
+	info.FreeFifos = n
+	return nil
+}
+
+// walkList follows a list of elements of size bytes linked by the offset
+// stored at nextOffset, calling fn on each element. The list ends at offset 0.
+func walkList(fsh []byte, head uint64, size, nextOffset int, fn func([]byte) error) (int, error) {
+	n := 0
+	for off := head; off != 0; off = binary.LittleEndian.Uint64(fsh[off+uint64(nextOffset):]) {
+		if off < FifoSegmentHeaderSize || off > uint64(len(fsh)-size) {
+			return 0, corrupt("list element at %#x is outside of the segment", off)
+		}
+		// each element takes size bytes, a longer list has a cycle
+		if n++; n > len(fsh)/size {
+			return 0, corrupt("list starting at %#x has a cycle", head)
+		}
+		if fn != nil {
+			if err := fn(fsh[off : off+uint64(size)]); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func corrupt(format string, args ...interface{}) error {
+	return errors.Wrapf(ErrCorruptSegment, format, args...)
+}
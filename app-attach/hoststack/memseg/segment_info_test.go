@@ -0,0 +1,148 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memseg
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/godirect/hoststack/app-attach/hoststack/internal/svm"
+)
+
+const (
+	testSegmentSize  = 64 << 10
+	testHeaderOffset = 8192
+)
+
+// testSegment lays out a segment the way VPP's fifo_segment_init does, with
+// one slice holding two free 4096 bytes chunks and a free fifo header
+func testSegment() []byte {
+	le := binary.LittleEndian
+	b := make([]byte, testSegmentSize)
+	le.PutUint64(b[svm.SsvmVa:], 0x7f0000000000)
+	le.PutUint64(b[svm.SsvmSize:], testSegmentSize)
+	le.PutUint64(b[svm.SsvmOpaque0:], testHeaderOffset)
+
+	fsh := b[testHeaderOffset:]
+	fsh[svm.FshNSlices] = 1
+	fsh[svm.FshHighWatermark] = 80
+	fsh[svm.FshLowWatermark] = 50
+	le.PutUint32(fsh[svm.FshMaxLog2FifoSize:], 14)
+	le.PutUint64(fsh[svm.FshMaxByteIndex:], testSegmentSize-testHeaderOffset)
+
+	chunk1 := uint64(FifoSegmentHeaderSize + SliceSize)
+	chunk2 := chunk1 + svm.ChunkHeaderSize + 4096
+	fifo := chunk2 + svm.ChunkHeaderSize + 4096
+	le.PutUint64(fsh[svm.FshByteIndex:], fifo+svm.FifoSharedSize)
+	le.PutUint32(fsh[chunk1+svm.ChunkLength:], 4096)
+	le.PutUint64(fsh[chunk1+svm.ChunkNext:], chunk2)
+	le.PutUint32(fsh[chunk2+svm.ChunkLength:], 4096)
+
+	slice := fsh[FifoSegmentHeaderSize:]
+	le.PutUint64(slice[svm.SliceFreeChunks:], chunk1)
+	le.PutUint64(slice[svm.SliceFreeFifos:], fifo)
+	le.PutUint64(slice[svm.SliceFlChunkBytes:], 2*4096)
+	le.PutUint64(slice[svm.SliceVirtualMem:], 2*4096)
+	le.PutUint32(slice[svm.SliceNumChunks:], 2)
+	return b
+}
+
+func TestParseSegment(t *testing.T) {
+	info, err := ParseSegment(testSegment())
+	if err != nil {
+		t.Fatalf("ParseSegment Error %v", err)
+	}
+	if info.Size != testSegmentSize || info.HeaderOffset != testHeaderOffset || info.HighWatermark != 80 || info.MaxLog2FifoSize != 14 {
+		t.Errorf("Unexpected segment info %+v", info)
+	}
+	if len(info.Slices) != 1 || info.Slices[0].FreeChunks[0] != 2 || info.Slices[0].NumChunks[0] != 2 || info.Slices[0].FreeFifos != 1 {
+		t.Errorf("Unexpected slice info %+v", info.Slices)
+	}
+	allocated := uint64(FifoSegmentHeaderSize + SliceSize + 2*(svm.ChunkHeaderSize+4096) + svm.FifoSharedSize)
+	if info.AllocatedBytes != allocated || info.FreeBytes() != testSegmentSize-testHeaderOffset-allocated+2*4096 {
+		t.Errorf("Unexpected allocated %d and free %d bytes", info.AllocatedBytes, info.FreeBytes())
+	}
+
+	// releases before 21.01 keep the address of the header
+	b := testSegment()
+	binary.LittleEndian.PutUint64(b[svm.SsvmOpaque0:], 0x7f0000000000+testHeaderOffset)
+	if info, err := ParseSegment(b); err != nil || info.HeaderOffset != testHeaderOffset {
+		t.Errorf("Expected: header at %d; Current: %+v, %v", testHeaderOffset, info, err)
+	}
+}
+
+func TestParseCorruptSegment(t *testing.T) {
+	le := binary.LittleEndian
+	fsh := func(b []byte) []byte { return b[testHeaderOffset:] }
+	slice := func(b []byte) []byte { return fsh(b)[FifoSegmentHeaderSize:] }
+	tests := []struct {
+		name    string
+		corrupt func(b []byte) []byte
+	}{
+		{name: "too small", corrupt: func(b []byte) []byte { return b[:64] }},
+		{name: "size larger than mapping", corrupt: func(b []byte) []byte { return b[:testSegmentSize/2] }},
+		{name: "header outside", corrupt: func(b []byte) []byte {
+			le.PutUint64(b[svm.SsvmOpaque0:], testSegmentSize)
+			return b
+		}},
+		{name: "header does not fit", corrupt: func(b []byte) []byte {
+			le.PutUint64(b[svm.SsvmOpaque0:], testSegmentSize-64)
+			return b
+		}},
+		{name: "no slices", corrupt: func(b []byte) []byte {
+			fsh(b)[svm.FshNSlices] = 0
+			return b
+		}},
+		{name: "too many slices", corrupt: func(b []byte) []byte {
+			fsh(b)[svm.FshNSlices] = 255
+			return b
+		}},
+		{name: "allocated past the end", corrupt: func(b []byte) []byte {
+			le.PutUint64(fsh(b)[svm.FshByteIndex:], testSegmentSize)
+			return b
+		}},
+		{name: "chunk outside", corrupt: func(b []byte) []byte {
+			le.PutUint64(slice(b)[svm.SliceFreeChunks:], testSegmentSize-testHeaderOffset-8)
+			return b
+		}},
+		{name: "chunk list cycle", corrupt: func(b []byte) []byte {
+			head := le.Uint64(slice(b)[svm.SliceFreeChunks:])
+			le.PutUint64(fsh(b)[head+svm.ChunkNext:], head)
+			return b
+		}},
+		{name: "chunk of the wrong size", corrupt: func(b []byte) []byte {
+			head := le.Uint64(slice(b)[svm.SliceFreeChunks:])
+			le.PutUint32(fsh(b)[head+svm.ChunkLength:], 8192)
+			return b
+		}},
+		{name: "free bytes mismatch", corrupt: func(b []byte) []byte {
+			le.PutUint64(slice(b)[svm.SliceFlChunkBytes:], 4096)
+			return b
+		}},
+		{name: "fifo outside", corrupt: func(b []byte) []byte {
+			le.PutUint64(slice(b)[svm.SliceFreeFifos:], 8)
+			return b
+		}},
+	}
+	for _, tt := range tests {
+		if _, err := ParseSegment(tt.corrupt(testSegment())); !errors.Is(err, ErrCorruptSegment) {
+			t.Errorf("%s: Expected: errors.Is(err, ErrCorruptSegment); Current: %v", tt.name, err)
+		}
+	}
+}
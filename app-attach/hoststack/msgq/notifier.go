@@ -0,0 +1,122 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package msgq
+
+import (
+	"context"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrClosed is returned by Notifier.Wait and Queue.Wait once the notifier or
+// the queue is closed
+var ErrClosed = errors.New("message queue notifier closed")
+
+// Notifier waits for the eventfd of a queue in the runtime network poller:
+// the goroutine waiting parks until the other end signals the queue, without
+// holding an OS thread or waking up to poll.
+type Notifier struct {
+	file      *os.File
+	conn      syscall.RawConn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewNotifier registers a duplicate of eventFd with the runtime network
+// poller, eventFd stays owned by the caller
+func NewNotifier(eventFd int) (*Notifier, error) {
+	dup, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(eventFd), syscall.F_DUPFD_CLOEXEC, 0)
+	if errno != 0 {
+		return nil, errors.Wrap(errno, "error while duplicating message queue eventfd")
+	}
+	fd := int(dup)
+	// the runtime poller only takes over non blocking fds
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		_ = syscall.Close(fd)
+		return nil, errors.Wrap(err, "error while setting message queue eventfd non blocking")
+	}
+	file := os.NewFile(uintptr(fd), "msgq-eventfd")
+	conn, err := file.SyscallConn()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return &Notifier{file: file, conn: conn, closed: make(chan struct{})}, nil
+}
+
+// Wait parks until the queue is signalled and resets the eventfd. It
+// returns the error of ctx once ctx ends and ErrClosed once the notifier is
+// closed. The signals sent while nobody waits add up to one.
+func (n *Notifier) Wait(ctx context.Context) error {
+	if done := ctx.Done(); done != nil {
+		// wake the parked read by expiring its deadline
+		stop, stopped := make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(stopped)
+			select {
+			case <-done:
+				_ = n.file.SetReadDeadline(time.Unix(1, 0))
+			case <-stop:
+			}
+		}()
+		defer func() {
+			close(stop)
+			<-stopped
+			_ = n.file.SetReadDeadline(time.Time{})
+		}()
+	}
+	var buf [8]byte
+	var readErr error
+	err := n.conn.Read(func(fd uintptr) bool {
+		_, readErr = syscall.Read(int(fd), buf[:])
+		return readErr != syscall.EAGAIN
+	})
+	switch {
+	case isClosed(n.closed):
+		return ErrClosed
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case err != nil:
+		return errors.Wrap(err, "error while waiting for message queue eventfd")
+	case readErr != nil:
+		return errors.Wrap(readErr, "error while reading message queue eventfd")
+	}
+	return nil
+}
+
+// Close unregisters the eventfd and wakes Wait
+func (n *Notifier) Close() error {
+	err := ErrClosed
+	n.closeOnce.Do(func() {
+		close(n.closed)
+		err = n.file.Close()
+	})
+	return err
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
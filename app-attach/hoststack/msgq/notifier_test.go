@@ -0,0 +1,83 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package msgq
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestNotifier(t *testing.T) {
+	eventFd, err := NewEventFd()
+	if err != nil {
+		t.Fatalf("NewEventFd Error %v", err)
+	}
+	defer func() { _ = syscall.Close(eventFd) }()
+	q, _ := newTestQueue(t, eventFd)
+	n, err := NewNotifier(eventFd)
+	if err != nil {
+		t.Fatalf("NewNotifier Error %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// a message sent to the empty queue wakes the waiter
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		_ = q.TrySend(0, []byte{1})
+	}()
+	if err := n.Wait(ctx); err != nil {
+		t.Errorf("Wait Error %v", err)
+	}
+	// signals sent while nobody waits are not lost
+	if _, err := q.TryRecv(); err != nil {
+		t.Fatalf("TryRecv Error %v", err)
+	}
+	_ = q.TrySend(0, []byte{2})
+	if err := n.Wait(ctx); err != nil {
+		t.Errorf("Wait Error %v", err)
+	}
+
+	timeoutCtx, timeoutCancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer timeoutCancel()
+	if err := n.Wait(timeoutCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected: errors.Is(err, context.DeadlineExceeded); Current: %v", err)
+	}
+
+	waitErr := make(chan error, 1)
+	go func() {
+		waitErr <- n.Wait(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := n.Close(); err != nil {
+		t.Errorf("Close Error %v", err)
+	}
+	if err := <-waitErr; !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected: errors.Is(err, ErrClosed); Current: %v", err)
+	}
+	if err := n.Close(); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected: errors.Is(err, ErrClosed); Current: %v", err)
+	}
+	// the eventfd of the queue is left open
+	if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(eventFd), syscall.F_GETFD, 0); errno != 0 {
+		t.Errorf("Expected: the eventfd to stay open; Current: %v", errno)
+	}
+}
@@ -0,0 +1,449 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package msgq implements VPP's svm_msg_q, the shared memory message queue
+// VPP and applications exchange session events over. A queue is a ring of
+// message handles, each pointing at an element of one of the data rings
+// that follow it:
+//
+//	svm_msg_q_shared_t        n_rings, pad
+//	svm_msg_q_shared_queue_t  mutex, condvar, head, tail, cursize, maxsize,
+//	                          elsize, pad, maxsize handles of elsize bytes
+//	svm_msg_q_ring_shared_t   cursize, nitems, head, tail, elsize,
+//	                          nitems elements of elsize bytes, per ring
+//
+// A queue has a single consumer, which dequeues without locking. Producers
+// of a queue signalling over an eventfd serialize on a process local lock,
+// like VPP does. Producers of other queues lock the robust pthread mutex of
+// the queue, which a Go process cannot hold safely: the kernel only releases
+// it for a dead owner that registered a robust list. Sending on them fails
+// with ErrNoEventFd.
+package msgq
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrEmpty is returned when receiving from an empty queue without
+	// waiting
+	ErrEmpty = errors.New("message queue is empty")
+	// ErrFull is returned when the queue or the ring a message is sent on
+	// has no room left
+	ErrFull = errors.New("message queue is full")
+	// ErrTooBig is returned when a message does not fit in an element of the
+	// ring it is sent on
+	ErrTooBig = errors.New("message does not fit in ring element")
+	// ErrCorrupt is returned when the shared queue state is inconsistent or
+	// points outside of the queue
+	ErrCorrupt = errors.New("corrupt message queue")
+	// ErrNoEventFd is returned when sending on a queue that does not signal
+	// over an eventfd
+	ErrNoEventFd = errors.New("message queue has no eventfd")
+)
+
+// Layout of svm_msg_q_shared_t, svm_msg_q_shared_queue_t and
+// svm_msg_q_ring_shared_t
+const (
+	headerSize = 8
+	nRings     = 0
+
+	queueHeaderSize = 112
+	queueMutex      = 0
+	queueHead       = 88
+	queueTail       = 92
+	queueCursize    = 96
+	queueMaxsize    = 100
+	queueElsize     = 104
+	handleSize      = 8
+
+	ringHeaderSize = 20
+	ringCursize    = 0
+	ringNitems     = 4
+	ringHead       = 8
+	ringTail       = 12
+	ringElsize     = 16
+
+	maxRings = 64
+)
+
+// pollInterval is how long a waiting call sleeps before checking the queue
+// and its context again, when nothing signals it
+const pollInterval = time.Millisecond
+
+// RingConfig configures a data ring of a queue
+type RingConfig struct {
+	NItems   uint32
+	ElemSize uint32
+}
+
+// Config configures a queue, as VPP's svm_msg_q_cfg_t
+type Config struct {
+	// QueueItems is the number of messages the queue holds
+	QueueItems uint32
+	Rings      []RingConfig
+}
+
+// Size returns the number of bytes a queue of cfg takes in shared memory
+func Size(cfg Config) int {
+	size := headerSize + queueHeaderSize + int(cfg.QueueItems)*handleSize
+	for _, ring := range cfg.Rings {
+		size += ringHeaderSize + int(ring.NItems)*int(ring.ElemSize)
+	}
+	return size
+}
+
+// Init lays out an empty queue of cfg at the start of b, as VPP's
+// svm_msg_q_init
+func Init(b []byte, cfg Config) error {
+	if len(cfg.Rings) == 0 || len(cfg.Rings) > maxRings || cfg.QueueItems == 0 {
+		return errors.Errorf("invalid message queue config %+v", cfg)
+	}
+	if size := Size(cfg); len(b) < size {
+		return errors.Errorf("message queue of %d bytes does not fit in %d bytes", size, len(b))
+	}
+	le := binary.LittleEndian
+	b = b[:Size(cfg)]
+	for i := range b {
+		b[i] = 0
+	}
+	le.PutUint32(b[nRings:], uint32(len(cfg.Rings)))
+	q := b[headerSize:]
+	initSharedMutex(q[queueMutex:])
+	le.PutUint32(q[queueMaxsize:], cfg.QueueItems)
+	le.PutUint32(q[queueElsize:], handleSize)
+	ring := q[queueHeaderSize+int(cfg.QueueItems)*handleSize:]
+	for _, rc := range cfg.Rings {
+		if rc.NItems == 0 || rc.ElemSize == 0 {
+			return errors.Errorf("invalid message queue ring config %+v", rc)
+		}
+		le.PutUint32(ring[ringNitems:], rc.NItems)
+		le.PutUint32(ring[ringElsize:], rc.ElemSize)
+		ring = ring[ringHeaderSize+int(rc.NItems)*int(rc.ElemSize):]
+	}
+	return nil
+}
+
+// ring is a data ring of a queue
+type ring struct {
+	hdr    []byte
+	data   []byte
+	nitems uint32
+	elsize uint32
+}
+
+// Queue is a message queue mapped from shared memory
+type Queue struct {
+	q       []byte
+	handles []byte
+	maxsize uint32
+	rings   []ring
+	eventFd int
+	localMu sync.Mutex
+	recvMu  sync.Mutex
+
+	notifierMu sync.Mutex
+	notifier   *Notifier // parks Wait on eventFd, set up on the first Wait
+	closed     bool
+}
+
+// Message is a message received from a queue
+type Message struct {
+	// Ring is the index of the ring the message was sent on
+	Ring int
+	// Data is a copy of the ring element holding the message
+	Data []byte
+}
+
+// Open maps the queue at the start of b. The queue signals over eventFd when
+// it is not negative, eventFd stays owned by the caller. The sizes of the queue and its rings are checked
+// against len(b) once, they are read from shared memory only here.
+func Open(b []byte, eventFd int) (*Queue, error) {
+	le := binary.LittleEndian
+	if len(b) < headerSize+queueHeaderSize {
+		return nil, corrupt("queue header does not fit in %d bytes", len(b))
+	}
+	n := le.Uint32(b[nRings:])
+	if n == 0 || n > maxRings {
+		return nil, corrupt("queue has %d rings", n)
+	}
+	q := b[headerSize:]
+	maxsize := le.Uint32(q[queueMaxsize:])
+	if elsize := le.Uint32(q[queueElsize:]); elsize != handleSize || maxsize == 0 {
+		return nil, corrupt("queue of %d elements of %d bytes", maxsize, elsize)
+	}
+	end := uint64(queueHeaderSize) + uint64(maxsize)*handleSize
+	if end > uint64(len(q)) {
+		return nil, corrupt("queue of %d elements does not fit in %d bytes", maxsize, len(b))
+	}
+	queue := &Queue{
+		q:       q[:queueHeaderSize],
+		handles: q[queueHeaderSize:end],
+		maxsize: maxsize,
+		eventFd: eventFd,
+	}
+	for i := uint32(0); i < n; i++ {
+		if end+ringHeaderSize > uint64(len(q)) {
+			return nil, corrupt("ring %d header does not fit in %d bytes", i, len(b))
+		}
+		hdr := q[end : end+ringHeaderSize]
+		r := ring{hdr: hdr, nitems: le.Uint32(hdr[ringNitems:]), elsize: le.Uint32(hdr[ringElsize:])}
+		dataEnd := end + ringHeaderSize + uint64(r.nitems)*uint64(r.elsize)
+		if r.nitems == 0 || r.elsize == 0 || dataEnd > uint64(len(q)) {
+			return nil, corrupt("ring %d of %d elements of %d bytes does not fit in %d bytes", i, r.nitems, r.elsize, len(b))
+		}
+		r.data = q[end+ringHeaderSize : dataEnd]
+		queue.rings = append(queue.rings, r)
+		end = dataEnd
+	}
+	return queue, nil
+}
+
+// EventFd returns the eventfd the queue signals over, or -1
+func (q *Queue) EventFd() int {
+	return q.eventFd
+}
+
+// Cap returns the number of messages the queue holds
+func (q *Queue) Cap() int {
+	return int(q.maxsize)
+}
+
+// Len returns the number of messages in the queue
+func (q *Queue) Len() int {
+	return int(atomic.LoadUint32(q.field(queueCursize)))
+}
+
+// NumRings returns the number of data rings of the queue
+func (q *Queue) NumRings() int {
+	return len(q.rings)
+}
+
+// RingElemSize returns the size of the elements of ring i
+func (q *Queue) RingElemSize(i int) int {
+	return int(q.rings[i].elsize)
+}
+
+// Send enqueues data on ring i, waiting for room until ctx ends
+func (q *Queue) Send(ctx context.Context, i int, data []byte) error {
+	for {
+		err := q.TrySend(i, data)
+		if !errors.Is(err, ErrFull) {
+			return err
+		}
+		if waitErr := q.WaitRoom(ctx); waitErr != nil {
+			return waitErr
+		}
+	}
+}
+
+// TrySend enqueues data on ring i, or returns ErrFull when the queue or the
+// ring has no room left. It returns ErrNoEventFd for a queue without an
+// eventfd.
+func (q *Queue) TrySend(i int, data []byte) error {
+	if q.eventFd < 0 {
+		return ErrNoEventFd
+	}
+	if i < 0 || i >= len(q.rings) {
+		return errors.Errorf("queue has no ring %d", i)
+	}
+	r := &q.rings[i]
+	if len(data) > int(r.elsize) {
+		return errors.Wrapf(ErrTooBig, "%d bytes in ring %d of %d bytes elements", len(data), i, r.elsize)
+	}
+	q.localMu.Lock()
+	defer q.localMu.Unlock()
+	cursize := atomic.LoadUint32(q.field(queueCursize))
+	if cursize >= q.maxsize || atomic.LoadUint32(r.field(ringCursize)) >= r.nitems {
+		return ErrFull
+	}
+	// svm_msg_q_alloc_msg_w_ring
+	elt := atomic.LoadUint32(r.field(ringTail))
+	if elt >= r.nitems {
+		return corrupt("ring %d tail %d out of %d elements", i, elt, r.nitems)
+	}
+	atomic.StoreUint32(r.field(ringTail), (elt+1)%r.nitems)
+	elem := r.data[elt*r.elsize : (elt+1)*r.elsize]
+	copy(elem, data)
+	for j := len(data); j < len(elem); j++ {
+		elem[j] = 0
+	}
+	atomic.AddUint32(r.field(ringCursize), 1)
+
+	// svm_msg_q_add_raw
+	tail := atomic.LoadUint32(q.field(queueTail))
+	if tail >= q.maxsize {
+		return corrupt("queue tail %d out of %d elements", tail, q.maxsize)
+	}
+	handle := q.handles[tail*handleSize:]
+	binary.LittleEndian.PutUint32(handle[0:], uint32(i))
+	binary.LittleEndian.PutUint32(handle[4:], elt)
+	atomic.StoreUint32(q.field(queueTail), (tail+1)%q.maxsize)
+	if atomic.AddUint32(q.field(queueCursize), 1) == 1 {
+		q.signal()
+	}
+	return nil
+}
+
+// Recv dequeues a message, waiting for one until ctx ends
+func (q *Queue) Recv(ctx context.Context) (*Message, error) {
+	for {
+		msg, err := q.TryRecv()
+		if !errors.Is(err, ErrEmpty) {
+			return msg, err
+		}
+		if waitErr := q.Wait(ctx); waitErr != nil {
+			return nil, waitErr
+		}
+	}
+}
+
+// TryRecv dequeues a message, or returns ErrEmpty when there is none. A
+// message that does not check out is left in the queue.
+func (q *Queue) TryRecv() (*Message, error) {
+	q.recvMu.Lock()
+	defer q.recvMu.Unlock()
+	if atomic.LoadUint32(q.field(queueCursize)) == 0 {
+		return nil, ErrEmpty
+	}
+	head := atomic.LoadUint32(q.field(queueHead))
+	if head >= q.maxsize {
+		return nil, corrupt("queue head %d out of %d elements", head, q.maxsize)
+	}
+	handle := q.handles[head*handleSize:]
+	i := binary.LittleEndian.Uint32(handle[0:])
+	elt := binary.LittleEndian.Uint32(handle[4:])
+	if i >= uint32(len(q.rings)) || elt >= q.rings[i].nitems {
+		return nil, corrupt("message in ring %d element %d", i, elt)
+	}
+	r := &q.rings[i]
+	if ringHead := atomic.LoadUint32(r.field(ringHead)); ringHead != elt {
+		return nil, corrupt("message in ring %d element %d out of order, head is %d", i, elt, ringHead)
+	}
+	msg := &Message{Ring: int(i), Data: make([]byte, r.elsize)}
+	copy(msg.Data, r.data[elt*r.elsize:(elt+1)*r.elsize])
+
+	// svm_msg_q_sub_raw
+	atomic.StoreUint32(q.field(queueHead), (head+1)%q.maxsize)
+	if atomic.AddUint32(q.field(queueCursize), ^uint32(0))+1 == q.maxsize {
+		q.signal()
+	}
+	// svm_msg_q_free_msg
+	atomic.StoreUint32(r.field(ringHead), (elt+1)%r.nitems)
+	if atomic.AddUint32(r.field(ringCursize), ^uint32(0))+1 == r.nitems {
+		q.signal()
+	}
+	return msg, nil
+}
+
+// signal wakes the other end of the queue. Without an eventfd VPP polls its
+// queues, waiters on the condvar of the queue are not woken.
+func (q *Queue) signal() {
+	if fd := q.eventFd; fd >= 0 {
+		var one [8]byte
+		binary.LittleEndian.PutUint64(one[:], 1)
+		_, _ = syscall.Write(fd, one[:])
+	}
+}
+
+// WaitRoom sleeps for a poll interval before a producer retries a full
+// queue, it returns the error of ctx once ctx ends. The eventfd of a queue
+// wakes its consumer, producers poll.
+func (q *Queue) WaitRoom(ctx context.Context) error {
+	timer := time.NewTimer(pollInterval)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Wait parks in the runtime poller until the queue is signalled over its
+// eventfd, or sleeps for a poll interval when the queue has none. It returns
+// the error of ctx once ctx ends and ErrClosed once the queue is closed.
+func (q *Queue) Wait(ctx context.Context) error {
+	if q.eventFd < 0 {
+		if q.isClosed() {
+			return ErrClosed
+		}
+		return q.WaitRoom(ctx)
+	}
+	n, err := q.waitNotifier()
+	if err != nil {
+		return err
+	}
+	return n.Wait(ctx)
+}
+
+// waitNotifier returns the notifier Wait parks on, registering it first
+func (q *Queue) waitNotifier() (*Notifier, error) {
+	q.notifierMu.Lock()
+	defer q.notifierMu.Unlock()
+	if q.closed {
+		return nil, ErrClosed
+	}
+	if q.notifier == nil {
+		n, err := NewNotifier(q.eventFd)
+		if err != nil {
+			return nil, err
+		}
+		q.notifier = n
+	}
+	return q.notifier, nil
+}
+
+func (q *Queue) isClosed() bool {
+	q.notifierMu.Lock()
+	defer q.notifierMu.Unlock()
+	return q.closed
+}
+
+// Close wakes Wait and unregisters the eventfd of the queue from the runtime
+// poller, the shared memory and the eventfd stay with the caller
+func (q *Queue) Close() error {
+	q.notifierMu.Lock()
+	defer q.notifierMu.Unlock()
+	if q.closed {
+		return ErrClosed
+	}
+	q.closed = true
+	if q.notifier != nil {
+		return q.notifier.Close()
+	}
+	return nil
+}
+
+func (q *Queue) field(off int) *uint32 {
+	return (*uint32)(unsafe.Pointer(&q.q[off]))
+}
+
+func (r *ring) field(off int) *uint32 {
+	return (*uint32)(unsafe.Pointer(&r.hdr[off]))
+}
+
+func corrupt(format string, args ...interface{}) error {
+	return errors.Wrapf(ErrCorrupt, format, args...)
+}
@@ -0,0 +1,247 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package msgq
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var testConfig = Config{
+	QueueItems: 8,
+	Rings:      []RingConfig{{NItems: 8, ElemSize: 18}, {NItems: 2, ElemSize: 256}},
+}
+
+// newEventFd returns an eventfd closed at the end of the test
+func newEventFd(t *testing.T) int {
+	fd, err := NewEventFd()
+	if err != nil {
+		t.Fatalf("NewEventFd Error %v", err)
+	}
+	t.Cleanup(func() { _ = syscall.Close(fd) })
+	return fd
+}
+
+func newTestQueue(t *testing.T, eventFd int) (*Queue, []byte) {
+	b := make([]byte, Size(testConfig))
+	if err := Init(b, testConfig); err != nil {
+		t.Fatalf("Init Error %v", err)
+	}
+	q, err := Open(b, eventFd)
+	if err != nil {
+		t.Fatalf("Open Error %v", err)
+	}
+	return q, b
+}
+
+func TestSendRecv(t *testing.T) {
+	q, _ := newTestQueue(t, newEventFd(t))
+	if q.Cap() != 8 || q.NumRings() != 2 || q.RingElemSize(1) != 256 {
+		t.Errorf("Unexpected queue of %d messages with %d rings", q.Cap(), q.NumRings())
+	}
+	if _, err := q.TryRecv(); !errors.Is(err, ErrEmpty) {
+		t.Errorf("Expected: errors.Is(err, ErrEmpty); Current: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		for ring := 0; ring < 2; ring++ {
+			if err := q.TrySend(ring, []byte{byte(i), byte(ring)}); err != nil {
+				t.Fatalf("TrySend Error %v", err)
+			}
+			msg, err := q.TryRecv()
+			if err != nil || msg.Ring != ring || len(msg.Data) != q.RingElemSize(ring) || !bytes.Equal(msg.Data[:3], []byte{byte(i), byte(ring), 0}) {
+				t.Errorf("Unexpected message %+v, %v", msg, err)
+			}
+		}
+	}
+	if q.Len() != 0 {
+		t.Errorf("Expected: empty queue; Current: %d messages", q.Len())
+	}
+}
+
+func TestSendFull(t *testing.T) {
+	q, _ := newTestQueue(t, newEventFd(t))
+	if err := q.TrySend(0, make([]byte, 19)); !errors.Is(err, ErrTooBig) {
+		t.Errorf("Expected: errors.Is(err, ErrTooBig); Current: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := q.TrySend(1, nil); err != nil {
+			t.Fatalf("TrySend Error %v", err)
+		}
+	}
+	if err := q.TrySend(1, nil); !errors.Is(err, ErrFull) {
+		t.Errorf("Expected a full ring; Current: %v", err)
+	}
+	for i := 0; i < 6; i++ {
+		if err := q.TrySend(0, nil); err != nil {
+			t.Fatalf("TrySend Error %v", err)
+		}
+	}
+	if err := q.TrySend(0, nil); !errors.Is(err, ErrFull) {
+		t.Errorf("Expected a full queue; Current: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := q.Send(ctx, 0, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected: errors.Is(err, context.DeadlineExceeded); Current: %v", err)
+	}
+}
+
+func TestProducers(t *testing.T) {
+	q, _ := newTestQueue(t, newEventFd(t))
+	const producers, count = 4, 200
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < count; i++ {
+				data := make([]byte, 8)
+				binary.LittleEndian.PutUint32(data, uint32(p))
+				binary.LittleEndian.PutUint32(data[4:], uint32(i))
+				if err := q.Send(context.Background(), 0, data); err != nil {
+					t.Errorf("Send Error %v", err)
+					return
+				}
+			}
+		}(p)
+	}
+	next := make([]uint32, producers)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for n := 0; n < producers*count; n++ {
+		msg, err := q.Recv(ctx)
+		if err != nil {
+			t.Fatalf("Recv Error %v", err)
+		}
+		p, i := binary.LittleEndian.Uint32(msg.Data), binary.LittleEndian.Uint32(msg.Data[4:])
+		if i != next[p] {
+			t.Fatalf("Expected: message %d of producer %d; Current: %d", next[p], p, i)
+		}
+		next[p]++
+	}
+	wg.Wait()
+}
+
+func TestSendNoEventFd(t *testing.T) {
+	q, _ := newTestQueue(t, -1)
+	if err := q.TrySend(0, []byte{1}); !errors.Is(err, ErrNoEventFd) {
+		t.Errorf("Expected: errors.Is(err, ErrNoEventFd); Current: %v", err)
+	}
+	if err := q.Send(context.Background(), 0, []byte{1}); !errors.Is(err, ErrNoEventFd) {
+		t.Errorf("Expected: errors.Is(err, ErrNoEventFd); Current: %v", err)
+	}
+	if q.Len() != 0 {
+		t.Errorf("Expected: empty queue; Current: %d messages", q.Len())
+	}
+}
+
+func TestRecvEventFd(t *testing.T) {
+	fd := newEventFd(t)
+	q, b := newTestQueue(t, fd)
+	producer, err := Open(b, fd)
+	if err != nil {
+		t.Fatalf("Open Error %v", err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		_ = producer.TrySend(1, []byte("connected"))
+	}()
+	start := time.Now()
+	msg, err := q.Recv(context.Background())
+	if err != nil || !bytes.HasPrefix(msg.Data, []byte("connected")) {
+		t.Errorf("Unexpected message %+v, %v", msg, err)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("Expected the eventfd to wake Recv; Current: woken after %v", elapsed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := q.Recv(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected: errors.Is(err, context.DeadlineExceeded); Current: %v", err)
+	}
+
+	recvErr := make(chan error, 1)
+	go func() {
+		_, err := q.Recv(context.Background())
+		recvErr <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := q.Close(); err != nil {
+		t.Errorf("Close Error %v", err)
+	}
+	if err := <-recvErr; !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected: errors.Is(err, ErrClosed); Current: %v", err)
+	}
+}
+
+func TestOpenCorrupt(t *testing.T) {
+	le := binary.LittleEndian
+	tests := []struct {
+		name    string
+		corrupt func(b []byte) []byte
+	}{
+		{name: "too small", corrupt: func(b []byte) []byte { return b[:64] }},
+		{name: "no rings", corrupt: func(b []byte) []byte {
+			le.PutUint32(b[nRings:], 0)
+			return b
+		}},
+		{name: "too many rings", corrupt: func(b []byte) []byte {
+			le.PutUint32(b[nRings:], 3)
+			return b
+		}},
+		{name: "queue too large", corrupt: func(b []byte) []byte {
+			le.PutUint32(b[headerSize+queueMaxsize:], 1<<30)
+			return b
+		}},
+		{name: "bad handle size", corrupt: func(b []byte) []byte {
+			le.PutUint32(b[headerSize+queueElsize:], 4)
+			return b
+		}},
+		{name: "ring too large", corrupt: func(b []byte) []byte { return b[:len(b)-1] }},
+	}
+	for _, tt := range tests {
+		b := make([]byte, Size(testConfig))
+		if err := Init(b, testConfig); err != nil {
+			t.Fatalf("Init Error %v", err)
+		}
+		if _, err := Open(tt.corrupt(b), -1); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%s: Expected: errors.Is(err, ErrCorrupt); Current: %v", tt.name, err)
+		}
+	}
+
+	q, b := newTestQueue(t, newEventFd(t))
+	if err := q.TrySend(0, nil); err != nil {
+		t.Fatalf("TrySend Error %v", err)
+	}
+	le.PutUint32(b[headerSize+queueHeaderSize:], 7)
+	if _, err := q.TryRecv(); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Expected: errors.Is(err, ErrCorrupt) for a message in a missing ring; Current: %v", err)
+	}
+	// the message is checked before it is dequeued
+	if head := le.Uint32(b[headerSize+queueHead:]); q.Len() != 1 || head != 0 {
+		t.Errorf("Expected: the corrupt message left in the queue; Current: %d messages, head %d", q.Len(), head)
+	}
+}
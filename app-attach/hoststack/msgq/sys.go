@@ -0,0 +1,45 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package msgq
+
+import (
+	"encoding/binary"
+	"syscall"
+)
+
+// Layout of glibc's pthread_mutex_t on 64 bit Linux
+const (
+	mutexKind = 16
+
+	mutexKindRobustPshared = 16 | 128
+)
+
+// initSharedMutex lays out an unlocked process shared robust mutex, as
+// pthread_mutex_init does. C producers of a queue without an eventfd
+// serialize on it, Go producers do not take it, see TrySend.
+func initSharedMutex(b []byte) {
+	binary.LittleEndian.PutUint32(b[mutexKind:], mutexKindRobustPshared)
+}
+
+// NewEventFd creates a non blocking eventfd to signal a queue with
+func NewEventFd() (int, error) {
+	fd, _, errno := syscall.Syscall(syscall.SYS_EVENTFD2, 0, syscall.O_CLOEXEC|syscall.O_NONBLOCK, 0)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
@@ -0,0 +1,253 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hoststack
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync"
+
+	"git.fd.io/govpp.git/api"
+)
+
+// Connection struct
+type Connection interface {
+	api.Connection
+	api.ChannelProvider
+}
+
+// socketPathFormat is where VPP creates the app socket of a namespace
+const socketPathFormat = "/var/run/vpp/app_ns_sockets/%v"
+
+// Namespace struct
+type Namespace struct {
+	vppConn    Connection
+	id         string
+	socketPath string
+	optionErr  error
+	udsConn    net.Conn
+	sapi       *sapiConn // serializes the exchanges of the attachments over udsConn
+	release    *Release
+
+	mu         sync.Mutex // serializes Attach
+	attachment *Attachment
+	attachErr  error
+}
+
+// NamespaceOption configures where a Namespace finds its app socket
+type NamespaceOption func(*Namespace)
+
+// WithSocketPath sets the path of the app socket. A path starting with @ is
+// a socket in the Linux abstract namespace.
+func WithSocketPath(path string) NamespaceOption {
+	return func(ns *Namespace) {
+		ns.socketPath = path
+	}
+}
+
+// WithRootDir places the app socket under rootDir, for VPP instances whose
+// runtime directory is relative to a root, like the ones vpphelper starts
+func WithRootDir(rootDir string) NamespaceOption {
+	return func(ns *Namespace) {
+		ns.socketPath = filepath.Join(rootDir, fmt.Sprintf(socketPathFormat, ns.id))
+	}
+}
+
+// WithVppConfig discovers the app socket from the session section of the
+// startup config of VPP, see SocketDirFromConfig. Discovery errors are
+// returned by Dial.
+func WithVppConfig(vppConfig string) NamespaceOption {
+	return func(ns *Namespace) {
+		dir, err := SocketDirFromConfig(vppConfig)
+		if err != nil {
+			ns.optionErr = err
+			return
+		}
+		ns.socketPath = dir + "/" + ns.id
+	}
+}
+
+// NewNamespace function
+func NewNamespace(conn Connection, id string, options ...NamespaceOption) *Namespace {
+	ns := &Namespace{ // should we pass udsConn too here
+		vppConn:    conn,
+		id:         id,
+		socketPath: fmt.Sprintf(socketPathFormat, id),
+	}
+	for _, option := range options {
+		option(ns)
+	}
+	return ns
+}
+
+// ID returns the app namespace id
+func (ns *Namespace) ID() string {
+	return ns.id
+}
+
+// SocketPath returns the path of the app socket, @ marks abstract sockets
+func (ns *Namespace) SocketPath() string {
+	return ns.socketPath
+}
+
+// Release returns the VPP release Dial found, nil before Dial or without
+// a VPP API connection
+func (ns *Namespace) Release() *Release {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	return ns.release
+}
+
+// Dial checks that VPP is a supported release, see CheckVersion, and
+// connects to the app socket of the namespace, giving up when ctx ends. The
+// check is skipped for a namespace created without a VPP API connection. A
+// namespace whose attach failed or whose attachment is detached can be
+// dialed anew, the previous connection is closed. Dial fails with
+// ErrAttached while the attachment is live.
+func (ns *Namespace) Dial(ctx context.Context) (net.Conn, error) {
+	if ns.isAttached() {
+		return nil, ErrAttached
+	}
+	var release *Release
+	if ns.vppConn != nil {
+		var vErr error
+		if release, vErr = CheckVersion(ctx, ns.vppConn); vErr != nil {
+			return nil, vErr
+		}
+	}
+	udsConn, dErr := ns.dialSocket(ctx)
+	if dErr != nil {
+		return nil, dErr
+	}
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if ns.attachment != nil && !ns.attachment.isDetached() {
+		_ = udsConn.Close()
+		return nil, ErrAttached
+	}
+	if ns.sapi != nil {
+		_ = ns.sapi.Close()
+	}
+	ns.udsConn = udsConn
+	ns.sapi = newSapiConn(udsConn)
+	ns.release = release
+	ns.attachErr = nil
+	return udsConn, nil
+}
+
+// sapiConn returns the app socket connection wrapping udsConn, the one of
+// the namespace if udsConn was opened by Dial
+func (ns *Namespace) sapiConn(udsConn net.Conn) *sapiConn {
+	if ns != nil && ns.sapi != nil && ns.sapi.Conn == udsConn {
+		return ns.sapi
+	}
+	return newSapiConn(udsConn)
+}
+
+// forgetConn drops the app socket connection of the namespace if it is c,
+// which Detach closed
+func (ns *Namespace) forgetConn(c *sapiConn) {
+	if ns == nil {
+		return
+	}
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if ns.sapi == c {
+		ns.udsConn, ns.sapi = nil, nil
+	}
+}
+
+// dialSocket opens a new connection to the app socket of the namespace
+func (ns *Namespace) dialSocket(ctx context.Context) (net.Conn, error) {
+	if ns.optionErr != nil {
+		return nil, wrapErr(ErrDial, ns.optionErr)
+	}
+	var dialer net.Dialer
+	udsConn, dErr := dialer.DialContext(ctx, "unixpacket", ns.socketPath)
+	if dErr != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, wrapErr(ErrDial, ctxErr)
+		}
+		return nil, wrapErr(ErrDial, dErr)
+	}
+	return udsConn, nil
+}
+
+// Close closes the app socket connection, VPP detaches the application
+// attached over it
+func (ns *Namespace) Close() error {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if ns.sapi == nil {
+		return nil
+	}
+	err := ns.sapi.Close()
+	ns.udsConn, ns.sapi = nil, nil
+	return err
+}
+
+// isAttached reports whether the namespace has a live attachment
+func (ns *Namespace) isAttached() bool {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	return ns.attachment != nil && !ns.attachment.isDetached()
+}
+
+// Attach attaches an application over the connection opened by Dial, giving
+// up when ctx ends. The first call attaches, the next ones return its
+// attachment or its error and ignore options. Once the attachment is
+// detached, Attach dials the app socket again, Detach closed it, and
+// attaches anew.
+func (ns *Namespace) Attach(ctx context.Context, options ...AttachOption) (*Attachment, error) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	for {
+		if ns.attachErr != nil {
+			return nil, ns.attachErr
+		}
+		a := ns.attachment
+		if a == nil {
+			break
+		}
+		if !a.isDetached() {
+			return a, nil
+		}
+		if isClosedChan(a.detachDone) {
+			break
+		}
+		// Detach is releasing the attachment, it does not need ns.mu
+		ns.mu.Unlock()
+		select {
+		case <-a.detachDone:
+		case <-ctx.Done():
+			ns.mu.Lock()
+			return nil, ctx.Err()
+		}
+		ns.mu.Lock()
+	}
+	if ns.attachment != nil && ns.sapi == nil {
+		udsConn, err := ns.dialSocket(ctx)
+		if err != nil {
+			return nil, err
+		}
+		ns.udsConn, ns.sapi = udsConn, newSapiConn(udsConn)
+	}
+	ns.attachment, ns.attachErr = NewAttachment(ctx, ns, ns.udsConn, options...)
+	return ns.attachment, ns.attachErr
+}
@@ -0,0 +1,290 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hoststack
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/godirect/hoststack/app-attach/hoststack/appsock"
+	"github.com/godirect/hoststack/app-attach/hoststack/hoststacktest"
+)
+
+func TestSocketDirFromConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantDir string
+		wantErr bool
+	}{
+		{
+			name:    "use app socket api",
+			config:  "unix {\n  nodaemon\n}\nsession {\n\tuse-app-socket-api\n}\n",
+			wantDir: "/var/run/vpp/app_ns_sockets",
+		},
+		{
+			name:    "runtime dir",
+			config:  "unix { runtime-dir /tmp/vpp # comment }\n}\nsession { use-app-socket-api }",
+			wantDir: "/tmp/vpp/app_ns_sockets",
+		},
+		{
+			name:    "relative app socket api dir",
+			config:  "unix { runtime-dir /tmp/vpp }\nsession { app-socket-api sockets }",
+			wantDir: "/tmp/vpp/sockets",
+		},
+		{
+			name:    "absolute app socket api dir",
+			config:  "session { use-app-socket-api app-socket-api /run/ns }",
+			wantDir: "/run/ns",
+		},
+		{
+			name:    "abstract app socket api dir",
+			config:  "session { app-socket-api @vpp/ns }",
+			wantDir: "@vpp/ns",
+		},
+		{
+			name:    "nested sections",
+			config:  "plugins {\n  plugin dpdk_plugin.so { disable }\n}\nsession {\n  use-app-socket-api\n}",
+			wantDir: "/var/run/vpp/app_ns_sockets",
+		},
+		{
+			name:    "example config",
+			config:  fmt.Sprintf(testVppConfig, "/root"),
+			wantDir: "/var/run/vpp/app_ns_sockets",
+		},
+		{
+			name:    "disabled",
+			config:  "session {\n  # use-app-socket-api\n  evt_qs_memfd_seg\n}",
+			wantErr: true,
+		},
+		{
+			name:    "unclosed section",
+			config:  "session {\n  use-app-socket-api\n",
+			wantErr: true,
+		},
+		{
+			name:    "section without body",
+			config:  "session use-app-socket-api",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		dir, err := SocketDirFromConfig(tt.config)
+		if (err != nil) != tt.wantErr || dir != tt.wantDir {
+			t.Errorf("%s: Expected: %q, error %v; Current: %q, %v", tt.name, tt.wantDir, tt.wantErr, dir, err)
+		}
+	}
+}
+
+// testVppConfig is a trimmed down version of the config of the example binary
+const testVppConfig = `unix {
+  nodaemon
+  log %[1]s/var/log/vpp/vpp.log
+  cli-listen %[1]s/var/run/vpp/cli.sock
+}
+
+socksvr {
+  socket-name %[1]s/var/run/vpp/api.sock
+}
+
+plugins {
+	plugin dpdk_plugin.so { disable }
+}
+
+session {
+	use-app-socket-api
+}
+`
+
+func TestNamespaceSocketPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []NamespaceOption
+		want    string
+	}{
+		{name: "default", want: "/var/run/vpp/app_ns_sockets/12"},
+		{name: "socket path", options: []NamespaceOption{WithSocketPath("/tmp/ns.sock")}, want: "/tmp/ns.sock"},
+		{name: "abstract socket path", options: []NamespaceOption{WithSocketPath("@vpp/ns/12")}, want: "@vpp/ns/12"},
+		{name: "root dir", options: []NamespaceOption{WithRootDir("/tmp/root")}, want: "/tmp/root/var/run/vpp/app_ns_sockets/12"},
+		{name: "vpp config", options: []NamespaceOption{WithVppConfig("session { app-socket-api @vpp/ns }")}, want: "@vpp/ns/12"},
+		{name: "last option wins", options: []NamespaceOption{WithRootDir("/tmp/root"), WithSocketPath("/tmp/ns.sock")}, want: "/tmp/ns.sock"},
+	}
+	for _, tt := range tests {
+		if path := NewNamespace(nil, "12", tt.options...).SocketPath(); path != tt.want {
+			t.Errorf("%s: Expected: %q; Current: %q", tt.name, tt.want, path)
+		}
+	}
+}
+
+func TestDialVppConfigError(t *testing.T) {
+	ns := NewNamespace(nil, "12", WithVppConfig("session { }"))
+	if _, err := ns.Dial(context.Background()); !errors.Is(err, ErrDial) || !errors.Is(err, ErrNoAppSocketAPI) {
+		t.Errorf("Expected: errors.Is(err, ErrDial) and errors.Is(err, ErrNoAppSocketAPI); Current: %v", err)
+	}
+}
+
+func TestDialCanceled(t *testing.T) {
+	vpp := hoststacktest.NewServer(t)
+	ns := NewNamespace(nil, "0", WithSocketPath(vpp.Path()))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ns.Dial(ctx); !errors.Is(err, ErrDial) || !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected: errors.Is(err, ErrDial) and errors.Is(err, context.Canceled); Current: %v", err)
+	}
+}
+
+func TestAttachAbstractSocket(t *testing.T) {
+	path := fmt.Sprintf("@hoststacktest/%d/%s", os.Getpid(), t.Name())
+	vpp := hoststacktest.NewServer(t, hoststacktest.WithSocketPath(path))
+	ns := NewNamespace(nil, "0", WithSocketPath(vpp.Path()))
+	if _, err := ns.Dial(context.Background()); err != nil {
+		t.Fatalf("Dial Error %v", err)
+	}
+	defer func() { _ = ns.Close() }()
+	if _, err := NewAttachment(context.Background(), ns, ns.udsConn); err != nil {
+		t.Errorf("Attach Error %v", err)
+	}
+}
+
+func TestAttachPerNamespace(t *testing.T) {
+	var attachments []*Attachment
+	for i := 0; i < 2; i++ {
+		ns := dial(t, hoststacktest.NewServer(t))
+		attachment, err := ns.Attach(context.Background())
+		if err != nil || attachment == nil {
+			t.Fatalf("Attach Error %v, %v", attachment, err)
+		}
+		attachments = append(attachments, attachment)
+	}
+	if attachments[0] == attachments[1] {
+		t.Errorf("Expected: an attachment per namespace")
+	}
+}
+
+func TestAttachConcurrent(t *testing.T) {
+	vpp := hoststacktest.NewServer(t)
+	ns := dial(t, vpp)
+	results := make(chan *Attachment, 8)
+	for i := 0; i < cap(results); i++ {
+		go func() {
+			attachment, err := ns.Attach(context.Background())
+			if err != nil {
+				t.Errorf("Attach Error %v", err)
+			}
+			results <- attachment
+		}()
+	}
+	first := <-results
+	for i := 1; i < cap(results); i++ {
+		if attachment := <-results; attachment != first {
+			t.Errorf("Expected: all callers to get the same attachment")
+		}
+	}
+	if n := len(vpp.Requests()); n != 1 {
+		t.Errorf("Expected: 1 attach request; Current: %d", n)
+	}
+}
+
+func TestAttachError(t *testing.T) {
+	vpp := hoststacktest.NewServer(t)
+	vpp.Script(appsock.MsgTypeAttach, hoststacktest.Action{Retval: -1})
+	ns := dial(t, vpp)
+	_, err := ns.Attach(context.Background())
+	var rejected *ErrAttachRejected
+	if !errors.As(err, &rejected) {
+		t.Fatalf("Expected: an *ErrAttachRejected; Current: %v", err)
+	}
+	if _, againErr := ns.Attach(context.Background()); againErr != err {
+		t.Errorf("Expected: %v; Current: %v", err, againErr)
+	}
+	if n := len(vpp.Requests()); n != 1 {
+		t.Errorf("Expected: 1 attach request; Current: %d", n)
+	}
+
+	// dialing anew gives attaching another chance
+	_ = ns.Close()
+	if _, err := ns.Dial(context.Background()); err != nil {
+		t.Fatalf("Dial Error %v", err)
+	}
+	if _, err := ns.Attach(context.Background()); err != nil {
+		t.Errorf("Attach Error %v", err)
+	}
+}
+
+func TestReattach(t *testing.T) {
+	vpp := hoststacktest.NewServer(t)
+	ns := dial(t, vpp)
+	attachment, err := ns.Attach(context.Background())
+	if err != nil {
+		t.Fatalf("Attach Error %v", err)
+	}
+	if err := attachment.Detach(context.Background()); err != nil {
+		t.Fatalf("Detach Error %v", err)
+	}
+	if vpp.Attached(attachment.AppIndex(), 0) {
+		t.Errorf("Expected: VPP to drop the application before Detach returns")
+	}
+	again, err := ns.Attach(context.Background())
+	if err != nil {
+		t.Fatalf("Attach Error %v", err)
+	}
+	if again == attachment || again.AppIndex() == attachment.AppIndex() {
+		t.Errorf("Expected: a new attachment; Current: app %d", again.AppIndex())
+	}
+	if cached, err := ns.Attach(context.Background()); cached != again || err != nil {
+		t.Errorf("Expected: the new attachment; Current: %v, %v", cached, err)
+	}
+}
+
+func TestRedial(t *testing.T) {
+	vpp := hoststacktest.NewServer(t)
+	ns := dial(t, vpp)
+	first := ns.udsConn
+
+	// dialing anew replaces the connection and closes the previous one
+	closeDone := make(chan error, 1)
+	go func() {
+		closeDone <- ns.Close()
+	}()
+	if _, err := ns.Dial(context.Background()); err != nil {
+		t.Fatalf("Dial Error %v", err)
+	}
+	<-closeDone
+	if _, err := first.Write([]byte{0}); err == nil {
+		t.Errorf("Expected: the previous connection to be closed")
+	}
+	if _, err := ns.Dial(context.Background()); err != nil {
+		t.Fatalf("Dial Error %v", err)
+	}
+	attachment, err := ns.Attach(context.Background())
+	if err != nil {
+		t.Fatalf("Attach Error %v", err)
+	}
+	if _, err := ns.Dial(context.Background()); !errors.Is(err, ErrAttached) {
+		t.Errorf("Expected: errors.Is(err, ErrAttached); Current: %v", err)
+	}
+	if err := attachment.Detach(context.Background()); err != nil {
+		t.Fatalf("Detach Error %v", err)
+	}
+	if _, err := ns.Dial(context.Background()); err != nil {
+		t.Errorf("Dial Error %v", err)
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hoststack
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/godirect/hoststack/app-attach/hoststack/appsock"
+)
+
+// AppFlags are the application flags sent with an attach request
+type AppFlags uint64
+
+// Flags an external application may set. VPP's builtin only flags
+// (IS_BUILTIN, IS_TRANSPORT_APP, MEMFD_FOR_BUILTIN) are rejected by
+// AttachOptions.Validate. Control messages always go over the app message
+// queue since VPP 20.01, so there is no flag for that anymore.
+const (
+	FlagAcceptRedirect  = AppFlags(appsock.AppOptionsFlagsAcceptRedirect)
+	FlagAddSegment      = AppFlags(appsock.AppOptionsFlagsAddSegment)
+	FlagIsProxy         = AppFlags(appsock.AppOptionsFlagsIsProxy)
+	FlagUseGlobalScope  = AppFlags(appsock.AppOptionsFlagsUseGlobalScope)
+	FlagUseLocalScope   = AppFlags(appsock.AppOptionsFlagsUseLocalScope)
+	FlagEvtMqUseEventfd = AppFlags(appsock.AppOptionsFlagsEvtMqUseEventfd)
+	FlagUseHugePage     = AppFlags(appsock.AppOptionsFlagsUseHugePage)
+)
+
+const (
+	allowedFlags    = FlagAcceptRedirect | FlagAddSegment | FlagIsProxy | FlagUseGlobalScope | FlagUseLocalScope | FlagEvtMqUseEventfd | FlagUseHugePage
+	defaultAppName  = "appattach"
+	defaultFlags    = FlagAddSegment | FlagUseGlobalScope | FlagUseLocalScope | FlagEvtMqUseEventfd
+	maxWatermarkPct = 100
+	maxFifoSize     = 1 << 31
+)
+
+// AttachOptions mirror the options VPP accepts with an attach request. Zero
+// values leave the choice to VPP.
+type AttachOptions struct {
+	// Name of the application
+	Name string
+	// Flags of the application
+	Flags AppFlags
+	// EvtQueueSize is the number of messages the app message queue holds
+	EvtQueueSize uint32
+	// SegmentSize is the size of the first fifo segment
+	SegmentSize uint64
+	// AddSegmentSize is the size of segments added when the first one fills
+	// up, FlagAddSegment has to be set for them to be added
+	AddSegmentSize uint64
+	// PrivateSegmentCount is the number of segments preallocated for the app
+	PrivateSegmentCount uint32
+	// RxFifoSize and TxFifoSize are the session fifo sizes
+	RxFifoSize uint32
+	TxFifoSize uint32
+	// PreallocFifoPairs is the number of fifo pairs allocated at attach time
+	PreallocFifoPairs uint32
+	// PreallocFifoHdrs is the number of fifo headers allocated at attach time
+	PreallocFifoHdrs uint32
+	// NamespaceSecret authenticates the app against the app namespace
+	NamespaceSecret uint64
+	// ProxyTransport is a bitmap of the transport protocols proxied by the app
+	ProxyTransport uint64
+	// AcceptCookie is echoed back by VPP with accept notifications
+	AcceptCookie uint64
+	// TLSEngine selects the crypto engine used by tls sessions
+	TLSEngine uint8
+	// MaxFifoSize caps the size fifos may grow to
+	MaxFifoSize uint32
+	// HighWatermark and LowWatermark are the segment memory pressure
+	// thresholds, in percent
+	HighWatermark uint8
+	LowWatermark  uint8
+	// PctFirstAlloc is the percentage of the fifo size allocated up front
+	PctFirstAlloc uint8
+}
+
+// AttachOption configures an attach request
+type AttachOption func(*AttachOptions)
+
+// DefaultAttachOptions returns the options used when Attach is called without
+// options
+func DefaultAttachOptions() AttachOptions {
+	return AttachOptions{
+		Name:  defaultAppName,
+		Flags: defaultFlags,
+	}
+}
+
+// WithAttachOptions replaces all options with opts
+func WithAttachOptions(opts *AttachOptions) AttachOption {
+	return func(o *AttachOptions) {
+		*o = *opts
+	}
+}
+
+// WithName sets the application name
+func WithName(name string) AttachOption {
+	return func(o *AttachOptions) {
+		o.Name = name
+	}
+}
+
+// WithFlags adds flags to the application flags
+func WithFlags(flags AppFlags) AttachOption {
+	return func(o *AttachOptions) {
+		o.Flags |= flags
+	}
+}
+
+// WithoutFlags clears flags from the application flags
+func WithoutFlags(flags AppFlags) AttachOption {
+	return func(o *AttachOptions) {
+		o.Flags &^= flags
+	}
+}
+
+// WithEvtQueueSize sets the size of the app message queue
+func WithEvtQueueSize(size uint32) AttachOption {
+	return func(o *AttachOptions) {
+		o.EvtQueueSize = size
+	}
+}
+
+// WithSegmentSize sets the size of the first fifo segment
+func WithSegmentSize(size uint64) AttachOption {
+	return func(o *AttachOptions) {
+		o.SegmentSize = size
+	}
+}
+
+// WithAddSegmentSize sets the size of segments added at runtime
+func WithAddSegmentSize(size uint64) AttachOption {
+	return func(o *AttachOptions) {
+		o.AddSegmentSize = size
+	}
+}
+
+// WithFifoSizes sets the rx and tx fifo sizes of sessions
+func WithFifoSizes(rx, tx uint32) AttachOption {
+	return func(o *AttachOptions) {
+		o.RxFifoSize = rx
+		o.TxFifoSize = tx
+	}
+}
+
+// WithPreallocFifoPairs sets the number of fifo pairs preallocated by VPP
+func WithPreallocFifoPairs(n uint32) AttachOption {
+	return func(o *AttachOptions) {
+		o.PreallocFifoPairs = n
+	}
+}
+
+// WithNamespaceSecret sets the secret of the app namespace
+func WithNamespaceSecret(secret uint64) AttachOption {
+	return func(o *AttachOptions) {
+		o.NamespaceSecret = secret
+	}
+}
+
+func newAttachOptions(opts []AttachOption) AttachOptions {
+	o := DefaultAttachOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// Validate checks the options for values VPP would reject or misinterpret
+func (o *AttachOptions) Validate() error {
+	switch {
+	case o.Name == "":
+		return errors.New("application name is empty")
+	case len(o.Name) >= appsock.AppNameLen:
+		return errors.Errorf("application name %q is longer than %d bytes", o.Name, appsock.AppNameLen-1)
+	case o.Flags&^allowedFlags != 0:
+		return errors.Errorf("unsupported application flags %#x", uint64(o.Flags&^allowedFlags))
+	case o.HighWatermark > maxWatermarkPct || o.LowWatermark > maxWatermarkPct || o.PctFirstAlloc > maxWatermarkPct:
+		return errors.New("watermarks and first allocation are percentages")
+	case o.HighWatermark != 0 && o.LowWatermark > o.HighWatermark:
+		return errors.Errorf("low watermark %d%% is above high watermark %d%%", o.LowWatermark, o.HighWatermark)
+	case o.MaxFifoSize > maxFifoSize:
+		return errors.Errorf("max fifo size %d exceeds %d", o.MaxFifoSize, uint32(maxFifoSize))
+	}
+	for _, size := range []uint32{o.RxFifoSize, o.TxFifoSize} {
+		if o.MaxFifoSize != 0 && size > o.MaxFifoSize {
+			return errors.Errorf("fifo size %d exceeds max fifo size %d", size, o.MaxFifoSize)
+		}
+		if o.SegmentSize != 0 && uint64(size) > o.SegmentSize {
+			return errors.Errorf("fifo size %d exceeds segment size %d", size, o.SegmentSize)
+		}
+	}
+	return nil
+}
+
+// Encode validates the options and converts them into the options array of
+// an attach request
+func (o *AttachOptions) Encode() ([appsock.AppOptionsNOptions]uint64, error) {
+	var options [appsock.AppOptionsNOptions]uint64
+	if err := o.Validate(); err != nil {
+		return options, err
+	}
+	options[appsock.AppOptionsFlags] = uint64(o.Flags)
+	options[appsock.AppOptionsEvtQueueSize] = uint64(o.EvtQueueSize)
+	options[appsock.AppOptionsSegmentSize] = o.SegmentSize
+	options[appsock.AppOptionsAddSegmentSize] = o.AddSegmentSize
+	options[appsock.AppOptionsPrivateSegmentCount] = uint64(o.PrivateSegmentCount)
+	options[appsock.AppOptionsRxFifoSize] = uint64(o.RxFifoSize)
+	options[appsock.AppOptionsTxFifoSize] = uint64(o.TxFifoSize)
+	options[appsock.AppOptionsPreallocFifoPairs] = uint64(o.PreallocFifoPairs)
+	options[appsock.AppOptionsPreallocFifoHdrs] = uint64(o.PreallocFifoHdrs)
+	options[appsock.AppOptionsNamespaceSecret] = o.NamespaceSecret
+	options[appsock.AppOptionsProxyTransport] = o.ProxyTransport
+	options[appsock.AppOptionsAcceptCookie] = o.AcceptCookie
+	options[appsock.AppOptionsTLSEngine] = uint64(o.TLSEngine)
+	options[appsock.AppOptionsMaxFifoSize] = uint64(o.MaxFifoSize)
+	options[appsock.AppOptionsHighWatermark] = uint64(o.HighWatermark)
+	options[appsock.AppOptionsLowWatermark] = uint64(o.LowWatermark)
+	options[appsock.AppOptionsPctFirstAlloc] = uint64(o.PctFirstAlloc)
+	return options, nil
+}
+
+// attachMsg builds the attach request for the options
+func (o *AttachOptions) attachMsg() (*appsock.AppSapiMsgAttach, error) {
+	options, err := o.Encode()
+	if err != nil {
+		return nil, err
+	}
+	msg := &appsock.AppSapiMsgAttach{MsgType: appsock.MsgTypeAttach, Msg: appsock.AppAttachMsg{Options: options}}
+	copy(msg.Msg.Name[:], o.Name)
+	return msg, nil
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hoststack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+)
+
+// attachMsgBytes lays out an encoded attach request: the message type, the
+// name padded to 64 bytes and the 18 little endian options.
+func attachMsgBytes(name string, options map[int]uint64) []byte {
+	b := make([]byte, 1+64+18*8)
+	b[0] = 0x01
+	copy(b[1:65], name)
+	for i, v := range options {
+		binary.LittleEndian.PutUint64(b[65+8*i:], v)
+	}
+	return b
+}
+
+func TestAttachOptionsEncoding(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []AttachOption
+		want    []byte
+	}{
+		{
+			name: "defaults",
+			want: attachMsgBytes("appattach", map[int]uint64{0: 0xe2}),
+		},
+		{
+			name:    "name",
+			options: []AttachOption{WithName("proxy")},
+			want:    attachMsgBytes("proxy", map[int]uint64{0: 0xe2}),
+		},
+		{
+			name:    "flags",
+			options: []AttachOption{WithFlags(FlagEvtMqUseEventfd | FlagIsProxy), WithoutFlags(FlagUseGlobalScope)},
+			want:    attachMsgBytes("appattach", map[int]uint64{0: 0xd2}),
+		},
+		{
+			name: "sizes",
+			options: []AttachOption{
+				WithEvtQueueSize(1024),
+				WithSegmentSize(256 << 20),
+				WithAddSegmentSize(128 << 20),
+				WithFifoSizes(64<<10, 32<<10),
+				WithPreallocFifoPairs(16),
+			},
+			want: attachMsgBytes("appattach", map[int]uint64{
+				0: 0xe2,
+				1: 1024,
+				2: 256 << 20,
+				3: 128 << 20,
+				5: 64 << 10,
+				6: 32 << 10,
+				7: 16,
+			}),
+		},
+		{
+			name:    "namespace secret",
+			options: []AttachOption{WithNamespaceSecret(0xdeadbeefcafe)},
+			want:    attachMsgBytes("appattach", map[int]uint64{0: 0xe2, 10: 0xdeadbeefcafe}),
+		},
+		{
+			name: "struct",
+			options: []AttachOption{WithAttachOptions(&AttachOptions{
+				Name:          "tls",
+				Flags:         FlagAcceptRedirect,
+				TLSEngine:     1,
+				MaxFifoSize:   1 << 20,
+				HighWatermark: 80,
+				LowWatermark:  50,
+				PctFirstAlloc: 25,
+			})},
+			want: attachMsgBytes("tls", map[int]uint64{0: 0x01, 13: 1, 14: 1 << 20, 15: 80, 16: 50, 17: 25}),
+		},
+	}
+	for _, tt := range tests {
+		o := newAttachOptions(tt.options)
+		msg, err := o.attachMsg()
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+			continue
+		}
+		got, err := msg.MarshalBinary()
+		if err != nil {
+			t.Errorf("%s: BinaryMarshaling Error %v", tt.name, err)
+			continue
+		}
+		if !bytes.Equal(tt.want, got) {
+			t.Errorf("%s: Output Mismatch. Expected Output:\n%v\n Current Output:\n%v", tt.name, hex.Dump(tt.want), hex.Dump(got))
+		}
+	}
+}
+
+func TestAttachOptionsValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []AttachOption
+	}{
+		{name: "empty name", options: []AttachOption{WithName("")}},
+		{name: "long name", options: []AttachOption{WithName(string(make([]byte, 64)))}},
+		{name: "builtin flag", options: []AttachOption{WithFlags(AppFlags(1 << 2))}},
+		{name: "fifo above segment", options: []AttachOption{WithSegmentSize(1 << 20), WithFifoSizes(2<<20, 0)}},
+		{name: "fifo above max", options: []AttachOption{WithAttachOptions(&AttachOptions{Name: "a", MaxFifoSize: 1 << 10, TxFifoSize: 1 << 11})}},
+		{name: "watermarks", options: []AttachOption{WithAttachOptions(&AttachOptions{Name: "a", HighWatermark: 50, LowWatermark: 60})}},
+		{name: "percentage", options: []AttachOption{WithAttachOptions(&AttachOptions{Name: "a", PctFirstAlloc: 101})}},
+	}
+	for _, tt := range tests {
+		o := newAttachOptions(tt.options)
+		if _, err := o.Encode(); err == nil {
+			t.Errorf("%s: expected a validation error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hoststack
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/godirect/hoststack/app-attach/hoststack/session"
+)
+
+// packetConn is a net.PacketConn over a datagram session, each datagram in
+// the session fifos follows a header with its addresses. A connected session
+// is the session of a single peer, a listener shares its session among all
+// the peers sending to it.
+type packetConn struct {
+	*conn
+	listener *listener // set when the session is a listener
+}
+
+func newPacketConn(s *appSession, l *listener, network string, laddr, raddr net.Addr) *packetConn {
+	return &packetConn{conn: newConn(s, network, laddr, raddr), listener: l}
+}
+
+// ListenPacket listens on address over a session of the first worker of the
+// attachment, see Worker.ListenPacket
+func (a *Attachment) ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error) {
+	workers := a.Workers()
+	if len(workers) == 0 {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: ErrDetached}
+	}
+	return workers[0].ListenPacket(ctx, network, address)
+}
+
+// ListenPacket asks VPP to listen on address for the worker. The network must
+// be "udp", "udp4" or "udp6", an address without a host listens on all
+// addresses. The datagrams of all peers go through the fifos of the
+// listener, Listen accepts a session per peer instead.
+func (w *Worker) ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error) {
+	if proto, ok := transportProto(network); !ok || proto != session.TransportProtoUDP {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+	l, reply, err := w.listen(ctx, network, address, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.session.open(reply.SegmentHandle, reply.RxFifo, reply.TxFifo, reply.VppEvtQ); err != nil {
+		_ = l.close()
+		return nil, l.opError("listen", err)
+	}
+	return newPacketConn(l.session, l, network, l.addr, nil), nil
+}
+
+// Read reads a datagram, what does not fit in b is dropped
+func (c *packetConn) Read(b []byte) (int, error) {
+	n, _, err := c.readFrom("read", b)
+	return n, err
+}
+
+// ReadFrom reads a datagram and returns the address of its sender, what
+// does not fit in b is dropped
+func (c *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	return c.readFrom("read", b)
+}
+
+func (c *packetConn) readFrom(op string, b []byte) (int, net.Addr, error) {
+	for {
+		if isClosedChan(c.readClosed) {
+			return 0, nil, io.EOF
+		}
+		if c.readDeadline.passed() {
+			return 0, nil, c.opError(op, os.ErrDeadlineExceeded)
+		}
+		peerClosed, reset := c.session.peerState()
+		n, hdr, notify, err := c.session.readDgram(b)
+		if err != nil {
+			return 0, nil, c.opError(op, err)
+		}
+		if notify {
+			ctx, cancel := c.readDeadline.context()
+			err = c.session.notifyVpp(ctx, EventIORx)
+			cancel()
+			if err != nil {
+				return n, nil, c.opError(op, err)
+			}
+		}
+		switch {
+		case hdr != nil:
+			return n, &net.UDPAddr{IP: hdr.RmtIP.IP(hdr.IsIP4 != 0), Port: int(session.Ntohs(hdr.RmtPort))}, nil
+		case reset:
+			return 0, nil, c.opError(op, syscall.ECONNRESET)
+		case peerClosed:
+			return 0, nil, io.EOF
+		}
+		select {
+		case <-c.session.rxEvent:
+		case <-c.session.closing:
+		case <-c.closed:
+		case <-c.readClosed:
+		case <-c.readDeadline.wait():
+		}
+	}
+}
+
+// Write writes a datagram to the peer of a connected session
+func (c *packetConn) Write(b []byte) (int, error) {
+	if c.raddr == nil {
+		return 0, c.opError("write", syscall.EDESTADDRREQ)
+	}
+	return c.writeTo("write", b, c.raddr.(*net.UDPAddr))
+}
+
+// WriteTo writes a datagram to addr, which must be a *net.UDPAddr. Connected
+// sessions only write to their peer, with Write.
+func (c *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if c.raddr != nil {
+		return 0, c.opError("write", net.ErrWriteToConnected)
+	}
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, &net.OpError{Op: "write", Net: c.network, Source: c.laddr, Addr: addr, Err: syscall.EINVAL}
+	}
+	return c.writeTo("write", b, udpAddr)
+}
+
+func (c *packetConn) writeTo(op string, b []byte, addr *net.UDPAddr) (int, error) {
+	hdr := session.DgramHdr{DataLength: uint32(len(b)), RmtPort: session.Htons(uint16(addr.Port))}
+	var isIP4 bool
+	hdr.RmtIP, isIP4 = session.NewIP46Address(addr.IP)
+	if isIP4 {
+		hdr.IsIP4 = 1
+	}
+	if laddr, ok := c.laddr.(*net.UDPAddr); ok {
+		hdr.LclIP, _ = session.NewIP46Address(laddr.IP)
+		hdr.LclPort = session.Htons(uint16(laddr.Port))
+	}
+	for {
+		if isClosedChan(c.writeClosed) {
+			return 0, c.writeError(op, addr, syscall.EPIPE)
+		}
+		if c.writeDeadline.passed() {
+			return 0, c.writeError(op, addr, os.ErrDeadlineExceeded)
+		}
+		if _, reset := c.session.peerState(); reset {
+			return 0, c.writeError(op, addr, syscall.ECONNRESET)
+		}
+		written, notify, err := c.session.writeDgram(&hdr, b)
+		if err != nil {
+			return 0, c.writeError(op, addr, err)
+		}
+		if notify {
+			ctx, cancel := c.writeDeadline.context()
+			err = c.session.notifyVpp(ctx, EventIOTx)
+			cancel()
+			if err != nil {
+				return len(b), c.writeError(op, addr, err)
+			}
+		}
+		if written {
+			return len(b), nil
+		}
+		select {
+		case <-c.session.txEvent:
+		case <-c.session.closing:
+		case <-c.closed:
+		case <-c.writeClosed:
+		case <-c.writeDeadline.wait():
+		}
+	}
+}
+
+// Close closes the session, a listener asks VPP to stop listening
+func (c *packetConn) Close() error {
+	if c.listener == nil {
+		return c.conn.Close()
+	}
+	err := errConnClosed
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		err = c.listener.close()
+	})
+	if err != nil {
+		return c.opError("close", err)
+	}
+	return nil
+}
+
+func (c *packetConn) writeError(op string, addr net.Addr, err error) error {
+	return &net.OpError{Op: op, Net: c.network, Source: c.laddr, Addr: addr, Err: err}
+}
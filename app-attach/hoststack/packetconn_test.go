@@ -0,0 +1,142 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hoststack
+
+import (
+	"context"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/godirect/hoststack/app-attach/hoststack/hoststacktest"
+)
+
+func TestDialUDP(t *testing.T) {
+	vpp := hoststacktest.NewServer(t, hoststacktest.WithSessionHandler(hoststacktest.Echo))
+	attachment := attach(t, vpp)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := attachment.Dial(ctx, "udp", "10.0.0.1:53")
+	if err != nil {
+		t.Fatalf("Dial Error %v", err)
+	}
+	defer conn.Close()
+	if _, ok := conn.LocalAddr().(*net.UDPAddr); !ok || conn.RemoteAddr().String() != "10.0.0.1:53" {
+		t.Errorf("Expected: UDP addresses; Current: %v, %v", conn.LocalAddr(), conn.RemoteAddr())
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	for _, datagram := range []string{"a", "bc", "0123456789"} {
+		if _, err := conn.Write([]byte(datagram)); err != nil {
+			t.Fatalf("Write Error %v", err)
+		}
+	}
+	buf := make([]byte, 4)
+	for _, want := range []string{"a", "bc", "0123"} {
+		n, err := conn.Read(buf)
+		if err != nil || string(buf[:n]) != want {
+			t.Errorf("Expected: %q; Current: %q, %v", want, buf[:n], err)
+		}
+	}
+
+	if _, err := conn.Write(make([]byte, 16<<10)); !errors.Is(err, syscall.EMSGSIZE) {
+		t.Errorf("Expected: errors.Is(err, syscall.EMSGSIZE); Current: %v", err)
+	}
+	if _, err := conn.(net.PacketConn).WriteTo([]byte{1}, conn.RemoteAddr()); !errors.Is(err, net.ErrWriteToConnected) {
+		t.Errorf("Expected: errors.Is(err, net.ErrWriteToConnected); Current: %v", err)
+	}
+}
+
+func TestListenPacket(t *testing.T) {
+	vpp := hoststacktest.NewServer(t, hoststacktest.WithSessionHandler(hoststacktest.Echo))
+	attachment := attach(t, vpp)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pc, err := attachment.ListenPacket(ctx, "udp", ":5353")
+	if err != nil {
+		t.Fatalf("Listen Error %v", err)
+	}
+	if addr := pc.LocalAddr().String(); addr != "0.0.0.0:5353" {
+		t.Errorf("Expected: 0.0.0.0:5353; Current: %s", addr)
+	}
+	if _, err := attachment.ListenPacket(ctx, "udp", ":5353"); !errors.Is(err, SessionErrPortInUse) {
+		t.Errorf("Expected: errors.Is(err, SessionErrPortInUse); Current: %v", err)
+	}
+	peer, err := vpp.Connect(ctx, "udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Connect Error %v", err)
+	}
+
+	_ = pc.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := peer.Write([]byte("query")); err != nil {
+		t.Fatalf("Write Error %v", err)
+	}
+	buf := make([]byte, 64)
+	n, from, err := pc.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "query" || from.String() != peer.Addr().String() {
+		t.Fatalf("Expected: query from %v; Current: %q from %v, %v", peer.Addr(), buf[:n], from, err)
+	}
+	if _, err := pc.WriteTo([]byte("answer"), from); err != nil {
+		t.Fatalf("Write Error %v", err)
+	}
+	if n, err := peer.Read(buf); err != nil || string(buf[:n]) != "answer" {
+		t.Errorf("Expected: answer; Current: %q, %v", buf[:n], err)
+	}
+	if _, err := pc.(net.Conn).Write([]byte{1}); !errors.Is(err, syscall.EDESTADDRREQ) {
+		t.Errorf("Expected: errors.Is(err, syscall.EDESTADDRREQ); Current: %v", err)
+	}
+
+	if err := pc.Close(); err != nil {
+		t.Fatalf("Close Error %v", err)
+	}
+	if _, err := peer.Read(buf); !errors.Is(err, io.EOF) {
+		t.Errorf("Expected: io.EOF once the listener is closed; Current: %v", err)
+	}
+	if _, _, err := pc.ReadFrom(buf); err == nil {
+		t.Errorf("Expected: an error reading after Close")
+	}
+}
+
+func TestListenUDP(t *testing.T) {
+	vpp, _, l := listenSession(t, "udp", ":5353")
+	sess, conn := connect(t, vpp, "udp", l)
+	if conn.RemoteAddr().String() != sess.Addr().String() {
+		t.Errorf("Expected: %v; Current: %v", sess.Addr(), conn.RemoteAddr())
+	}
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	for _, datagram := range []string{"ping", "again"} {
+		if _, err := sess.Write([]byte(datagram)); err != nil {
+			t.Fatalf("Write Error %v", err)
+		}
+	}
+	buf := make([]byte, 64)
+	for _, want := range []string{"ping", "again"} {
+		if n, err := conn.Read(buf); err != nil || string(buf[:n]) != want {
+			t.Errorf("Expected: %q; Current: %q, %v", want, buf[:n], err)
+		}
+	}
+	if _, err := conn.Write([]byte("pong")); err != nil {
+		t.Fatalf("Write Error %v", err)
+	}
+	if n, err := sess.Read(buf); err != nil || string(buf[:n]) != "pong" {
+		t.Errorf("Expected: pong; Current: %q, %v", buf[:n], err)
+	}
+}
@@ -0,0 +1,417 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hoststack
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/godirect/hoststack/app-attach/hoststack/fifo"
+)
+
+// PollEvents is a set of conditions of a session, as the EPOLL* flags VCL
+// reports sessions with
+type PollEvents uint32
+
+// Poll conditions. PollHup and PollReset are reported whether they are
+// waited for or not.
+const (
+	// PollIn is set when a read does not block: the rx fifo holds data, the
+	// peer closed or reset the session, or a listener or quic connection
+	// holds a session or stream to accept
+	PollIn PollEvents = 1 << iota
+	// PollOut is set when the tx fifo has room for a write
+	PollOut
+	// PollHup is set once the peer closed or reset the session, or VPP
+	// freed it
+	PollHup
+	// PollReset is set once the peer reset the session
+	PollReset
+	// PollET makes the session edge-triggered: its conditions are reported
+	// once per signal VPP sends for it, instead of for as long as they hold.
+	// VPP signals data once the rx fifo was drained and room once the tx
+	// fifo filled up, the application reads and writes until they block.
+	PollET
+)
+
+// pollConditions are the conditions of a session a Poller reports
+const pollConditions = PollIn | PollOut | PollHup | PollReset
+
+// PollEvent is a session Poller.Wait reports, with the conditions that hold
+// for it
+type PollEvent struct {
+	Conn   io.Closer
+	Events PollEvents
+}
+
+// Poller waits on many sessions of a worker at once, as VCL's epoll
+// sessions. The sessions are the net.Conns, net.PacketConns and
+// net.Listeners of the worker, its QUICSessions and QUICListeners. Closing a
+// session removes it from the poller.
+type Poller struct {
+	worker    *Worker
+	wake      chan struct{} // signalled when a condition of a session may have changed
+	mu        sync.Mutex
+	items     []*pollItem // in the order Wait reports them, replaced on change
+	bySession map[*appSession]*pollItem
+	next      int // the item Wait looks at first, so that all of them are reported in turn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// pollItem is a session added to a poller
+type pollItem struct {
+	poller  *Poller
+	conn    pollable
+	session *appSession
+	events  uint32 // the PollEvents waited for
+	pending uint32 // the PollEvents signalled since Wait last looked at the session
+}
+
+// pollable is implemented by the sessions a Poller waits on
+type pollable interface {
+	io.Closer
+	pollSession() *appSession
+	// pollState returns the conditions that hold for the session. VPP is
+	// asked to signal the conditions of events that do not.
+	pollState(events PollEvents) PollEvents
+}
+
+// NewPoller returns a Poller waiting on sessions of the worker
+func (w *Worker) NewPoller() *Poller {
+	w.startDispatch()
+	return &Poller{
+		worker:    w,
+		wake:      make(chan struct{}, 1),
+		bySession: make(map[*appSession]*pollItem),
+		closed:    make(chan struct{}),
+	}
+}
+
+// Add waits for the conditions of events on c, PollET makes it
+// edge-triggered. It fails with syscall.EEXIST if c was added before and
+// with syscall.EBADF if c is not a session of the worker.
+func (p *Poller) Add(c io.Closer, events PollEvents) error {
+	pc, s, err := p.lookup(c)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if isClosedChan(p.closed) {
+		return ErrPollerClosed
+	}
+	if _, ok := p.bySession[s]; ok {
+		return syscall.EEXIST
+	}
+	item := &pollItem{poller: p, conn: pc, session: s, events: uint32(events), pending: uint32(pollConditions)}
+	items := make([]*pollItem, len(p.items), len(p.items)+1)
+	copy(items, p.items)
+	p.items = append(items, item)
+	p.bySession[s] = item
+	s.addPollItem(item)
+	notify(p.wake)
+	return nil
+}
+
+// Modify changes the conditions waited for on c. It fails with
+// syscall.ENOENT if c was not added.
+func (p *Poller) Modify(c io.Closer, events PollEvents) error {
+	_, s, err := p.lookup(c)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if isClosedChan(p.closed) {
+		return ErrPollerClosed
+	}
+	item, ok := p.bySession[s]
+	if !ok {
+		return syscall.ENOENT
+	}
+	atomic.StoreUint32(&item.events, uint32(events))
+	item.signal(pollConditions)
+	return nil
+}
+
+// Del stops waiting on c. It fails with syscall.ENOENT if c was not added.
+func (p *Poller) Del(c io.Closer) error {
+	_, s, err := p.lookup(c)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if isClosedChan(p.closed) {
+		return ErrPollerClosed
+	}
+	item, ok := p.bySession[s]
+	if !ok {
+		return syscall.ENOENT
+	}
+	p.remove(item)
+	return nil
+}
+
+// Wait waits until ctx ends for sessions with conditions to report and fills
+// events with them. It returns the number of events it filled.
+func (p *Poller) Wait(ctx context.Context, events []PollEvent) (int, error) {
+	if len(events) == 0 {
+		return 0, syscall.EINVAL
+	}
+	for {
+		if isClosedChan(p.closed) {
+			return 0, ErrPollerClosed
+		}
+		if n := p.collect(events); n > 0 {
+			return n, nil
+		}
+		select {
+		case <-p.wake:
+		case <-p.closed:
+			return 0, ErrPollerClosed
+		case <-p.worker.dispatchDone:
+			return 0, p.worker.dispatchErr
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// Close removes all sessions from the poller and wakes Wait
+func (p *Poller) Close() error {
+	err := ErrPollerClosed
+	p.closeOnce.Do(func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		close(p.closed)
+		for _, item := range p.items {
+			item.session.removePollItem(item)
+		}
+		p.items, p.bySession = nil, nil
+		err = nil
+	})
+	return err
+}
+
+// lookup returns the session of c, which must be a session of the worker
+// the application did not close
+func (p *Poller) lookup(c io.Closer) (pollable, *appSession, error) {
+	pc, ok := c.(pollable)
+	if !ok {
+		return nil, nil, syscall.EBADF
+	}
+	s := pc.pollSession()
+	if s.worker != p.worker || s.isClosed() {
+		return nil, nil, syscall.EBADF
+	}
+	return pc, s, nil
+}
+
+// collect fills events with the sessions that have conditions to report,
+// sessions the application closed are removed on the way
+func (p *Poller) collect(events []PollEvent) int {
+	p.mu.Lock()
+	items, start := p.items, p.next
+	p.mu.Unlock()
+	n, i := 0, 0
+	for ; i < len(items) && n < len(events); i++ {
+		item := items[(start+i)%len(items)]
+		if item.session.isClosed() {
+			p.mu.Lock()
+			if p.bySession[item.session] == item {
+				p.remove(item)
+			}
+			p.mu.Unlock()
+			continue
+		}
+		if ready := item.ready(); ready != 0 {
+			events[n] = PollEvent{Conn: item.conn, Events: ready}
+			n++
+		}
+	}
+	p.mu.Lock()
+	p.next = start + i
+	if len(p.items) > 0 {
+		p.next %= len(p.items)
+	}
+	p.mu.Unlock()
+	return n
+}
+
+// remove drops item from the poller, p.mu must be held
+func (p *Poller) remove(item *pollItem) {
+	items := make([]*pollItem, 0, len(p.items))
+	for _, other := range p.items {
+		if other != item {
+			items = append(items, other)
+		}
+	}
+	p.items = items
+	delete(p.bySession, item.session)
+	item.session.removePollItem(item)
+}
+
+// ready returns the conditions of the session to report. An edge-triggered
+// session only reports the conditions signalled since it was last looked at.
+func (item *pollItem) ready() PollEvents {
+	events := PollEvents(atomic.LoadUint32(&item.events))
+	pending := PollEvents(atomic.SwapUint32(&item.pending, 0))
+	if events&PollET != 0 && pending == 0 {
+		return 0
+	}
+	ready := item.conn.pollState(events) & (events | PollHup | PollReset) & pollConditions
+	if events&PollET != 0 {
+		ready &= pending
+	}
+	return ready
+}
+
+// signal records that the conditions of events may have changed and wakes
+// the poller. It does not lock, sessions signal while the worker mutex is
+// held.
+func (item *pollItem) signal(events PollEvents) {
+	for {
+		pending := atomic.LoadUint32(&item.pending)
+		if atomic.CompareAndSwapUint32(&item.pending, pending, pending|uint32(events)) {
+			break
+		}
+	}
+	notify(item.poller.wake)
+}
+
+func (s *appSession) addPollItem(item *pollItem) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	items := make([]*pollItem, len(s.pollItems), len(s.pollItems)+1)
+	copy(items, s.pollItems)
+	s.pollItems = append(items, item)
+}
+
+func (s *appSession) removePollItem(item *pollItem) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	items := make([]*pollItem, 0, len(s.pollItems))
+	for _, other := range s.pollItems {
+		if other != item {
+			items = append(items, other)
+		}
+	}
+	s.pollItems = items
+}
+
+// pollNotify signals the pollers waiting on the session that the conditions
+// of events may have changed
+func (s *appSession) pollNotify(events PollEvents) {
+	s.mu.RLock()
+	items := s.pollItems
+	s.mu.RUnlock()
+	for _, item := range items {
+		item.signal(events)
+	}
+}
+
+func (s *appSession) isClosed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.closed
+}
+
+// pollState returns the conditions of the session and of its fifos, which
+// are armed as reads and writes arm them when they would block
+func (s *appSession) pollState(events PollEvents) PollEvents {
+	s.worker.mu.RLock()
+	defer s.worker.mu.RUnlock()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var state PollEvents
+	switch {
+	case s.reset:
+		state = PollIn | PollHup | PollReset
+	case s.peerClosed:
+		state = PollIn | PollHup
+	case s.gone:
+		state = PollHup
+	}
+	if s.usable() != nil || s.rx == nil {
+		return state
+	}
+	if events&PollIn != 0 {
+		if s.rx.MaxDequeue() == 0 {
+			s.unsetRxEvent()
+		}
+		if s.rx.MaxDequeue() > 0 {
+			state |= PollIn
+		}
+	}
+	if events&PollOut != 0 {
+		if s.tx.MaxEnqueue() == 0 {
+			s.tx.AddWantDeqNtf(fifo.WantDeqNtf)
+		}
+		if s.tx.MaxEnqueue() > 0 {
+			state |= PollOut
+		}
+	}
+	return state
+}
+
+func (c *conn) pollSession() *appSession {
+	return c.session
+}
+
+func (c *conn) pollState(events PollEvents) PollEvents {
+	return c.session.pollState(events)
+}
+
+func (l *listener) pollSession() *appSession {
+	return l.session
+}
+
+// pollState reports a listener readable while it holds sessions to accept
+func (l *listener) pollState(PollEvents) PollEvents {
+	state := l.session.pollState(0) &^ PollIn
+	if len(l.backlog) > 0 {
+		state |= PollIn
+	}
+	return state
+}
+
+func (ql *QUICListener) pollSession() *appSession {
+	return ql.l.session
+}
+
+func (ql *QUICListener) pollState(events PollEvents) PollEvents {
+	return ql.l.pollState(events)
+}
+
+func (q *QUICSession) pollSession() *appSession {
+	return q.session
+}
+
+// pollState reports a quic connection readable while it holds streams to
+// accept
+func (q *QUICSession) pollState(PollEvents) PollEvents {
+	state := q.session.pollState(0) &^ PollIn
+	if len(q.backlog) > 0 {
+		state |= PollIn
+	}
+	return state
+}
@@ -0,0 +1,239 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hoststack
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/godirect/hoststack/app-attach/hoststack/hoststacktest"
+)
+
+// poll waits for the events of p for up to timeout
+func poll(t *testing.T, p *Poller, timeout time.Duration) []PollEvent {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	events := make([]PollEvent, 8)
+	n, err := p.Wait(ctx, events)
+	if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Wait Error %v", err)
+	}
+	return events[:n]
+}
+
+func expectPoll(t *testing.T, p *Poller, c io.Closer, want PollEvents) {
+	t.Helper()
+	events := poll(t, p, 5*time.Second)
+	if len(events) != 1 || events[0].Conn != c || events[0].Events != want {
+		t.Fatalf("Expected: events %#x; Current: %+v", want, events)
+	}
+}
+
+func expectNoPoll(t *testing.T, p *Poller) {
+	t.Helper()
+	if events := poll(t, p, 20*time.Millisecond); len(events) != 0 {
+		t.Fatalf("Expected: no events; Current: %+v", events)
+	}
+}
+
+func TestPollerLevelTriggered(t *testing.T) {
+	vpp, attachment, l := listenSession(t, "tcp", ":8080")
+	p := attachment.Workers()[0].NewPoller()
+	defer func() { _ = p.Close() }()
+	if err := p.Add(l, PollIn); err != nil {
+		t.Fatalf("Add Error %v", err)
+	}
+	expectNoPoll(t, p)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	sessc := make(chan *hoststacktest.Session, 1)
+	go func() {
+		sess, err := vpp.Connect(ctx, "tcp", l.Addr().String())
+		if err != nil {
+			t.Errorf("Connect Error %v", err)
+		}
+		sessc <- sess
+	}()
+	expectPoll(t, p, l, PollIn)
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept Error %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	sess := <-sessc
+	if sess == nil {
+		t.FailNow()
+	}
+	if err := p.Add(conn, PollIn); err != nil {
+		t.Fatalf("Add Error %v", err)
+	}
+	if err := p.Add(conn, PollIn); !errors.Is(err, syscall.EEXIST) {
+		t.Errorf("Expected: errors.Is(err, syscall.EEXIST); Current: %v", err)
+	}
+	expectNoPoll(t, p)
+
+	// the session is reported for as long as it holds data
+	if _, err := sess.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write Error %v", err)
+	}
+	expectPoll(t, p, conn, PollIn)
+	expectPoll(t, p, conn, PollIn)
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("Expected: ping; Current: %q, %v", buf, err)
+	}
+	expectNoPoll(t, p)
+
+	if err := p.Modify(conn, PollIn|PollOut); err != nil {
+		t.Fatalf("Modify Error %v", err)
+	}
+	expectPoll(t, p, conn, PollOut)
+	if err := p.Modify(conn, PollIn); err != nil {
+		t.Fatalf("Modify Error %v", err)
+	}
+	expectNoPoll(t, p)
+
+	if err := sess.Close(); err != nil {
+		t.Fatalf("Close Error %v", err)
+	}
+	expectPoll(t, p, conn, PollIn|PollHup)
+	if err := p.Del(conn); err != nil {
+		t.Errorf("Del Error %v", err)
+	}
+	if err := p.Del(conn); !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("Expected: errors.Is(err, syscall.ENOENT); Current: %v", err)
+	}
+	expectNoPoll(t, p)
+
+	// closing a session removes it from the poller
+	if err := p.Add(conn, PollIn); err != nil {
+		t.Fatalf("Add Error %v", err)
+	}
+	_ = conn.Close()
+	expectNoPoll(t, p)
+	if err := p.Add(conn, PollIn); !errors.Is(err, syscall.EBADF) {
+		t.Errorf("Expected: errors.Is(err, syscall.EBADF); Current: %v", err)
+	}
+	if err := p.Add(ioutil.NopCloser(nil), PollIn); !errors.Is(err, syscall.EBADF) {
+		t.Errorf("Expected: errors.Is(err, syscall.EBADF); Current: %v", err)
+	}
+
+	waitErr := make(chan error, 1)
+	go func() {
+		_, err := p.Wait(context.Background(), make([]PollEvent, 1))
+		waitErr <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := p.Close(); err != nil {
+		t.Errorf("Close Error %v", err)
+	}
+	if err := <-waitErr; !errors.Is(err, ErrPollerClosed) {
+		t.Errorf("Expected: errors.Is(err, ErrPollerClosed); Current: %v", err)
+	}
+	if err := p.Add(l, PollIn); !errors.Is(err, ErrPollerClosed) {
+		t.Errorf("Expected: errors.Is(err, ErrPollerClosed); Current: %v", err)
+	}
+}
+
+func TestPollerEdgeTriggered(t *testing.T) {
+	next := make(chan struct{})
+	_, attachment, conn := dialSession(t, func(s *hoststacktest.Session) {
+		_, _ = s.Write([]byte("a"))
+		<-next
+		_, _ = s.Write([]byte("b"))
+		<-next
+		_ = s.Reset()
+	})
+	p := attachment.Workers()[0].NewPoller()
+	defer func() { _ = p.Close() }()
+	if err := p.Add(conn, PollIn|PollET); err != nil {
+		t.Fatalf("Add Error %v", err)
+	}
+
+	// the data is reported once, until VPP signals more
+	expectPoll(t, p, conn, PollIn)
+	expectNoPoll(t, p)
+	buf := make([]byte, 1)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(buf); err != nil || string(buf) != "a" {
+		t.Fatalf("Expected: a; Current: %q, %v", buf, err)
+	}
+	next <- struct{}{}
+	expectPoll(t, p, conn, PollIn)
+	if _, err := conn.Read(buf); err != nil || string(buf) != "b" {
+		t.Fatalf("Expected: b; Current: %q, %v", buf, err)
+	}
+
+	next <- struct{}{}
+	expectPoll(t, p, conn, PollIn|PollHup|PollReset)
+	expectNoPoll(t, p)
+}
+
+func TestPollerManySessions(t *testing.T) {
+	vpp := hoststacktest.NewServer(t, hoststacktest.WithSessionHandler(func(s *hoststacktest.Session) {
+		_, _ = s.Write([]byte("x"))
+	}))
+	attachment := attach(t, vpp)
+	p := attachment.Workers()[0].NewPoller()
+	defer func() { _ = p.Close() }()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	const sessions = 2
+	for i := 0; i < sessions; i++ {
+		conn, err := attachment.Dial(ctx, "tcp", "10.0.0.1:80")
+		if err != nil {
+			t.Fatalf("Dial Error %v", err)
+		}
+		defer func() { _ = conn.Close() }()
+		if err := p.Add(conn, PollIn); err != nil {
+			t.Fatalf("Add Error %v", err)
+		}
+	}
+
+	for {
+		if n, err := p.Wait(ctx, make([]PollEvent, sessions)); err != nil || n == sessions {
+			break
+		}
+	}
+
+	// the sessions are reported in turn when events has no room for all
+	seen := make(map[io.Closer]bool)
+	events := make([]PollEvent, 1)
+	for len(seen) < sessions {
+		n, err := p.Wait(ctx, events)
+		if err != nil {
+			t.Fatalf("Wait Error %v; Current: %d sessions reported", err, len(seen))
+		}
+		if n != 1 || events[0].Events&PollIn == 0 {
+			t.Fatalf("Expected: a readable session; Current: %+v", events[:n])
+		}
+		if seen[events[0].Conn] {
+			t.Fatalf("Expected: %d sessions reported in turn; Current: %v reported twice", sessions, events[0].Conn)
+		}
+		seen[events[0].Conn] = true
+	}
+	if _, err := p.Wait(ctx, nil); !errors.Is(err, syscall.EINVAL) {
+		t.Errorf("Expected: errors.Is(err, syscall.EINVAL); Current: %v", err)
+	}
+}
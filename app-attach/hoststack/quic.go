@@ -0,0 +1,344 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hoststack
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/godirect/hoststack/app-attach/hoststack/session"
+)
+
+// streamBacklog is the number of streams the peer opened a QUICSession
+// holds on to until AcceptStream returns them, further streams are closed
+const streamBacklog = 64
+
+// QUICSession is a quic connection VPP terminates. The connection carries
+// no data itself, its streams are net.Conns over sessions of their own: VPP
+// connects the streams OpenStream asks for as children of the connection and
+// reports the streams the peer opens as sessions accepted on it.
+type QUICSession struct {
+	worker       *Worker
+	session      *appSession
+	laddr, raddr net.Addr
+	config       TLSSessionConfig
+	backlog      chan *conn // the streams the peer opened
+	mu           sync.Mutex // serializes the bookkeeping of streams with Close
+	streams      map[*conn]struct{}
+	closed       chan struct{}
+	closeOnce    sync.Once
+}
+
+// QUICListener accepts the quic connections VPP accepted on a listener
+type QUICListener struct {
+	l *listener
+}
+
+func newQUICSession(w *Worker, s *appSession, laddr, raddr net.Addr, config *TLSSessionConfig) *QUICSession {
+	q := &QUICSession{
+		worker:  w,
+		session: s,
+		laddr:   laddr,
+		raddr:   raddr,
+		backlog: make(chan *conn, streamBacklog),
+		streams: make(map[*conn]struct{}),
+		closed:  make(chan struct{}),
+	}
+	if config != nil {
+		q.config = *config
+	}
+	return q
+}
+
+// DialQUIC connects to address over a quic connection of the first worker
+// of the attachment, see Worker.DialQUIC
+func (a *Attachment) DialQUIC(ctx context.Context, address string, config *TLSConfig) (*QUICSession, error) {
+	workers := a.Workers()
+	if len(workers) == 0 {
+		return nil, &net.OpError{Op: "dial", Net: "quic", Err: ErrDetached}
+	}
+	return workers[0].DialQUIC(ctx, address, config)
+}
+
+// DialQUIC connects to address over a quic connection of the worker, with
+// the crypto config of config as for DialTLS. Data goes over the streams of
+// the returned connection.
+func (w *Worker) DialQUIC(ctx context.Context, address string, config *TLSConfig) (*QUICSession, error) {
+	const network = "quic"
+	if config == nil {
+		config = &TLSConfig{}
+	}
+	ip, port, err := resolveAddr(ctx, network, address, false)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	raddr := sockAddr(network, ip, port)
+	serverName := config.ServerName
+	if serverName == "" {
+		if host, _, _ := net.SplitHostPort(address); net.ParseIP(host) == nil {
+			serverName = host
+		}
+	}
+	cfg, err := config.extConfig(serverName)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: raddr, Err: err}
+	}
+	q := newQUICSession(w, nil, nil, raddr, sessionConfig(cfg))
+	s, reply, err := w.connect(ctx, &connectRequest{proto: session.TransportProtoQUIC, ip: ip, port: port, cfg: cfg, quic: q})
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: raddr, Err: err}
+	}
+	q.session = s
+	q.laddr = endpointAddr(network, &reply.Lcl)
+	return q, nil
+}
+
+// ListenQUIC listens on address for quic connections of the first worker of
+// the attachment, see Worker.ListenQUIC
+func (a *Attachment) ListenQUIC(ctx context.Context, address string, config *TLSConfig) (*QUICListener, error) {
+	workers := a.Workers()
+	if len(workers) == 0 {
+		return nil, &net.OpError{Op: "listen", Net: "quic", Err: ErrDetached}
+	}
+	return workers[0].ListenQUIC(ctx, address, config)
+}
+
+// ListenQUIC asks VPP to listen on address for quic connections of the
+// worker, presenting the certificate of config.CertKey
+func (w *Worker) ListenQUIC(ctx context.Context, address string, config *TLSConfig) (*QUICListener, error) {
+	const network = "quic"
+	if config == nil {
+		config = &TLSConfig{}
+	}
+	cfg, err := config.extConfig(config.ServerName)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+	l, _, err := w.listen(ctx, network, address, 0, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &QUICListener{l: l}, nil
+}
+
+// Accept waits until ctx ends for a quic connection VPP accepted
+func (ql *QUICListener) Accept(ctx context.Context) (*QUICSession, error) {
+	c, err := ql.l.accept(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.(*QUICSession), nil
+}
+
+// Close stops listening and closes the connections Accept did not return
+func (ql *QUICListener) Close() error {
+	return ql.l.Close()
+}
+
+// Addr returns the address VPP listens on
+func (ql *QUICListener) Addr() net.Addr {
+	return ql.l.Addr()
+}
+
+// OpenStream opens a stream on the connection, waiting until ctx ends for
+// VPP to connect it
+func (q *QUICSession) OpenStream(ctx context.Context) (net.Conn, error) {
+	if err := q.usable(); err != nil {
+		return nil, q.opError("open stream", err)
+	}
+	raddr := q.raddr.(*net.UDPAddr)
+	s, _, err := q.worker.connect(ctx, &connectRequest{
+		proto:  session.TransportProtoQUIC,
+		ip:     raddr.IP,
+		port:   raddr.Port,
+		quic:   q,
+		stream: true,
+	})
+	if err != nil {
+		return nil, q.opError("open stream", err)
+	}
+	c := newConn(s, "quic", q.laddr, q.raddr)
+	if !q.addStream(c) {
+		_ = c.Close()
+		return nil, q.opError("open stream", errConnClosed)
+	}
+	return c, nil
+}
+
+// AcceptStream waits until ctx ends for a stream the peer opened
+func (q *QUICSession) AcceptStream(ctx context.Context) (net.Conn, error) {
+	select {
+	case c := <-q.backlog:
+		return c, nil
+	default:
+	}
+	select {
+	case c := <-q.backlog:
+		return c, nil
+	case <-q.closed:
+		return nil, q.opError("accept stream", errConnClosed)
+	case <-q.session.closing:
+		err := q.usable()
+		if err == nil {
+			err = errConnGone
+		}
+		return nil, q.opError("accept stream", err)
+	case <-ctx.Done():
+		return nil, q.opError("accept stream", ctx.Err())
+	}
+}
+
+// Close closes the streams of the connection, then the connection
+func (q *QUICSession) Close() error {
+	err := errConnClosed
+	q.closeOnce.Do(func() {
+		q.mu.Lock()
+		close(q.closed)
+		streams := q.streams
+		q.streams = nil
+		q.mu.Unlock()
+		for c := range streams {
+			_ = c.Close()
+		}
+		for {
+			select {
+			case c := <-q.backlog:
+				_ = c.Close()
+				continue
+			default:
+			}
+			break
+		}
+		if err = q.session.close(); errors.Is(err, ErrWorkerClosed) {
+			err = nil
+		}
+	})
+	if err != nil {
+		return q.opError("close", err)
+	}
+	return nil
+}
+
+// LocalAddr returns the local address of the connection
+func (q *QUICSession) LocalAddr() net.Addr {
+	return q.laddr
+}
+
+// RemoteAddr returns the address of the peer of the connection
+func (q *QUICSession) RemoteAddr() net.Addr {
+	return q.raddr
+}
+
+// SessionConfig returns the crypto config the connection was opened with
+func (q *QUICSession) SessionConfig() TLSSessionConfig {
+	return q.config
+}
+
+// accepted takes over a stream the peer opened on the connection, off the
+// dispatcher
+func (q *QUICSession) accepted(s *appSession, msg *session.AcceptedMsg) {
+	if !q.worker.acceptSession(s, msg) {
+		return
+	}
+	c := newConn(s, "quic", q.laddr, q.raddr)
+	if !q.addStream(c) {
+		_ = c.Close()
+		return
+	}
+	select {
+	case q.backlog <- c:
+	default:
+		log.Warnf("quic connection %v drops stream %#x, AcceptStream is not keeping up", q.raddr, msg.Handle)
+		q.removeStream(c)
+		_ = c.Close()
+		return
+	}
+	q.session.pollNotify(PollIn)
+}
+
+// addStream tracks a stream of the connection, it fails once the connection
+// is closed
+func (q *QUICSession) addStream(c *conn) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.streams == nil {
+		return false
+	}
+	for other := range q.streams {
+		if isClosedChan(other.closed) {
+			delete(q.streams, other)
+		}
+	}
+	q.streams[c] = struct{}{}
+	return true
+}
+
+func (q *QUICSession) removeStream(c *conn) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.streams, c)
+}
+
+// endStreams ends the streams of the connection once VPP ended it: they
+// read what is left and then io.EOF if the peer closed the connection, they
+// are reset otherwise
+func (q *QUICSession) endStreams(peerClosed bool) {
+	q.mu.Lock()
+	streams := make([]*conn, 0, len(q.streams))
+	for c := range q.streams {
+		streams = append(streams, c)
+	}
+	q.mu.Unlock()
+	for _, c := range streams {
+		s := c.session
+		s.end(func() {
+			if peerClosed {
+				s.peerClosed = true
+			} else {
+				s.reset = true
+			}
+		})
+	}
+}
+
+// usable returns why the connection cannot carry new streams, if it cannot
+func (q *QUICSession) usable() error {
+	if isClosedChan(q.closed) {
+		return errConnClosed
+	}
+	q.session.mu.RLock()
+	defer q.session.mu.RUnlock()
+	switch {
+	case q.session.reset:
+		return syscall.ECONNRESET
+	case q.session.peerClosed:
+		return io.EOF
+	case q.session.gone:
+		return errConnGone
+	}
+	return nil
+}
+
+func (q *QUICSession) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "quic", Source: q.laddr, Addr: q.raddr, Err: err}
+}
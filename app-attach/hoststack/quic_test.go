@@ -0,0 +1,226 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hoststack
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/godirect/hoststack/app-attach/hoststack/hoststacktest"
+)
+
+// echoStream checks that stream carries msg both ways
+func echoStream(t *testing.T, stream net.Conn, msg string) {
+	_ = stream.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(stream, msg); err != nil {
+		t.Fatalf("Write Error %v", err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(stream, buf); err != nil || string(buf) != msg {
+		t.Errorf("Expected: %s; Current: %q, %v", msg, buf, err)
+	}
+}
+
+func TestDialQUIC(t *testing.T) {
+	_, attachment, index, sessions := attachTLS(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	config := &TLSConfig{CertKey: index, ServerName: "hoststack.test"}
+	q, err := attachment.DialQUIC(ctx, "10.0.0.1:443", config)
+	if err != nil {
+		t.Fatalf("DialQUIC Error %v", err)
+	}
+	defer func() { _ = q.Close() }()
+	want := TLSSessionConfig{ServerName: "hoststack.test", CertKey: index}
+	if config := q.SessionConfig(); !reflect.DeepEqual(config, want) {
+		t.Errorf("Expected: %+v; Current: %+v", want, config)
+	}
+	if raddr, ok := q.RemoteAddr().(*net.UDPAddr); !ok || raddr.String() != "10.0.0.1:443" {
+		t.Errorf("Expected: 10.0.0.1:443 over udp; Current: %#v", q.RemoteAddr())
+	}
+
+	var streams []net.Conn
+	for _, msg := range []string{"first", "second"} {
+		stream, err := q.OpenStream(ctx)
+		if err != nil {
+			t.Fatalf("OpenStream Error %v", err)
+		}
+		defer func() { _ = stream.Close() }()
+		sess := <-sessions
+		if params, ok := sess.TLS(); !ok || params.ServerName != "hoststack.test" {
+			t.Errorf("Expected: the stream to share the crypto config of its connection; Current: %+v", params)
+		}
+		echoStream(t, stream, msg)
+		streams = append(streams, stream)
+	}
+
+	// closing a stream leaves the connection and its other streams alone
+	if err := streams[0].Close(); err != nil {
+		t.Errorf("Close Error %v", err)
+	}
+	echoStream(t, streams[1], "still there")
+	stream, err := q.OpenStream(ctx)
+	if err != nil {
+		t.Fatalf("OpenStream Error %v", err)
+	}
+	<-sessions
+	echoStream(t, stream, "third")
+
+	if err := q.Close(); err != nil {
+		t.Errorf("Close Error %v", err)
+	}
+	if _, err := stream.Write([]byte("closed")); err == nil {
+		t.Errorf("Expected: the streams to be closed along with the connection")
+	}
+	if _, err := q.OpenStream(ctx); err == nil {
+		t.Errorf("Expected: no stream on a closed connection")
+	}
+	if err := q.Close(); err == nil {
+		t.Errorf("Expected: an error closing twice")
+	}
+}
+
+func TestDialQUICErrors(t *testing.T) {
+	_, attachment, _, _ := attachTLS(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := attachment.DialQUIC(ctx, "10.0.0.1:443", &TLSConfig{CertKey: 42}); !errors.Is(err, SessionErrNoCryptoCkp) {
+		t.Errorf("Expected: errors.Is(err, SessionErrNoCryptoCkp); Current: %v", err)
+	}
+	if _, err := attachment.DialQUIC(ctx, "10.0.0.1:443", &TLSConfig{ServerName: string(make([]byte, 256))}); !errors.Is(err, ErrTLSConfig) {
+		t.Errorf("Expected: errors.Is(err, ErrTLSConfig); Current: %v", err)
+	}
+	var unknown net.UnknownNetworkError
+	if _, err := attachment.Dial(ctx, "quic", "10.0.0.1:443"); !errors.As(err, &unknown) {
+		t.Errorf("Expected: net.UnknownNetworkError dialing quic; Current: %v", err)
+	}
+	if _, err := attachment.Listen(ctx, "quic", ":443"); !errors.As(err, &unknown) {
+		t.Errorf("Expected: net.UnknownNetworkError listening on quic; Current: %v", err)
+	}
+}
+
+// acceptQUIC listens for quic connections and accepts one connected by a
+// peer of vpp
+func acceptQUIC(t *testing.T, vpp *hoststacktest.Server, attachment *Attachment) (*hoststacktest.Session, *QUICSession) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	l, err := attachment.ListenQUIC(ctx, ":443", nil)
+	if err != nil {
+		t.Fatalf("ListenQUIC Error %v", err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	sessc := make(chan *hoststacktest.Session, 1)
+	go func() {
+		sess, err := vpp.Connect(ctx, "quic", l.Addr().String())
+		if err != nil {
+			t.Errorf("Connect Error %v", err)
+		}
+		sessc <- sess
+	}()
+	q, err := l.Accept(ctx)
+	if err != nil {
+		t.Fatalf("Accept Error %v", err)
+	}
+	t.Cleanup(func() { _ = q.Close() })
+	sess := <-sessc
+	if sess == nil {
+		t.FailNow()
+	}
+	return sess, q
+}
+
+func TestListenQUIC(t *testing.T) {
+	vpp, attachment, _, sessions := attachTLS(t)
+	peer, q := acceptQUIC(t, vpp, attachment)
+	if _, ok := q.RemoteAddr().(*net.UDPAddr); !ok {
+		t.Errorf("Expected: a UDP address; Current: %T", q.RemoteAddr())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// streams the peer opens
+	peerStream, err := peer.OpenStream(ctx)
+	if err != nil {
+		t.Fatalf("OpenStream Error %v", err)
+	}
+	stream, err := q.AcceptStream(ctx)
+	if err != nil {
+		t.Fatalf("AcceptStream Error %v", err)
+	}
+	if _, err := peerStream.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write Error %v", err)
+	}
+	buf := make([]byte, 4)
+	_ = stream.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(stream, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("Expected: ping; Current: %q, %v", buf, err)
+	}
+
+	// streams the application opens
+	ownStream, err := q.OpenStream(ctx)
+	if err != nil {
+		t.Fatalf("OpenStream Error %v", err)
+	}
+	<-sessions
+	echoStream(t, ownStream, "pong")
+
+	// the peer closing the connection closes its streams
+	if err := peer.Close(); err != nil {
+		t.Fatalf("Close Error %v", err)
+	}
+	if _, err := ioutil.ReadAll(stream); err != nil {
+		t.Errorf("Expected: io.EOF on the streams of a closed connection; Current: %v", err)
+	}
+	if _, err := q.AcceptStream(ctx); !errors.Is(err, io.EOF) {
+		t.Errorf("Expected: errors.Is(err, io.EOF); Current: %v", err)
+	}
+	if _, err := q.OpenStream(ctx); !errors.Is(err, io.EOF) {
+		t.Errorf("Expected: errors.Is(err, io.EOF); Current: %v", err)
+	}
+}
+
+func TestQUICReset(t *testing.T) {
+	vpp, attachment, _, _ := attachTLS(t)
+	peer, q := acceptQUIC(t, vpp, attachment)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := peer.OpenStream(ctx); err != nil {
+		t.Fatalf("OpenStream Error %v", err)
+	}
+	stream, err := q.AcceptStream(ctx)
+	if err != nil {
+		t.Fatalf("AcceptStream Error %v", err)
+	}
+	if err := peer.Reset(); err != nil {
+		t.Fatalf("Reset Error %v", err)
+	}
+	_ = stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := stream.Read(make([]byte, 1)); !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("Expected: errors.Is(err, syscall.ECONNRESET); Current: %v", err)
+	}
+	if _, err := q.AcceptStream(ctx); !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("Expected: errors.Is(err, syscall.ECONNRESET); Current: %v", err)
+	}
+}
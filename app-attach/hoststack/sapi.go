@@ -0,0 +1,272 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hoststack
+
+import (
+	"context"
+	"encoding"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/godirect/hoststack/app-attach/hoststack/appsock"
+)
+
+// aLongTimeAgo is a deadline in the past, used to interrupt blocked reads
+var aLongTimeAgo = time.Unix(1, 0)
+
+// replyTimeout bounds how long requests without a context wait for VPP
+const replyTimeout = 5 * time.Second
+
+// withConnContext runs fn with the deadline of conn bound to ctx. If ctx ends
+// while fn is blocked, the error of fn is replaced by the error of ctx.
+func withConnContext(ctx context.Context, conn net.Conn, fn func() error) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return err
+		}
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(aLongTimeAgo)
+		case <-stop:
+		}
+	}()
+	err := fn()
+	close(stop)
+	<-done
+	_ = conn.SetDeadline(time.Time{})
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	// the conn deadline may expire before the timer of ctx fires
+	if deadline, ok := ctx.Deadline(); ok && err != nil && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return err
+}
+
+// sendMsg writes one message to the app socket
+func sendMsg(conn net.Conn, msg encoding.BinaryMarshaler) error {
+	encMsg, encErr := msg.MarshalBinary()
+	if encErr != nil {
+		return errors.Wrap(encErr, "error while encoding message")
+	}
+	if _, writeErr := conn.Write(encMsg); writeErr != nil {
+		return wrapErr(ErrSend, writeErr)
+	}
+	return nil
+}
+
+// sapiConn is a connection to the app socket. Besides the replies to the
+// requests of the application, VPP sends the fds of the segments it adds
+// over it, so requests and fd receives are serialized and fds that arrive
+// while a reply is awaited are kept for recvFds.
+type sapiConn struct {
+	net.Conn
+	mu      sync.Mutex // held for the duration of an exchange
+	sentFds [][]int    // fds passed by VPP and not received yet
+}
+
+func newSapiConn(conn net.Conn) *sapiConn {
+	return &sapiConn{Conn: conn}
+}
+
+// exchange runs fn, a request/reply exchange or fd receive, alone on the
+// connection and bound to ctx
+func (c *sapiConn) exchange(ctx context.Context, fn func() error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return withConnContext(ctx, c.Conn, fn)
+}
+
+// recvMsg reads one message of type msgType from the app socket into msg,
+// along with up to maxFds file descriptors. The fds are closed on error. It
+// must be called within exchange.
+func (c *sapiConn) recvMsg(msgType appsock.AppSapiMsgType, msg encoding.BinaryUnmarshaler, maxFds int) ([]int, error) {
+	reader, ok := c.Conn.(unixMsgReader)
+	if !ok {
+		return nil, wrapErr(ErrNotDialed, errors.Errorf("connection of type %T cannot receive file descriptors", c.Conn))
+	}
+	buf := make([]byte, appsock.MsgSize)
+	// room for the fds of a segment VPP sends in between
+	if maxFds < maxSegmentFds {
+		maxFds = maxSegmentFds
+	}
+	oob := make([]byte, syscall.CmsgSpace(4*maxFds))
+	for {
+		n, oobn, flags, _, readErr := reader.ReadMsgUnix(buf, oob)
+		fds, fdErr := parseFds(oob[:oobn])
+		if readErr != nil {
+			closeFds(fds)
+			return nil, wrapErr(ErrRecv, readErr)
+		}
+		if fdErr != nil {
+			closeFds(fds)
+			return nil, wrapErr(ErrRecv, fdErr)
+		}
+		if flags&syscall.MSG_CTRUNC != 0 {
+			closeFds(fds)
+			return nil, wrapErr(ErrBadFdCount, errors.Errorf("more than %d fds passed, the excess was dropped", maxFds))
+		}
+		if flags&syscall.MSG_TRUNC != 0 {
+			closeFds(fds)
+			return nil, wrapErr(ErrRecv, errors.Errorf("message longer than %d bytes", appsock.MsgSize))
+		}
+		if n < appsock.MsgSize {
+			closeFds(fds)
+			return nil, wrapErr(ErrShortReply, errors.Errorf("got %d bytes, want %d", n, appsock.MsgSize))
+		}
+		t := appsock.PeekMsgType(buf)
+		if t == appsock.MsgTypeSendFds && msgType != appsock.MsgTypeSendFds {
+			c.sentFds = append(c.sentFds, fds)
+			continue
+		}
+		if t != msgType {
+			closeFds(fds)
+			return nil, wrapErr(ErrRecv, errors.Errorf("got message type %d, want %d", t, msgType))
+		}
+		if decErr := msg.UnmarshalBinary(buf[:n]); decErr != nil {
+			closeFds(fds)
+			return nil, wrapErr(ErrShortReply, decErr)
+		}
+		return fds, nil
+	}
+}
+
+// maxSegmentFds is the number of fds VPP passes with a segment at most
+const maxSegmentFds = 1
+
+// recvFds receives the fds VPP passed ahead of an event, waiting for them
+// until ctx ends
+func (c *sapiConn) recvFds(ctx context.Context) ([]int, error) {
+	var fds []int
+	err := c.exchange(ctx, func() error {
+		if len(c.sentFds) > 0 {
+			fds = c.sentFds[0]
+			c.sentFds = c.sentFds[1:]
+			return nil
+		}
+		var msg appsock.AppSapiMsgSendFds
+		var recvErr error
+		fds, recvErr = c.recvMsg(appsock.MsgTypeSendFds, &msg, maxSegmentFds)
+		return recvErr
+	})
+	return fds, err
+}
+
+// Close closes the connection and the fds that were never received
+func (c *sapiConn) Close() error {
+	err := c.Conn.Close()
+	c.dropFds()
+	return err
+}
+
+// shutdown closes the application end of the connection and waits for VPP
+// to close its own until ctx ends, dropping what VPP sends meanwhile. The
+// connection is closed either way.
+func (c *sapiConn) shutdown(ctx context.Context) error {
+	var err error
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		if err = cw.CloseWrite(); err == nil {
+			err = c.exchange(ctx, c.drain)
+		}
+	}
+	if closeErr := c.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// drain reads and drops messages and fds until VPP closes the connection. It
+// must be called within exchange.
+func (c *sapiConn) drain() error {
+	reader, ok := c.Conn.(unixMsgReader)
+	if !ok {
+		return nil
+	}
+	buf := make([]byte, appsock.MsgSize)
+	oob := make([]byte, syscall.CmsgSpace(4*maxReplyFds))
+	for {
+		n, oobn, _, _, err := reader.ReadMsgUnix(buf, oob)
+		fds, _ := parseFds(oob[:oobn])
+		closeFds(fds)
+		if errors.Is(err, io.EOF) || err == nil && n == 0 && oobn == 0 {
+			return nil
+		}
+		if err != nil {
+			return wrapErr(ErrRecv, err)
+		}
+	}
+}
+
+// dropFds closes the fds passed by VPP that were never received
+func (c *sapiConn) dropFds() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, fds := range c.sentFds {
+		closeFds(fds)
+	}
+	c.sentFds = nil
+}
+
+// fdsByFlag maps the fds of a reply to the fd flags set in fdFlags, VPP
+// sends them in the order of the flag bits
+func fdsByFlag(fdFlags uint8, fds []int) (map[uint8]int, error) {
+	byFlag := make(map[uint8]int)
+	for flag := appsock.FdFlagVppMqSegment; flag <= appsock.FdFlagMqEventfd; flag <<= 1 {
+		if fdFlags&flag == 0 {
+			continue
+		}
+		if len(fds) == 0 {
+			return nil, wrapErr(ErrBadFdCount, errors.Errorf("missing fd for fd flag %#x", flag))
+		}
+		byFlag[flag] = fds[0]
+		fds = fds[1:]
+	}
+	if len(fds) != 0 {
+		return nil, wrapErr(ErrBadFdCount, errors.Errorf("%d fds without fd flag", len(fds)))
+	}
+	return byFlag, nil
+}
+
+// takeFd removes the fd of flag from fds and returns it, or -1 if there is
+// none
+func takeFd(fds map[uint8]int, flag uint8) int {
+	fd, ok := fds[flag]
+	if !ok {
+		return -1
+	}
+	delete(fds, flag)
+	return fd
+}
+
+// closeFdMap closes the fds left in fds
+func closeFdMap(fds map[uint8]int) {
+	for flag, fd := range fds {
+		_ = syscall.Close(fd)
+		delete(fds, flag)
+	}
+}
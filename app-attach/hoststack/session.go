@@ -0,0 +1,716 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hoststack
+
+import (
+	"context"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/godirect/hoststack/app-attach/hoststack/fifo"
+	"github.com/godirect/hoststack/app-attach/hoststack/msgq"
+	"github.com/godirect/hoststack/app-attach/hoststack/session"
+)
+
+// appSession is the application side of a VPP session. Its index is the
+// client session index VPP tags the io events of its fifos with.
+type appSession struct {
+	worker   *Worker
+	index    uint32
+	reply    chan *Event   // receives the reply to a connect, listen or unlisten
+	listener *listener     // set for listening sessions
+	rxEvent  chan struct{} // signalled when VPP enqueued data
+	txEvent  chan struct{} // signalled when VPP dequeued data
+	closing  chan struct{} // closed when the peer or VPP ends the session
+
+	mu         sync.RWMutex // held for reading while the fifos are in use
+	handle     uint64
+	segment    uint64 // handle of the segment of the fifos
+	rx, tx     *fifo.Fifo
+	vppEvtQ    *msgq.Queue
+	quic       *QUICSession // set for quic connections, streams are accepted on them
+	pending    bool         // waiting for the reply to a connect or listen
+	abandoned  bool         // the request was given up on before VPP answered
+	closed     bool         // closed by the application
+	peerClosed bool
+	reset      bool
+	gone       bool // VPP freed the session or the worker is released
+
+	// the fifos of the session in VPP, VPP tracks its io events on them:
+	// rx and tx unless the session is cut-through, its data then goes
+	// through fifos shared with the peer in a segment of their own
+	evtSegment   uint64
+	evtRx, evtTx *fifo.Fifo
+
+	pollItems []*pollItem // the pollers waiting on the session, replaced on change
+}
+
+func newAppSession(worker *Worker, index uint32) *appSession {
+	return &appSession{
+		worker:  worker,
+		index:   index,
+		handle:  session.InvalidHandle,
+		reply:   make(chan *Event, 1),
+		rxEvent: make(chan struct{}, 1),
+		txEvent: make(chan struct{}, 1),
+		closing: make(chan struct{}),
+	}
+}
+
+// sessionTable holds the sessions of a worker by index and by handle
+type sessionTable struct {
+	mu        sync.Mutex
+	byIndex   map[uint32]*appSession
+	byHandle  map[uint64]*appSession
+	nextIndex uint32
+}
+
+func newSessionTable() sessionTable {
+	return sessionTable{
+		byIndex:  make(map[uint32]*appSession),
+		byHandle: make(map[uint64]*appSession),
+	}
+}
+
+// add creates a session with an index no other session of the worker uses,
+// pending the reply to a connect or listen if pending is set. Listening
+// sessions are created with their listener.
+func (t *sessionTable) add(worker *Worker, pending bool, l *listener) *appSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for {
+		index := t.nextIndex
+		t.nextIndex++
+		if _, ok := t.byIndex[index]; !ok {
+			s := newAppSession(worker, index)
+			s.pending = pending
+			s.listener = l
+			t.byIndex[index] = s
+			return s
+		}
+	}
+}
+
+// setHandle makes the session reachable by the handle VPP assigned to it
+func (t *sessionTable) setHandle(s *appSession, handle uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s.handle = handle
+	t.byHandle[handle] = s
+}
+
+func (t *sessionTable) get(index uint32) *appSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.byIndex[index]
+}
+
+func (t *sessionTable) getByHandle(handle uint64) *appSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.byHandle[handle]
+}
+
+func (t *sessionTable) remove(s *appSession) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.byIndex[s.index] == s {
+		delete(t.byIndex, s.index)
+	}
+	if s.handle != session.InvalidHandle && t.byHandle[s.handle] == s {
+		delete(t.byHandle, s.handle)
+	}
+}
+
+// closeAll ends all sessions, the fifos are about to be unmapped
+func (t *sessionTable) closeAll() {
+	t.mu.Lock()
+	sessions := t.byIndex
+	t.byIndex = make(map[uint32]*appSession)
+	t.byHandle = make(map[uint64]*appSession)
+	t.mu.Unlock()
+	for _, s := range sessions {
+		s := s
+		s.end(func() { s.gone = true })
+	}
+}
+
+// endInSegment ends the sessions with fifos in the segment of
+// segmentHandle, the segment is about to be unmapped
+func (t *sessionTable) endInSegment(segmentHandle uint64) {
+	t.mu.Lock()
+	var sessions []*appSession
+	for _, s := range t.byIndex {
+		sessions = append(sessions, s)
+	}
+	t.mu.Unlock()
+	for _, s := range sessions {
+		s := s
+		s.mu.RLock()
+		inSegment := s.rx != nil && (s.segment == segmentHandle || s.evtSegment == segmentHandle)
+		s.mu.RUnlock()
+		if inSegment {
+			s.end(func() { s.gone = true })
+		}
+	}
+}
+
+// handleEvent hands event to the session it is for and reports whether it
+// found one
+func (w *Worker) handleEvent(event *Event) bool {
+	switch event.Type {
+	case EventIORx, EventIOTx:
+		index, ok := session.IOSessionIndex(event.Data)
+		if !ok {
+			return false
+		}
+		s := w.sessions.get(index)
+		if s == nil {
+			return false
+		}
+		if event.Type == EventIORx {
+			notify(s.rxEvent)
+			s.pollNotify(PollIn)
+		} else {
+			notify(s.txEvent)
+			s.pollNotify(PollOut)
+		}
+		return true
+	case EventConnected:
+		var msg session.ConnectedMsg
+		if session.Unmarshal(event.Data, &msg) != nil {
+			return false
+		}
+		s := w.sessions.get(msg.Context)
+		if s == nil {
+			return false
+		}
+		return w.replied(s, msg.Handle, msg.Retval, event)
+	case EventBound:
+		var msg session.BoundMsg
+		if session.Unmarshal(event.Data, &msg) != nil {
+			return false
+		}
+		s := w.sessions.get(msg.Context)
+		if s == nil {
+			return false
+		}
+		return w.replied(s, msg.Handle, msg.Retval, event)
+	case EventUnlistenReply:
+		var msg session.UnlistenReplyMsg
+		if session.Unmarshal(event.Data, &msg) != nil {
+			return false
+		}
+		s := w.sessions.getByHandle(msg.Handle)
+		if s == nil || s.listener == nil {
+			return false
+		}
+		w.sessions.remove(s)
+		select {
+		case s.reply <- event:
+		default:
+		}
+		s.end(func() { s.gone = true })
+		return true
+	case EventAccepted:
+		var msg session.AcceptedMsg
+		if session.Unmarshal(event.Data, &msg) != nil {
+			return false
+		}
+		s := w.sessions.getByHandle(msg.ListenerHandle)
+		switch {
+		case s == nil:
+			return false
+		case s.listener != nil:
+			// the events VPP sends next for the session find it, while it
+			// is opened and VPP is replied to off the dispatcher
+			go s.listener.accepted(w.acceptedSession(&msg), &msg)
+		case s.getQUIC() != nil:
+			go s.getQUIC().accepted(w.acceptedSession(&msg), &msg)
+		default:
+			return false
+		}
+		return true
+	case EventDisconnected:
+		var msg session.DisconnectedMsg
+		if session.Unmarshal(event.Data, &msg) != nil {
+			return false
+		}
+		s := w.sessions.getByHandle(msg.Handle)
+		if s == nil {
+			return false
+		}
+		s.end(func() { s.peerClosed = true })
+		return true
+	case EventReset:
+		var msg session.ResetMsg
+		if session.Unmarshal(event.Data, &msg) != nil {
+			return false
+		}
+		s := w.sessions.getByHandle(msg.Handle)
+		if s == nil {
+			return false
+		}
+		s.end(func() { s.reset = true })
+		return true
+	case EventCleanup:
+		var msg session.CleanupMsg
+		if session.Unmarshal(event.Data, &msg) != nil {
+			return false
+		}
+		s := w.sessions.getByHandle(msg.Handle)
+		if s == nil {
+			return false
+		}
+		if msg.Type == session.CleanupSession {
+			w.sessions.remove(s)
+			s.end(func() { s.gone = true })
+		}
+		return true
+	case EventAppAddSegment:
+		var msg session.AppAddSegmentMsg
+		if session.Unmarshal(event.Data, &msg) != nil {
+			return false
+		}
+		if err := w.addSegment(&msg); err != nil {
+			log.Errorf("worker %d cannot map segment %#x: %v", w.index, msg.SegmentHandle, err)
+		}
+		return true
+	case EventAppDelSegment:
+		var msg session.AppDelSegmentMsg
+		if session.Unmarshal(event.Data, &msg) != nil {
+			return false
+		}
+		if err := w.delSegment(msg.SegmentHandle); err != nil {
+			log.Warnf("worker %d cannot unmap segment %#x: %v", w.index, msg.SegmentHandle, err)
+		}
+		return true
+	}
+	return false
+}
+
+// replied hands the reply to a connect or listen to the session waiting for
+// it, it reports whether the session was waiting. A session VPP connected or
+// bound after the application gave up on it is closed right away.
+func (w *Worker) replied(s *appSession, handle uint64, retval int32, event *Event) bool {
+	s.mu.Lock()
+	if !s.pending {
+		s.mu.Unlock()
+		return false
+	}
+	s.pending = false
+	abandoned := s.abandoned
+	s.mu.Unlock()
+	// the events VPP sends next may name the session by its handle
+	if retval == 0 {
+		w.sessions.setHandle(s, handle)
+	}
+	if !abandoned {
+		s.reply <- event
+		return true
+	}
+	if retval != 0 {
+		w.sessions.remove(s)
+		return true
+	}
+	go func() {
+		if err := s.close(); err != nil {
+			log.Warnf("cannot close session %#x: %v", handle, err)
+		}
+	}()
+	return true
+}
+
+// open attaches the session to the fifos VPP allocated for it in the
+// segment of segmentHandle
+func (s *appSession) open(segmentHandle, rxFifo, txFifo, vppEvtQ uint64) error {
+	w := s.worker
+	w.waitSegment(segmentHandle)
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.released {
+		return ErrWorkerClosed
+	}
+	segment, ok := w.fifoSegments[segmentHandle]
+	if !ok {
+		return errors.Errorf("session fifos in unknown segment %#x", segmentHandle)
+	}
+	rx, err := segment.Fifo(rxFifo)
+	if err != nil {
+		return errors.WithMessage(err, "rx fifo")
+	}
+	tx, err := segment.Fifo(txFifo)
+	if err != nil {
+		return errors.WithMessage(err, "tx fifo")
+	}
+	queue, err := w.attachment.vppEventQueue(vppEvtQ)
+	if err != nil {
+		return err
+	}
+	rx.SetClientSessionIndex(s.index)
+	tx.SetClientSessionIndex(s.index)
+	s.mu.Lock()
+	s.segment, s.rx, s.tx, s.vppEvtQ = segmentHandle, rx, tx, queue
+	s.evtSegment, s.evtRx, s.evtTx = segmentHandle, rx, tx
+	s.mu.Unlock()
+	return nil
+}
+
+// openCutThrough moves the data of a session VPP connected to a listener of
+// an application in the same namespace to the fifos the two share in the
+// cut-through segment of segmentHandle. The fifos belong to the session of
+// the peer, their client session index is left alone.
+func (s *appSession) openCutThrough(segmentHandle, rxFifo, txFifo uint64) error {
+	w := s.worker
+	w.waitSegment(segmentHandle)
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.released {
+		return ErrWorkerClosed
+	}
+	segment, ok := w.fifoSegments[segmentHandle]
+	if !ok {
+		return errors.Errorf("cut-through fifos in unknown segment %#x", segmentHandle)
+	}
+	rx, err := segment.Fifo(rxFifo)
+	if err != nil {
+		return errors.WithMessage(err, "cut-through rx fifo")
+	}
+	tx, err := segment.Fifo(txFifo)
+	if err != nil {
+		return errors.WithMessage(err, "cut-through tx fifo")
+	}
+	s.mu.Lock()
+	s.segment, s.rx, s.tx = segmentHandle, rx, tx
+	s.mu.Unlock()
+	return nil
+}
+
+// setQUIC makes the session the one of the quic connection q
+func (s *appSession) setQUIC(q *QUICSession) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.quic = q
+}
+
+func (s *appSession) getQUIC() *QUICSession {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.quic
+}
+
+// abandon gives up on a connect VPP has not answered yet, it reports
+// whether the reply arrived in the meantime
+func (s *appSession) abandon() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.pending {
+		return false
+	}
+	s.abandoned = true
+	return true
+}
+
+// peerState reports whether the peer closed or reset the session
+func (s *appSession) peerState() (peerClosed, reset bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.peerClosed, s.reset
+}
+
+// end records why the session ends and wakes its readers, writers and
+// pollers. The streams of a quic connection end with it.
+func (s *appSession) end(fn func()) {
+	s.mu.Lock()
+	fn()
+	select {
+	case <-s.closing:
+	default:
+		close(s.closing)
+	}
+	q, peerClosed := s.quic, s.peerClosed && !s.reset && !s.gone
+	s.mu.Unlock()
+	s.pollNotify(pollConditions)
+	if q != nil {
+		q.endStreams(peerClosed)
+	}
+}
+
+// read dequeues data from the rx fifo. It returns no data and no error when
+// the fifo is empty, once it made sure VPP signals the data it enqueues
+// next. It also reports whether VPP asked to be notified of the dequeue.
+func (s *appSession) read(b []byte) (int, bool, error) {
+	s.worker.mu.RLock()
+	defer s.worker.mu.RUnlock()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if err := s.usable(); err != nil {
+		return 0, false, err
+	}
+	n, err := s.rx.Dequeue(b)
+	if errors.Is(err, fifo.ErrEmpty) {
+		s.unsetRxEvent()
+		if n, err = s.rx.Dequeue(b); errors.Is(err, fifo.ErrEmpty) {
+			return 0, false, nil
+		}
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	s.rxDrained()
+	notify := s.rx.NeedsDeqNtf(uint32(n))
+	if notify {
+		s.rx.ClearDeqNtf()
+	}
+	return n, notify, nil
+}
+
+// write enqueues data to the tx fifo. It returns no data and no error when
+// the fifo is full, once it asked VPP to signal the room it makes next. It
+// also reports whether VPP must be told about the data.
+func (s *appSession) write(b []byte) (int, bool, error) {
+	s.worker.mu.RLock()
+	defer s.worker.mu.RUnlock()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if err := s.usable(); err != nil {
+		return 0, false, err
+	}
+	n, err := s.tx.Enqueue(b)
+	if errors.Is(err, fifo.ErrFull) {
+		s.tx.AddWantDeqNtf(fifo.WantDeqNtf)
+		if n, err = s.tx.Enqueue(b); errors.Is(err, fifo.ErrFull) {
+			return 0, false, nil
+		}
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return n, n > 0 && s.evtTx.SetEvent(), nil
+}
+
+// readDgram dequeues a datagram from the rx fifo into b, dropping what does
+// not fit. It returns no header when the fifo is empty, once it made sure VPP
+// signals the datagram it enqueues next. VPP enqueues a datagram together
+// with its header, a fifo holding data holds whole datagrams.
+func (s *appSession) readDgram(b []byte) (int, *session.DgramHdr, bool, error) {
+	s.worker.mu.RLock()
+	defer s.worker.mu.RUnlock()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if err := s.usable(); err != nil {
+		return 0, nil, false, err
+	}
+	if s.rx.MaxDequeue() == 0 {
+		s.unsetRxEvent()
+		if s.rx.MaxDequeue() == 0 {
+			return 0, nil, false, nil
+		}
+	}
+	buf := make([]byte, session.DgramHdrSize)
+	if n, err := s.rx.Dequeue(buf); err != nil || n != len(buf) {
+		return 0, nil, false, errors.Wrapf(fifo.ErrCorrupt, "datagram header of %d bytes", n)
+	}
+	var hdr session.DgramHdr
+	if err := session.Unmarshal(buf, &hdr); err != nil {
+		return 0, nil, false, err
+	}
+	if hdr.DataLength > s.rx.MaxDequeue() {
+		return 0, nil, false, errors.Wrapf(fifo.ErrCorrupt, "datagram of %d bytes", hdr.DataLength)
+	}
+	n := int(hdr.DataLength)
+	if n > len(b) {
+		n = len(b)
+	}
+	if _, err := s.rx.Dequeue(b[:n]); err != nil && n > 0 {
+		return 0, nil, false, err
+	}
+	if rest := hdr.DataLength - uint32(n); rest > 0 {
+		if _, err := s.rx.Drop(rest); err != nil {
+			return 0, nil, false, err
+		}
+	}
+	s.rxDrained()
+	notify := s.rx.NeedsDeqNtf(session.DgramHdrSize + hdr.DataLength)
+	if notify {
+		s.rx.ClearDeqNtf()
+	}
+	return n, &hdr, notify, nil
+}
+
+// writeDgram enqueues b with its header to the tx fifo. It reports whether b
+// was written, it is not when the fifo is full, once VPP was asked to signal
+// the room it makes next. It also reports whether VPP must be told about the
+// datagram.
+func (s *appSession) writeDgram(hdr *session.DgramHdr, b []byte) (bool, bool, error) {
+	data, err := session.Marshal(hdr)
+	if err != nil {
+		return false, false, err
+	}
+	s.worker.mu.RLock()
+	defer s.worker.mu.RUnlock()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if err := s.usable(); err != nil {
+		return false, false, err
+	}
+	if len(data)+len(b) > int(s.tx.Size()) {
+		return false, false, syscall.EMSGSIZE
+	}
+	_, err = s.tx.EnqueueSegments(data, b)
+	if errors.Is(err, fifo.ErrFull) {
+		s.tx.AddWantDeqNtf(fifo.WantDeqNtf)
+		if _, err = s.tx.EnqueueSegments(data, b); errors.Is(err, fifo.ErrFull) {
+			return false, false, nil
+		}
+	}
+	if err != nil {
+		return false, false, err
+	}
+	return true, s.evtTx.SetEvent(), nil
+}
+
+// unsetRxEvent clears the event flag VPP sets when it signals data in the
+// rx fifo, on the fifo of the session in VPP too if the session is
+// cut-through
+func (s *appSession) unsetRxEvent() {
+	s.rx.UnsetEvent()
+	if s.evtRx != s.rx {
+		s.evtRx.UnsetEvent()
+	}
+}
+
+// rxDrained makes sure VPP signals the data it enqueues next once a read
+// emptied the rx fifo, edge-triggered pollers wait for that signal. Data
+// enqueued in the meantime is signalled to them right away.
+func (s *appSession) rxDrained() {
+	if s.rx.MaxDequeue() > 0 {
+		return
+	}
+	s.unsetRxEvent()
+	if s.rx.MaxDequeue() > 0 {
+		for _, item := range s.pollItems {
+			item.signal(PollIn)
+		}
+	}
+}
+
+// usable returns an error if the fifos of the session must not be touched,
+// s.mu and the worker mutex must be held
+func (s *appSession) usable() error {
+	switch {
+	case s.worker.released:
+		return ErrWorkerClosed
+	case s.closed:
+		return errConnClosed
+	case s.gone:
+		return errConnGone
+	}
+	return nil
+}
+
+// notifyVpp sends an io event for the session to VPP
+func (s *appSession) notifyVpp(ctx context.Context, eventType EventType) error {
+	s.mu.RLock()
+	queue, f := s.vppEvtQ, s.evtTx
+	if eventType == EventIORx {
+		f = s.evtRx
+	}
+	s.mu.RUnlock()
+	return s.worker.sendTo(ctx, queue, &Event{Type: eventType, Data: session.IOEventData(f.MasterSessionIndex())})
+}
+
+// close marks the session closed by the application and tells VPP: an
+// unlisten for listeners, a disconnect, or the reply to the disconnect or
+// reset of the peer
+func (s *appSession) close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errConnClosed
+	}
+	s.closed = true
+	gone, peerClosed, reset := s.gone, s.peerClosed, s.reset
+	s.mu.Unlock()
+	if gone {
+		return nil
+	}
+	switch {
+	case s.listener != nil:
+		return s.sendCtrl(EventUnlisten, &session.UnlistenMsg{
+			ClientIndex: s.worker.apiClientHandle,
+			Context:     s.index,
+			WrkIndex:    s.worker.index,
+			Handle:      s.handle,
+		})
+	case reset:
+		return s.sendCtrl(EventResetReply, &session.ResetReplyMsg{Context: s.index, Handle: s.handle})
+	case peerClosed:
+		return s.sendCtrl(EventDisconnectedReply, &session.DisconnectedReplyMsg{Context: s.index, Handle: s.handle})
+	}
+	return s.sendDisconnect()
+}
+
+// shutdown asks VPP to close the sending side of the session
+func (s *appSession) shutdown() error {
+	s.mu.Lock()
+	closed, gone, reset := s.closed, s.gone, s.reset
+	s.mu.Unlock()
+	switch {
+	case closed:
+		return errConnClosed
+	case gone:
+		return errConnGone
+	case reset:
+		return syscall.ECONNRESET
+	}
+	return s.sendCtrl(EventShutdown, &session.ShutdownMsg{
+		ClientIndex: s.worker.apiClientHandle,
+		Context:     s.index,
+		Handle:      s.handle,
+	})
+}
+
+func (s *appSession) sendDisconnect() error {
+	return s.sendCtrl(EventDisconnect, &session.DisconnectMsg{
+		ClientIndex: s.worker.apiClientHandle,
+		Context:     s.index,
+		Handle:      s.handle,
+	})
+}
+
+// sendCtrl sends a control message for the session to VPP
+func (s *appSession) sendCtrl(eventType EventType, msg interface{}) error {
+	data, err := session.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), replyTimeout)
+	defer cancel()
+	return s.worker.Send(ctx, &Event{Type: eventType, Data: data})
+}
+
+// notify signals ch without blocking, a signal already pending is enough
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,370 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package session implements the control messages VPP's session layer and
+// applications exchange in session events over the message queues. Messages
+// are packed little endian structs, as VPP's session_*_msg_t. Addresses and
+// ports are in network byte order.
+package session
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+)
+
+// InvalidHandle is VPP's SESSION_INVALID_HANDLE
+const InvalidHandle = ^uint64(0)
+
+// Transport protocols, as VPP's transport_proto_t
+const (
+	TransportProtoTCP uint8 = iota
+	TransportProtoUDP
+	TransportProtoNone
+	TransportProtoTLS
+	TransportProtoQUIC
+	TransportProtoDTLS
+)
+
+// TransportCfgFlagConnected is VPP's TRANSPORT_CFG_F_CONNECTED, set in the
+// flags of a ListenMsg for a UDP listener accepting a session per peer
+// instead of sharing its fifos among all of them
+const TransportCfgFlagConnected uint8 = 1
+
+// Types of a CleanupMsg, as VPP's session_cleanup_type_t
+const (
+	CleanupTransport uint8 = iota
+	CleanupSession
+)
+
+// IP46Address is VPP's ip46_address_t, IPv4 addresses take its last four
+// bytes
+type IP46Address [16]byte
+
+// NewIP46Address returns the ip46 address of ip and whether ip is an IPv4
+// address
+func NewIP46Address(ip net.IP) (IP46Address, bool) {
+	var addr IP46Address
+	if ip4 := ip.To4(); ip4 != nil {
+		copy(addr[12:], ip4)
+		return addr, true
+	}
+	copy(addr[:], ip.To16())
+	return addr, false
+}
+
+// IP returns the address as a net.IP
+func (a IP46Address) IP(isIP4 bool) net.IP {
+	if isIP4 {
+		return net.IPv4(a[12], a[13], a[14], a[15])
+	}
+	return append(net.IP(nil), a[:]...)
+}
+
+// Htons converts a port to network byte order
+func Htons(port uint16) uint16 {
+	return port<<8 | port>>8
+}
+
+// Ntohs converts a port from network byte order
+func Ntohs(port uint16) uint16 {
+	return Htons(port)
+}
+
+// TransportEndpoint is VPP's transport_endpoint_t, which is not packed
+type TransportEndpoint struct {
+	IP        IP46Address
+	Port      uint16
+	IsIP4     uint8
+	_         uint8
+	SwIfIndex uint32
+	FibIndex  uint32
+}
+
+// ConnectMsg is sent by the application in an EventConnect
+type ConnectMsg struct {
+	ClientIndex  uint32
+	Context      uint32
+	WrkIndex     uint8
+	IsIP4        uint8
+	IP           IP46Address
+	Port         uint16
+	Proto        uint8
+	Vrf          uint32
+	LclIP        IP46Address
+	LclPort      uint16
+	Hostname     [16]uint8
+	HostnameLen  uint8
+	ParentHandle uint64
+	CkpairIndex  uint32
+	CryptoEngine uint8
+	Flags        uint8
+	ExtConfig    uint64 // offset of the chunk of an ExtConfig, 0 for none
+}
+
+// ConnectedMsg is sent by VPP in an EventConnected. The fifo and queue
+// addresses are offsets in the segment of SegmentHandle. A cut-through
+// session also names the fifos it shares with its peer, in the segment of
+// CtSegmentHandle.
+type ConnectedMsg struct {
+	Context              uint32
+	Retval               int32
+	Handle               uint64
+	ServerRxFifo         uint64
+	ServerTxFifo         uint64
+	SegmentHandle        uint64
+	CtRxFifo             uint64
+	CtTxFifo             uint64
+	CtSegmentHandle      uint64
+	VppEventQueueAddress uint64
+	Lcl                  TransportEndpoint
+	MqIndex              uint32
+}
+
+// ListenMsg is sent by the application in an EventListen
+type ListenMsg struct {
+	ClientIndex  uint32
+	Context      uint32
+	WrkIndex     uint32
+	Vrf          uint32
+	Port         uint16
+	Proto        uint8
+	IsIP4        uint8
+	IP           IP46Address
+	CkpairIndex  uint32
+	CryptoEngine uint8
+	Flags        uint8
+	ExtConfig    uint64 // offset of the chunk of an ExtConfig, 0 for none
+}
+
+// BoundMsg is sent by VPP in an EventBound, the reply to a ListenMsg
+type BoundMsg struct {
+	Context       uint32
+	Handle        uint64
+	Retval        int32
+	LclIsIP4      uint8
+	LclIP         IP46Address
+	LclPort       uint16
+	RxFifo        uint64
+	TxFifo        uint64
+	VppEvtQ       uint64
+	SegmentHandle uint64
+	MqIndex       uint32
+}
+
+// UnlistenMsg is sent by the application in an EventUnlisten
+type UnlistenMsg struct {
+	ClientIndex uint32
+	Context     uint32
+	WrkIndex    uint32
+	Handle      uint64
+}
+
+// UnlistenReplyMsg is sent by VPP in an EventUnlistenReply
+type UnlistenReplyMsg struct {
+	Context uint32
+	Handle  uint64
+	Retval  int32
+}
+
+// AcceptedMsg is sent by VPP in an EventAccepted when a listener accepted a
+// session. The fifo and queue addresses are offsets in the segment of
+// SegmentHandle.
+type AcceptedMsg struct {
+	Context              uint32
+	ListenerHandle       uint64
+	Handle               uint64
+	ServerRxFifo         uint64
+	ServerTxFifo         uint64
+	SegmentHandle        uint64
+	VppEventQueueAddress uint64
+	MqIndex              uint32
+	Lcl                  TransportEndpoint
+	Rmt                  TransportEndpoint
+	Flags                uint8
+}
+
+// AcceptedReplyMsg is sent by the application in an EventAcceptedReply, a
+// non zero Retval rejects the session
+type AcceptedReplyMsg struct {
+	Context uint32
+	Retval  int32
+	Handle  uint64
+}
+
+// ShutdownMsg is sent by the application in an EventShutdown, VPP closes
+// the sending side of the session once its tx fifo is drained
+type ShutdownMsg struct {
+	ClientIndex uint32
+	Context     uint32
+	Handle      uint64
+}
+
+// DisconnectMsg is sent by the application in an EventDisconnect
+type DisconnectMsg struct {
+	ClientIndex uint32
+	Context     uint32
+	Handle      uint64
+}
+
+// DisconnectedMsg is sent by VPP in an EventDisconnected when the peer
+// closes the session
+type DisconnectedMsg struct {
+	ClientIndex uint32
+	Context     uint32
+	Handle      uint64
+}
+
+// DisconnectedReplyMsg is sent by the application in an
+// EventDisconnectedReply
+type DisconnectedReplyMsg struct {
+	Context uint32
+	Retval  int32
+	Handle  uint64
+}
+
+// ResetMsg is sent by VPP in an EventReset when the peer resets the session
+type ResetMsg struct {
+	ClientIndex uint32
+	Context     uint32
+	Handle      uint64
+}
+
+// ResetReplyMsg is sent by the application in an EventResetReply
+type ResetReplyMsg struct {
+	Context uint32
+	Retval  int32
+	Handle  uint64
+}
+
+// CleanupMsg is sent by VPP in an EventCleanup once it freed the transport
+// or the session, and with it the session fifos
+type CleanupMsg struct {
+	Handle uint64
+	Type   uint8
+}
+
+// AppAddSegmentMsg is sent by VPP in an EventAppAddSegment when it maps an
+// additional fifo segment for the application. The fd of a memfd segment is
+// passed over the app socket before the event.
+type AppAddSegmentMsg struct {
+	ClientIndex   uint32
+	Context       uint32
+	FdFlags       uint8
+	SegmentSize   uint32
+	SegmentName   [128]byte
+	SegmentHandle uint64
+}
+
+// AppDelSegmentMsg is sent by VPP in an EventAppDelSegment once no session
+// of the application has fifos in the segment anymore
+type AppDelSegmentMsg struct {
+	ClientIndex   uint32
+	Context       uint32
+	SegmentHandle uint64
+}
+
+// ExtConfigTypeCrypto is VPP's TRANSPORT_ENDPT_EXT_CFG_CRYPTO, the type of
+// an ExtConfig carrying the crypto config of a tls session
+const ExtConfigTypeCrypto uint16 = 1
+
+// ExtConfig is VPP's transport_endpt_ext_cfg_t holding a
+// transport_endpt_crypto_cfg_t. The application writes it to a chunk of the
+// VPP message queue segment and passes the chunk offset in the ExtConfig of
+// a ConnectMsg or ListenMsg, VPP frees the chunk once it read it. The layout
+// is the one of src/vnet/session/transport_types.h in VPP 21.06:
+//
+//	typedef struct transport_endpt_crypto_cfg_
+//	{
+//	  u32 ckpair_index;
+//	  u8 crypto_engine;
+//	  u8 hostname[256];
+//	} transport_endpt_crypto_cfg_t;
+//
+//	typedef struct transport_endpt_ext_cfg_
+//	{
+//	  u16 type;
+//	  u16 len;
+//	  union
+//	  {
+//	    transport_endpt_crypto_cfg_t crypto;
+//	    u32 opaque;
+//	  };
+//	} transport_endpt_ext_cfg_t;
+//
+// The crypto config is padded to its 4 byte alignment.
+type ExtConfig struct {
+	Type         uint16
+	Len          uint16
+	CkpairIndex  uint32
+	CryptoEngine uint8
+	Hostname     [256]byte
+	_            [3]byte
+}
+
+// ExtConfigSize is the encoded size of an ExtConfig,
+// sizeof(transport_endpt_ext_cfg_t)
+const ExtConfigSize = 268
+
+// DgramHdr is VPP's session_dgram_hdr_t, the header preceding each datagram
+// in the fifos of a datagram session. It is not a control message but is
+// encoded as one.
+type DgramHdr struct {
+	DataLength uint32
+	DataOffset uint32
+	RmtIP      IP46Address
+	LclIP      IP46Address
+	RmtPort    uint16
+	LclPort    uint16
+	IsIP4      uint8
+}
+
+// DgramHdrSize is the encoded size of a DgramHdr
+const DgramHdrSize = 45
+
+// Marshal encodes a message
+func Marshal(msg interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.LittleEndian, msg); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes a message, data may be longer than the message
+func Unmarshal(data []byte, msg interface{}) error {
+	return binary.Read(bytes.NewReader(data), binary.LittleEndian, msg)
+}
+
+// IOSessionIndex returns the session index IO event data carries
+func IOSessionIndex(data []byte) (uint32, bool) {
+	if len(data) < 4 {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(data), true
+}
+
+// IOEventData returns the data of an IO event for session index
+func IOEventData(index uint32) []byte {
+	data := make([]byte, 4)
+	binary.LittleEndian.PutUint32(data, index)
+	return data
+}
+
+// ThreadIndex returns the VPP thread a session handle belongs to
+func ThreadIndex(handle uint64) uint32 {
+	return uint32(handle >> 32)
+}
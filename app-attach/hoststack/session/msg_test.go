@@ -0,0 +1,107 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package session
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestMsgSizes(t *testing.T) {
+	cases := []struct {
+		name string
+		msg  interface{}
+		size int
+	}{
+		{name: "transport endpoint", msg: TransportEndpoint{}, size: 28},
+		{name: "connect", msg: ConnectMsg{}, size: 90},
+		{name: "connected", msg: ConnectedMsg{}, size: 104},
+		{name: "listen", msg: ListenMsg{}, size: 50},
+		{name: "bound", msg: BoundMsg{}, size: 71},
+		{name: "unlisten", msg: UnlistenMsg{}, size: 20},
+		{name: "unlisten reply", msg: UnlistenReplyMsg{}, size: 16},
+		{name: "accepted", msg: AcceptedMsg{}, size: 113},
+		{name: "accepted reply", msg: AcceptedReplyMsg{}, size: 16},
+		{name: "shutdown", msg: ShutdownMsg{}, size: 16},
+		{name: "disconnect", msg: DisconnectMsg{}, size: 16},
+		{name: "disconnected reply", msg: DisconnectedReplyMsg{}, size: 16},
+		{name: "cleanup", msg: CleanupMsg{}, size: 9},
+		{name: "app add segment", msg: AppAddSegmentMsg{}, size: 149},
+		{name: "app del segment", msg: AppDelSegmentMsg{}, size: 16},
+		{name: "ext config", msg: ExtConfig{}, size: ExtConfigSize},
+		{name: "dgram header", msg: DgramHdr{}, size: DgramHdrSize},
+	}
+	for _, c := range cases {
+		if size := binary.Size(c.msg); size != c.size {
+			t.Errorf("%s: Expected: %d bytes; Current: %d", c.name, c.size, size)
+		}
+	}
+}
+
+// TestExtConfigLayout checks the encoding of an ExtConfig against the field
+// offsets of transport_endpt_ext_cfg_t in VPP 21.06
+func TestExtConfigLayout(t *testing.T) {
+	cfg := ExtConfig{Type: ExtConfigTypeCrypto, Len: ExtConfigSize, CkpairIndex: 0x01020304, CryptoEngine: 5}
+	copy(cfg.Hostname[:], "hoststack.test")
+	data, err := Marshal(&cfg)
+	if err != nil {
+		t.Fatalf("Marshal Error %v", err)
+	}
+	offsets := []struct {
+		field  string
+		offset int
+		want   []byte
+	}{
+		{field: "type", offset: 0, want: []byte{1, 0}},
+		{field: "len", offset: 2, want: []byte{ExtConfigSize & 0xff, ExtConfigSize >> 8}},
+		{field: "crypto.ckpair_index", offset: 4, want: []byte{4, 3, 2, 1}},
+		{field: "crypto.crypto_engine", offset: 8, want: []byte{5}},
+		{field: "crypto.hostname", offset: 9, want: []byte("hoststack.test\x00")},
+		{field: "padding", offset: 9 + 256, want: []byte{0, 0, 0}},
+	}
+	for _, o := range offsets {
+		if got := data[o.offset : o.offset+len(o.want)]; string(got) != string(o.want) {
+			t.Errorf("%s: Expected: % x at offset %d; Current: % x", o.field, o.want, o.offset, got)
+		}
+	}
+	if len(data) != ExtConfigSize {
+		t.Errorf("Expected: %d bytes; Current: %d", ExtConfigSize, len(data))
+	}
+}
+
+func TestConnectedMsg(t *testing.T) {
+	lcl, _ := NewIP46Address(net.IPv4(10, 0, 0, 2))
+	msg := ConnectedMsg{Context: 7, Handle: 1<<32 | 3, ServerRxFifo: 0x1000, Lcl: TransportEndpoint{IP: lcl, Port: Htons(8080), IsIP4: 1}}
+	data, err := Marshal(&msg)
+	if err != nil {
+		t.Fatalf("Marshal Error %v", err)
+	}
+	if binary.LittleEndian.Uint64(data[16:]) != 0x1000 || data[72+12] != 10 || data[72+16] != 0x1f || data[72+17] != 0x90 {
+		t.Errorf("Unexpected encoding % x", data)
+	}
+	var decoded ConnectedMsg
+	if err := Unmarshal(append(data, make([]byte, 32)...), &decoded); err != nil || decoded != msg {
+		t.Errorf("Expected: %+v; Current: %+v, %v", msg, decoded, err)
+	}
+	if ThreadIndex(decoded.Handle) != 1 {
+		t.Errorf("Expected: thread 1; Current: %d", ThreadIndex(decoded.Handle))
+	}
+	if ip := decoded.Lcl.IP.IP(true); !ip.Equal(net.IPv4(10, 0, 0, 2)) {
+		t.Errorf("Expected: 10.0.0.2; Current: %v", ip)
+	}
+}
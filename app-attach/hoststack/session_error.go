@@ -0,0 +1,107 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hoststack
+
+import "fmt"
+
+// SessionError is one of VPP's session layer error codes (session_error_t).
+// VPP reports them as negative retvals.
+type SessionError int32
+
+// Session layer error codes, in the order of VPP's foreach_session_error
+const (
+	SessionErrNone             SessionError = 0
+	SessionErrUnknown          SessionError = -1
+	SessionErrRefused          SessionError = -2
+	SessionErrTimedOut         SessionError = -3
+	SessionErrAlloc            SessionError = -4
+	SessionErrOwner            SessionError = -5
+	SessionErrNoRoute          SessionError = -6
+	SessionErrNoIntf           SessionError = -7
+	SessionErrNoIP             SessionError = -8
+	SessionErrNoPort           SessionError = -9
+	SessionErrNoSupport        SessionError = -10
+	SessionErrNoListen         SessionError = -11
+	SessionErrNoSession        SessionError = -12
+	SessionErrNoApp            SessionError = -13
+	SessionErrPortInUse        SessionError = -14
+	SessionErrIPInUse          SessionError = -15
+	SessionErrAlreadyListening SessionError = -16
+	SessionErrInvalidRmtIP     SessionError = -17
+	SessionErrInvalidAppWrk    SessionError = -18
+	SessionErrInvalidNs        SessionError = -19
+	SessionErrSegNoSpace       SessionError = -20
+	SessionErrSegNoSpace2      SessionError = -21
+	SessionErrSegCreate        SessionError = -22
+	SessionErrFiltered         SessionError = -23
+	SessionErrScope            SessionError = -24
+	SessionErrBapiNoFd         SessionError = -25
+	SessionErrBapiSendFd       SessionError = -26
+	SessionErrBapiNoReg        SessionError = -27
+	SessionErrMqMsgAlloc       SessionError = -28
+	SessionErrTLSHandshake     SessionError = -29
+	SessionErrEventfdAlloc     SessionError = -30
+	SessionErrNoExtCfg         SessionError = -31
+	SessionErrNoCryptoEng      SessionError = -32
+	SessionErrNoCryptoCkp      SessionError = -33
+	SessionErrLocalConnect     SessionError = -34
+)
+
+var sessionErrorStrings = map[SessionError]string{
+	SessionErrNone:             "no error",
+	SessionErrUnknown:          "generic/unknown error",
+	SessionErrRefused:          "refused",
+	SessionErrTimedOut:         "timedout",
+	SessionErrAlloc:            "obj/memory allocation error",
+	SessionErrOwner:            "object not owned by owner",
+	SessionErrNoRoute:          "no route",
+	SessionErrNoIntf:           "no resolving interface",
+	SessionErrNoIP:             "no ip for lcl interface",
+	SessionErrNoPort:           "no lcl port",
+	SessionErrNoSupport:        "not supported",
+	SessionErrNoListen:         "not listening",
+	SessionErrNoSession:        "session does not exist",
+	SessionErrNoApp:            "app not attached",
+	SessionErrPortInUse:        "lcl port in use",
+	SessionErrIPInUse:          "ip in use",
+	SessionErrAlreadyListening: "ip port pair already listened on",
+	SessionErrInvalidRmtIP:     "invalid remote ip",
+	SessionErrInvalidAppWrk:    "invalid app worker",
+	SessionErrInvalidNs:        "invalid namespace",
+	SessionErrSegNoSpace:       "couldn't allocate a fifo pair",
+	SessionErrSegNoSpace2:      "created segment, couldn't allocate a fifo pair",
+	SessionErrSegCreate:        "couldn't create a new segment",
+	SessionErrFiltered:         "session filtered",
+	SessionErrScope:            "scope not supported",
+	SessionErrBapiNoFd:         "bapi doesn't have a socket fd",
+	SessionErrBapiSendFd:       "couldn't send fd over bapi socket fd",
+	SessionErrBapiNoReg:        "app bapi registration not found",
+	SessionErrMqMsgAlloc:       "failed to alloc mq msg",
+	SessionErrTLSHandshake:     "failed tls handshake",
+	SessionErrEventfdAlloc:     "failed to alloc eventfd",
+	SessionErrNoExtCfg:         "no extended transport config",
+	SessionErrNoCryptoEng:      "no crypto engine",
+	SessionErrNoCryptoCkp:      "cert key pair not found",
+	SessionErrLocalConnect:     "could not connect with local scope",
+}
+
+func (e SessionError) Error() string {
+	if s, ok := sessionErrorStrings[e]; ok {
+		return fmt.Sprintf("%s (%d)", s, int32(e))
+	}
+	return fmt.Sprintf("unknown session error (%d)", int32(e))
+}
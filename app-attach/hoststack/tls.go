@@ -0,0 +1,180 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hoststack
+
+import (
+	"context"
+	"net"
+
+	"github.com/pkg/errors"
+
+	"github.com/godirect/hoststack/app-attach/hoststack/session"
+)
+
+// CryptoEngine is the engine VPP terminates a tls session with, as VPP's
+// crypto_engine_type_t
+type CryptoEngine uint8
+
+// Crypto engines
+const (
+	CryptoEngineDefault CryptoEngine = iota // the TLSEngine attach option
+	CryptoEngineOpenSSL
+	CryptoEngineMbedTLS
+	CryptoEngineVPP
+	CryptoEnginePicoTLS
+)
+
+// ErrTLSConfig is returned for a TLSConfig VPP cannot carry out
+var ErrTLSConfig = errors.New("invalid tls config")
+
+// TLSConfig configures a tls session VPP terminates
+type TLSConfig struct {
+	// CertKey is the certificate and key pair of the session, see
+	// AddCertKey. The zero index is the test pair built into VPP.
+	CertKey CertKeyIndex
+	// ServerName is the SNI hostname of a dialed session. It defaults to
+	// the host of the dialed address unless that is an IP address.
+	ServerName string
+	// Engine is the crypto engine of the session
+	Engine CryptoEngine
+}
+
+// TLSSessionConfig is the crypto config a tls session was opened with: the
+// config of DialTLS for dialed sessions, the one of the listener for
+// accepted sessions. It is a view of the config the application passed to
+// VPP, not of the handshake: VPP does not report what the handshake
+// negotiated, nor the SNI hostname of the peer, to the application. It
+// reports sessions once their handshake completed.
+type TLSSessionConfig struct {
+	ServerName string // the SNI hostname sent by a dialed session
+	CertKey    CertKeyIndex
+	Engine     CryptoEngine
+}
+
+// TLSConn is a net.Conn over a tls session VPP terminates, reads and writes
+// carry plaintext
+type TLSConn struct {
+	*conn
+	config TLSSessionConfig
+}
+
+// SessionConfig returns the crypto config the session was opened with
+func (c *TLSConn) SessionConfig() TLSSessionConfig {
+	return c.config
+}
+
+// DialTLS connects to address over a tls session of the first worker of the
+// attachment, see Worker.DialTLS
+func (a *Attachment) DialTLS(ctx context.Context, address string, config *TLSConfig) (*TLSConn, error) {
+	workers := a.Workers()
+	if len(workers) == 0 {
+		return nil, &net.OpError{Op: "dial", Net: "tls", Err: ErrDetached}
+	}
+	return workers[0].DialTLS(ctx, address, config)
+}
+
+// DialTLS connects to address over a tls session of the worker. VPP does
+// the handshake, encrypts what is written to the returned connection and
+// decrypts what is read from it. A nil config dials with the defaults of
+// TLSConfig. A failed handshake is reported as SessionErrTLSHandshake.
+func (w *Worker) DialTLS(ctx context.Context, address string, config *TLSConfig) (*TLSConn, error) {
+	const network = "tls"
+	if config == nil {
+		config = &TLSConfig{}
+	}
+	ip, port, err := resolveAddr(ctx, network, address, false)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	raddr := sockAddr(network, ip, port)
+	serverName := config.ServerName
+	if serverName == "" {
+		if host, _, _ := net.SplitHostPort(address); net.ParseIP(host) == nil {
+			serverName = host
+		}
+	}
+	cfg, err := config.extConfig(serverName)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: raddr, Err: err}
+	}
+	s, reply, err := w.connect(ctx, &connectRequest{proto: session.TransportProtoTLS, ip: ip, port: port, cfg: cfg})
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: raddr, Err: err}
+	}
+	c := newConn(s, network, endpointAddr(network, &reply.Lcl), raddr)
+	return &TLSConn{conn: c, config: *sessionConfig(cfg)}, nil
+}
+
+// ListenTLS listens on address for tls sessions of the first worker of the
+// attachment, see Worker.ListenTLS
+func (a *Attachment) ListenTLS(ctx context.Context, address string, config *TLSConfig) (net.Listener, error) {
+	workers := a.Workers()
+	if len(workers) == 0 {
+		return nil, &net.OpError{Op: "listen", Net: "tls", Err: ErrDetached}
+	}
+	return workers[0].ListenTLS(ctx, address, config)
+}
+
+// ListenTLS asks VPP to listen on address for tls sessions of the worker,
+// presenting the certificate of config.CertKey. The listener accepts
+// *TLSConns once VPP completed their handshake. A nil config listens with
+// the defaults of TLSConfig.
+func (w *Worker) ListenTLS(ctx context.Context, address string, config *TLSConfig) (net.Listener, error) {
+	const network = "tls"
+	if config == nil {
+		config = &TLSConfig{}
+	}
+	cfg, err := config.extConfig(config.ServerName)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+	l, _, err := w.listen(ctx, network, address, 0, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// extConfig encodes the config for the ext config of a connect or listen
+func (c *TLSConfig) extConfig(serverName string) (*session.ExtConfig, error) {
+	cfg := &session.ExtConfig{
+		Type:         session.ExtConfigTypeCrypto,
+		Len:          session.ExtConfigSize,
+		CkpairIndex:  uint32(c.CertKey),
+		CryptoEngine: uint8(c.Engine),
+	}
+	if len(serverName) >= len(cfg.Hostname) {
+		return nil, wrapErr(ErrTLSConfig, errors.Errorf("server name exceeds %d bytes", len(cfg.Hostname)-1))
+	}
+	copy(cfg.Hostname[:], serverName)
+	return cfg, nil
+}
+
+// sessionConfig returns the config of a session opened with cfg
+func sessionConfig(cfg *session.ExtConfig) *TLSSessionConfig {
+	config := &TLSSessionConfig{
+		CertKey: CertKeyIndex(cfg.CkpairIndex),
+		Engine:  CryptoEngine(cfg.CryptoEngine),
+	}
+	for i, b := range cfg.Hostname {
+		if b == 0 {
+			config.ServerName = string(cfg.Hostname[:i])
+			break
+		}
+	}
+	return config
+}
@@ -0,0 +1,198 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hoststack
+
+import (
+	"context"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/godirect/hoststack/app-attach/hoststack/hoststacktest"
+)
+
+// attachTLS attaches to a server echoing on the sessions it serves, which
+// it hands to sessions, and registers a certificate and key pair
+func attachTLS(t *testing.T) (*hoststacktest.Server, *Attachment, CertKeyIndex, chan *hoststacktest.Session) {
+	sessions := make(chan *hoststacktest.Session, 1)
+	vpp := hoststacktest.NewServer(t, hoststacktest.WithSessionHandler(func(s *hoststacktest.Session) {
+		sessions <- s
+		hoststacktest.Echo(s)
+	}))
+	ns := dial(t, vpp)
+	// the server does not reuse the fifos of closed sessions
+	attachment, err := NewAttachment(context.Background(), ns, ns.udsConn, WithFifoSizes(4096, 4096))
+	if err != nil {
+		t.Fatalf("Attach Error %v", err)
+	}
+	certPEM, keyPEM := selfSignedCertKey(t)
+	index, err := attachment.AddCertKey(context.Background(), certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("AddCertKey Error %v", err)
+	}
+	return vpp, attachment, index, sessions
+}
+
+func TestDialTLS(t *testing.T) {
+	_, attachment, index, sessions := attachTLS(t)
+	tests := []struct {
+		name    string
+		address string
+		config  *TLSConfig
+		want    TLSSessionConfig
+	}{
+		{
+			name:    "defaults",
+			address: "10.0.0.1:443",
+			want:    TLSSessionConfig{},
+		},
+		{
+			name:    "server name from address",
+			address: "localhost:443",
+			want:    TLSSessionConfig{ServerName: "localhost"},
+		},
+		{
+			name:    "full config",
+			address: "10.0.0.1:443",
+			config:  &TLSConfig{CertKey: index, ServerName: "hoststack.test", Engine: CryptoEnginePicoTLS},
+			want:    TLSSessionConfig{ServerName: "hoststack.test", CertKey: index, Engine: CryptoEnginePicoTLS},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, err := attachment.DialTLS(ctx, tt.address, tt.config)
+			if err != nil {
+				t.Fatalf("DialTLS Error %v", err)
+			}
+			defer func() { _ = conn.Close() }()
+			if config := conn.SessionConfig(); !reflect.DeepEqual(config, tt.want) {
+				t.Errorf("Expected: %+v; Current: %+v", tt.want, config)
+			}
+			sess := <-sessions
+			params, ok := sess.TLS()
+			if !ok || params.ServerName != tt.want.ServerName || params.CertKey != uint32(tt.want.CertKey) ||
+				params.Engine != uint8(tt.want.Engine) {
+				t.Errorf("Expected: vpp to get %+v; Current: %+v", tt.want, params)
+			}
+			if _, err := conn.Write([]byte("hello")); err != nil {
+				t.Fatalf("Write Error %v", err)
+			}
+			buf := make([]byte, 5)
+			if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+				t.Errorf("Expected: hello; Current: %q, %v", buf, err)
+			}
+		})
+	}
+}
+
+func TestDialTLSNetwork(t *testing.T) {
+	_, attachment, _, sessions := attachTLS(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := attachment.Dial(ctx, "tls", "10.0.0.1:443")
+	if err != nil {
+		t.Fatalf("Dial Error %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	<-sessions
+	if _, ok := conn.(*TLSConn); !ok {
+		t.Errorf("Expected: a *TLSConn; Current: %T", conn)
+	}
+	if _, ok := conn.RemoteAddr().(*net.TCPAddr); !ok {
+		t.Errorf("Expected: a TCP address; Current: %T", conn.RemoteAddr())
+	}
+}
+
+func TestDialTLSErrors(t *testing.T) {
+	vpp, attachment, _, _ := attachTLS(t)
+	tests := []struct {
+		name    string
+		config  *TLSConfig
+		script  *hoststacktest.Action
+		wantErr error
+	}{
+		{
+			name:    "server name too long",
+			config:  &TLSConfig{ServerName: string(make([]byte, 256))},
+			wantErr: ErrTLSConfig,
+		},
+		{
+			name:    "unknown cert key",
+			config:  &TLSConfig{CertKey: 42},
+			wantErr: SessionErrNoCryptoCkp,
+		},
+		{
+			name:    "failed handshake",
+			script:  &hoststacktest.Action{Retval: int32(SessionErrTLSHandshake)},
+			wantErr: SessionErrTLSHandshake,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.script != nil {
+				vpp.ScriptConnect(*tt.script)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, err := attachment.DialTLS(ctx, "10.0.0.1:443", tt.config)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Expected: errors.Is(err, %v); Current: %v", tt.wantErr, err)
+			}
+			if conn != nil {
+				t.Errorf("Expected: no connection; Current: %v", conn)
+			}
+		})
+	}
+}
+
+func TestListenTLS(t *testing.T) {
+	vpp, attachment, index, _ := attachTLS(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	config := &TLSConfig{CertKey: index, ServerName: "hoststack.test", Engine: CryptoEngineOpenSSL}
+	l, err := attachment.ListenTLS(ctx, ":8443", config)
+	if err != nil {
+		t.Fatalf("ListenTLS Error %v", err)
+	}
+	defer func() { _ = l.Close() }()
+	sess, conn := connect(t, vpp, "tls", l)
+	tlsConn, ok := conn.(*TLSConn)
+	if !ok {
+		t.Fatalf("Expected: a *TLSConn; Current: %T", conn)
+	}
+	// the config of the listener, not what the peer sent
+	want := TLSSessionConfig{ServerName: "hoststack.test", CertKey: index, Engine: CryptoEngineOpenSSL}
+	if config := tlsConn.SessionConfig(); !reflect.DeepEqual(config, want) {
+		t.Errorf("Expected: %+v; Current: %+v", want, config)
+	}
+	if params, ok := sess.TLS(); !ok || params.CertKey != uint32(index) {
+		t.Errorf("Expected: vpp to accept with cert key %d; Current: %+v", index, params)
+	}
+
+	if _, err := attachment.ListenTLS(ctx, ":8444", &TLSConfig{ServerName: string(make([]byte, 256))}); !errors.Is(err, ErrTLSConfig) {
+		t.Errorf("Expected: errors.Is(err, ErrTLSConfig); Current: %v", err)
+	}
+	if _, err := attachment.ListenTLS(ctx, ":8444", &TLSConfig{CertKey: index + 1}); !errors.Is(err, SessionErrNoCryptoCkp) {
+		t.Errorf("Expected: errors.Is(err, SessionErrNoCryptoCkp); Current: %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hoststack
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"git.fd.io/govpp.git/api"
+	"github.com/harshgondaliya/govpp/binapi/session"
+	"github.com/harshgondaliya/govpp/binapi/vpe"
+	"github.com/pkg/errors"
+)
+
+// Release is a VPP release the package supports. The layouts of the app
+// socket messages, the fifo segments and the session events are those of
+// VPP 21.06, built into appsock, memseg, fifo and session; the release only
+// gates which VPP the package agrees to talk to.
+type Release struct {
+	Version string // major.minor, like 21.06
+}
+
+// supportedReleases are the VPP releases the package was tested against
+var supportedReleases = []*Release{
+	{Version: "21.06"},
+}
+
+// releaseVersion matches the major.minor prefix of the version VPP reports,
+// like v21.06-rc0~123-g1234567 or 21.06-release
+var releaseVersion = regexp.MustCompile(`^v?(\d+\.\d+)`)
+
+// SupportedVersions returns the VPP releases the package supports
+func SupportedVersions() []string {
+	versions := make([]string, 0, len(supportedReleases))
+	for _, r := range supportedReleases {
+		versions = append(versions, r.Version)
+	}
+	return versions
+}
+
+// lookupRelease returns the supported release matching version
+func lookupRelease(version string) (*Release, error) {
+	m := releaseVersion.FindStringSubmatch(version)
+	if m == nil {
+		return nil, wrapErr(ErrUnsupportedVpp, errors.Errorf("cannot parse vpp version %q", version))
+	}
+	for _, r := range supportedReleases {
+		if r.Version == m[1] {
+			return r, nil
+		}
+	}
+	return nil, wrapErr(ErrUnsupportedVpp, errors.Errorf("vpp %s, supported releases: %s",
+		version, strings.Join(SupportedVersions(), ", ")))
+}
+
+// CheckVersion asks VPP for its version and the CRCs of the session API
+// messages, and returns the matching supported release
+func CheckVersion(ctx context.Context, conn Connection) (*Release, error) {
+	reply, err := vpe.NewServiceClient(conn).ShowVersion(ctx, &vpe.ShowVersion{})
+	if err != nil {
+		return nil, wrapErr(ErrVersion, err)
+	}
+	release, err := lookupRelease(reply.Version)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := conn.NewAPIChannel()
+	if err != nil {
+		return nil, wrapErr(ErrVersion, err)
+	}
+	defer ch.Close()
+	if err := ch.CheckCompatiblity(session.AllMessages()...); err != nil {
+		var compatErr *api.CompatibilityError
+		if errors.As(err, &compatErr) {
+			return nil, wrapErr(ErrUnsupportedVpp, errors.Errorf("vpp %s, session api messages differ: %s",
+				reply.Version, strings.Join(compatErr.IncompatibleMessages, ", ")))
+		}
+		return nil, wrapErr(ErrVersion, err)
+	}
+	return release, nil
+}
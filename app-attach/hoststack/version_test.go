@@ -0,0 +1,146 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hoststack
+
+import (
+	"context"
+	"testing"
+
+	"github.com/godirect/hoststack/app-attach/hoststack/hoststacktest"
+
+	"git.fd.io/govpp.git/api"
+	"github.com/harshgondaliya/govpp/binapi/vpe"
+	"github.com/pkg/errors"
+)
+
+// fakeVpp answers ShowVersion with version and CheckCompatiblity with
+// compatErr
+type fakeVpp struct {
+	api.Connection
+	api.ChannelProvider
+	version   string
+	invokeErr error
+	compatErr error
+}
+
+func (f *fakeVpp) Invoke(_ context.Context, _, reply api.Message) error {
+	if f.invokeErr != nil {
+		return f.invokeErr
+	}
+	reply.(*vpe.ShowVersionReply).Version = f.version
+	return nil
+}
+
+func (f *fakeVpp) NewAPIChannel() (api.Channel, error) {
+	return &fakeChannel{compatErr: f.compatErr}, nil
+}
+
+type fakeChannel struct {
+	api.Channel
+	compatErr error
+}
+
+func (c *fakeChannel) CheckCompatiblity(...api.Message) error {
+	return c.compatErr
+}
+
+func (c *fakeChannel) Close() {}
+
+func TestCheckVersion(t *testing.T) {
+	tests := []struct {
+		name        string
+		vpp         *fakeVpp
+		wantVersion string
+		wantErr     error
+		wantMsg     string
+	}{
+		{
+			name:        "release",
+			vpp:         &fakeVpp{version: "21.06-release"},
+			wantVersion: "21.06",
+		},
+		{
+			name:        "development build",
+			vpp:         &fakeVpp{version: "v21.06-rc0~285-g0c7aa7ab5"},
+			wantVersion: "21.06",
+		},
+		{
+			name:    "unsupported release",
+			vpp:     &fakeVpp{version: "v20.09-release"},
+			wantErr: ErrUnsupportedVpp,
+			wantMsg: "unsupported vpp: vpp v20.09-release, supported releases: 21.06",
+		},
+		{
+			name:    "unparsable version",
+			vpp:     &fakeVpp{version: "master"},
+			wantErr: ErrUnsupportedVpp,
+		},
+		{
+			name: "session api differs",
+			vpp: &fakeVpp{version: "21.06-release", compatErr: &api.CompatibilityError{
+				IncompatibleMessages: []string{"app_attach_c5c1bd4d", "session_enable_disable_9b7a1e9b"},
+			}},
+			wantErr: ErrUnsupportedVpp,
+			wantMsg: "unsupported vpp: vpp 21.06-release, session api messages differ: " +
+				"app_attach_c5c1bd4d, session_enable_disable_9b7a1e9b",
+		},
+		{
+			name:    "query fails",
+			vpp:     &fakeVpp{invokeErr: errors.New("disconnected")},
+			wantErr: ErrVersion,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release, err := CheckVersion(context.Background(), tt.vpp)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("Expected: errors.Is(err, %v); Current: %v", tt.wantErr, err)
+				}
+				if tt.wantMsg != "" && (err == nil || err.Error() != tt.wantMsg) {
+					t.Errorf("Expected: %q; Current: %v", tt.wantMsg, err)
+				}
+				return
+			}
+			if err != nil || release.Version != tt.wantVersion {
+				t.Errorf("Expected: %v; Current: %+v, %v", tt.wantVersion, release, err)
+			}
+		})
+	}
+}
+
+func TestDialUnsupportedVpp(t *testing.T) {
+	ns := NewNamespace(&fakeVpp{version: "19.08.3-release"}, "0", WithSocketPath("@unused"))
+	if _, err := ns.Dial(context.Background()); !errors.Is(err, ErrUnsupportedVpp) {
+		t.Errorf("Expected: errors.Is(err, ErrUnsupportedVpp); Current: %v", err)
+	}
+	if ns.Release() != nil {
+		t.Errorf("Expected: no release; Current: %+v", ns.Release())
+	}
+}
+
+func TestDialRelease(t *testing.T) {
+	vpp := hoststacktest.NewServer(t)
+	ns := NewNamespace(&fakeVpp{version: "21.06-release"}, "0", WithSocketPath(vpp.Path()))
+	if _, err := ns.Dial(context.Background()); err != nil {
+		t.Fatalf("Dial Error %v", err)
+	}
+	defer func() { _ = ns.Close() }()
+	if r := ns.Release(); r == nil || r.Version != "21.06" {
+		t.Errorf("Expected: release 21.06; Current: %+v", r)
+	}
+}
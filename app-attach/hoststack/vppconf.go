@@ -0,0 +1,139 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hoststack
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNoAppSocketAPI is returned when the VPP config does not enable the app
+// socket API
+var ErrNoAppSocketAPI = errors.New("app socket api is not enabled in vpp config")
+
+const (
+	// defaultRuntimeDir is the runtime directory of VPP unless set with
+	// unix { runtime-dir }
+	defaultRuntimeDir = "/var/run/vpp"
+	// defaultSocketSubdir holds the namespace sockets within the runtime
+	// directory
+	defaultSocketSubdir = "app_ns_sockets"
+)
+
+// SocketDirFromConfig returns the directory holding the app namespace sockets
+// of a VPP instance started with the given startup config. The app socket API
+// has to be enabled with session { use-app-socket-api } or
+// session { app-socket-api <dir> }. A relative dir is taken relative to the
+// runtime directory, a dir starting with @ is in the abstract namespace.
+func SocketDirFromConfig(vppConfig string) (string, error) {
+	sections, err := parseVppConfig(vppConfig)
+	if err != nil {
+		return "", err
+	}
+	runtimeDir := defaultRuntimeDir
+	if dir, ok := sectionValue(sections["unix"], "runtime-dir"); ok {
+		runtimeDir = dir
+	}
+	session := sections["session"]
+	dir, ok := sectionValue(session, "app-socket-api")
+	if !ok {
+		if !sectionHas(session, "use-app-socket-api") {
+			return "", ErrNoAppSocketAPI
+		}
+		dir = defaultSocketSubdir
+	}
+	if strings.HasPrefix(dir, "@") || filepath.IsAbs(dir) {
+		return dir, nil
+	}
+	return filepath.Join(runtimeDir, dir), nil
+}
+
+// parseVppConfig splits a VPP startup config into the tokens of its top
+// level sections. Nested sections are kept as tokens, braces included.
+func parseVppConfig(vppConfig string) (map[string][]string, error) {
+	var tokens []string
+	for _, line := range strings.Split(vppConfig, "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.NewReplacer("{", " { ", "}", " } ").Replace(line)
+		tokens = append(tokens, strings.Fields(line)...)
+	}
+	sections := make(map[string][]string)
+	for len(tokens) > 0 {
+		name := tokens[0]
+		if name == "{" || name == "}" {
+			return nil, errors.Errorf("unexpected %q in vpp config", name)
+		}
+		if len(tokens) < 2 || tokens[1] != "{" {
+			return nil, errors.Errorf("vpp config section %q has no body", name)
+		}
+		depth := 0
+		end := -1
+		for i := 1; i < len(tokens) && end < 0; i++ {
+			switch tokens[i] {
+			case "{":
+				depth++
+			case "}":
+				depth--
+				if depth == 0 {
+					end = i
+				}
+			}
+		}
+		if end < 0 {
+			return nil, errors.Errorf("vpp config section %q is not closed", name)
+		}
+		sections[name] = append(sections[name], tokens[2:end]...)
+		tokens = tokens[end+1:]
+	}
+	return sections, nil
+}
+
+// sectionValue returns the token following key in the top level of section
+func sectionValue(section []string, key string) (string, bool) {
+	depth := 0
+	for i, token := range section {
+		switch {
+		case token == "{":
+			depth++
+		case token == "}":
+			depth--
+		case depth == 0 && token == key && i+1 < len(section) && section[i+1] != "{" && section[i+1] != "}":
+			return section[i+1], true
+		}
+	}
+	return "", false
+}
+
+// sectionHas reports whether key is in the top level of section
+func sectionHas(section []string, key string) bool {
+	depth := 0
+	for _, token := range section {
+		switch {
+		case token == "{":
+			depth++
+		case token == "}":
+			depth--
+		case depth == 0 && token == key:
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,471 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hoststack
+
+import (
+	"context"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/godirect/hoststack/app-attach/hoststack/appsock"
+	"github.com/godirect/hoststack/app-attach/hoststack/fifo"
+	"github.com/godirect/hoststack/app-attach/hoststack/memseg"
+	"github.com/godirect/hoststack/app-attach/hoststack/msgq"
+	"github.com/godirect/hoststack/app-attach/hoststack/session"
+)
+
+// Worker struct
+type Worker struct {
+	attachment      *Attachment
+	index           uint32
+	apiClientHandle uint32    // identifies the worker in the control messages it sends
+	udsConn         *sapiConn // nil for the first worker, which uses the attach connection
+	segmentHandle   uint64
+	memorySegment   *memseg.MemorySegment
+	fifoSegments    map[uint64]*fifo.Segment         // the segments VPP allocates session fifos in, by handle
+	addedSegments   map[uint64]*memseg.MemorySegment // the segments VPP added after the worker, by handle
+	pendingSegments map[uint64]chan struct{}         // closed once the segment VPP added is mapped or failed to
+	lastPending     chan struct{}                    // of the segment added last, segments are mapped in order
+	appMq           *msgq.Queue                      // VPP sends session events to the worker over it
+	eventFd         int                              // eventfd of appMq, -1 if VPP does not signal it
+	sessions        sessionTable
+	dispatchOnce    sync.Once
+	events          chan *Event   // events not consumed by sessions, returned by Recv
+	dispatchDone    chan struct{} // closed when the dispatcher stops, dispatchErr tells why
+	dispatchErr     error
+	closeOnce       sync.Once
+	mu              sync.RWMutex // held for reading while the queues and fifos are in use
+	released        bool
+}
+
+// eventBacklog is the number of events Recv has not consumed yet the worker
+// holds on to, further events are dropped
+const eventBacklog = 64
+
+// NewWorker function
+func NewWorker(attachment *Attachment, memorySegment *memseg.MemorySegment) *Worker {
+	return &Worker{
+		attachment:      attachment,
+		memorySegment:   memorySegment,
+		fifoSegments:    make(map[uint64]*fifo.Segment),
+		addedSegments:   make(map[uint64]*memseg.MemorySegment),
+		pendingSegments: make(map[uint64]chan struct{}),
+		eventFd:         -1,
+		sessions:        newSessionTable(),
+		events:          make(chan *Event, eventBacklog),
+		dispatchDone:    make(chan struct{}),
+	}
+}
+
+// init sets the segment handle of the fifo segment of the worker and opens
+// its app message queue at appMq
+func (w *Worker) init(segmentHandle, appMq uint64) error {
+	w.segmentHandle = segmentHandle
+	segment, err := newFifoSegment(w.memorySegment)
+	if err != nil {
+		return err
+	}
+	w.fifoSegments[segmentHandle] = segment
+	queue, err := openQueue(w.memorySegment, appMq, w.eventFd)
+	if err != nil {
+		return errors.WithMessage(err, "app message queue")
+	}
+	w.appMq = queue
+	return nil
+}
+
+// Index returns the worker index assigned by VPP
+func (w *Worker) Index() uint32 {
+	return w.index
+}
+
+// Attachment returns the attachment the worker belongs to
+func (w *Worker) Attachment() *Attachment {
+	return w.attachment
+}
+
+// MemorySegment returns the fifo segment of the worker
+func (w *Worker) MemorySegment() *memseg.MemorySegment {
+	return w.memorySegment
+}
+
+// Recv receives a session event VPP sent to the worker, waiting for one
+// until ctx ends. Events of the sessions opened with Dial are consumed by
+// those sessions and not returned.
+func (w *Worker) Recv(ctx context.Context) (*Event, error) {
+	w.startDispatch()
+	select {
+	case event := <-w.events:
+		return event, nil
+	case <-w.dispatchDone:
+		return nil, w.dispatchErr
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// startDispatch starts the goroutine consuming the app message queue
+func (w *Worker) startDispatch() {
+	w.dispatchOnce.Do(func() {
+		go w.dispatch()
+	})
+}
+
+// dispatch hands the events VPP sends to the sessions they are for, and
+// the other events to Recv, until the worker is released. It drains the app
+// message queue in batches and parks in between until VPP signals it.
+func (w *Worker) dispatch() {
+	defer close(w.dispatchDone)
+	var batch []*msgq.Message
+	for {
+		var err error
+		batch, err = w.drain(batch[:0])
+		if err == nil && len(batch) == 0 {
+			err = w.wait()
+		}
+		if err != nil {
+			w.dispatchErr = err
+			if !errors.Is(err, ErrWorkerClosed) {
+				log.Errorf("worker %d stops receiving events: %v", w.index, err)
+			}
+			return
+		}
+		for i, msg := range batch {
+			w.dispatchMsg(msg)
+			batch[i] = nil
+		}
+	}
+}
+
+// drain appends the messages pending in the app message queue to batch, up
+// to the number of messages the queue holds
+func (w *Worker) drain(batch []*msgq.Message) ([]*msgq.Message, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.released {
+		return batch, ErrWorkerClosed
+	}
+	if w.appMq == nil {
+		return batch, wrapErr(ErrMsgQueue, errors.New("vpp did not set up an app message queue"))
+	}
+	for len(batch) < w.appMq.Cap() {
+		msg, err := w.appMq.TryRecv()
+		if errors.Is(err, msgq.ErrEmpty) {
+			break
+		}
+		if err != nil {
+			return batch, wrapErr(ErrMsgQueue, err)
+		}
+		batch = append(batch, msg)
+	}
+	return batch, nil
+}
+
+// wait parks the dispatcher until VPP signals the app message queue, or for
+// a poll interval when VPP does not signal it. It does not hold the worker
+// mutex, release wakes it by closing the queue.
+func (w *Worker) wait() error {
+	w.mu.RLock()
+	queue := w.appMq
+	w.mu.RUnlock()
+	if queue == nil {
+		return ErrWorkerClosed
+	}
+	err := queue.Wait(context.Background())
+	if errors.Is(err, msgq.ErrClosed) {
+		return ErrWorkerClosed
+	}
+	if err != nil {
+		return wrapErr(ErrMsgQueue, err)
+	}
+	return nil
+}
+
+// dispatchMsg hands a message of the app message queue to the session it is
+// for, or to Recv
+func (w *Worker) dispatchMsg(msg *msgq.Message) {
+	event, err := unmarshalEvent(msg.Data)
+	if err != nil {
+		log.Warnf("worker %d drops event: %v", w.index, err)
+		return
+	}
+	if w.handleEvent(event) {
+		return
+	}
+	select {
+	case w.events <- event:
+	default:
+		log.Warnf("worker %d drops event %d, Recv is not keeping up", w.index, event.Type)
+	}
+}
+
+// Send sends a session event to VPP over the control message queue of the
+// attachment, waiting for room until ctx ends
+func (w *Worker) Send(ctx context.Context, event *Event) error {
+	return w.sendTo(ctx, w.attachment.vppCtrlMq, event)
+}
+
+// sendTo sends a session event over queue, one of the message queues of VPP
+func (w *Worker) sendTo(ctx context.Context, queue *msgq.Queue, event *Event) error {
+	data := event.marshal()
+	for {
+		sent, err := w.send(ctx, queue, event.ring(), data)
+		if sent || err != nil {
+			return err
+		}
+	}
+}
+
+// send enqueues data on queue, or waits for room for a poll interval and
+// returns false
+func (w *Worker) send(ctx context.Context, queue *msgq.Queue, ring int, data []byte) (bool, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.released {
+		return false, ErrWorkerClosed
+	}
+	if queue == nil {
+		return false, wrapErr(ErrMsgQueue, errors.New("vpp did not set up a control message queue"))
+	}
+	err := queue.TrySend(ring, data)
+	if errors.Is(err, msgq.ErrFull) {
+		return false, queue.WaitRoom(ctx)
+	}
+	if err != nil {
+		return false, wrapErr(ErrMsgQueue, err)
+	}
+	return true, nil
+}
+
+// Close deletes a worker added with Attachment.AddWorker in VPP, closes its
+// app socket connection and releases its fifo segment. The first worker of
+// an attachment is released by Attachment.Detach.
+func (w *Worker) Close() error {
+	if w.udsConn == nil {
+		return ErrFirstWorker
+	}
+	err := ErrWorkerClosed
+	w.closeOnce.Do(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), replyTimeout)
+		defer cancel()
+		err = w.udsConn.exchange(ctx, func() error {
+			msg := appsock.AppSapiMsgWorkerAddDel{MsgType: appsock.MsgTypeAddDelWorker, Msg: appsock.AppWorkerAddDelMsg{
+				AppIndex: w.attachment.AppIndex(),
+				WrkIndex: w.index,
+			}}
+			if sendErr := sendMsg(w.udsConn, &msg); sendErr != nil {
+				return sendErr
+			}
+			var replyMsg appsock.AppSapiMsgWorkerAddDelReply
+			if _, recvErr := w.udsConn.recvMsg(appsock.MsgTypeAddDelWorkerReply, &replyMsg, 0); recvErr != nil {
+				return recvErr
+			}
+			if replyMsg.Msg.Retval != 0 {
+				return errors.Wrap(SessionError(replyMsg.Msg.Retval), "worker delete rejected by vpp")
+			}
+			return nil
+		})
+		w.attachment.removeWorker(w)
+		if releaseErr := w.release(); err == nil {
+			err = releaseErr
+		}
+	})
+	return err
+}
+
+// release closes the app socket connection of the worker and unmaps its
+// fifo segment once its queues are no longer in use
+func (w *Worker) release() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.released = true
+	if w.appMq != nil {
+		_ = w.appMq.Close()
+	}
+	w.appMq = nil
+	w.fifoSegments = nil
+	w.sessions.closeAll()
+	for handle, segment := range w.addedSegments {
+		_ = segment.Close()
+		delete(w.addedSegments, handle)
+	}
+	if w.eventFd >= 0 {
+		_ = syscall.Close(w.eventFd)
+		w.eventFd = -1
+	}
+	if w.udsConn != nil {
+		_ = w.udsConn.Close()
+	}
+	return w.memorySegment.Close()
+}
+
+// sapiConn returns the app socket connection of the worker
+func (w *Worker) sapiConn() *sapiConn {
+	if w.udsConn != nil {
+		return w.udsConn
+	}
+	return w.attachment.udsConn
+}
+
+// addSegment maps a fifo segment VPP added for the sessions of the worker.
+// VPP passes the memfd of the segment over the app socket ahead of the
+// event, it is received and the segment mapped off the dispatcher. Sessions
+// opened in the segment meanwhile wait for it, see waitSegment.
+func (w *Worker) addSegment(msg *session.AppAddSegmentMsg) error {
+	if msg.FdFlags&appsock.FdFlagMemfdSegment == 0 {
+		return wrapErr(ErrMapSegment, errors.Errorf("fd flags %#x do not announce a memfd segment", msg.FdFlags))
+	}
+	handle := msg.SegmentHandle
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.released {
+		return ErrWorkerClosed
+	}
+	if _, ok := w.fifoSegments[handle]; ok {
+		return wrapErr(ErrMapSegment, errors.New("segment handle in use"))
+	}
+	if _, ok := w.pendingSegments[handle]; ok {
+		return wrapErr(ErrMapSegment, errors.New("segment handle in use"))
+	}
+	done, prev := make(chan struct{}), w.lastPending
+	w.pendingSegments[handle], w.lastPending = done, done
+	go func() {
+		// VPP passes the fds of the segments in the order it adds them
+		if prev != nil {
+			<-prev
+		}
+		err := w.mapSegment(handle)
+		w.mu.Lock()
+		delete(w.pendingSegments, handle)
+		w.mu.Unlock()
+		close(done)
+		if err != nil {
+			log.Errorf("worker %d cannot map segment %#x: %v", w.index, handle, err)
+		}
+	}()
+	return nil
+}
+
+// mapSegment receives the memfd of the segment of segmentHandle and maps it
+func (w *Worker) mapSegment(segmentHandle uint64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), replyTimeout)
+	defer cancel()
+	fds, err := w.sapiConn().recvFds(ctx)
+	if err != nil {
+		return err
+	}
+	if len(fds) != 1 {
+		closeFds(fds)
+		return wrapErr(ErrBadFdCount, errors.Errorf("got %d fds, want 1", len(fds)))
+	}
+	memorySegment, err := memseg.NewMemorySegment(fds[0])
+	if err != nil {
+		return wrapErr(ErrMapSegment, err)
+	}
+	fifoSegment, err := newFifoSegment(memorySegment)
+	if err != nil {
+		_ = memorySegment.Close()
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.released {
+		_ = memorySegment.Close()
+		return ErrWorkerClosed
+	}
+	w.fifoSegments[segmentHandle] = fifoSegment
+	w.addedSegments[segmentHandle] = memorySegment
+	return nil
+}
+
+// waitSegment waits for the segment of segmentHandle to be mapped, if its
+// fds are still being received. mapSegment gives up on them after
+// replyTimeout.
+func (w *Worker) waitSegment(segmentHandle uint64) {
+	w.mu.RLock()
+	done := w.pendingSegments[segmentHandle]
+	w.mu.RUnlock()
+	if done != nil {
+		<-done
+	}
+}
+
+// delSegment unmaps a segment added with addSegment. VPP deletes segments
+// once their fifos are freed, sessions left in the segment are ended. A
+// segment still being mapped is unmapped once it is.
+func (w *Worker) delSegment(segmentHandle uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if done, ok := w.pendingSegments[segmentHandle]; ok {
+		go func() {
+			<-done
+			if err := w.delSegment(segmentHandle); err != nil {
+				log.Warnf("worker %d cannot unmap segment %#x: %v", w.index, segmentHandle, err)
+			}
+		}()
+		return nil
+	}
+	memorySegment, ok := w.addedSegments[segmentHandle]
+	if !ok {
+		return errors.New("unknown segment")
+	}
+	w.sessions.endInSegment(segmentHandle)
+	delete(w.addedSegments, segmentHandle)
+	delete(w.fifoSegments, segmentHandle)
+	return memorySegment.Close()
+}
+
+// segment returns the segment VPP added with segmentHandle, or nil
+func (w *Worker) segment(segmentHandle uint64) *memseg.MemorySegment {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.addedSegments[segmentHandle]
+}
+
+// newFifoSegment returns the fifo segment of a memory segment
+func newFifoSegment(segment *memseg.MemorySegment) (*fifo.Segment, error) {
+	info, err := segment.Info()
+	if err != nil {
+		return nil, wrapErr(ErrMapSegment, err)
+	}
+	fifoSegment, err := fifo.NewSegment(segment.Bytes()[info.HeaderOffset:info.Size])
+	if err != nil {
+		return nil, wrapErr(ErrMapSegment, err)
+	}
+	return fifoSegment, nil
+}
+
+// openQueue opens the message queue at offset, relative to the fifo segment
+// header of segment
+func openQueue(segment *memseg.MemorySegment, offset uint64, eventFd int) (*msgq.Queue, error) {
+	info, err := segment.Info()
+	if err != nil {
+		return nil, wrapErr(ErrMsgQueue, err)
+	}
+	start := info.HeaderOffset + offset
+	if offset == 0 || start < info.HeaderOffset || start >= info.Size {
+		return nil, wrapErr(ErrMsgQueue, errors.Errorf("message queue at %#x is outside of the segment", offset))
+	}
+	queue, err := msgq.Open(segment.Bytes()[start:info.Size], eventFd)
+	if err != nil {
+		return nil, wrapErr(ErrMsgQueue, err)
+	}
+	return queue, nil
+}
@@ -0,0 +1,299 @@
+// Copyright (c) 2020 Cisco and/or its affiliates.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at:
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hoststack
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/godirect/hoststack/app-attach/hoststack/appsock"
+	"github.com/godirect/hoststack/app-attach/hoststack/hoststacktest"
+	"github.com/godirect/hoststack/app-attach/hoststack/session"
+)
+
+func testWorkerEvents(t *testing.T, options ...AttachOption) {
+	vpp := hoststacktest.NewServer(t)
+	ns := dial(t, vpp)
+	attachment, err := NewAttachment(context.Background(), ns, ns.udsConn, options...)
+	if err != nil {
+		t.Fatalf("Attach Error %v", err)
+	}
+	worker := attachment.Workers()[0]
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	appMq := vpp.AppQueue(attachment.AppIndex(), worker.Index())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		_ = appMq.TrySend(ctrlEventRing, append([]byte{byte(EventConnected), 0}, "connected"...))
+		_ = appMq.TrySend(ioEventRing, []byte{byte(EventIORx), 0, 42})
+	}()
+	event, err := worker.Recv(ctx)
+	if err != nil || event.Type != EventConnected || !bytes.HasPrefix(event.Data, []byte("connected")) {
+		t.Errorf("Unexpected event %+v, %v", event, err)
+	}
+	event, err = worker.Recv(ctx)
+	if err != nil || event.Type != EventIORx || event.Data[0] != 42 {
+		t.Errorf("Unexpected event %+v, %v", event, err)
+	}
+
+	if err := worker.Send(ctx, &Event{Type: EventListen, Data: []byte("listen")}); err != nil {
+		t.Fatalf("Send Error %v", err)
+	}
+	if err := worker.Send(ctx, &Event{Type: EventIOTx, Data: []byte{7}}); err != nil {
+		t.Fatalf("Send Error %v", err)
+	}
+	msg, err := vpp.CtrlQueue().Recv(ctx)
+	if err != nil || msg.Ring != ctrlEventRing || EventType(msg.Data[0]) != EventListen || !bytes.HasPrefix(msg.Data[2:], []byte("listen")) {
+		t.Errorf("Unexpected control message %+v, %v", msg, err)
+	}
+	msg, err = vpp.CtrlQueue().Recv(ctx)
+	if err != nil || msg.Ring != ioEventRing || EventType(msg.Data[0]) != EventIOTx || msg.Data[2] != 7 {
+		t.Errorf("Unexpected control message %+v, %v", msg, err)
+	}
+
+	timeoutCtx, timeoutCancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer timeoutCancel()
+	if _, err := worker.Recv(timeoutCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected: errors.Is(err, context.DeadlineExceeded); Current: %v", err)
+	}
+
+	if err := attachment.Detach(ctx); err != nil {
+		t.Errorf("Detach Error %v", err)
+	}
+	if _, err := worker.Recv(ctx); !errors.Is(err, ErrWorkerClosed) {
+		t.Errorf("Expected: errors.Is(err, ErrWorkerClosed); Current: %v", err)
+	}
+	if err := worker.Send(ctx, &Event{Type: EventListen}); !errors.Is(err, ErrWorkerClosed) {
+		t.Errorf("Expected: errors.Is(err, ErrWorkerClosed); Current: %v", err)
+	}
+}
+
+func TestWorkerEvents(t *testing.T) {
+	testWorkerEvents(t)
+}
+
+func TestWorkerEventsNoEventFd(t *testing.T) {
+	testWorkerEvents(t, WithoutFlags(FlagEvtMqUseEventfd))
+}
+
+func TestWorkerDefaultEventFd(t *testing.T) {
+	vpp := hoststacktest.NewServer(t)
+	attachment, err := dial(t, vpp).Attach(context.Background())
+	if err != nil {
+		t.Fatalf("Attach Error %v", err)
+	}
+	// VPP signals the app message queue over an eventfd unless told not to
+	if worker := attachment.Workers()[0]; worker.eventFd < 0 || worker.appMq.EventFd() != worker.eventFd {
+		t.Errorf("Expected: the app message queue to signal over an eventfd by default")
+	}
+}
+
+func TestWorkerEventBatch(t *testing.T) {
+	vpp := hoststacktest.NewServer(t)
+	ns := dial(t, vpp)
+	attachment, err := NewAttachment(context.Background(), ns, ns.udsConn)
+	if err != nil {
+		t.Fatalf("Attach Error %v", err)
+	}
+	worker := attachment.Workers()[0]
+	if worker.appMq.EventFd() < 0 {
+		t.Fatalf("Expected: the app message queue to signal over an eventfd")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// the dispatcher parks on the empty queue, then drains the burst at once
+	timeoutCtx, timeoutCancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer timeoutCancel()
+	if _, err := worker.Recv(timeoutCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected: errors.Is(err, context.DeadlineExceeded); Current: %v", err)
+	}
+	appMq := vpp.AppQueue(attachment.AppIndex(), worker.Index())
+	const n = 32
+	for i := 0; i < n; i++ {
+		if err := appMq.TrySend(ioEventRing, []byte{byte(EventIOTx), 0, byte(i)}); err != nil {
+			t.Fatalf("TrySend Error %v", err)
+		}
+	}
+	for i := 0; i < n; i++ {
+		event, err := worker.Recv(ctx)
+		if err != nil || event.Type != EventIOTx || event.Data[0] != byte(i) {
+			t.Fatalf("Expected: event %d; Current: %+v, %v", i, event, err)
+		}
+	}
+}
+
+func TestAddedWorkerEvents(t *testing.T) {
+	vpp := hoststacktest.NewServer(t)
+	attachment := attach(t, vpp)
+	worker, err := attachment.AddWorker(context.Background())
+	if err != nil {
+		t.Fatalf("AddWorker Error %v", err)
+	}
+	defer func() { _ = worker.Close() }()
+	appMq := vpp.AppQueue(attachment.AppIndex(), worker.Index())
+	if appMq == nil || appMq == vpp.AppQueue(attachment.AppIndex(), 0) {
+		t.Fatalf("Expected the worker to have its own app message queue")
+	}
+	if err := appMq.TrySend(ctrlEventRing, []byte{byte(EventAccepted), 0}); err != nil {
+		t.Fatalf("TrySend Error %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if event, err := worker.Recv(ctx); err != nil || event.Type != EventAccepted {
+		t.Errorf("Unexpected event %+v, %v", event, err)
+	}
+}
+
+// echoOver dials a session over worker and checks that data is echoed
+func echoOver(t *testing.T, worker *Worker) *appSession {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := worker.Dial(ctx, "tcp", "10.0.0.1:80")
+	if err != nil {
+		t.Fatalf("Dial Error %v", err)
+	}
+	defer func() { _ = c.Close() }()
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write Error %v", err)
+	}
+	echo := make([]byte, 4)
+	if _, err := io.ReadFull(c, echo); err != nil || string(echo) != "ping" {
+		t.Errorf("Expected: ping; Current: %q, %v", echo, err)
+	}
+	return c.(*conn).session
+}
+
+// delSegment deletes a segment once the sessions in it are cleaned up
+func delSegment(t *testing.T, vpp *hoststacktest.Server, worker *Worker, handle uint64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err := vpp.DelSegment(worker.Attachment().AppIndex(), worker.Index(), handle)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("DelSegment Error %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for worker.segment(handle) != nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected: segment %#x to be unmapped", handle)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAddDelSegment(t *testing.T) {
+	cases := []struct {
+		name      string
+		addWorker bool
+	}{
+		{name: "first worker"},
+		{name: "added worker", addWorker: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			vpp := hoststacktest.NewServer(t, hoststacktest.WithSessionHandler(hoststacktest.Echo))
+			attachment := attach(t, vpp)
+			worker := attachment.Workers()[0]
+			if c.addWorker {
+				var err error
+				if worker, err = attachment.AddWorker(context.Background()); err != nil {
+					t.Fatalf("AddWorker Error %v", err)
+				}
+				defer func() { _ = worker.Close() }()
+			}
+			if s := echoOver(t, worker); s.segment != worker.segmentHandle {
+				t.Errorf("Expected: fifos in segment %#x; Current: %#x", worker.segmentHandle, s.segment)
+			}
+
+			handle, err := vpp.AddSegment(attachment.AppIndex(), worker.Index(), hoststacktest.DefaultSegmentSize)
+			if err != nil {
+				t.Fatalf("AddSegment Error %v", err)
+			}
+			// the segment is mapped before the session in it is connected
+			if s := echoOver(t, worker); s.segment != handle {
+				t.Errorf("Expected: fifos in segment %#x; Current: %#x", handle, s.segment)
+			}
+			if worker.segment(handle) == nil {
+				t.Fatalf("Expected: segment %#x to be mapped", handle)
+			}
+
+			delSegment(t, vpp, worker, handle)
+			if s := echoOver(t, worker); s.segment != worker.segmentHandle {
+				t.Errorf("Expected: fifos in segment %#x; Current: %#x", worker.segmentHandle, s.segment)
+			}
+		})
+	}
+}
+
+func TestAddSegmentWithoutFds(t *testing.T) {
+	vpp := hoststacktest.NewServer(t)
+	attachment := attach(t, vpp)
+	worker := attachment.Workers()[0]
+	appMq := vpp.AppQueue(attachment.AppIndex(), worker.Index())
+	// VPP announces a segment whose fds have not arrived, then another event
+	data, err := session.Marshal(&session.AppAddSegmentMsg{FdFlags: appsock.FdFlagMemfdSegment, SegmentHandle: 42})
+	if err != nil {
+		t.Fatalf("Marshal Error %v", err)
+	}
+	if err := appMq.TrySend(ctrlEventRing, (&Event{Type: EventAppAddSegment, Data: data}).marshal()); err != nil {
+		t.Fatalf("TrySend Error %v", err)
+	}
+	if err := appMq.TrySend(ctrlEventRing, []byte{byte(EventAccepted), 0}); err != nil {
+		t.Fatalf("TrySend Error %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), replyTimeout/2)
+	defer cancel()
+	// the dispatcher does not wait for the fds of the segment
+	if event, err := worker.Recv(ctx); err != nil || event.Type != EventAccepted {
+		t.Errorf("Expected: the next event while the segment is pending; Current: %+v, %v", event, err)
+	}
+	worker.mu.RLock()
+	_, pending := worker.pendingSegments[42]
+	worker.mu.RUnlock()
+	if !pending {
+		t.Errorf("Expected: segment 0x2a to wait for its fds")
+	}
+}
+
+func TestAddSegmentDuringRequest(t *testing.T) {
+	vpp := hoststacktest.NewServer(t, hoststacktest.WithSessionHandler(hoststacktest.Echo))
+	attachment := attach(t, vpp)
+	worker := attachment.Workers()[0]
+	handle, err := vpp.AddSegment(attachment.AppIndex(), worker.Index(), hoststacktest.DefaultSegmentSize)
+	if err != nil {
+		t.Fatalf("AddSegment Error %v", err)
+	}
+	// the fds of the segment arrive ahead of the reply to the request, they
+	// are kept until the worker handles the add segment event
+	certPEM, keyPEM := selfSignedCertKey(t)
+	if _, err := attachment.AddCertKey(context.Background(), certPEM, keyPEM); err != nil {
+		t.Fatalf("AddCertKey Error %v", err)
+	}
+	if s := echoOver(t, worker); s.segment != handle || worker.segment(handle) == nil {
+		t.Errorf("Expected: fifos in the mapped segment %#x; Current: %#x", handle, s.segment)
+	}
+}
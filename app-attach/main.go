@@ -23,6 +23,8 @@ import (
 	"github.com/edwarnicke/vpphelper"
 	"github.com/harshgondaliya/govpp/binapi/session"
 	log "github.com/sirupsen/logrus"
+
+	"github.com/godirect/hoststack/app-attach/hoststack"
 )
 
 func main() {
@@ -45,10 +47,19 @@ func main() {
 		log.Fatalf("ERROR: Adding App Namespace Failed %v", sErr)
 	}
 	log.Infof("Added App Namespace")
-	ns := NewNamespace(vppConn, id)
-	_, _ = ns.Dial()
-	_ = ns.Attach()
-	ns.Close()
+	ns := hoststack.NewNamespace(vppConn, id, hoststack.WithVppConfig(vppConfContents))
+	attachCtx, cancel3 := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel3()
+	if _, dErr := ns.Dial(attachCtx); dErr != nil {
+		log.Fatalf("ERROR: Dialing App Namespace Socket Failed: %v", dErr)
+	}
+	log.Infof("Dialed App Namespace Socket, VPP %v", ns.Release().Version)
+	attachment, attachErr := ns.Attach(attachCtx)
+	if attachErr != nil {
+		log.Fatalf("ERROR: Attaching Application Failed: %v", attachErr)
+	}
+	log.Infof("Application Attached, App Index: %v", attachment.AppIndex())
+	_ = ns.Close()
 
 	cancel1()
 	cancel2()